@@ -0,0 +1,957 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package bbolt contains an implementation of checkpointstate.Manager
+// and checkpointstate.Session that uses an embedded bbolt database to
+// represent checkpoints. Each session is stored in its own bucket, which
+// contains the session's metadata, its in-progress step, a nested
+// bucket containing its completed and failed steps and another containing
+// its in-progress concurrent steps. Since all updates
+// are made within bbolt write transactions no additional locking
+// is required.
+package bbolt
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metadataKey = []byte("metadata")
+	currentKey  = []byte("in-progress")
+	stepsBucket = []byte("steps")
+	// concurrentBucket is created when the first concurrent step is
+	// started.
+	concurrentBucket = []byte("concurrent")
+	sealedKey        = []byte("sealed")
+)
+
+type boltManager struct {
+	db      *bolt.DB
+	ids     checkpointstate.IDGenerator
+	timeout time.Duration
+}
+
+// Option represents an option to NewManager.
+type Option func(bm *boltManager)
+
+// WithIDGenerator specifies the strategy used to create session IDs,
+// the default is checkpointstate.HashIDs.
+func WithIDGenerator(gen checkpointstate.IDGenerator) Option {
+	return func(bm *boltManager) {
+		bm.ids = gen
+	}
+}
+
+// WithTimeout specifies how long to wait to open a database that is
+// held open by another process, the default is to wait indefinitely.
+// Since bbolt only allows a database to be opened by a single process at
+// a time this is the only point at which another process can block it.
+func WithTimeout(timeout time.Duration) Option {
+	return func(bm *boltManager) {
+		bm.timeout = timeout
+	}
+}
+
+type boltSession struct {
+	db *bolt.DB
+	id []byte
+}
+
+// NewManager returns a new instance of a checkpointstate.Manager that
+// manages checkpoints in the bbolt database stored in the specified file,
+// which will be created if it does not exist. The returned Manager also
+// implements io.Closer to allow for the database to be closed.
+func NewManager(path string, opts ...Option) checkpointstate.Manager {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		log.Fatalf("failed to create directory: %v", filepath.Dir(path))
+	}
+	bm := &boltManager{ids: checkpointstate.HashIDs}
+	for _, fn := range opts {
+		fn(bm)
+	}
+	options := *bolt.DefaultOptions
+	options.Timeout = bm.timeout
+	db, err := bolt.Open(path, 0600, &options)
+	if err != nil {
+		log.Fatalf("failed to open database: %v: %v", path, err)
+	}
+	bm.db = db
+	return bm
+}
+
+// Close closes the underlying database.
+func (bm *boltManager) Close() error {
+	return bm.db.Close()
+}
+
+// Init implements checkpointstate.Initializer. The database is created
+// by NewManager and hence Init only returns its location.
+func (bm *boltManager) Init(ctx context.Context) (string, error) {
+	return bm.db.Path(), nil
+}
+
+// SessionID implements checkpointstate.Manager.
+func (bm *boltManager) SessionID(keys ...string) string {
+	return checkpointstate.ValidSessionID(bm.ids, keys...)
+}
+
+// Use implements checkpointstate.Manager.
+func (bm *boltManager) Use(ctx context.Context, id string, reset bool) (checkpointstate.Session, error) {
+	return bm.use(id, reset, nil)
+}
+
+// UseWithMetadata implements checkpointstate.Manager. The session is
+// created, if need be, and its metadata initialized within a single
+// transaction.
+func (bm *boltManager) UseWithMetadata(ctx context.Context, id string, reset bool, initMetadata map[string]interface{}) (checkpointstate.Session, bool, error) {
+	created := false
+	sess, err := bm.use(id, reset, func(b *bolt.Bucket) error {
+		if b.Get(sealedKey) != nil {
+			return checkpointstate.ErrSealed
+		}
+		var md map[string]interface{}
+		if buf := b.Get(metadataKey); buf != nil {
+			if err := json.Unmarshal(buf, &md); err != nil {
+				return fmt.Errorf("failed to decode json metadata for %s: %v", id, err)
+			}
+		}
+		md, created = checkpointstate.InitMetadata(md, initMetadata, time.Now().UTC())
+		buf, err := json.Marshal(md)
+		if err != nil {
+			return fmt.Errorf("failed to json encode metadata: %v", err)
+		}
+		return b.Put(metadataKey, buf)
+	})
+	return sess, created, err
+}
+
+// use implements Use, calling init, if not nil, with the session's bucket
+// within the same transaction as that used to create, or reset, it.
+func (bm *boltManager) use(id string, reset bool, init func(*bolt.Bucket) error) (checkpointstate.Session, error) {
+	if len(id) == 0 {
+		return nil, checkpointstate.ErrEmptySessionID
+	}
+	sess := &boltSession{db: bm.db, id: []byte(id)}
+	if !reset {
+		check := func(tx *bolt.Tx) error {
+			b := tx.Bucket(sess.id)
+			if b == nil {
+				return checkpointstate.ErrNoSuchSession
+			}
+			if init != nil {
+				return init(b)
+			}
+			return nil
+		}
+		var err error
+		if init != nil {
+			err = bm.db.Update(check)
+		} else {
+			err = bm.db.View(check)
+		}
+		if err != nil {
+			return nil, err
+		}
+		return sess, nil
+	}
+	err := bm.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(sess.id)
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists(stepsBucket); err != nil {
+			return err
+		}
+		if b.Get(sealedKey) != nil {
+			return checkpointstate.ErrSealed
+		}
+		if err := b.DeleteBucket(concurrentBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if err := b.Delete(currentKey); err != nil {
+			return err
+		}
+		if init != nil {
+			return init(b)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sess, nil
+}
+
+// List implements checkpointstate.Manager.
+func (bm *boltManager) List(ctx context.Context) ([]string, error) {
+	ids := []string{}
+	err := bm.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			ids = append(ids, string(name))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// Walk implements checkpointstate.Manager. The IDs of all sessions are
+// read within a single transaction, but fn is called outside of that
+// transaction so that it may itself access the session.
+func (bm *boltManager) Walk(ctx context.Context, fn func(id string, sess checkpointstate.Session) error) error {
+	ids, err := bm.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(id, &boltSession{db: bm.db, id: []byte(id)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type stepState struct {
+	Step        string
+	ContentHash string `json:",omitempty"`
+	Created     time.Time
+	Completed   time.Time
+	Artifacts   map[string]string `json:",omitempty"`
+	Failed      time.Time
+	Reason      string                 `json:",omitempty"`
+	Metadata    map[string]interface{} `json:",omitempty"`
+	Result      json.RawMessage        `json:",omitempty"`
+	Group       string                 `json:",omitempty"`
+	Phase       string                 `json:",omitempty"`
+	Command     []string               `json:",omitempty"`
+	ExitCode    *int                   `json:",omitempty"`
+}
+
+// key returns the key under which the step is stored, its content hash
+// if it has one, its display name otherwise.
+func (s stepState) key() string {
+	if len(s.ContentHash) > 0 {
+		return s.ContentHash
+	}
+	return s.Step
+}
+
+func (s stepState) toStep() checkpointstate.Step {
+	return checkpointstate.Step{
+		Name:        s.Step,
+		ContentHash: s.ContentHash,
+		Created:     s.Created,
+		Completed:   s.Completed,
+		Artifacts:   s.Artifacts,
+		Failed:      s.Failed,
+		Reason:      s.Reason,
+		Metadata:    s.Metadata,
+		Result:      s.Result,
+		Group:       s.Group,
+		Phase:       s.Phase,
+		Command:     s.Command,
+		ExitCode:    s.ExitCode,
+	}
+}
+
+func now() time.Time {
+	return time.Now().UTC()
+}
+
+// bucket returns the session's bucket, or an error if the session
+// does not exist.
+func (bs *boltSession) bucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b := tx.Bucket(bs.id)
+	if b == nil {
+		return nil, fmt.Errorf("session %s does not exist", bs.id)
+	}
+	return b, nil
+}
+
+// unsealedBucket returns the session's bucket, or an error if the
+// session does not exist or is sealed.
+func (bs *boltSession) unsealedBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	b, err := bs.bucket(tx)
+	if err != nil {
+		return nil, err
+	}
+	if b.Get(sealedKey) != nil {
+		return nil, checkpointstate.ErrSealed
+	}
+	return b, nil
+}
+
+func getState(b *bolt.Bucket, key []byte) (stepState, bool, error) {
+	var state stepState
+	buf := b.Get(key)
+	if buf == nil {
+		return state, false, nil
+	}
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return state, false, fmt.Errorf("failed to unmarshal state for step %s: %v", key, err)
+	}
+	return state, true, nil
+}
+
+func putState(b *bolt.Bucket, key []byte, state stepState) error {
+	buf, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, buf)
+}
+
+// Step implements checkpointstate.Session.
+func (bs *boltSession) Step(ctx context.Context, step string, opts ...checkpointstate.StepOption) (bool, error) {
+	o := checkpointstate.NewStepOptions(opts...)
+	key := o.Key(step)
+	done := false
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.unsealedBucket(tx)
+		if err != nil {
+			return err
+		}
+		steps := b.Bucket(stepsBucket)
+		// Mark the prior step, if any, as done, annotating it with the
+		// options if no next step was requested.
+		var doneOpts checkpointstate.StepOptions
+		if len(step) == 0 {
+			doneOpts = o
+		}
+		if err := markDone(b, steps, key, doneOpts); err != nil {
+			return err
+		}
+		// No next step was requested.
+		if len(step) == 0 {
+			done = true
+			return nil
+		}
+		state, ok, err := getState(steps, []byte(key))
+		if err != nil {
+			return err
+		}
+		if ok && state.Failed.IsZero() {
+			done = true
+			return nil
+		}
+		marker, inProgress, err := concurrentState(b, key)
+		if err != nil {
+			return err
+		}
+		if len(o.Group) > 0 {
+			if current, ok, err := getState(b, currentKey); err != nil || (ok && current.key() == key) {
+				if err == nil {
+					err = fmt.Errorf("step %v is already in progress", key)
+				}
+				return err
+			}
+			if inProgress {
+				return nil
+			}
+		} else if inProgress {
+			return fmt.Errorf("step %v is in progress in group %v", key, marker.Group)
+		}
+		// Discard the record of any previous, failed, attempt.
+		if err := steps.Delete([]byte(key)); err != nil {
+			return err
+		}
+		state = stepState{
+			Step:        step,
+			ContentHash: o.ContentHash,
+			Created:     now(),
+			Artifacts:   o.Artifacts,
+			Group:       o.Group,
+			Phase:       o.Phase,
+			Command:     o.Command,
+			ExitCode:    o.ExitCode,
+		}
+		if len(o.Group) > 0 {
+			cb, err := b.CreateBucketIfNotExists(concurrentBucket)
+			if err != nil {
+				return err
+			}
+			return putState(cb, []byte(key), state)
+		}
+		// Mark the requested step as in process.
+		return putState(b, currentKey, state)
+	})
+	return done, err
+}
+
+// IsComplete implements checkpointstate.Session.
+func (bs *boltSession) IsComplete(ctx context.Context, step string, opts ...checkpointstate.StepOption) (bool, error) {
+	key := checkpointstate.NewStepOptions(opts...).Key(step)
+	done := false
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b, err := bs.bucket(tx)
+		if err != nil {
+			return err
+		}
+		state, ok, err := getState(b.Bucket(stepsBucket), []byte(key))
+		done = ok && state.Failed.IsZero()
+		return err
+	})
+	return done, err
+}
+
+// concurrentState returns the state of the specified concurrent step, if
+// it is in progress.
+func concurrentState(b *bolt.Bucket, step string) (stepState, bool, error) {
+	cb := b.Bucket(concurrentBucket)
+	if cb == nil {
+		return stepState{}, false, nil
+	}
+	return getState(cb, []byte(step))
+}
+
+// completeState records state as completed, annotated with the
+// artifacts, command and exit status in opts.
+func completeState(steps *bolt.Bucket, state stepState, opts checkpointstate.StepOptions) error {
+	state.Completed = now()
+	for k, v := range opts.Artifacts {
+		if state.Artifacts == nil {
+			state.Artifacts = map[string]string{}
+		}
+		state.Artifacts[k] = v
+	}
+	if len(opts.Command) > 0 {
+		state.Command = opts.Command
+	}
+	if opts.ExitCode != nil {
+		state.ExitCode = opts.ExitCode
+	}
+	return putState(steps, []byte(state.key()), state)
+}
+
+func markDone(b, steps *bolt.Bucket, step string, opts checkpointstate.StepOptions) error {
+	state, ok, err := getState(b, currentKey)
+	if err != nil || !ok {
+		// treat a non-existent step as success.
+		return err
+	}
+	if state.key() == step {
+		return nil
+	}
+	// A record of an earlier attempt that failed is replaced, the step
+	// is only being reused if it has already been completed.
+	existing, exists, err := getState(steps, []byte(state.key()))
+	if err != nil {
+		return err
+	}
+	if exists && existing.Failed.IsZero() {
+		return fmt.Errorf("step %v is being reused", state.Step)
+	}
+	if err := completeState(steps, state, opts); err != nil {
+		return err
+	}
+	return b.Delete(currentKey)
+}
+
+// Complete implements checkpointstate.Session.
+func (bs *boltSession) Complete(ctx context.Context, step string, opts ...checkpointstate.StepOption) error {
+	o := checkpointstate.NewStepOptions(opts...)
+	key := o.Key(step)
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.unsealedBucket(tx)
+		if err != nil {
+			return err
+		}
+		steps := b.Bucket(stepsBucket)
+		state, ok, err := concurrentState(b, key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			if err := completeState(steps, state, o); err != nil {
+				return err
+			}
+			return b.Bucket(concurrentBucket).Delete([]byte(key))
+		}
+		current, ok, err := getState(b, currentKey)
+		if err != nil {
+			return err
+		}
+		if !ok || current.key() != key {
+			// Completing a step that has already been completed is a no-op.
+			if state, ok, err := getState(steps, []byte(key)); err != nil || (ok && state.Failed.IsZero()) {
+				return err
+			}
+			return fmt.Errorf("step %v is not in progress", key)
+		}
+		return markDone(b, steps, "", o)
+	})
+}
+
+// Steps implements checkpointstate.Session.
+func (bs *boltSession) Steps(ctx context.Context) ([]checkpointstate.Step, error) {
+	steps := []checkpointstate.Step{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b, err := bs.bucket(tx)
+		if err != nil {
+			return err
+		}
+		err = b.Bucket(stepsBucket).ForEach(func(k, _ []byte) error {
+			state, _, err := getState(b.Bucket(stepsBucket), k)
+			if err != nil {
+				return err
+			}
+			steps = append(steps, state.toStep())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		state, ok, err := getState(b, currentKey)
+		if err != nil {
+			return err
+		}
+		if ok {
+			steps = append(steps, state.toStep())
+		}
+		if cb := b.Bucket(concurrentBucket); cb != nil {
+			return cb.ForEach(func(k, _ []byte) error {
+				state, _, err := getState(cb, k)
+				if err != nil {
+					return err
+				}
+				steps = append(steps, state.toStep())
+				return nil
+			})
+		}
+		return nil
+	})
+	sort.Slice(steps, func(i, j int) bool {
+		return steps[i].Created.Before(steps[j].Created)
+	})
+	return steps, err
+}
+
+// Current implements checkpointstate.Session.
+func (bs *boltSession) Current(ctx context.Context) (*checkpointstate.Step, error) {
+	var current *checkpointstate.Step
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b, err := bs.bucket(tx)
+		if err != nil {
+			return err
+		}
+		state, ok, err := getState(b, currentKey)
+		if err != nil || !ok {
+			return err
+		}
+		step := state.toStep()
+		current = &step
+		return nil
+	})
+	return current, err
+}
+
+// Summary implements checkpointstate.Session.
+func (bs *boltSession) Summary(ctx context.Context) (checkpointstate.Summary, error) {
+	steps, err := bs.Steps(ctx)
+	if err != nil {
+		return checkpointstate.Summary{}, err
+	}
+	return checkpointstate.NewSummary(steps), nil
+}
+
+// Phases implements checkpointstate.Session.
+func (bs *boltSession) Phases(ctx context.Context) ([]checkpointstate.Phase, error) {
+	steps, err := bs.Steps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return checkpointstate.NewPhases(steps), nil
+}
+
+// Fail implements checkpointstate.Session.
+func (bs *boltSession) Fail(ctx context.Context, step, reason string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.unsealedBucket(tx)
+		if err != nil {
+			return err
+		}
+		steps := b.Bucket(stepsBucket)
+		state, ok, err := getState(b, currentKey)
+		if err != nil {
+			return err
+		}
+		current := ok && (len(step) == 0 || state.key() == step)
+		marker, concurrent, err := concurrentState(b, step)
+		if err != nil {
+			return err
+		}
+		switch {
+		case current:
+		case len(step) == 0:
+			return fmt.Errorf("no step is in progress")
+		case concurrent:
+			state = marker
+			if err := b.Bucket(concurrentBucket).Delete([]byte(step)); err != nil {
+				return err
+			}
+		default:
+			prev, ok, err := getState(steps, []byte(step))
+			if err != nil {
+				return err
+			}
+			if ok && prev.Failed.IsZero() {
+				return fmt.Errorf("step %v has already been completed", step)
+			}
+			state = stepState{Step: step, Created: now()}
+		}
+		state.Failed = now()
+		state.Reason = reason
+		if err := putState(steps, []byte(state.key()), state); err != nil {
+			return err
+		}
+		if current {
+			return b.Delete(currentKey)
+		}
+		return nil
+	})
+}
+
+// Import implements checkpointstate.Importer. All of the steps are
+// imported in a single transaction.
+func (bs *boltSession) Import(ctx context.Context, steps []checkpointstate.Step) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.unsealedBucket(tx)
+		if err != nil {
+			return err
+		}
+		sb := b.Bucket(stepsBucket)
+		for _, step := range steps {
+			if step.Completed.IsZero() && step.Failed.IsZero() {
+				continue
+			}
+			state := stepState{
+				Step:        step.Name,
+				ContentHash: step.ContentHash,
+				Created:     step.Created.UTC(),
+				Completed:   step.Completed.UTC(),
+				Artifacts:   step.Artifacts,
+				Failed:      step.Failed.UTC(),
+				Reason:      step.Reason,
+				Metadata:    step.Metadata,
+				Result:      step.Result,
+				Group:       step.Group,
+				Phase:       step.Phase,
+				Command:     step.Command,
+				ExitCode:    step.ExitCode,
+			}
+			if err := putState(sb, []byte(state.key()), state); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// stepKey returns the bucket and key under which the named step, whether
+// in progress, completed or failed, is stored.
+func stepKey(b *bolt.Bucket, step string) (*bolt.Bucket, []byte, error) {
+	state, ok, err := getState(b, currentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok && state.key() == step {
+		return b, currentKey, nil
+	}
+	if cb := b.Bucket(concurrentBucket); cb != nil && cb.Get([]byte(step)) != nil {
+		return cb, []byte(step), nil
+	}
+	steps := b.Bucket(stepsBucket)
+	if steps.Get([]byte(step)) == nil {
+		return nil, nil, fmt.Errorf("step %v does not exist", step)
+	}
+	return steps, []byte(step), nil
+}
+
+// SetStepMetadata implements checkpointstate.Session.
+func (bs *boltSession) SetStepMetadata(ctx context.Context, step string, metadata map[string]interface{}) error {
+	if _, err := json.Marshal(metadata); err != nil {
+		return fmt.Errorf("failed to json encode metadata: %v", err)
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.unsealedBucket(tx)
+		if err != nil {
+			return err
+		}
+		sb, key, err := stepKey(b, step)
+		if err != nil {
+			return err
+		}
+		state, _, err := getState(sb, key)
+		if err != nil {
+			return err
+		}
+		state.Metadata = metadata
+		return putState(sb, key, state)
+	})
+}
+
+// StepMetadata implements checkpointstate.Session.
+func (bs *boltSession) StepMetadata(ctx context.Context, step string) (map[string]interface{}, error) {
+	var md map[string]interface{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b, err := bs.bucket(tx)
+		if err != nil {
+			return err
+		}
+		sb, key, err := stepKey(b, step)
+		if err != nil {
+			return err
+		}
+		state, _, err := getState(sb, key)
+		md = state.Metadata
+		return err
+	})
+	return md, err
+}
+
+// SetStepResult implements checkpointstate.Session.
+func (bs *boltSession) SetStepResult(ctx context.Context, step string, result json.RawMessage) error {
+	if err := checkpointstate.ValidateResult(result); err != nil {
+		return err
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.unsealedBucket(tx)
+		if err != nil {
+			return err
+		}
+		sb, key, err := stepKey(b, step)
+		if err != nil {
+			return err
+		}
+		state, _, err := getState(sb, key)
+		if err != nil {
+			return err
+		}
+		state.Result = result
+		return putState(sb, key, state)
+	})
+}
+
+// StepResult implements checkpointstate.Session.
+func (bs *boltSession) StepResult(ctx context.Context, step string) (json.RawMessage, error) {
+	var result json.RawMessage
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b, err := bs.bucket(tx)
+		if err != nil {
+			return err
+		}
+		sb, key, err := stepKey(b, step)
+		if err != nil {
+			return err
+		}
+		state, _, err := getState(sb, key)
+		result = state.Result
+		return err
+	})
+	return result, err
+}
+
+// Delete implements checkpointstate.Session.
+func (bs *boltSession) Delete(ctx context.Context, steps ...string) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		if len(steps) == 0 {
+			if b := tx.Bucket(bs.id); b != nil && b.Get(sealedKey) != nil {
+				return checkpointstate.ErrSealed
+			}
+			err := tx.DeleteBucket(bs.id)
+			if err == bolt.ErrBucketNotFound {
+				return nil
+			}
+			return err
+		}
+		b, err := bs.unsealedBucket(tx)
+		if err != nil {
+			return err
+		}
+		cb := b.Bucket(concurrentBucket)
+		for _, step := range steps {
+			if err := b.Bucket(stepsBucket).Delete([]byte(step)); err != nil {
+				return err
+			}
+			if cb == nil {
+				continue
+			}
+			if err := cb.Delete([]byte(step)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteMatching implements checkpointstate.MatchingDeleter. The steps are
+// selected and deleted within a single transaction.
+func (bs *boltSession) DeleteMatching(ctx context.Context, match func(checkpointstate.Step) bool) ([]checkpointstate.Step, error) {
+	matched := []checkpointstate.Step{}
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.unsealedBucket(tx)
+		if err != nil {
+			return err
+		}
+		sb := b.Bucket(stepsBucket)
+		var keys [][]byte
+		err = sb.ForEach(func(k, _ []byte) error {
+			state, _, err := getState(sb, k)
+			if err != nil {
+				return err
+			}
+			if step := state.toStep(); match(step) {
+				matched = append(matched, step)
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Keys may not be deleted whilst iterating over them.
+		for _, k := range keys {
+			if err := sb.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return matched[i].Created.Before(matched[j].Created)
+	})
+	return matched, nil
+}
+
+// Abort implements checkpointstate.Session.
+func (bs *boltSession) Abort(ctx context.Context) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.unsealedBucket(tx)
+		if err != nil {
+			return err
+		}
+		if b.Get(currentKey) == nil {
+			return fmt.Errorf("no step is in progress")
+		}
+		return b.Delete(currentKey)
+	})
+}
+
+// SetMetadata implements checkpointstate.Session.
+func (bs *boltSession) SetMetadata(ctx context.Context, metadata map[string]interface{}) error {
+	buf, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to json encode metadata: %v", err)
+	}
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.unsealedBucket(tx)
+		if err != nil {
+			return err
+		}
+		return b.Put(metadataKey, buf)
+	})
+}
+
+// UpdateMetadata implements checkpointstate.MetadataUpdater.
+func (bs *boltSession) UpdateMetadata(ctx context.Context, fn func(map[string]interface{}) (map[string]interface{}, error)) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.bucket(tx)
+		if err != nil {
+			return err
+		}
+		var md map[string]interface{}
+		if buf := b.Get(metadataKey); buf != nil {
+			if err := json.Unmarshal(buf, &md); err != nil {
+				return fmt.Errorf("failed to decode json metadata for %s: %v", bs.id, err)
+			}
+		}
+		updated, err := fn(md)
+		if err != nil || updated == nil {
+			return err
+		}
+		if b.Get(sealedKey) != nil {
+			return checkpointstate.ErrSealed
+		}
+		buf, err := json.Marshal(updated)
+		if err != nil {
+			return fmt.Errorf("failed to json encode metadata: %v", err)
+		}
+		return b.Put(metadataKey, buf)
+	})
+}
+
+// Metadata implements checkpointstate.Session.
+func (bs *boltSession) Metadata(ctx context.Context) (map[string]interface{}, error) {
+	var md map[string]interface{}
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b, err := bs.bucket(tx)
+		if err != nil {
+			return err
+		}
+		buf := b.Get(metadataKey)
+		if buf == nil {
+			return nil
+		}
+		if err := json.Unmarshal(buf, &md); err != nil {
+			return fmt.Errorf("failed to decode json metadata for %s: %v", bs.id, err)
+		}
+		return nil
+	})
+	return md, err
+}
+
+// Seal implements checkpointstate.Sealer.
+func (bs *boltSession) Seal(ctx context.Context) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.bucket(tx)
+		if err != nil {
+			return err
+		}
+		buf, err := now().MarshalText()
+		if err != nil {
+			return err
+		}
+		return b.Put(sealedKey, buf)
+	})
+}
+
+// Unseal implements checkpointstate.Sealer.
+func (bs *boltSession) Unseal(ctx context.Context) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := bs.bucket(tx)
+		if err != nil {
+			return err
+		}
+		return b.Delete(sealedKey)
+	})
+}
+
+// Sealed implements checkpointstate.Sealer.
+func (bs *boltSession) Sealed(ctx context.Context) (bool, error) {
+	sealed := false
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		b, err := bs.bucket(tx)
+		if err != nil {
+			return err
+		}
+		sealed = b.Get(sealedKey) != nil
+		return nil
+	})
+	return sealed, err
+}
@@ -0,0 +1,31 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+package bbolt_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cosnicolaou/checkpoint/bbolt"
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/cosnicolaou/checkpoint/checkpointstatetest"
+)
+
+func TestConformance(t *testing.T) {
+	checkpointstatetest.RunConformance(t, func(t *testing.T) checkpointstate.Manager {
+		dir, err := ioutil.TempDir("", "bbolt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		mgr := bbolt.NewManager(filepath.Join(dir, "checkpoints.db"))
+		t.Cleanup(func() {
+			mgr.(io.Closer).Close()
+			os.RemoveAll(dir)
+		})
+		return mgr
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package checkpointstate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrEmptySessionID is returned by Manager.Use for an empty session ID,
+// such as that returned by SlugIDs when it is given no inputs.
+var ErrEmptySessionID = errors.New("empty session id")
+
+// ErrInvalidTags is returned, possibly wrapped, by ValidateTags.
+var ErrInvalidTags = errors.New("invalid tags")
+
+// MaxTagLength is the maximum length, in bytes, of a single tag accepted
+// by ValidateTags.
+const MaxTagLength = 1024
+
+// ValidateTags returns an error, that wraps ErrInvalidTags, if tags, the
+// inputs to be supplied to Manager.SessionID, are degenerate, that is,
+// if there are none, or any of them is empty or longer than MaxTagLength.
+func ValidateTags(tags ...string) error {
+	if len(tags) == 0 {
+		return fmt.Errorf("%w: no tags specified", ErrInvalidTags)
+	}
+	for i, tag := range tags {
+		switch {
+		case len(tag) == 0:
+			return fmt.Errorf("%w: tag %v is empty", ErrInvalidTags, i)
+		case len(tag) > MaxTagLength:
+			return fmt.Errorf("%w: tag %v is longer than %v bytes", ErrInvalidTags, i, MaxTagLength)
+		}
+	}
+	return nil
+}
+
+// ValidSessionID returns the ID created by ids for inputs, or the empty
+// ID, which Manager.Use rejects with ErrEmptySessionID, if the inputs are
+// rejected by ValidateTags. Managers use it to implement SessionID so that
+// degenerate inputs, such as none at all, are rejected regardless of the
+// IDGenerator in use.
+func ValidSessionID(ids IDGenerator, inputs ...string) string {
+	if ValidateTags(inputs...) != nil {
+		return ""
+	}
+	return ids.SessionID(inputs...)
+}
+
+// IDGenerator represents a strategy for creating session IDs, see
+// Manager.SessionID.
+type IDGenerator interface {
+	SessionID(inputs ...string) string
+}
+
+// IDGeneratorFunc allows a function to be used as an IDGenerator.
+type IDGeneratorFunc func(inputs ...string) string
+
+// SessionID implements IDGenerator.
+func (fn IDGeneratorFunc) SessionID(inputs ...string) string {
+	return fn(inputs...)
+}
+
+// HashIDs is the default IDGenerator, it returns the hex encoded sha256
+// of the sha256 of each of its inputs.
+var HashIDs IDGenerator = IDGeneratorFunc(hashID)
+
+// SlugIDs is an IDGenerator that returns human readable IDs formed by
+// lower casing its inputs, replacing all runs of characters other than
+// ASCII letters and digits with a single -, and joining the results with -.
+// For example, "my", "project" and "My Project!" both become "my-project".
+// Unlike HashIDs, different inputs may result in the same ID and it is
+// the caller's responsibility to choose inputs that do not.
+var SlugIDs IDGenerator = IDGeneratorFunc(slugID)
+
+func hashID(inputs ...string) string {
+	h := sha256.New()
+	for _, k := range inputs {
+		dgst := sha256.Sum256([]byte(k))
+		h.Write(dgst[:])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func slugID(inputs ...string) string {
+	var out strings.Builder
+	sep := false
+	for _, r := range strings.ToLower(strings.Join(inputs, "-")) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if sep && out.Len() > 0 {
+				out.WriteByte('-')
+			}
+			sep = false
+			out.WriteRune(r)
+			continue
+		}
+		sep = true
+	}
+	return out.String()
+}
@@ -2,28 +2,354 @@ package checkpointstate
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"os"
 	"time"
 )
 
+// ErrNoSuchSession is returned by Manager.Use when reset is false and
+// the requested session does not exist.
+var ErrNoSuchSession = errors.New("no such session")
+
+// ErrSealed is returned by operations that would modify a session that
+// has been sealed, see Sealer.
+var ErrSealed = errors.New("session is sealed")
+
+// ErrTxDone is returned by the methods of a Tx that has already been
+// committed or rolled back.
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// ErrNotSupported is returned for operations that a backend does
+// not support.
+var ErrNotSupported = errors.New("not supported")
+
 // Manager represents a checkpoint manager.
 type Manager interface {
 	// SessionID creates a unique, stable ID for the session from the supplied
-	// inputs, which are expected to be unique to each session.
+	// inputs, which are expected to be unique to each session. The empty
+	// ID, which Use rejects, is returned for inputs that are rejected by
+	// ValidateTags, see ValidSessionID.
 	SessionID(inputs ...string) string
 	// Use will use or create the session for the requested ID. Reset
 	// must be set to true when the current step state is not be reset and true
-	// when it is.
+	// when it is. Sessions are only created when reset is true, if reset
+	// is false and the session does not exist ErrNoSuchSession is returned.
+	// ErrEmptySessionID is returned for an empty ID.
 	Use(ctx context.Context, ID string, reset bool) (Session, error)
 
+	// UseWithMetadata is like Use but also initializes the session's
+	// metadata whilst holding the lock used to create the session, so
+	// that concurrent calls for the same session do not race. If the
+	// session has no metadata, ie. it is new, its metadata is set to
+	// initMetadata with Created set to the current time and created is
+	// returned as true. Accessed is set to the current time for both new
+	// and existing sessions, see InitMetadata.
+	UseWithMetadata(ctx context.Context, ID string, reset bool, initMetadata map[string]interface{}) (sess Session, created bool, err error)
+
 	// List returns the IDs of all existing Sessions.
 	List(ctx context.Context) ([]string, error)
+
+	// Walk calls fn for each existing session without first reading the
+	// IDs of all sessions. The order in which sessions are visited is
+	// determined by the implementation and need not be that of List. It
+	// stops at, and returns, the first error returned by fn or when the
+	// context is canceled.
+	Walk(ctx context.Context, fn func(id string, sess Session) error) error
+}
+
+// InitMetadata returns the metadata to be stored by UseWithMetadata for
+// a session whose existing metadata is md, which is nil for a new session,
+// and true if the session is new. initMetadata is only used for new
+// sessions and neither it nor md are modified. The Created and Accessed
+// fields are set to now as described for UseWithMetadata.
+func InitMetadata(md, initMetadata map[string]interface{}, now time.Time) (map[string]interface{}, bool) {
+	created := md == nil
+	if created {
+		md = initMetadata
+	}
+	updated := make(map[string]interface{}, len(md)+2)
+	for k, v := range md {
+		updated[k] = v
+	}
+	if created {
+		updated["Created"] = now
+	}
+	updated["Accessed"] = now
+	return updated, created
 }
 
 // Step represents a step.
 type Step struct {
-	Name      string
-	Created   time.Time
-	Completed time.Time
+	Name string
+	// ContentHash is the hash of the content key supplied via
+	// WithContentKey, if any, and identifies the step in place of Name.
+	ContentHash string `json:",omitempty"`
+	Created     time.Time
+	Completed   time.Time
+	// Artifacts records annotations, such as the names of output files,
+	// associated with the step.
+	Artifacts map[string]string `json:",omitempty"`
+	// Failed is the time at which the step was marked as having failed,
+	// and Reason the reason given for its failure.
+	Failed time.Time
+	Reason string `json:",omitempty"`
+	// Metadata records free-form metadata associated with the step,
+	// see Session.SetStepMetadata.
+	Metadata map[string]interface{} `json:",omitempty"`
+	// Result is the result recorded for the step, if any, see
+	// Session.SetStepResult.
+	Result json.RawMessage `json:",omitempty"`
+	// Order, if non-zero, is the explicit position of the step as
+	// assigned by Reorderer.Reorder.
+	Order int `json:",omitempty"`
+	// Group is the concurrency group, if any, that the step was started
+	// in, see WithGroup.
+	Group string `json:",omitempty"`
+	// Phase is the phase, if any, that the step belongs to, see
+	// WithPhase.
+	Phase string `json:",omitempty"`
+	// Command is the command, if any, run as the step, see WithCommand,
+	// and ExitCode its exit status, if known, see WithExitCode.
+	Command  []string `json:",omitempty"`
+	ExitCode *int     `json:",omitempty"`
+}
+
+// InProgress returns true if the step has neither completed nor failed.
+func (s Step) InProgress() bool {
+	return s.Completed.IsZero() && s.Failed.IsZero()
+}
+
+// MarshalJSON implements json.Marshaler. A zero Completed time, ie. that
+// of the in-progress step, is encoded as null and a zero Failed time
+// is omitted.
+func (s Step) MarshalJSON() ([]byte, error) {
+	type step Step
+	var completed, failed *time.Time
+	if !s.Completed.IsZero() {
+		completed = &s.Completed
+	}
+	if !s.Failed.IsZero() {
+		failed = &s.Failed
+	}
+	return json.Marshal(struct {
+		step
+		Completed *time.Time
+		Failed    *time.Time `json:",omitempty"`
+	}{step(s), completed, failed})
+}
+
+// Summary represents aggregate statistics for the steps of a session.
+type Summary struct {
+	// Total is the number of steps, including failed steps and the
+	// in-progress step, if any.
+	Total int
+	// Completed is the number of completed steps.
+	Completed int
+	// InProgress is true if a step is in progress.
+	InProgress bool
+	// FirstCreated is the time at which the earliest step was created
+	// and LastCompleted that at which the most recent step was completed;
+	// both are zero if there are no such steps.
+	FirstCreated  time.Time
+	LastCompleted time.Time
+	// LastActive is the most recent time at which any step was created,
+	// completed or failed, ie. the time at which the session was last
+	// used to run a step; it is zero if there are no steps.
+	LastActive time.Time
+}
+
+// NewSummary returns the Summary for the supplied steps.
+func NewSummary(steps []Step) Summary {
+	var s Summary
+	for _, step := range steps {
+		s.Total++
+		switch {
+		case !step.Completed.IsZero():
+			s.Completed++
+			if step.Completed.After(s.LastCompleted) {
+				s.LastCompleted = step.Completed
+			}
+		case step.InProgress():
+			s.InProgress = true
+		}
+		if s.FirstCreated.IsZero() || step.Created.Before(s.FirstCreated) {
+			s.FirstCreated = step.Created
+		}
+		for _, t := range []time.Time{step.Created, step.Completed, step.Failed} {
+			if t.After(s.LastActive) {
+				s.LastActive = t
+			}
+		}
+	}
+	return s
+}
+
+// MarshalJSON implements json.Marshaler. Zero times are encoded as null.
+func (s Summary) MarshalJSON() ([]byte, error) {
+	type summary Summary
+	var first, last, active *time.Time
+	if !s.FirstCreated.IsZero() {
+		first = &s.FirstCreated
+	}
+	if !s.LastCompleted.IsZero() {
+		last = &s.LastCompleted
+	}
+	if !s.LastActive.IsZero() {
+		active = &s.LastActive
+	}
+	return json.Marshal(struct {
+		summary
+		FirstCreated  *time.Time
+		LastCompleted *time.Time
+		LastActive    *time.Time
+	}{summary(s), first, last, active})
+}
+
+// Phase summarizes the steps of a session that belong to the same phase,
+// see WithPhase.
+type Phase struct {
+	Name string
+	// Steps are the names of the phase's steps in the order returned by
+	// Session.Steps.
+	Steps []string
+	// Failed is the number of the phase's steps that have failed.
+	Failed  int
+	Summary Summary
+}
+
+// Complete returns true if all of the phase's steps, of which there must
+// be at least one, have been completed.
+func (p Phase) Complete() bool {
+	return p.Summary.Total > 0 && p.Summary.Completed == p.Summary.Total
+}
+
+// NewPhases returns the Phases of the supplied steps, in the order in
+// which the first step of each phase appears. Steps that do not belong
+// to a phase are ignored.
+func NewPhases(steps []Step) []Phase {
+	var names []string
+	byPhase := map[string][]Step{}
+	for _, step := range steps {
+		if len(step.Phase) == 0 {
+			continue
+		}
+		if _, ok := byPhase[step.Phase]; !ok {
+			names = append(names, step.Phase)
+		}
+		byPhase[step.Phase] = append(byPhase[step.Phase], step)
+	}
+	phases := make([]Phase, 0, len(names))
+	for _, name := range names {
+		phase := Phase{Name: name, Summary: NewSummary(byPhase[name])}
+		for _, step := range byPhase[name] {
+			phase.Steps = append(phase.Steps, step.Name)
+			if !step.Failed.IsZero() {
+				phase.Failed++
+			}
+		}
+		phases = append(phases, phase)
+	}
+	return phases
+}
+
+// StepOptions represents the options that may be supplied to Session.Step.
+type StepOptions struct {
+	Artifacts map[string]string
+	// ContentHash, if set, identifies the step in place of its name.
+	ContentHash string
+	// Group, if set, is the concurrency group that the step is started in.
+	Group string
+	// Phase, if set, is the phase that the step belongs to.
+	Phase string
+	// Command and ExitCode, if set, are the command run as the step and
+	// its exit status.
+	Command  []string
+	ExitCode *int
+}
+
+// Key returns the name under which the named step is to be recorded and
+// tested for completion: the content hash if one was supplied, the
+// step's name otherwise.
+func (o StepOptions) Key(step string) string {
+	if len(o.ContentHash) > 0 {
+		return o.ContentHash
+	}
+	return step
+}
+
+// StepOption represents an option to Session.Step.
+type StepOption func(o *StepOptions)
+
+// WithArtifact records the specified key/value annotation against the step,
+// for example, the name of a file that it produced.
+func WithArtifact(key, value string) StepOption {
+	return func(o *StepOptions) {
+		if o.Artifacts == nil {
+			o.Artifacts = map[string]string{}
+		}
+		o.Artifacts[key] = value
+	}
+}
+
+// WithContentKey identifies the step by a hash of the supplied inputs
+// rather than by its name, so that a step that is re-run with the same
+// inputs is recognized as having been completed even if its name
+// differs. The name is retained for display purposes.
+func WithContentKey(inputs ...string) StepOption {
+	return func(o *StepOptions) {
+		o.ContentHash = hashID(inputs...)
+	}
+}
+
+// WithGroup starts the step as a member of the named concurrency group.
+// Any number of steps may be in progress concurrently in addition to the
+// current step, provided that they are started in a group; starting such
+// a step completes the current step, as usual, but it does not become the
+// current step itself and hence is not completed by subsequent calls to
+// Step. Instead, it must be explicitly completed via Session.Complete or
+// failed via Session.Fail.
+func WithGroup(group string) StepOption {
+	return func(o *StepOptions) {
+		o.Group = group
+	}
+}
+
+// WithPhase records the step as belonging to the named phase, such as
+// setup, build or test, so that the progress of a session may be reported,
+// and queried, per phase as well as per step, see Session.Phases. It
+// applies when the step is started.
+func WithPhase(phase string) StepOption {
+	return func(o *StepOptions) {
+		o.Phase = phase
+	}
+}
+
+// WithCommand records the command, as an argv, that is run as the step.
+// It is typically supplied when the step is started so that it is also
+// recorded if the step fails.
+func WithCommand(argv ...string) StepOption {
+	return func(o *StepOptions) {
+		o.Command = append([]string{}, argv...)
+	}
+}
+
+// WithExitCode records the exit status of the command run as the step,
+// it is typically supplied when the step is completed.
+func WithExitCode(code int) StepOption {
+	return func(o *StepOptions) {
+		o.ExitCode = &code
+	}
+}
+
+// NewStepOptions returns the StepOptions that result from applying
+// the supplied options.
+func NewStepOptions(opts ...StepOption) StepOptions {
+	var o StepOptions
+	for _, fn := range opts {
+		fn(&o)
+	}
+	return o
 }
 
 // Session represents a checkpoint session which is a series of steps that
@@ -35,14 +361,84 @@ type Session interface {
 	// Metadata returns the metadata, if any, associated with the current session.
 	Metadata(ctx context.Context) (map[string]interface{}, error)
 
-	// Steps returns the current and completed steps. The current step will
-	// always be the last one and will have a zero completion time.
+	// SetStepMetadata associates the specified metadata with the named
+	// step, which may be in progress, completed or failed, replacing any
+	// existing metadata for that step.
+	SetStepMetadata(ctx context.Context, step string, metadata map[string]interface{}) error
+
+	// StepMetadata returns the metadata, if any, associated with the
+	// named step.
+	StepMetadata(ctx context.Context, step string) (map[string]interface{}, error)
+
+	// SetStepResult records result, which must be valid JSON, as the
+	// result of the named step, which may be in progress, completed or
+	// failed, replacing any existing result; a nil result removes it.
+	// Unlike step metadata, a step's result is a single value that is
+	// intended to be read by later steps or other programs.
+	SetStepResult(ctx context.Context, step string, result json.RawMessage) error
+
+	// StepResult returns the result, if any, recorded for the named step.
+	StepResult(ctx context.Context, step string) (json.RawMessage, error)
+
+	// Steps returns the current, concurrent, completed and failed steps.
+	// In-progress steps, of which there may be several if steps have been
+	// started in a concurrency group, will have zero completion and
+	// failure times.
 	Steps(ctx context.Context) ([]Step, error)
 
+	// Current returns the step that is currently in progress, or nil
+	// if there is none. Steps started in a concurrency group are never
+	// the current step.
+	Current(ctx context.Context) (*Step, error)
+
+	// Summary returns aggregate statistics for the session's steps.
+	Summary(ctx context.Context) (Summary, error)
+
+	// Phases returns aggregate statistics for each of the phases of the
+	// session's steps, see NewPhases.
+	Phases(ctx context.Context) ([]Phase, error)
+
 	// Step determines if the specified step has been completed it or not;
 	// if it has been completed it will return true, if not, the step will
-	// be marked as in process and it will return false.
-	Step(ctx context.Context, step string) (bool, error)
+	// be marked as in process and it will return false. The options
+	// apply to the specified step when it is marked as in process, or to
+	// the step being completed if no step is specified; they are ignored
+	// for steps that have already been completed.
+	//
+	// Step is idempotent with respect to completion: requesting a step
+	// that has already been completed returns true, however many times
+	// it is requested, without modifying it or its completion time, and
+	// requesting no step when there is no step in progress also returns
+	// true without modifying the session. Requesting the step that is in
+	// progress leaves it in progress, restarting it, and returns false.
+	Step(ctx context.Context, step string, opts ...StepOption) (bool, error)
+
+	// IsComplete returns true if the specified step has been completed.
+	// Unlike Step it never modifies the session: a step that has not been
+	// completed is not marked as in progress. Steps that are in progress
+	// or that have failed are not complete. As for Step, a content key
+	// must be supplied for steps that were started with one; all other
+	// options are ignored.
+	IsComplete(ctx context.Context, step string, opts ...StepOption) (bool, error)
+
+	// Fail marks the specified step, or the current step if none is
+	// specified, as having failed for the supplied reason. A failed step
+	// is not complete and hence will be rerun by a subsequent call to Step.
+	Fail(ctx context.Context, step, reason string) error
+
+	// Complete marks the specified step, which must be in progress, as
+	// completed; this is the only way to complete steps started in a
+	// concurrency group, see WithGroup. The options are applied to the
+	// completed step, and, as for Step, a content key must be supplied
+	// for steps that were started with one. Completing a step that has
+	// already been completed is a no-op; its options are ignored and its
+	// completion time is unchanged.
+	Complete(ctx context.Context, step string, opts ...StepOption) error
+
+	// Abort abandons the current step without recording it, so that
+	// the next call to Step for it will treat it as a new step. It
+	// returns an error if no step is in progress.
+	Abort(ctx context.Context) error
 
 	// Done marks the specified step as done.
 	// Done(ctx context.Context) error
@@ -51,3 +447,322 @@ type Session interface {
 	// with the session if no steps are specified.
 	Delete(ctx context.Context, steps ...string) error
 }
+
+// Compactor is implemented by Sessions that can consolidate the storage
+// used for their completed steps.
+type Compactor interface {
+	// Compact consolidates the storage used for completed steps.
+	Compact(ctx context.Context) error
+}
+
+// Squasher is implemented by Sessions that can replace a group of
+// completed steps with a single step.
+type Squasher interface {
+	// Squash replaces the specified steps, all of which must have been
+	// completed, with a single completed step of the given name whose
+	// creation time is the earliest, and whose completion time is the
+	// latest, of those of the replaced steps. Its result, see
+	// Session.SetStepResult, is that of the most recently completed of
+	// the replaced steps that has one.
+	Squash(ctx context.Context, name string, steps ...string) error
+}
+
+// Reorderer is implemented by Sessions that allow the order in which
+// their steps are returned by Steps to be specified explicitly.
+type Reorderer interface {
+	// Reorder assigns the specified steps, none of which may be in
+	// progress, the order in which they are given. Steps returns the
+	// ordered steps first, followed by all other steps in order of
+	// creation. Any previously assigned order is discarded, hence
+	// calling Reorder with no steps restores the default ordering.
+	Reorder(ctx context.Context, steps ...string) error
+}
+
+// Sealer is implemented by Sessions that can be made immutable. Once
+// a session is sealed any operation that would modify it, including
+// resetting it via Manager.Use, returns ErrSealed until it is unsealed.
+// Sealed sessions may still be read.
+type Sealer interface {
+	// Seal marks the session as immutable.
+	Seal(ctx context.Context) error
+	// Unseal reverses the effect of Seal.
+	Unseal(ctx context.Context) error
+	// Sealed returns true if the session is sealed.
+	Sealed(ctx context.Context) (bool, error)
+}
+
+// Notifier is implemented by Sessions that can report changes to their
+// steps as they occur.
+type Notifier interface {
+	// Notify returns a channel on which a Step is sent whenever a step
+	// is completed or a new step is marked as in progress. The channel
+	// is closed when the context is canceled.
+	Notify(ctx context.Context) (<-chan Step, error)
+}
+
+// Notify calls sess.Notify if sess implements Notifier and returns
+// ErrNotSupported otherwise, in which case callers should fall back to
+// polling Steps.
+func Notify(ctx context.Context, sess Session) (<-chan Step, error) {
+	if n, ok := sess.(Notifier); ok {
+		return n.Notify(ctx)
+	}
+	return nil, ErrNotSupported
+}
+
+// StepsNewestFirst returns the steps of sess in the reverse of the order
+// in which they are returned by Session.Steps, ie. with the most
+// recently created step, including any step that is in progress, first.
+// Step.InProgress should be used to identify the in-progress step rather
+// than its position.
+func StepsNewestFirst(ctx context.Context, sess Session) ([]Step, error) {
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(steps)-1; i < j; i, j = i+1, j-1 {
+		steps[i], steps[j] = steps[j], steps[i]
+	}
+	return steps, nil
+}
+
+// MatchingDeleter is implemented by Sessions that can select and delete
+// steps atomically.
+type MatchingDeleter interface {
+	// DeleteMatching deletes, whilst holding the lock used to serialize
+	// access to the session, every completed or failed step for which
+	// match returns true and returns the deleted steps in the same order
+	// as Session.Steps. In-progress steps are never deleted.
+	DeleteMatching(ctx context.Context, match func(Step) bool) ([]Step, error)
+}
+
+// StepWalker is implemented by Sessions that can visit their steps as
+// they are read from storage rather than first reading all of them into
+// memory, as Session.Steps does, which is intended for sessions with very
+// large numbers of steps.
+type StepWalker interface {
+	// WalkSteps calls fn for each step in the session, in an unspecified
+	// order, stopping at, and returning, the first error returned by fn.
+	// fn must not modify the session since it may be called whilst a
+	// lock that prevents concurrent modification is held.
+	WalkSteps(ctx context.Context, fn func(Step) error) error
+}
+
+// WalkSteps calls fn for each step in sess, using StepWalker if sess
+// implements it and in the order returned by Session.Steps otherwise.
+func WalkSteps(ctx context.Context, sess Session, fn func(Step) error) error {
+	if walker, ok := sess.(StepWalker); ok {
+		return walker.WalkSteps(ctx, fn)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		if err := fn(step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LockInspector is implemented by Managers that can report on the locks
+// that they use to serialize access to sessions.
+type LockInspector interface {
+	// Locked returns true if the specified session is currently locked.
+	Locked(ctx context.Context, id string) (bool, error)
+
+	// ForceUnlock clears any stale lock state and the in-progress step
+	// for the specified session provided that it is not currently locked,
+	// holding the session's lock whilst doing so. It is intended for
+	// recovering sessions left in an inconsistent state by a process that
+	// crashed. Backends whose locks are only held whilst a command is
+	// running, rather than for the duration of a step, cannot distinguish
+	// a script that is part way through a step from one that crashed.
+	ForceUnlock(ctx context.Context, id string) error
+}
+
+// RawFile represents a single file, or other unit of storage, used by a
+// backend to store a session, as returned by RawDumper.
+type RawFile struct {
+	Name     string
+	Mode     os.FileMode
+	Contents []byte
+}
+
+// RawDumper is implemented by Sessions that can return the unparsed
+// contents of their underlying storage, which is intended for diagnosing
+// corrupt or otherwise unreadable sessions.
+type RawDumper interface {
+	// RawDump returns all of the files used to store the session, in
+	// lexical order of their names, regardless of whether they can be
+	// parsed.
+	RawDump(ctx context.Context) ([]RawFile, error)
+}
+
+// PathLister is implemented by Sessions that are stored as files, such as
+// those of the directory backend, and can return the locations of those
+// files so that they may be inspected, archived or copied directly. The
+// paths are specific to the backend and the files must not be modified
+// whilst the session is in use.
+type PathLister interface {
+	// Paths returns the absolute paths of all of the files used to store
+	// the session, other than any transient lock files, in lexical order.
+	Paths(ctx context.Context) ([]string, error)
+}
+
+// Problem represents an inconsistency in the storage used for a session,
+// as found by Verifier.
+type Problem struct {
+	// File is the name of the file, or other unit of storage, that is
+	// inconsistent.
+	File        string
+	Description string
+	// Fixed is true if the inconsistency has been repaired.
+	Fixed bool
+}
+
+// Verifier is implemented by Sessions that can check the integrity of
+// their underlying storage.
+type Verifier interface {
+	// Verify returns the inconsistencies found in the storage used for
+	// the session. If fix is true, those that can be safely repaired
+	// are repaired.
+	Verify(ctx context.Context, fix bool) ([]Problem, error)
+}
+
+// Migrator is implemented by Managers whose underlying storage has a
+// versioned format that may need to be upgraded as that format evolves.
+type Migrator interface {
+	// FormatVersion returns the format version of the existing store
+	// and the version used by the Manager for new stores.
+	FormatVersion(ctx context.Context) (store, current int, err error)
+
+	// Migrate upgrades every session in the store to the current format,
+	// and, for Managers that support more than one layout, to the layout
+	// that the Manager is configured to use, and returns the IDs of those
+	// sessions that were modified. It is idempotent, migrating an up to
+	// date store has no effect.
+	Migrate(ctx context.Context) ([]string, error)
+}
+
+// Initializer is implemented by Managers that can create their underlying
+// store ahead of its first use.
+type Initializer interface {
+	// Init creates the store, if it does not already exist, and returns
+	// its location.
+	Init(ctx context.Context) (string, error)
+}
+
+// Tx represents a set of steps that are completed atomically, see
+// Transactor. A Tx may be used concurrently.
+type Tx interface {
+	// Step is like Session.Step except that the steps completed within
+	// the transaction, whether implicitly by starting the next step or
+	// explicitly by calling Step with an empty step name, are staged
+	// rather than recorded as completed. A step that has been completed,
+	// either before the transaction was begun or within it, is reported
+	// as such. Steps may not be started in concurrency groups.
+	Step(ctx context.Context, step string, opts ...StepOption) (bool, error)
+
+	// Commit completes the step that is in progress within the
+	// transaction, if any, and then records all of the staged steps as
+	// completed at once. Steps that were completed outside of the
+	// transaction whilst it was in progress are left as is.
+	Commit(ctx context.Context) error
+
+	// Rollback discards the staged steps. It is called implicitly if the
+	// context passed to Transactor.Begin is canceled before the
+	// transaction is committed.
+	Rollback(ctx context.Context) error
+}
+
+// Transactor is implemented by Sessions that can complete a set of steps
+// atomically, so that either all, or none, of them are recorded as
+// completed.
+type Transactor interface {
+	// Begin starts a transaction for the session.
+	Begin(ctx context.Context) (Tx, error)
+}
+
+// Importer is implemented by Sessions that can record steps verbatim,
+// including their times, such as those of a session exported from another
+// store, rather than as they are run.
+type Importer interface {
+	// Import records the specified completed and failed steps as is,
+	// replacing any existing steps with the same name, or content hash.
+	// Steps that are neither completed nor failed, ie. were in progress,
+	// are ignored.
+	Import(ctx context.Context, steps []Step) error
+}
+
+// MetadataUpdater is implemented by Sessions that can read, modify and
+// write their metadata atomically so that concurrent updates, such as
+// those made to a parent session as its subsessions are created, are not
+// lost.
+type MetadataUpdater interface {
+	// UpdateMetadata calls fn with the session's metadata, or nil if it
+	// has none, and replaces it with the metadata returned by fn, all
+	// whilst preventing any concurrent modification of the session. The
+	// metadata is left unchanged if fn returns nil, or an error, which is
+	// then returned.
+	UpdateMetadata(ctx context.Context, fn func(map[string]interface{}) (map[string]interface{}, error)) error
+}
+
+// UpdateMetadata updates the metadata of sess using fn, as per
+// MetadataUpdater, atomically if sess implements MetadataUpdater and by
+// reading and then writing its metadata otherwise.
+func UpdateMetadata(ctx context.Context, sess Session, fn func(map[string]interface{}) (map[string]interface{}, error)) error {
+	if updater, ok := sess.(MetadataUpdater); ok {
+		return updater.UpdateMetadata(ctx, fn)
+	}
+	md, err := sess.Metadata(ctx)
+	if err != nil {
+		return err
+	}
+	updated, err := fn(md)
+	if err != nil || updated == nil {
+		return err
+	}
+	return sess.SetMetadata(ctx, updated)
+}
+
+// TrashedSession describes a session that has been moved to the trash,
+// see Trasher.
+type TrashedSession struct {
+	ID      string
+	Trashed time.Time
+}
+
+// Trasher is implemented by Managers that can move sessions to a trash
+// area, from which they may later be restored, rather than deleting them
+// outright.
+type Trasher interface {
+	// Trash moves the specified session to the trash. As for Delete,
+	// sealed sessions cannot be trashed. The same session may be trashed
+	// more than once, each copy is retained until the trash is emptied.
+	Trash(ctx context.Context, id string) error
+
+	// Trashed returns the sessions in the trash in lexical order of
+	// their IDs and, for the same ID, in the order that they were
+	// trashed.
+	Trashed(ctx context.Context) ([]TrashedSession, error)
+
+	// Restore moves the most recently trashed copy of the specified
+	// session out of the trash. It fails if the session already exists.
+	Restore(ctx context.Context, id string) error
+
+	// EmptyTrash permanently deletes the specified sessions, or all
+	// sessions if none are specified, from the trash and returns those
+	// that were deleted.
+	EmptyTrash(ctx context.Context, ids ...string) ([]TrashedSession, error)
+}
+
+// ValidateResult returns an error if result is neither nil nor valid
+// JSON, as required by Session.SetStepResult.
+func ValidateResult(result json.RawMessage) error {
+	if result != nil && !json.Valid(result) {
+		return errors.New("step result is not valid json")
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+package checkpointstate_test
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+func TestStepJSON(t *testing.T) {
+	created := time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC)
+	for i, tc := range []struct {
+		step     checkpointstate.Step
+		contains string
+	}{
+		{checkpointstate.Step{Name: "current", Created: created}, `"Completed":null`},
+		{checkpointstate.Step{Name: "done", Created: created, Completed: created.Add(time.Minute)},
+			`"Completed":"2021-01-02T03:05:05.000000006Z"`},
+		{checkpointstate.Step{Name: "annotated", Created: created, Artifacts: map[string]string{"a": "b"}},
+			`"Artifacts":{"a":"b"}`},
+	} {
+		buf, err := json.Marshal(tc.step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf), tc.contains; !strings.Contains(got, want) {
+			t.Errorf("%v: %v does not contain %v", i, got, want)
+		}
+		if strings.Contains(string(buf), "0001-01-01") {
+			t.Errorf("%v: %s contains a zero time", i, buf)
+		}
+		var step checkpointstate.Step
+		if err := json.Unmarshal(buf, &step); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := step, tc.step; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestIDGenerators(t *testing.T) {
+	if got, want := checkpointstate.HashIDs.SessionID("a", "b"), "e5a01fee14e0ed5c48714f22180f25ad8365b53f9779f79dc4a3d7e93963f94a"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for i, tc := range []struct {
+		inputs []string
+		id     string
+	}{
+		{nil, ""},
+		{[]string{"my", "project"}, "my-project"},
+		{[]string{"My Project!"}, "my-project"},
+		{[]string{"  --a__b--  ", "C", "", "d"}, "a-b-c-d"},
+		{[]string{"../../etc"}, "etc"},
+		{[]string{"v1.2", "café"}, "v1-2-caf"},
+	} {
+		if got, want := checkpointstate.SlugIDs.SessionID(tc.inputs...), tc.id; got != want {
+			t.Errorf("%v: got %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	long := strings.Repeat("x", checkpointstate.MaxTagLength)
+	for i, tc := range []struct {
+		tags []string
+		err  string
+	}{
+		{nil, "no tags specified"},
+		{[]string{}, "no tags specified"},
+		{[]string{""}, "tag 0 is empty"},
+		{[]string{"a", ""}, "tag 1 is empty"},
+		{[]string{"a", long + "x"}, "tag 1 is longer than 1024 bytes"},
+		{[]string{"a"}, ""},
+		{[]string{"a", long}, ""},
+	} {
+		err := checkpointstate.ValidateTags(tc.tags...)
+		if len(tc.err) == 0 {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", i, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: got %v, want an error containing %q", i, err, tc.err)
+			continue
+		}
+		if !errors.Is(err, checkpointstate.ErrInvalidTags) {
+			t.Errorf("%v: %v does not wrap ErrInvalidTags", i, err)
+		}
+	}
+}
+
+func TestInitMetadata(t *testing.T) {
+	t0 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Hour)
+	initMetadata := map[string]interface{}{"ID": "a"}
+	md, created := checkpointstate.InitMetadata(nil, initMetadata, t0)
+	if !created {
+		t.Errorf("new session was not created")
+	}
+	if got, want := md, map[string]interface{}{"ID": "a", "Created": t0, "Accessed": t0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := initMetadata, map[string]interface{}{"ID": "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("initMetadata was modified: got %v, want %v", got, want)
+	}
+	updated, created := checkpointstate.InitMetadata(md, map[string]interface{}{"ID": "b"}, t1)
+	if created {
+		t.Errorf("existing session was created")
+	}
+	if got, want := updated, map[string]interface{}{"ID": "a", "Created": t0, "Accessed": t1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := md["Accessed"], t0; got != want {
+		t.Errorf("existing metadata was modified: got %v, want %v", got, want)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	created := time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC)
+	at := func(d time.Duration) time.Time { return created.Add(d) }
+	summary := checkpointstate.NewSummary([]checkpointstate.Step{
+		{Name: "b", Created: at(time.Minute), Completed: at(3 * time.Minute)},
+		{Name: "a", Created: at(0), Completed: at(2 * time.Minute)},
+		{Name: "c", Created: at(4 * time.Minute), Failed: at(5 * time.Minute)},
+		{Name: "d", Created: at(6 * time.Minute)},
+	})
+	want := checkpointstate.Summary{
+		Total:         4,
+		Completed:     2,
+		InProgress:    true,
+		FirstCreated:  at(0),
+		LastCompleted: at(3 * time.Minute),
+		LastActive:    at(6 * time.Minute),
+	}
+	if got := summary; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	buf, err := json.Marshal(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf), `"LastCompleted":"2021-01-02T03:07:05.000000006Z"`; !strings.Contains(got, want) {
+		t.Errorf("%v does not contain %v", got, want)
+	}
+	buf, err = json.Marshal(checkpointstate.NewSummary(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf), `{"Total":0,"Completed":0,"InProgress":false,"FirstCreated":null,"LastCompleted":null,"LastActive":null}`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPhases(t *testing.T) {
+	created := time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC)
+	at := func(d time.Duration) time.Time { return created.Add(d) }
+	phases := checkpointstate.NewPhases([]checkpointstate.Step{
+		{Name: "fetch", Phase: "setup", Created: at(0), Completed: at(time.Minute)},
+		{Name: "configure", Phase: "setup", Created: at(time.Minute), Completed: at(2 * time.Minute)},
+		{Name: "untracked", Created: at(2 * time.Minute), Completed: at(3 * time.Minute)},
+		{Name: "compile", Phase: "build", Created: at(3 * time.Minute), Failed: at(4 * time.Minute)},
+		{Name: "link", Phase: "build", Created: at(4 * time.Minute), Completed: at(5 * time.Minute)},
+		{Name: "unit", Phase: "test", Created: at(5 * time.Minute)},
+		{Name: "generate", Phase: "build", Created: at(6 * time.Minute)},
+	})
+	want := []checkpointstate.Phase{
+		{
+			Name:  "setup",
+			Steps: []string{"fetch", "configure"},
+			Summary: checkpointstate.Summary{
+				Total:         2,
+				Completed:     2,
+				FirstCreated:  at(0),
+				LastCompleted: at(2 * time.Minute),
+				LastActive:    at(2 * time.Minute),
+			},
+		},
+		{
+			Name:   "build",
+			Steps:  []string{"compile", "link", "generate"},
+			Failed: 1,
+			Summary: checkpointstate.Summary{
+				Total:         3,
+				Completed:     1,
+				InProgress:    true,
+				FirstCreated:  at(3 * time.Minute),
+				LastCompleted: at(5 * time.Minute),
+				LastActive:    at(6 * time.Minute),
+			},
+		},
+		{
+			Name:  "test",
+			Steps: []string{"unit"},
+			Summary: checkpointstate.Summary{
+				Total:        1,
+				InProgress:   true,
+				FirstCreated: at(5 * time.Minute),
+				LastActive:   at(5 * time.Minute),
+			},
+		},
+	}
+	if got := phases; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for i, complete := range []bool{true, false, false} {
+		if got, want := phases[i].Complete(), complete; got != want {
+			t.Errorf("%v: got %v, want %v", phases[i].Name, got, want)
+		}
+	}
+	if got := checkpointstate.NewPhases(nil); len(got) != 0 {
+		t.Errorf("unexpected phases: %v", got)
+	}
+	if (checkpointstate.Phase{Name: "empty"}).Complete() {
+		t.Errorf("a phase without steps should not be complete")
+	}
+}
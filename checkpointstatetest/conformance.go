@@ -0,0 +1,1496 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package checkpointstatetest provides a conformance test suite that
+// any implementation of checkpointstate.Manager and checkpointstate.Session
+// can use to verify that it behaves as expected. A backend's tests
+// need only call RunConformance with a factory for its Manager.
+package checkpointstatetest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// ManagerFactory returns a new Manager, with no existing sessions, for
+// use by a single test. Any cleanup required should be registered
+// using t.Cleanup.
+type ManagerFactory func(t *testing.T) checkpointstate.Manager
+
+// RunConformance runs the conformance suite, as a series of subtests,
+// against Managers created by factory.
+func RunConformance(t *testing.T, factory ManagerFactory) {
+	for _, tc := range []struct {
+		name string
+		fn   func(t *testing.T, mgr checkpointstate.Manager)
+	}{
+		{"SessionID", testSessionID},
+		{"Metadata", testMetadata},
+		{"UseWithMetadata", testUseWithMetadata},
+		{"UpdateMetadata", testUpdateMetadata},
+		{"Walk", testWalk},
+		{"Steps", testSteps},
+		{"StepNames", testStepNames},
+		{"StepsNewestFirst", testStepsNewestFirst},
+		{"WalkSteps", testWalkSteps},
+		{"Current", testCurrent},
+		{"Summary", testSummary},
+		{"Reset", testReset},
+		{"Artifacts", testArtifacts},
+		{"Command", testCommand},
+		{"ContentKey", testContentKey},
+		{"Fail", testFail},
+		{"DoubleCompletion", testDoubleCompletion},
+		{"IsComplete", testIsComplete},
+		{"Abort", testAbort},
+		{"Concurrent", testConcurrent},
+		{"StepMetadata", testStepMetadata},
+		{"StepResult", testStepResult},
+		{"Delete", testDelete},
+		{"DeleteMatching", testDeleteMatching},
+		{"NoSuchSession", testNoSuchSession},
+		{"Notify", testNotify},
+		{"Seal", testSeal},
+		{"Import", testImport},
+		{"Phases", testPhases},
+	} {
+		fn := tc.fn
+		t.Run(tc.name, func(t *testing.T) {
+			fn(t, factory(t))
+		})
+	}
+}
+
+func loc(depth int) string {
+	_, file, line, _ := runtime.Caller(depth + 1)
+	return fmt.Sprintf("%v:%v", filepath.Base(file), line)
+}
+
+// session wraps a checkpointstate.Session to provide assertions on its
+// behaviour.
+type session struct {
+	t    *testing.T
+	ctx  context.Context
+	mgr  checkpointstate.Manager
+	id   string
+	sess checkpointstate.Session
+}
+
+func newSession(t *testing.T, mgr checkpointstate.Manager, tags ...string) *session {
+	s := &session{t: t, ctx: context.Background(), mgr: mgr, id: mgr.SessionID(tags...)}
+	s.use(true)
+	return s
+}
+
+func (s *session) use(reset bool) {
+	sess, err := s.mgr.Use(s.ctx, s.id, reset)
+	if err != nil {
+		s.t.Fatalf("%v: %v", loc(1), err)
+	}
+	s.sess = sess
+}
+
+// step calls Step and verifies that it returns the expected completion
+// status.
+func (s *session) step(name string, done bool, opts ...checkpointstate.StepOption) {
+	ok, err := s.sess.Step(s.ctx, name, opts...)
+	if err != nil {
+		s.t.Fatalf("%v: %v: unexpected error: %v", loc(1), name, err)
+	}
+	if got, want := ok, done; got != want {
+		s.t.Errorf("%v: %v: got %v, want %v", loc(1), name, got, want)
+	}
+}
+
+// steps calls Steps and verifies that the names of the returned steps
+// are as expected.
+func (s *session) steps(names ...string) []checkpointstate.Step {
+	steps, err := s.sess.Steps(s.ctx)
+	if err != nil {
+		s.t.Fatalf("%v: unexpected error: %v", loc(1), err)
+	}
+	var got []string
+	for _, step := range steps {
+		got = append(got, step.Name)
+	}
+	if want := names; !reflect.DeepEqual(got, want) {
+		s.t.Errorf("%v: got %v, want %v", loc(1), got, want)
+	}
+	return steps
+}
+
+func expectError(t *testing.T, err error, contains string) {
+	if err == nil || !strings.Contains(err.Error(), contains) {
+		t.Errorf("%v: missing or unexpected error: %v, should contain %q", loc(1), err, contains)
+	}
+}
+
+func list(t *testing.T, mgr checkpointstate.Manager) []string {
+	ids, err := mgr.List(context.Background())
+	if err != nil {
+		t.Fatalf("%v: %v", loc(1), err)
+	}
+	return ids
+}
+
+func testSessionID(t *testing.T, mgr checkpointstate.Manager) {
+	if got, want := mgr.SessionID("a", "b"), mgr.SessionID("a", "b"); got != want {
+		t.Errorf("session IDs are not stable: %v != %v", got, want)
+	}
+	ids := map[string]bool{}
+	for _, tags := range [][]string{{"a"}, {"a", "b"}, {"b", "a"}, {"ab"}} {
+		id := mgr.SessionID(tags...)
+		if len(id) == 0 {
+			t.Errorf("%v: empty session ID", tags)
+		}
+		if ids[id] {
+			t.Errorf("%v: duplicate session ID: %v", tags, id)
+		}
+		ids[id] = true
+	}
+	for _, reset := range []bool{true, false} {
+		if _, err := mgr.Use(context.Background(), "", reset); !errors.Is(err, checkpointstate.ErrEmptySessionID) {
+			t.Errorf("reset: %v: got %v, want %v", reset, err, checkpointstate.ErrEmptySessionID)
+		}
+	}
+	// Degenerate inputs result in the empty ID, and hence can never be
+	// used to create a session.
+	for _, tags := range [][]string{nil, {""}, {"a", ""}, {strings.Repeat("x", checkpointstate.MaxTagLength+1)}} {
+		id := mgr.SessionID(tags...)
+		if len(id) != 0 {
+			t.Errorf("%q: got %v, want an empty session ID", tags, id)
+		}
+		if _, err := mgr.Use(context.Background(), id, true); !errors.Is(err, checkpointstate.ErrEmptySessionID) {
+			t.Errorf("%q: got %v, want %v", tags, err, checkpointstate.ErrEmptySessionID)
+		}
+	}
+}
+
+func testMetadata(t *testing.T, mgr checkpointstate.Manager) {
+	ctx := context.Background()
+	if got, want := list(t, mgr), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	s := newSession(t, mgr, "a", "b")
+	md, err := s.sess.Metadata(ctx)
+	if err != nil || md != nil {
+		t.Errorf("unexpected metadata for a new session: %v, %v", md, err)
+	}
+	md = map[string]interface{}{
+		"Tags": []interface{}{"a", "b"},
+		"ID":   s.id,
+		"Date": time.Now().Format(time.RFC3339),
+	}
+	if err := s.sess.SetMetadata(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+	nmd, err := s.sess.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := nmd, md; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	s1 := newSession(t, mgr, "c")
+	ids := []string{s.id, s1.id}
+	if ids[0] > ids[1] {
+		ids[0], ids[1] = ids[1], ids[0]
+	}
+	if got, want := list(t, mgr), ids; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func testUseWithMetadata(t *testing.T, mgr checkpointstate.Manager) {
+	ctx := context.Background()
+	id := mgr.SessionID("use-with-metadata")
+	initMetadata := map[string]interface{}{"ID": id, "Tags": []interface{}{"use-with-metadata"}}
+	if _, _, err := mgr.UseWithMetadata(ctx, id, false, initMetadata); err != checkpointstate.ErrNoSuchSession {
+		t.Errorf("got %v, want %v", err, checkpointstate.ErrNoSuchSession)
+	}
+	if _, _, err := mgr.UseWithMetadata(ctx, "", true, initMetadata); !errors.Is(err, checkpointstate.ErrEmptySessionID) {
+		t.Errorf("got %v, want %v", err, checkpointstate.ErrEmptySessionID)
+	}
+
+	// Exactly one of many simultaneous calls creates the session and
+	// all of the others see the metadata that it wrote.
+	const concurrency = 10
+	var wg sync.WaitGroup
+	created := make([]bool, concurrency)
+	errs := make([]error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, created[i], errs[i] = mgr.UseWithMetadata(ctx, id, true, initMetadata)
+		}(i)
+	}
+	wg.Wait()
+	ncreated := 0
+	for i := range created {
+		if errs[i] != nil {
+			t.Fatalf("%v: %v", i, errs[i])
+		}
+		if created[i] {
+			ncreated++
+		}
+	}
+	if ncreated != 1 {
+		t.Errorf("session created %v times", ncreated)
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := sess.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md["ID"], id; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := md["Tags"], initMetadata["Tags"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	createdAt, accessedAt := md["Created"], md["Accessed"]
+	if createdAt == nil || accessedAt == nil {
+		t.Fatalf("missing Created or Accessed: %v", md)
+	}
+
+	// Created and the initial metadata are unchanged for an existing
+	// session, but Accessed is updated.
+	time.Sleep(time.Millisecond)
+	sess, ok, err := mgr.UseWithMetadata(ctx, id, false, map[string]interface{}{"ID": "other"})
+	if err != nil || ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	}
+	md, err = sess.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md["ID"], id; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := md["Created"], createdAt; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := md["Accessed"]; got == accessedAt {
+		t.Errorf("Accessed was not updated: %v", got)
+	}
+}
+
+func testWalk(t *testing.T, mgr checkpointstate.Manager) {
+	ctx := context.Background()
+	for _, tag := range []string{"a", "b", "c", "d"} {
+		s := newSession(t, mgr, tag)
+		s.step(tag, false)
+	}
+	ids := list(t, mgr)
+
+	walked := []string{}
+	err := mgr.Walk(ctx, func(id string, sess checkpointstate.Session) error {
+		steps, err := sess.Steps(ctx)
+		if err != nil {
+			return err
+		}
+		if got, want := len(steps), 1; got != want {
+			t.Errorf("%v: got %v, want %v", id, got, want)
+		}
+		walked = append(walked, id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Walk need not visit sessions in the same order as List.
+	sort.Strings(walked)
+	if got, want := walked, ids; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	listed := map[string]bool{}
+	for _, id := range ids {
+		listed[id] = true
+	}
+
+	// Stop early via the callback.
+	stop := fmt.Errorf("stop")
+	walked = []string{}
+	err = mgr.Walk(ctx, func(id string, sess checkpointstate.Session) error {
+		walked = append(walked, id)
+		if len(walked) == 2 {
+			return stop
+		}
+		return nil
+	})
+	if got, want := err, stop; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(walked), 2; got != want || !listed[walked[0]] || !listed[walked[1]] {
+		t.Errorf("got %v, want %v of %v", walked, want, ids)
+	}
+
+	// Stop early via context cancelation.
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	walked = []string{}
+	err = mgr.Walk(cctx, func(id string, sess checkpointstate.Session) error {
+		walked = append(walked, id)
+		cancel()
+		return nil
+	})
+	if got, want := err, context.Canceled; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(walked), 1; got != want || !listed[walked[0]] {
+		t.Errorf("got %v, want %v of %v", walked, want, ids)
+	}
+}
+
+func testSteps(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "xyz")
+	s.steps()
+	s.step("zz", false)
+	s.steps("zz")
+	s.step("xx", false)
+	steps := s.steps("zz", "xx")
+	if steps[0].Completed.IsZero() {
+		t.Errorf("completed state has no completion time")
+	}
+	if !steps[1].Completed.IsZero() || !steps[1].InProgress() {
+		t.Errorf("current state has completion time")
+	}
+	time.Sleep(10 * time.Millisecond)
+	s.step("ww", false)
+	steps = s.steps("zz", "xx", "ww")
+	if !steps[2].InProgress() {
+		t.Errorf("current state has completion time")
+	}
+	for i, step := range steps {
+		if step.Created.IsZero() {
+			t.Errorf("%v: step has no creation time", i)
+		}
+		if !step.Completed.IsZero() && step.Completed.Before(step.Created) {
+			t.Errorf("%v: step completed before it was created", i)
+		}
+	}
+	duration := steps[1].Completed.Sub(steps[1].Created)
+	if from, to := 10*time.Millisecond, time.Minute; duration < from || duration > to {
+		t.Errorf("step duration is out of expected range: %v: %v...%v", duration, from, to)
+	}
+
+	// Explicitly complete the current step.
+	s.step("", true)
+	// Completed steps are reported as such.
+	s.step("zz", true)
+	s.step("xx", true)
+	s.step("ww", true)
+	steps = s.steps("zz", "xx", "ww")
+	for i, step := range steps {
+		if step.Completed.IsZero() {
+			t.Errorf("%v: step has no completion time", i)
+		}
+	}
+}
+
+// testStepNames verifies that steps may be given arbitrary names.
+func testStepNames(t *testing.T, mgr checkpointstate.Manager) {
+	ctx := context.Background()
+	names := []string{
+		"build & test (stage 1)",
+		"a/b/c",
+		"/leading/slash",
+		"..",
+		".hidden",
+		"100%",
+		"a%2Fb",
+		" padded ",
+		"metadata",
+		"in-progress",
+		"日本語のステップ",
+		"naïve café",
+		"tab\tand\nnewline",
+	}
+	s := newSession(t, mgr, "names")
+	for _, name := range names {
+		s.step(name, false)
+	}
+	s.step("", true)
+	s.steps(names...)
+	for _, name := range names {
+		s.step(name, true)
+	}
+	if err := s.sess.SetStepMetadata(ctx, "a/b/c", map[string]interface{}{"k": "v"}); err != nil {
+		t.Fatal(err)
+	}
+	md, err := s.sess.StepMetadata(ctx, "a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md, map[string]interface{}{"k": "v"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := s.sess.Delete(ctx, "a/b/c", "日本語のステップ"); err != nil {
+		t.Fatal(err)
+	}
+	s.step("a/b/c", false)
+	s.step("日本語のステップ", false)
+	s.step("", true)
+	var want []string
+	for _, name := range names {
+		if name != "a/b/c" && name != "日本語のステップ" {
+			want = append(want, name)
+		}
+	}
+	s.steps(append(want, "a/b/c", "日本語のステップ")...)
+}
+
+func testReset(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "/a/b/c")
+	s.step("a", false)
+	s.step("b", false)
+	s.steps("a", "b")
+
+	// Reseting the session discards the current step, b, which will
+	// hence be rerun.
+	s.use(true)
+	s.step("a", true)
+	s.step("b", false)
+	s.step("", true)
+
+	s.use(true)
+	s.step("a", true)
+	s.step("b", true)
+
+	// Make sure that reseting the current step can be overridden.
+	s.use(false)
+	s.step("c", false)
+	s.use(false)
+	s.step("", true)
+	s.step("c", true)
+	s.steps("a", "b", "c")
+}
+
+func testArtifacts(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "artifacts")
+	s.step("a", false, checkpointstate.WithArtifact("out", "/tmp/a.tar"))
+	s.step("b", false, checkpointstate.WithArtifact("out", "/tmp/b.tar"))
+	// Annotate the step being completed.
+	s.step("", true, checkpointstate.WithArtifact("size", "42"))
+	// Options are ignored for steps that are already complete.
+	s.step("a", true, checkpointstate.WithArtifact("ignored", "true"))
+	s.step("c", false)
+	steps := s.steps("a", "b", "c")
+	for i, artifacts := range []map[string]string{
+		{"out": "/tmp/a.tar"},
+		{"out": "/tmp/b.tar", "size": "42"},
+		nil,
+	} {
+		if got, want := steps[i].Artifacts, artifacts; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func testCommand(t *testing.T, mgr checkpointstate.Manager) {
+	ctx := context.Background()
+	s := newSession(t, mgr, "command")
+	s.step("a", false, checkpointstate.WithCommand("make", "build"))
+	// The exit status is supplied when the step is completed.
+	s.step("", true, checkpointstate.WithExitCode(0))
+	s.step("b", false)
+	s.step("", true)
+	s.step("c", false, checkpointstate.WithCommand("false"))
+	if err := s.sess.Fail(ctx, "", "exit status 1"); err != nil {
+		t.Fatal(err)
+	}
+	steps := s.steps("a", "b", "c")
+	zero := 0
+	for i, tc := range []struct {
+		command  []string
+		exitCode *int
+	}{
+		{[]string{"make", "build"}, &zero},
+		{nil, nil},
+		{[]string{"false"}, nil},
+	} {
+		if got, want := steps[i].Command, tc.command; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := steps[i].ExitCode, tc.exitCode; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func testContentKey(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "content-key")
+	s.step("build v1", false, checkpointstate.WithContentKey("src", "v1"))
+	s.step("", true)
+	// The same inputs are recognized as complete regardless of name.
+	s.step("rebuild v1", true, checkpointstate.WithContentKey("src", "v1"))
+	s.step("build v2", false, checkpointstate.WithContentKey("src", "v2"))
+	// Steps without a content key are still identified by name.
+	s.step("build v1", false)
+	steps := s.steps("build v1", "build v2", "build v1")
+	h1, h2 := steps[0].ContentHash, steps[1].ContentHash
+	if len(h1) == 0 || len(h2) == 0 || h1 == h2 {
+		t.Errorf("missing or non-unique content hashes: %q, %q", h1, h2)
+	}
+	if got, want := steps[2].ContentHash, ""; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := h1, checkpointstate.NewStepOptions(checkpointstate.WithContentKey("src", "v1")).Key("ignored"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Steps identified by content hash are deleted by that hash.
+	if err := s.sess.Delete(s.ctx, h1); err != nil {
+		t.Fatal(err)
+	}
+	s.use(true)
+	s.step("rebuild v1", false, checkpointstate.WithContentKey("src", "v1"))
+}
+
+func testFail(t *testing.T, mgr checkpointstate.Manager) {
+	ctx := context.Background()
+	s := newSession(t, mgr, "fail")
+	expectError(t, s.sess.Fail(ctx, "", "nothing in progress"), "no step is in progress")
+	s.step("a", false)
+	if err := s.sess.Fail(ctx, "a", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	steps := s.steps("a")
+	if steps[0].Failed.IsZero() || !steps[0].Completed.IsZero() || steps[0].InProgress() {
+		t.Errorf("step was not marked as failed: %v", steps[0])
+	}
+	if got, want := steps[0].Reason, "oops"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A failed step is rerun.
+	s.step("a", false)
+	steps = s.steps("a")
+	if !steps[0].InProgress() || len(steps[0].Reason) != 0 {
+		t.Errorf("step is not in progress: %v", steps[0])
+	}
+	// Fail the current step without naming it.
+	if err := s.sess.Fail(ctx, "", "oops again"); err != nil {
+		t.Fatal(err)
+	}
+	s.step("a", false)
+	s.step("", true)
+	s.step("a", true)
+	expectError(t, s.sess.Fail(ctx, "a", "too late"), "already been completed")
+
+	// Fail a step that is not in progress.
+	if err := s.sess.Fail(ctx, "b", "never started"); err != nil {
+		t.Fatal(err)
+	}
+	steps = s.steps("a", "b")
+	if steps[0].Completed.IsZero() || steps[1].Failed.IsZero() {
+		t.Errorf("unexpected steps: %v", steps)
+	}
+}
+
+func testDoubleCompletion(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "double-completion")
+	completed := func(name string) time.Time {
+		for _, step := range s.steps("a", "b") {
+			if step.Name == name {
+				return step.Completed
+			}
+		}
+		return time.Time{}
+	}
+	s.step("a", false)
+	s.step("b", false, checkpointstate.WithGroup("g"))
+	if err := s.sess.Complete(s.ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	s.step("", true)
+	a, b := completed("a"), completed("b")
+	if a.IsZero() || b.IsZero() {
+		t.Fatalf("steps were not completed: %v %v", a, b)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// Requesting, or completing, a step that has already been completed,
+	// twice in a row, is a no-op that never errors.
+	for i := 0; i < 2; i++ {
+		s.step("a", true)
+		s.step("b", true, checkpointstate.WithGroup("g"))
+		s.step("", true, checkpointstate.WithArtifact("k", "v"))
+		for _, name := range []string{"a", "b"} {
+			if err := s.sess.Complete(s.ctx, name, checkpointstate.WithArtifact("k", "v")); err != nil {
+				t.Errorf("%v: %v: %v", i, name, err)
+			}
+		}
+	}
+	if got, want := completed("a"), a; !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := completed("b"), b; !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, step := range s.steps("a", "b") {
+		if len(step.Artifacts) != 0 {
+			t.Errorf("%v: unexpected artifacts: %v", step.Name, step.Artifacts)
+		}
+	}
+	if step, err := s.sess.Current(s.ctx); err != nil || step != nil {
+		t.Errorf("unexpected current step: %v, %v", step, err)
+	}
+
+	// Requesting the step that is in progress, as running the same
+	// command twice in a row does, restarts it and leaves it in progress.
+	current := func() checkpointstate.Step {
+		step, err := s.sess.Current(s.ctx)
+		if err != nil || step == nil || step.Name != "c" {
+			t.Fatalf("%v: unexpected current step: %v, %v", loc(1), step, err)
+		}
+		if !step.InProgress() {
+			t.Errorf("%v: step is not in progress: %v", loc(1), step)
+		}
+		return *step
+	}
+	s.step("c", false)
+	started := current()
+	time.Sleep(10 * time.Millisecond)
+	s.step("c", false)
+	restarted := current()
+	if !restarted.Created.After(started.Created) {
+		t.Errorf("step was not restarted: got %v, want after %v", restarted.Created, started.Created)
+	}
+	s.steps("a", "b", "c")
+}
+
+func testIsComplete(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "is-complete")
+	key := checkpointstate.WithContentKey("input")
+	isComplete := func(name string, want bool, opts ...checkpointstate.StepOption) {
+		done, err := s.sess.IsComplete(s.ctx, name, opts...)
+		if err != nil {
+			t.Fatalf("%v: %v: %v", loc(1), name, err)
+		}
+		if got := done; got != want {
+			t.Errorf("%v: %v: got %v, want %v", loc(1), name, got, want)
+		}
+	}
+	// Querying a step never starts it.
+	isComplete("a", false)
+	isComplete("a", false)
+	s.steps()
+	if step, err := s.sess.Current(s.ctx); err != nil || step != nil {
+		t.Errorf("unexpected current step: %v, %v", step, err)
+	}
+
+	// In-progress steps, including concurrent ones, are not complete.
+	s.step("a", false)
+	isComplete("a", false)
+	s.step("b", false, checkpointstate.WithGroup("g"))
+	isComplete("a", true)
+	isComplete("b", false)
+	s.step("c", false, key)
+	isComplete("c", false, key)
+	if err := s.sess.Complete(s.ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	isComplete("b", true)
+	s.step("", true)
+	isComplete("c", true, key)
+	isComplete("c", false)
+
+	// Failed steps are not complete.
+	s.step("d", false)
+	if err := s.sess.Fail(s.ctx, "", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	isComplete("d", false)
+	s.steps("a", "b", "c", "d")
+	if step, err := s.sess.Current(s.ctx); err != nil || step != nil {
+		t.Errorf("unexpected current step: %v, %v", step, err)
+	}
+}
+
+func testStepsNewestFirst(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "newest-first")
+	steps, err := checkpointstate.StepsNewestFirst(s.ctx, s.sess)
+	if err != nil || len(steps) != 0 {
+		t.Errorf("unexpected steps for a new session: %v, %v", steps, err)
+	}
+	for _, step := range []string{"a", "b", "c"} {
+		s.step(step, false)
+		time.Sleep(time.Millisecond)
+	}
+	steps, err = checkpointstate.StepsNewestFirst(s.ctx, s.sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, step := range steps {
+		got = append(got, step.Name)
+	}
+	if want := []string{"c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The in-progress step remains identifiable.
+	for i, step := range steps {
+		if got, want := step.InProgress(), i == 0; got != want {
+			t.Errorf("%v: in progress: got %v, want %v", step.Name, got, want)
+		}
+	}
+	// The order of Steps itself is unchanged.
+	s.steps("a", "b", "c")
+}
+
+func testWalkSteps(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "walk-steps")
+	for _, step := range []string{"a", "b", "c"} {
+		s.step(step, false)
+		time.Sleep(time.Millisecond)
+	}
+	steps := s.steps("a", "b", "c")
+	want := map[string]checkpointstate.Step{}
+	for _, step := range steps {
+		want[step.Name] = step
+	}
+	got := map[string]checkpointstate.Step{}
+	err := checkpointstate.WalkSteps(s.ctx, s.sess, func(step checkpointstate.Step) error {
+		if _, ok := got[step.Name]; ok {
+			t.Errorf("%v: visited more than once", step.Name)
+		}
+		got[step.Name] = step
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Walking stops at the first error.
+	stop := errors.New("stop")
+	visited := 0
+	err = checkpointstate.WalkSteps(s.ctx, s.sess, func(step checkpointstate.Step) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Errorf("got %v after %v steps, want %v after 1 step", err, visited, stop)
+	}
+}
+
+func testCurrent(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "current")
+	current := func() *checkpointstate.Step {
+		step, err := s.sess.Current(s.ctx)
+		if err != nil {
+			t.Fatalf("%v: %v", loc(1), err)
+		}
+		return step
+	}
+	if step := current(); step != nil {
+		t.Errorf("unexpected current step: %v", step)
+	}
+	s.step("a", false, checkpointstate.WithArtifact("k", "v"))
+	step := current()
+	if step == nil {
+		t.Fatal("missing current step")
+	}
+	if got, want := *step, s.steps("a")[0]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !step.InProgress() || step.Artifacts["k"] != "v" {
+		t.Errorf("unexpected current step: %v", step)
+	}
+	s.step("b", false)
+	if step := current(); step == nil || step.Name != "b" {
+		t.Errorf("unexpected current step: %v", step)
+	}
+	// Completed, failed and aborted steps are not current.
+	s.step("", true)
+	if step := current(); step != nil {
+		t.Errorf("unexpected current step: %v", step)
+	}
+	s.step("c", false)
+	if err := s.sess.Fail(s.ctx, "", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	if step := current(); step != nil {
+		t.Errorf("unexpected current step: %v", step)
+	}
+	s.step("d", false)
+	if err := s.sess.Abort(s.ctx); err != nil {
+		t.Fatal(err)
+	}
+	if step := current(); step != nil {
+		t.Errorf("unexpected current step: %v", step)
+	}
+	// Use with reset discards the in-progress step.
+	s.step("e", false)
+	s.use(true)
+	if step := current(); step != nil {
+		t.Errorf("unexpected current step: %v", step)
+	}
+}
+
+func testSummary(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "summary")
+	summary := func() checkpointstate.Summary {
+		sm, err := s.sess.Summary(s.ctx)
+		if err != nil {
+			t.Fatalf("%v: %v", loc(1), err)
+		}
+		return sm
+	}
+	if got, want := summary(), (checkpointstate.Summary{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	s.step("a", false)
+	s.step("b", false)
+	s.step("c", false)
+	if err := s.sess.Fail(s.ctx, "", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	s.step("d", false)
+	steps := s.steps("a", "b", "c", "d")
+	want := checkpointstate.Summary{
+		Total:         4,
+		Completed:     2,
+		InProgress:    true,
+		FirstCreated:  steps[0].Created,
+		LastCompleted: steps[1].Completed,
+		LastActive:    steps[3].Created,
+	}
+	if got := summary(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	s.step("", true)
+	last := s.steps("a", "b", "c", "d")[3].Completed
+	want.Completed, want.InProgress, want.LastCompleted, want.LastActive = 3, false, last, last
+	if got := summary(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func testAbort(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "abort")
+	expectError(t, s.sess.Abort(s.ctx), "no step is in progress")
+	s.step("a", false)
+	s.step("b", false)
+	steps := s.steps("a", "b")
+	if err := s.sess.Abort(s.ctx); err != nil {
+		t.Fatal(err)
+	}
+	// The aborted step is not recorded at all.
+	s.steps("a")
+	expectError(t, s.sess.Abort(s.ctx), "no step is in progress")
+	// And is rerun as a new step.
+	time.Sleep(time.Millisecond)
+	s.step("b", false)
+	retried := s.steps("a", "b")
+	if !retried[1].Created.After(steps[1].Created) {
+		t.Errorf("step was not restarted: %v, %v", retried[1].Created, steps[1].Created)
+	}
+	s.step("", true)
+	s.step("b", true)
+}
+
+func testConcurrent(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "concurrent")
+	group := checkpointstate.WithGroup("g")
+	s.step("a", false)
+	// Starting a concurrent step completes the current one, but the
+	// concurrent steps do not complete each other.
+	s.step("b", false, group)
+	s.step("c", false, group)
+	s.step("b", false, group)
+	steps := s.steps("a", "b", "c")
+	if steps[0].InProgress() || !steps[1].InProgress() || !steps[2].InProgress() {
+		t.Errorf("unexpected steps: %v", steps)
+	}
+	if got, want := steps[1].Group, "g"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if step, err := s.sess.Current(s.ctx); err != nil || step != nil {
+		t.Errorf("unexpected current step: %v, %v", step, err)
+	}
+	s.step("d", false)
+	_, err := s.sess.Step(s.ctx, "b")
+	expectError(t, err, "step b is in progress in group g")
+	s.steps("a", "b", "c", "d")
+
+	// The current step may also be completed explicitly.
+	if err := s.sess.Complete(s.ctx, "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sess.Complete(s.ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	// Completing a step again is a no-op.
+	if err := s.sess.Complete(s.ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	expectError(t, s.sess.Complete(s.ctx, "x"), "step x is not in progress")
+	if err := s.sess.Fail(s.ctx, "b", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	// A failed concurrent step is rerun.
+	s.step("b", false, group)
+	if err := s.sess.Complete(s.ctx, "b", checkpointstate.WithArtifact("k", "v")); err != nil {
+		t.Fatal(err)
+	}
+	steps = s.steps("a", "c", "d", "b")
+	for _, step := range steps {
+		if step.Completed.IsZero() || !step.Failed.IsZero() {
+			t.Errorf("step %v was not completed", step.Name)
+		}
+	}
+	if got, want := steps[3].Artifacts["k"], "v"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	s.step("b", true, group)
+	s.step("c", true)
+
+	// Concurrent steps are discarded when the session is reset.
+	s.step("e", false, group)
+	s.use(true)
+	s.steps("a", "c", "d", "b")
+	expectError(t, s.sess.Complete(s.ctx, "e"), "step e is not in progress")
+}
+
+func testDelete(t *testing.T, mgr checkpointstate.Manager) {
+	ctx := context.Background()
+	s := newSession(t, mgr, "delete")
+	other := newSession(t, mgr, "other")
+	s.step("a", false)
+	s.step("b", false)
+	s.step("c", false)
+	if err := s.sess.Delete(ctx, "a", "nonexistent"); err != nil {
+		t.Fatal(err)
+	}
+	s.steps("b", "c")
+	s.use(true)
+	s.step("a", false)
+	s.step("b", true)
+	s.step("", true)
+	s.steps("b", "a")
+
+	if err := s.sess.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list(t, mgr), []string{other.id}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	s.use(true)
+	s.steps()
+	s.step("a", false)
+	s.step("b", false)
+	s.use(true)
+	s.step("a", true)
+	s.step("b", false)
+}
+
+func testDeleteMatching(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "delete-matching")
+	deleter, ok := s.sess.(checkpointstate.MatchingDeleter)
+	if !ok {
+		t.Skip("deleting matching steps is not supported")
+	}
+	s.step("tmp-1", false)
+	time.Sleep(time.Millisecond)
+	s.step("keep", false)
+	time.Sleep(time.Millisecond)
+	s.step("tmp-2", false)
+	if err := s.sess.Fail(s.ctx, "", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	s.step("tmp-3", false, checkpointstate.WithContentKey("v1"))
+	time.Sleep(time.Millisecond)
+	s.step("tmp-4", false)
+	var offered []string
+	deleted, err := deleter.DeleteMatching(s.ctx, func(step checkpointstate.Step) bool {
+		offered = append(offered, step.Name)
+		return strings.HasPrefix(step.Name, "tmp-")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, step := range deleted {
+		got = append(got, step.Name)
+	}
+	if want := []string{"tmp-1", "tmp-2", "tmp-3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The in-progress step is never offered.
+	sort.Strings(offered)
+	if want := []string{"keep", "tmp-1", "tmp-2", "tmp-3"}; !reflect.DeepEqual(offered, want) {
+		t.Errorf("got %v, want %v", offered, want)
+	}
+	s.steps("keep", "tmp-4")
+
+	// Nothing is deleted if nothing matches.
+	deleted, err = deleter.DeleteMatching(s.ctx, func(checkpointstate.Step) bool { return false })
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("unexpected result: %v, %v", deleted, err)
+	}
+	s.steps("keep", "tmp-4")
+
+	// Deleted steps are rerun, including those with content keys.
+	s.use(true)
+	s.step("tmp-1", false)
+	s.step("keep", true)
+	s.step("tmp-3", false, checkpointstate.WithContentKey("v1"))
+}
+
+func testStepMetadata(t *testing.T, mgr checkpointstate.Manager) {
+	ctx := context.Background()
+	s := newSession(t, mgr, "step-metadata")
+	expectError(t, s.sess.SetStepMetadata(ctx, "a", map[string]interface{}{"x": "y"}), "does not exist")
+	expectError(t, s.sess.SetStepMetadata(ctx, "a", map[string]interface{}{"x": func() {}}), "json")
+
+	s.step("a", false)
+	s.step("b", false)
+	s.step("c", false)
+	if err := s.sess.Fail(ctx, "", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	s.step("d", false)
+	for _, step := range []string{"a", "b", "c", "d"} {
+		md, err := s.sess.StepMetadata(ctx, step)
+		if err != nil || md != nil {
+			t.Errorf("%v: unexpected metadata for a new step: %v, %v", step, md, err)
+		}
+	}
+	// Set metadata for completed, failed and in-progress steps.
+	mds := map[string]map[string]interface{}{}
+	for _, step := range []string{"a", "c", "d"} {
+		mds[step] = map[string]interface{}{
+			"Command": "run " + step,
+			"Args":    []interface{}{step, "--verbose"},
+			"Elapsed": map[string]interface{}{"user": 1.5, "sys": 0.25},
+		}
+		if err := s.sess.SetStepMetadata(ctx, step, mds[step]); err != nil {
+			t.Fatalf("%v: %v", step, err)
+		}
+	}
+	// Metadata is retained when the in-progress step is completed.
+	s.step("", true)
+	// Metadata is replaced, not merged.
+	mds["a"] = map[string]interface{}{"Command": "rerun a"}
+	if err := s.sess.SetStepMetadata(ctx, "a", mds["a"]); err != nil {
+		t.Fatal(err)
+	}
+	steps := s.steps("a", "b", "c", "d")
+	for i, step := range steps {
+		md, err := s.sess.StepMetadata(ctx, step.Name)
+		if err != nil {
+			t.Fatalf("%v: %v", step.Name, err)
+		}
+		if got, want := md, mds[step.Name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", step.Name, got, want)
+		}
+		if got, want := steps[i].Metadata, mds[step.Name]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", step.Name, got, want)
+		}
+	}
+	// Step metadata is independent of session metadata.
+	md, err := s.sess.Metadata(ctx)
+	if err != nil || md != nil {
+		t.Errorf("unexpected session metadata: %v, %v", md, err)
+	}
+	if err := s.sess.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.sess.StepMetadata(ctx, "a")
+	expectError(t, err, "does not exist")
+}
+
+func testStepResult(t *testing.T, mgr checkpointstate.Manager) {
+	ctx := context.Background()
+	s := newSession(t, mgr, "step-result")
+	expectError(t, s.sess.SetStepResult(ctx, "a", json.RawMessage(`"1.2.3"`)), "does not exist")
+
+	s.step("a", false)
+	s.step("b", false)
+	s.step("c", false)
+	if err := s.sess.Fail(ctx, "", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	s.step("d", false)
+	expectError(t, s.sess.SetStepResult(ctx, "a", json.RawMessage(`{"rows":`)), "not valid json")
+	for _, step := range []string{"a", "b", "c", "d"} {
+		result, err := s.sess.StepResult(ctx, step)
+		if err != nil || result != nil {
+			t.Errorf("%v: unexpected result for a new step: %s, %v", step, result, err)
+		}
+	}
+	// Set results for completed, failed and in-progress steps.
+	results := map[string]string{
+		"a": `"1.2.3"`,
+		"c": `{"rows":42,"tables":["x","y"]}`,
+		"d": `[1,2,3]`,
+	}
+	for step, result := range results {
+		if err := s.sess.SetStepResult(ctx, step, json.RawMessage(result)); err != nil {
+			t.Fatalf("%v: %v", step, err)
+		}
+	}
+	// Results are retained when the in-progress step is completed.
+	s.step("", true)
+	// Results are replaced and may be removed.
+	results["a"] = `true`
+	if err := s.sess.SetStepResult(ctx, "a", json.RawMessage(results["a"])); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sess.SetStepResult(ctx, "d", nil); err != nil {
+		t.Fatal(err)
+	}
+	delete(results, "d")
+	steps := s.steps("a", "b", "c", "d")
+	for i, step := range steps {
+		result, err := s.sess.StepResult(ctx, step.Name)
+		if err != nil {
+			t.Fatalf("%v: %v", step.Name, err)
+		}
+		if got, want := string(result), results[step.Name]; got != want {
+			t.Errorf("%v: got %s, want %s", step.Name, got, want)
+		}
+		if got, want := string(steps[i].Result), results[step.Name]; got != want {
+			t.Errorf("%v: got %s, want %s", step.Name, got, want)
+		}
+	}
+	// Results are independent of step metadata.
+	md, err := s.sess.StepMetadata(ctx, "a")
+	if err != nil || md != nil {
+		t.Errorf("unexpected step metadata: %v, %v", md, err)
+	}
+}
+
+func testNoSuchSession(t *testing.T, mgr checkpointstate.Manager) {
+	ctx := context.Background()
+	id := mgr.SessionID("never-created")
+	if _, err := mgr.Use(ctx, id, false); err != checkpointstate.ErrNoSuchSession {
+		t.Errorf("got %v, want %v", err, checkpointstate.ErrNoSuchSession)
+	}
+	s := newSession(t, mgr, "deleted")
+	s.use(false)
+	if err := s.sess.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.Use(ctx, s.id, false); err != checkpointstate.ErrNoSuchSession {
+		t.Errorf("got %v, want %v", err, checkpointstate.ErrNoSuchSession)
+	}
+	if got, want := list(t, mgr), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func testNotify(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "notify")
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	ch, err := checkpointstate.Notify(ctx, s.sess)
+	if errors.Is(err, checkpointstate.ErrNotSupported) {
+		t.Skip("notifications are not supported")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() string {
+		select {
+		case step := <-ch:
+			if step.InProgress() {
+				return step.Name + ": in progress"
+			}
+			return step.Name + ": completed"
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%v: timed out waiting for a notification", loc(1))
+		}
+		return ""
+	}
+	s.step("a", false)
+	if got, want := next(), "a: in progress"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	s.step("b", false)
+	// The order of these notifications is not defined.
+	got := []string{next(), next()}
+	sort.Strings(got)
+	if want := []string{"a: completed", "b: in progress"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	cancel()
+	for range ch {
+	}
+}
+
+func testSeal(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "seal")
+	sealer, ok := s.sess.(checkpointstate.Sealer)
+	if !ok {
+		t.Skip("sealing is not supported")
+	}
+	sealed := func(want bool) {
+		got, err := sealer.Sealed(s.ctx)
+		if err != nil {
+			t.Fatalf("%v: %v", loc(1), err)
+		}
+		if got != want {
+			t.Errorf("%v: got %v, want %v", loc(1), got, want)
+		}
+	}
+	s.step("a", false)
+	s.step("b", false)
+	sealed(false)
+	if err := sealer.Seal(s.ctx); err != nil {
+		t.Fatal(err)
+	}
+	sealed(true)
+	for i, fn := range []func() error{
+		func() error {
+			_, err := s.sess.Step(s.ctx, "c")
+			return err
+		},
+		func() error { return s.sess.Fail(s.ctx, "b", "oops") },
+		func() error { return s.sess.Abort(s.ctx) },
+		func() error { return s.sess.SetMetadata(s.ctx, map[string]interface{}{"a": 1}) },
+		func() error { return s.sess.SetStepMetadata(s.ctx, "a", map[string]interface{}{"a": 1}) },
+		func() error { return s.sess.SetStepResult(s.ctx, "a", json.RawMessage(`1`)) },
+		func() error { return s.sess.Delete(s.ctx, "a") },
+		func() error { return s.sess.Delete(s.ctx) },
+		func() error {
+			_, err := mgr.Use(s.ctx, s.id, true)
+			return err
+		},
+	} {
+		if err := fn(); !errors.Is(err, checkpointstate.ErrSealed) {
+			t.Errorf("%v: unexpected error: %v", i, err)
+		}
+	}
+	// Sealed sessions may still be read.
+	s.use(false)
+	s.steps("a", "b")
+	if err := sealer.Unseal(s.ctx); err != nil {
+		t.Fatal(err)
+	}
+	sealed(false)
+	s.step("c", false)
+	s.steps("a", "b", "c")
+	if err := s.sess.Delete(s.ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testUpdateMetadata(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "update-metadata")
+	updater, ok := s.sess.(checkpointstate.MetadataUpdater)
+	if !ok {
+		t.Skip("atomic metadata updates are not supported")
+	}
+	// None of many simultaneous updates is lost.
+	const concurrency = 10
+	var wg sync.WaitGroup
+	errs := make([]error, concurrency)
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = updater.UpdateMetadata(s.ctx, func(md map[string]interface{}) (map[string]interface{}, error) {
+				if md == nil {
+					md = map[string]interface{}{}
+				}
+				md[fmt.Sprintf("k%v", i)] = float64(i)
+				return md, nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	want := map[string]interface{}{}
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+		}
+		want[fmt.Sprintf("k%v", i)] = float64(i)
+	}
+	md, err := s.sess.Metadata(s.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := md; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The metadata is unchanged if fn returns nil or an error.
+	oops := errors.New("oops")
+	for _, tc := range []struct {
+		md  map[string]interface{}
+		err error
+	}{
+		{nil, nil},
+		{map[string]interface{}{}, oops},
+	} {
+		err := updater.UpdateMetadata(s.ctx, func(map[string]interface{}) (map[string]interface{}, error) {
+			return tc.md, tc.err
+		})
+		if err != tc.err {
+			t.Errorf("got %v, want %v", err, tc.err)
+		}
+		md, err := s.sess.Metadata(s.ctx)
+		if err != nil || !reflect.DeepEqual(md, want) {
+			t.Errorf("metadata was modified: %v: %v", md, err)
+		}
+	}
+
+	// Sealed sessions may not be updated, but nil may be returned.
+	sealer, ok := s.sess.(checkpointstate.Sealer)
+	if !ok {
+		return
+	}
+	if err := sealer.Seal(s.ctx); err != nil {
+		t.Fatal(err)
+	}
+	update := func(md map[string]interface{}) (map[string]interface{}, error) { return md, nil }
+	if err := updater.UpdateMetadata(s.ctx, update); !errors.Is(err, checkpointstate.ErrSealed) {
+		t.Errorf("got %v, want %v", err, checkpointstate.ErrSealed)
+	}
+	unchanged := func(map[string]interface{}) (map[string]interface{}, error) { return nil, nil }
+	if err := updater.UpdateMetadata(s.ctx, unchanged); err != nil {
+		t.Error(err)
+	}
+}
+
+func testImport(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "import")
+	importer, ok := s.sess.(checkpointstate.Importer)
+	if !ok {
+		t.Skip("importing is not supported")
+	}
+	s.step("x", false)
+	s.step("b", false)
+	s.step("", true)
+	start := time.Date(2020, 6, 1, 10, 0, 0, 0, time.UTC)
+	at := func(seconds int) time.Time {
+		return start.Add(time.Duration(seconds) * time.Second)
+	}
+	contentKey := checkpointstate.WithContentKey("src", "v1")
+	hash := checkpointstate.NewStepOptions(contentKey).Key("ignored")
+	if err := importer.Import(s.ctx, []checkpointstate.Step{
+		{Name: "a", Created: at(0), Completed: at(1), Artifacts: map[string]string{"k": "v"}, Result: json.RawMessage(`1`)},
+		{Name: "b", Created: at(2), Failed: at(3), Reason: "oops"},
+		{Name: "c", ContentHash: hash, Created: at(4), Completed: at(5)},
+		// Steps that were in progress are not imported.
+		{Name: "d", Created: at(6)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// The imported failed step replaces the existing completed one.
+	steps := s.steps("a", "b", "c", "x")
+	if got, want := steps[0].Created, at(0); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := steps[0].Completed, at(1); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := steps[0].Artifacts, map[string]string{"k": "v"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := string(steps[0].Result), "1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := steps[1].Failed, at(3); !got.Equal(want) || steps[1].Reason != "oops" || !steps[1].Completed.IsZero() {
+		t.Errorf("unexpected failed step: %v", steps[1])
+	}
+	for _, tc := range []struct {
+		step string
+		opts []checkpointstate.StepOption
+		done bool
+	}{
+		{"a", nil, true},
+		{"b", nil, false},
+		{"renamed", []checkpointstate.StepOption{contentKey}, true},
+		{"d", nil, false},
+		{"x", nil, true},
+	} {
+		done, err := s.sess.IsComplete(s.ctx, tc.step, tc.opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := done, tc.done; got != want {
+			t.Errorf("%v: got %v, want %v", tc.step, got, want)
+		}
+	}
+	// Imported steps behave as any others.
+	s.step("a", true)
+	s.step("b", false)
+	s.step("", true)
+	s.steps("a", "c", "x", "b")
+}
+
+func testPhases(t *testing.T, mgr checkpointstate.Manager) {
+	s := newSession(t, mgr, "phases")
+	phases := func() []checkpointstate.Phase {
+		phases, err := s.sess.Phases(s.ctx)
+		if err != nil {
+			t.Fatalf("%v: %v", loc(1), err)
+		}
+		return phases
+	}
+	if got := phases(); len(got) != 0 {
+		t.Errorf("unexpected phases: %v", got)
+	}
+	setup, build := checkpointstate.WithPhase("setup"), checkpointstate.WithPhase("build")
+	s.step("fetch", false, setup)
+	s.step("configure", false, setup)
+	s.step("untracked", false)
+	s.step("compile", false, build)
+	if err := s.sess.Fail(s.ctx, "compile", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	s.step("generate", false, build, checkpointstate.WithGroup("g"))
+	steps := s.steps("fetch", "configure", "untracked", "compile", "generate")
+	for i, phase := range []string{"setup", "setup", "", "build", "build"} {
+		if got, want := steps[i].Phase, phase; got != want {
+			t.Errorf("%v: got %v, want %v", steps[i].Name, got, want)
+		}
+	}
+	summarize := func(phases []checkpointstate.Phase) []string {
+		var out []string
+		for _, p := range phases {
+			out = append(out, fmt.Sprintf("%v: %v: %v/%v/%v %v", p.Name, p.Steps, p.Summary.Completed, p.Failed, p.Summary.Total, p.Complete()))
+		}
+		return out
+	}
+	if got, want := summarize(phases()), []string{
+		"setup: [fetch configure]: 2/0/2 true",
+		"build: [compile generate]: 0/1/2 false",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// The phase of a step is retained when it is completed.
+	if err := s.sess.Complete(s.ctx, "generate"); err != nil {
+		t.Fatal(err)
+	}
+	s.step("compile", false, build)
+	s.step("", true)
+	if got, want := summarize(phases()), []string{
+		"setup: [fetch configure]: 2/0/2 true",
+		"build: [generate compile]: 2/0/2 true",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package client provides convenience methods for Go programs that use
+// checkpoints, hiding the need to explicitly use a session before
+// every step.
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// Client wraps a checkpointstate.Manager.
+type Client struct {
+	mgr checkpointstate.Manager
+}
+
+// New returns a new Client for the supplied Manager.
+func New(mgr checkpointstate.Manager) *Client {
+	return &Client{mgr: mgr}
+}
+
+// Manager returns the Manager wrapped by the client.
+func (c *Client) Manager() checkpointstate.Manager {
+	return c.mgr
+}
+
+// Begin must be called at the start of each run of a program to discard
+// the in-progress step, if any, left by a previous run that failed, so
+// that it is rerun rather than being marked as complete by the next call
+// to Checkpoint. The session is created if it does not already exist.
+func (c *Client) Begin(ctx context.Context, sessionID string) error {
+	if _, err := c.mgr.Use(ctx, sessionID, true); err != nil {
+		return fmt.Errorf("checkpoint: failed to use session %v: %w", sessionID, err)
+	}
+	return nil
+}
+
+// use returns the specified session, creating it if it does not exist.
+// Existing sessions are never reset so that the in-progress step is
+// retained between calls.
+func (c *Client) use(ctx context.Context, sessionID string) (checkpointstate.Session, error) {
+	sess, err := c.mgr.Use(ctx, sessionID, false)
+	if err == checkpointstate.ErrNoSuchSession {
+		sess, err = c.mgr.Use(ctx, sessionID, true)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("checkpoint: failed to use session %v: %w", sessionID, err)
+	}
+	return sess, nil
+}
+
+// Checkpoint returns true if the specified step in the specified session
+// has been completed. If it has not, it is marked as being in progress,
+// completing the previous step, if any, and false is returned. The
+// session is created if it does not already exist.
+func (c *Client) Checkpoint(ctx context.Context, sessionID, step string, opts ...checkpointstate.StepOption) (bool, error) {
+	if len(step) == 0 {
+		return false, fmt.Errorf("checkpoint: session %v: no step specified", sessionID)
+	}
+	sess, err := c.use(ctx, sessionID)
+	if err != nil {
+		return false, err
+	}
+	done, err := sess.Step(ctx, step, opts...)
+	if err != nil {
+		return false, fmt.Errorf("checkpoint: session %v: step %v: %w", sessionID, step, err)
+	}
+	return done, nil
+}
+
+// CompleteSession marks the in-progress step, if any, in the specified
+// session as complete, as is required once the last step has been
+// executed successfully.
+func (c *Client) CompleteSession(ctx context.Context, sessionID string, opts ...checkpointstate.StepOption) error {
+	sess, err := c.mgr.Use(ctx, sessionID, false)
+	if err != nil {
+		return fmt.Errorf("checkpoint: failed to use session %v: %w", sessionID, err)
+	}
+	if _, err := sess.Step(ctx, "", opts...); err != nil {
+		return fmt.Errorf("checkpoint: session %v: failed to complete the current step: %w", sessionID, err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+package client_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/cosnicolaou/checkpoint/client"
+	"github.com/cosnicolaou/checkpoint/directory"
+)
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := client.New(directory.NewManager(dir))
+	id := c.Manager().SessionID("client")
+
+	run := func(steps ...string) []string {
+		var ran []string
+		for _, step := range steps {
+			done, err := c.Checkpoint(ctx, id, step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !done {
+				ran = append(ran, step)
+			}
+		}
+		return ran
+	}
+
+	// The session is created by the first checkpoint.
+	if got, want := run("a", "b"), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// b is still in progress and hence is rerun by a subsequent run.
+	if err := c.Begin(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := run("a", "b", "c"), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := c.CompleteSession(ctx, id, checkpointstate.WithArtifact("out", "c.tar")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Begin(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := run("a", "b", "c"), []string(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	sess, err := c.Manager().Use(ctx, id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(steps), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := steps[2].Artifacts, map[string]string{"out": "c.tar"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := c.Checkpoint(ctx, id, ""); err == nil {
+		t.Errorf("expected an error for an empty step")
+	}
+	err = c.CompleteSession(ctx, c.Manager().SessionID("nonexistent"))
+	if !errors.Is(err, checkpointstate.ErrNoSuchSession) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
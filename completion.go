@@ -0,0 +1,166 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// completeCmd is the hidden command used by the completion scripts to
+// obtain the candidate session IDs and step names.
+const completeCmd = "__complete"
+
+var (
+	// completionCommands are the commands offered as completions.
+	completionCommands = []string{
+		"help", "init", "use", "list", "state", "status", "dump", "history", "replay", "steps",
+		"slow", "top", "result", "compact", "squash", "reorder", "template", "new", "seal", "unseal", "locks",
+		"unlock", "verify", "migrate", "gc", "run", "auto", "exec", "current", "summary", "abort", "delete",
+		"completion", "env", "restore", "empty-trash", "paths", "trace", "retain", "is-complete", "subsession", "digest", "import", "phases",
+	}
+	// sessionCommands are the commands that accept session IDs.
+	sessionCommands = []string{
+		"state", "status", "dump", "history", "replay", "slow", "result", "compact", "squash", "reorder",
+		"template", "seal", "unseal", "locks", "unlock", "verify", "run", "auto", "current", "paths", "summary",
+		"abort", "trace", "is-complete", "subsession", "digest", "phases",
+	}
+	completionShells = []string{"bash", "zsh", "fish"}
+)
+
+func runCompletionCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	if len(args) != 1 {
+		return true, fmt.Errorf("a single shell, one of %v, must be specified", strings.Join(completionShells, ", "))
+	}
+	var tpl string
+	switch args[0] {
+	case "bash":
+		tpl = bashCompletion
+	case "zsh":
+		tpl = zshCompletion
+	case "fish":
+		tpl = fishCompletion
+	default:
+		return true, fmt.Errorf("unsupported shell: %q", args[0])
+	}
+	fmt.Fprintf(out, tpl,
+		filepath.Base(os.Args[0]),
+		strings.Join(completionCommands, " "),
+		strings.Join(sessionCommands, "|"),
+		strings.Join(sessionCommands, " "),
+		completeCmd,
+		strings.Join(completionShells, " "),
+	)
+	return true, nil
+}
+
+// runCompleteCmd prints the candidates requested by a completion
+// script, one per line: either all session IDs or the names of the
+// steps in the specified session. Errors are not reported since they
+// would be displayed as part of the user's command line.
+func runCompleteCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	if len(args) == 0 {
+		return true, nil
+	}
+	switch args[0] {
+	case "sessions":
+		ids, _ := mgr.List(ctx)
+		for _, id := range ids {
+			fmt.Fprintln(out, id)
+		}
+	case "steps":
+		if len(args) != 2 {
+			return true, nil
+		}
+		sess, err := mgr.Use(ctx, args[1], false)
+		if err != nil {
+			return true, nil
+		}
+		steps, _ := sess.Steps(ctx)
+		for _, step := range steps {
+			fmt.Fprintln(out, step.Name)
+		}
+	}
+	return true, nil
+}
+
+// The completion templates are parameterized as follows:
+// 1: the program name, 2: the space separated commands,
+// 3 and 4: the commands that accept session IDs separated by | and
+// spaces respectively, 5: the name of the hidden completion command and
+// 6: the supported shells.
+
+const bashCompletion = `# bash completion for %[1]s
+_%[1]s() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    if [[ $COMP_CWORD -eq 1 ]]; then
+        COMPREPLY=($(compgen -W "%[2]s" -- "$cur"))
+        return
+    fi
+    case "${COMP_WORDS[1]}" in
+    %[3]s)
+        COMPREPLY=($(compgen -W "$(%[1]s %[5]s sessions 2>/dev/null)" -- "$cur"))
+        ;;
+    delete)
+        if [[ $COMP_CWORD -eq 2 ]]; then
+            COMPREPLY=($(compgen -W "$(%[1]s %[5]s sessions 2>/dev/null)" -- "$cur"))
+        else
+            COMPREPLY=($(compgen -W "$(%[1]s %[5]s steps "${COMP_WORDS[2]}" 2>/dev/null)" -- "$cur"))
+        fi
+        ;;
+    completion)
+        COMPREPLY=($(compgen -W "%[6]s" -- "$cur"))
+        ;;
+    esac
+}
+complete -F _%[1]s %[1]s
+`
+
+const zshCompletion = `#compdef %[1]s
+_%[1]s() {
+    if (( CURRENT == 2 )); then
+        compadd -- %[2]s
+        return
+    fi
+    case "$words[2]" in
+    %[3]s)
+        compadd -- ${(f)"$(%[1]s %[5]s sessions 2>/dev/null)"}
+        ;;
+    delete)
+        if (( CURRENT == 3 )); then
+            compadd -- ${(f)"$(%[1]s %[5]s sessions 2>/dev/null)"}
+        else
+            compadd -- ${(f)"$(%[1]s %[5]s steps "$words[3]" 2>/dev/null)"}
+        fi
+        ;;
+    completion)
+        compadd -- %[6]s
+        ;;
+    esac
+}
+compdef _%[1]s %[1]s
+`
+
+const fishCompletion = `# fish completion for %[1]s
+function __%[1]s_delete
+    set -l tokens (commandline -opc)
+    if test (count $tokens) -ge 3
+        %[1]s %[5]s steps $tokens[3] 2>/dev/null
+    else
+        %[1]s %[5]s sessions 2>/dev/null
+    end
+end
+complete -c %[1]s -f
+complete -c %[1]s -n '__fish_use_subcommand' -a '%[2]s'
+complete -c %[1]s -n '__fish_seen_subcommand_from %[4]s' -a '(%[1]s %[5]s sessions 2>/dev/null)'
+complete -c %[1]s -n '__fish_seen_subcommand_from delete' -a '(__%[1]s_delete)'
+complete -c %[1]s -n '__fish_seen_subcommand_from completion' -a '%[6]s'
+`
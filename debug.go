@@ -0,0 +1,75 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// checkpointDebugEnvVar enables debug output, as does --debug, when set
+// to any non-empty value.
+const checkpointDebugEnvVar = "CHECKPOINT_DEBUG"
+
+// debugLogger writes a json object, on a line of its own, for each of
+// the operations that the command performs. It is intended to help
+// diagnose the command's behaviour and is distinct from the completion
+// log that may be maintained by the store.
+type debugLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// debugLog is nil, and debug output disabled, unless debugging has been
+// requested via --debug or CHECKPOINT_DEBUG.
+var debugLog *debugLogger
+
+func newDebugLogger(w io.Writer) *debugLogger {
+	return &debugLogger{enc: json.NewEncoder(w)}
+}
+
+// enableDebug enables debug output to stderr if it has been requested.
+func enableDebug(requested bool) {
+	if requested || len(os.Getenv(checkpointDebugEnvVar)) > 0 {
+		debugLog = newDebugLogger(os.Stderr)
+	}
+}
+
+// log records the named operation along with the supplied key/value
+// pairs, omitting those with nil, empty or zero duration values; it does
+// nothing if debug output is disabled.
+func (d *debugLogger) log(op string, kv ...interface{}) {
+	if d == nil {
+		return
+	}
+	entry := map[string]interface{}{
+		"time": time.Now().UTC().Format(time.RFC3339Nano),
+		"op":   op,
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		key, _ := kv[i].(string)
+		switch val := kv[i+1].(type) {
+		case nil:
+		case string:
+			if len(val) > 0 {
+				entry[key] = val
+			}
+		case error:
+			entry[key] = val.Error()
+		case time.Duration:
+			if val != 0 {
+				entry[key] = val.String()
+			}
+		default:
+			entry[key] = val
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.enc.Encode(entry)
+}
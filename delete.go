@@ -0,0 +1,234 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+func runDeleteCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	all := fs.Bool("all", false, "delete all sessions that match the --tag and --before filters")
+	var tags tagsFlag
+	fs.Var(&tags, "tag", "with --all, only delete sessions with this tag, may be repeated")
+	before := fs.String("before", "", "with --all, only delete sessions created or accessed before the specified RFC3339 time or duration, eg. 7d")
+	by := fs.String("by", "accessed", "the metadata timestamp used by --before, one of created or accessed")
+	dryRun := fs.Bool("dry-run", false, "with --all or --glob, display, but do not delete, the matching sessions or steps")
+	force := fs.Bool("force", false, "must be specified to confirm that --all, without any filters, is to delete every session")
+	hard := fs.Bool("hard", false, "delete sessions permanently rather than moving them to the trash")
+	glob := fs.String("glob", "", "delete the completed or failed steps, of the current or specified session, whose names match this glob pattern")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(*glob) > 0 {
+		return true, deleteGlob(ctx, mgr, out, fs, args, *glob, *dryRun)
+	}
+	if *all {
+		if len(args) > 0 {
+			return true, fmt.Errorf("sessions or steps cannot be specified with --all")
+		}
+		filter := sessionFilter{tags: tags}
+		if len(*before) > 0 {
+			if filter.before, err = parseSince(*before, time.Now()); err != nil {
+				return true, err
+			}
+		}
+		if filter.field, err = metadataTimeField(*by); err != nil {
+			return true, err
+		}
+		if filter.all() && !*dryRun && !*force {
+			return true, fmt.Errorf("--force must be specified to delete all sessions")
+		}
+		return true, deleteSessions(ctx, mgr, out, filter, *dryRun, *hard)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil && f.Name != "all" && f.Name != "hard" {
+			err = fmt.Errorf("--%v can only be used with --all", f.Name)
+		}
+	})
+	if err != nil {
+		return true, err
+	}
+	id, _ := defaultSessionID()
+	if len(args) >= 1 {
+		id = args[0]
+	}
+	var steps []string
+	if len(args) >= 2 {
+		steps = args[1:]
+	}
+	if len(id) == 0 {
+		return true, errNoSession
+	}
+	if len(steps) > 0 {
+		return true, deleteSession(ctx, mgr, id, steps...)
+	}
+	return true, removeSession(ctx, mgr, id, *hard)
+}
+
+// removeSession moves the session to the trash, provided that mgr
+// supports it and hard is false, and deletes it permanently otherwise.
+func removeSession(ctx context.Context, mgr checkpointstate.Manager, id string, hard bool) error {
+	trasher, ok := mgr.(checkpointstate.Trasher)
+	if !ok || hard {
+		return deleteSession(ctx, mgr, id)
+	}
+	if _, err := mgr.Use(ctx, id, false); err != nil {
+		return fmt.Errorf("failed to access session for %q: %v", id, err)
+	}
+	if err := trasher.Trash(ctx, id); err != nil {
+		return fmt.Errorf("failed to move session %v to the trash: %v", id, err)
+	}
+	return nil
+}
+
+// deleteGlob deletes, and displays the names of, the completed or failed
+// steps of the current, or specified, session whose names match pattern.
+// Patterns are matched against entire step names, using path.Match, and
+// hence, as for file names, * and ? never match a /.
+func deleteGlob(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, fs *flag.FlagSet, args []string, pattern string, dryRun bool) error {
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		if err == nil && f.Name != "glob" && f.Name != "dry-run" {
+			err = fmt.Errorf("--%v cannot be used with --glob", f.Name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("steps cannot be specified with --glob")
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid glob pattern %q: %v", pattern, err)
+	}
+	id, _ := defaultSessionID()
+	if len(args) == 1 {
+		id = args[0]
+	}
+	if len(id) == 0 {
+		return errNoSession
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return fmt.Errorf("failed to access session for %q: %v", id, err)
+	}
+	match := func(step checkpointstate.Step) bool {
+		matched, _ := path.Match(pattern, step.Name)
+		return matched && !step.InProgress()
+	}
+	var matched []checkpointstate.Step
+	if dryRun {
+		steps, err := sess.Steps(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get session steps %v: %v", id, err)
+		}
+		for _, step := range steps {
+			if match(step) {
+				matched = append(matched, step)
+			}
+		}
+	} else {
+		deleter, ok := sess.(checkpointstate.MatchingDeleter)
+		if !ok {
+			return fmt.Errorf("deleting steps by pattern is not supported")
+		}
+		if matched, err = deleter.DeleteMatching(ctx, match); err != nil {
+			return fmt.Errorf("failed to delete steps from session %v: %v", id, err)
+		}
+	}
+	for _, step := range matched {
+		fmt.Fprintln(out, step.Name)
+	}
+	return nil
+}
+
+// sessionFilter selects sessions by their tags and by the time
+// recorded in one of their metadata fields.
+type sessionFilter struct {
+	tags   []string
+	before time.Time
+	field  string
+}
+
+// all returns true if the filter matches every session.
+func (f sessionFilter) all() bool {
+	return len(f.tags) == 0 && f.before.IsZero()
+}
+
+// matches returns true if the session with the specified metadata has
+// all of the filter's tags and, if a time is specified, was created or
+// accessed before it. Sessions without the timestamp never match a time.
+func (f sessionFilter) matches(md map[string]interface{}) bool {
+	if !hasTags(sessionTags(md), f.tags) {
+		return false
+	}
+	if f.before.IsZero() {
+		return true
+	}
+	when, ok := metadataTime(md, f.field)
+	return ok && when.Before(f.before)
+}
+
+// deleteSessions deletes, or moves to the trash, see removeSession, all
+// sessions that match filter and displays their IDs. Each session is
+// deleted under its own lock and failures are collected, rather than
+// returned immediately, so that one session that cannot be deleted, eg.
+// because it is sealed, does not prevent the others from being deleted.
+func deleteSessions(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, filter sessionFilter, dryRun, hard bool) error {
+	var matched []string
+	err := mgr.Walk(ctx, func(id string, sess checkpointstate.Session) error {
+		md, err := sess.Metadata(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to obtain metadata for session %v: %v", id, err)
+		}
+		if filter.matches(md) {
+			matched = append(matched, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %v", err)
+	}
+	// Sessions are deleted once the walk is complete so as to not
+	// modify the store whilst it is being walked, and in lexical order
+	// since Walk need not visit them in any particular order.
+	sort.Strings(matched)
+	return removeSessions(ctx, mgr, out, matched, dryRun, hard)
+}
+
+// removeSessions deletes, or moves to the trash, and displays the IDs of,
+// the specified sessions, collecting rather than returning failures as
+// described for deleteSessions. With dryRun the IDs are displayed but the
+// sessions are not deleted.
+func removeSessions(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, ids []string, dryRun, hard bool) error {
+	var failed []string
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !dryRun {
+			if err := removeSession(ctx, mgr, id, hard); err != nil {
+				failed = append(failed, fmt.Sprintf("%v: %v", id, err))
+				continue
+			}
+		}
+		fmt.Fprintln(out, id)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to delete %v of %v sessions: %v", len(failed), len(ids), strings.Join(failed, ", "))
+	}
+	return nil
+}
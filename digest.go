@@ -0,0 +1,95 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// digestField is the metadata field in which digest --store records the
+// session's digest.
+const digestField = "Digest"
+
+// sessionDigest returns a digest of the sequence of completed steps, ie.
+// those that ran, in order. Steps are identified by their content hash,
+// if any, and by name otherwise, and, if withResults is true, by their
+// results, if any, in compact form so that insignificant whitespace is
+// ignored. The digest is computed using checkpointstate.HashIDs, regardless
+// of the IDGenerator used for session IDs, so that it is always a hash.
+func sessionDigest(steps []checkpointstate.Step, withResults bool) (string, error) {
+	var inputs []string
+	for _, step := range steps {
+		if step.Completed.IsZero() {
+			continue
+		}
+		key := step.Name
+		if len(step.ContentHash) > 0 {
+			key = step.ContentHash
+		}
+		// Step names may contain any byte, so the name is length prefixed
+		// to separate it unambiguously from the result that follows it.
+		input := fmt.Sprintf("%d:%s", len(key), key)
+		if withResults && len(step.Result) > 0 {
+			var compact bytes.Buffer
+			if err := json.Compact(&compact, step.Result); err != nil {
+				return "", fmt.Errorf("invalid result for step %v: %v", step.Name, err)
+			}
+			input += compact.String()
+		}
+		inputs = append(inputs, input)
+	}
+	return checkpointstate.HashIDs.SessionID(inputs...), nil
+}
+
+func runDigestCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("digest", flag.ContinueOnError)
+	withResults := fs.Bool("results", false, "include the results of the steps in the digest")
+	store := fs.Bool("store", false, "record the digest in the session's metadata")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) > 1 {
+		return true, fmt.Errorf("digest accepts at most one session")
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to get session steps %v: %v", id, err)
+	}
+	digest, err := sessionDigest(steps, *withResults)
+	if err != nil {
+		return true, err
+	}
+	if *store {
+		md, err := sess.Metadata(ctx)
+		if err != nil {
+			return true, fmt.Errorf("failed to read metadata for %v: %v", id, err)
+		}
+		if md == nil {
+			md = map[string]interface{}{}
+		}
+		md[digestField] = digest
+		if err := sess.SetMetadata(ctx, md); err != nil {
+			return true, fmt.Errorf("failed to write metadata for %v: %v", id, err)
+		}
+	}
+	_, err = fmt.Fprintln(out, digest)
+	return true, err
+}
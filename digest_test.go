@@ -0,0 +1,152 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/cosnicolaou/checkpoint/directory"
+)
+
+func TestDigest(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+
+	// run creates a session, completing each of the specified steps, in
+	// order, setting the result of each to results[step], and leaving the
+	// last of them in progress if inProgress is true.
+	run := func(tag string, results map[string]string, inProgress bool, steps ...string) string {
+		id := mgr.SessionID(tag)
+		sess, err := mgr.Use(ctx, id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range steps {
+			if _, err := sess.Step(ctx, step); err != nil {
+				t.Fatal(err)
+			}
+			if result, ok := results[step]; ok {
+				if err := sess.SetStepResult(ctx, step, json.RawMessage(result)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if !inProgress {
+			if err := sess.Complete(ctx, steps[len(steps)-1]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return id
+	}
+	digest := func(args ...string) string {
+		out := &bytes.Buffer{}
+		if _, err := runDigestCmd(ctx, mgr, out, args); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return strings.TrimSpace(out.String())
+	}
+
+	a := run("a", map[string]string{"fetch": `{"rows": 1}`}, false, "fetch", "build", "test")
+	b := run("b", map[string]string{"fetch": `{"rows":1}`}, false, "fetch", "build", "test")
+	c := run("c", map[string]string{"fetch": `{"rows":2}`}, false, "fetch", "build", "test")
+	d := run("d", nil, false, "build", "fetch", "test")
+	e := run("e", nil, true, "fetch", "build", "test", "deploy")
+
+	// Identical step sequences have identical digests, regardless of their
+	// results unless --results is specified, and regardless of any step
+	// that is still in progress.
+	if got, want := digest(b), digest(a); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := digest(c), digest(a); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := digest(e), digest(a); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := digest("--results", b), digest("--results", a); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Different sequences, or results, have different digests.
+	if got, notWant := digest(d), digest(a); got == notWant {
+		t.Errorf("%v: unexpectedly the same digest as %v: %v", d, a, got)
+	}
+	if got, notWant := digest("--results", c), digest("--results", a); got == notWant {
+		t.Errorf("%v: unexpectedly the same digest as %v: %v", c, a, got)
+	}
+
+	// The digest is only recorded if --store is specified.
+	sess, err := mgr.Use(ctx, a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := sess.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := md[digestField]; ok {
+		t.Errorf("unexpected digest in metadata: %v", md)
+	}
+	stored := digest("--store", a)
+	if md, err = sess.Metadata(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md[digestField], stored; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Digests are always hashes, even if session IDs are not.
+	slugs := directory.NewManager(dir, directory.WithIDGenerator(checkpointstate.SlugIDs))
+	out := &bytes.Buffer{}
+	if _, err := runDigestCmd(ctx, slugs, out, []string{a}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(out.String()), digest(a); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDigestAmbiguity(t *testing.T) {
+	now := time.Now()
+	step := func(name, result string) checkpointstate.Step {
+		s := checkpointstate.Step{Name: name, Created: now, Completed: now}
+		if len(result) > 0 {
+			s.Result = json.RawMessage(result)
+		}
+		return s
+	}
+	digest := func(steps ...checkpointstate.Step) string {
+		d, err := sessionDigest(steps, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	// Names may contain any byte, including a NUL, or look like the name
+	// and result of another step.
+	for i, tc := range [][2]checkpointstate.Step{
+		{step("a", "1"), step("a\x001", "")},
+		{step("a", "1"), step("a1", "")},
+		{step("1:a", ""), step("a", "")},
+		{step("a", `"b"`), step(`a"b"`, "")},
+	} {
+		if got, notWant := digest(tc[0]), digest(tc[1]); got == notWant {
+			t.Errorf("%v: %q and %q have the same digest: %v", i, tc[0].Name, tc[1].Name, got)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// WithMetadataCache requests that each Session cache its metadata so
+// that repeated calls to Metadata need not read and decode the metadata
+// file. The cache is invalidated by SetMetadata and is validated, under
+// the session's lock, against the modification time and size of the
+// metadata file so that changes made by other Sessions or processes
+// are not missed.
+func WithMetadataCache() Option {
+	return func(o *options) {
+		o.metadataCache = true
+	}
+}
+
+type metadataCache struct {
+	sync.Mutex
+	valid   bool
+	modTime time.Time
+	size    int64
+	md      map[string]interface{}
+}
+
+// get returns a copy of the cached metadata if it is valid for the
+// metadata file described by info.
+func (c *metadataCache) get(info os.FileInfo) (map[string]interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if !c.valid || !c.modTime.Equal(info.ModTime()) || c.size != info.Size() {
+		return nil, false
+	}
+	return copyJSON(c.md).(map[string]interface{}), true
+}
+
+func (c *metadataCache) set(info os.FileInfo, md map[string]interface{}) {
+	c.Lock()
+	defer c.Unlock()
+	c.valid, c.modTime, c.size = true, info.ModTime(), info.Size()
+	c.md = copyJSON(md).(map[string]interface{})
+}
+
+func (c *metadataCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.valid, c.md = false, nil
+}
+
+// copyJSON returns a deep copy of a value decoded by encoding/json so
+// that callers cannot modify the cached copy.
+func copyJSON(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case map[string]interface{}:
+		if tv == nil {
+			return tv
+		}
+		r := make(map[string]interface{}, len(tv))
+		for k, v := range tv {
+			r[k] = copyJSON(v)
+		}
+		return r
+	case []interface{}:
+		r := make([]interface{}, len(tv))
+		for i, v := range tv {
+			r[i] = copyJSON(v)
+		}
+		return r
+	}
+	return v
+}
@@ -0,0 +1,216 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// beforeRename, if set, is called by writeFileAtomic once the temporary
+// file has been written and before it is renamed. It allows tests to
+// simulate a write that is interrupted part way through.
+var beforeRename func(tmp string) error
+
+// writeFileAtomic writes buf to filename via a temporary file in the
+// same directory that is renamed over filename once it has been
+// completely written, so that readers never see a partially written
+// file. The temporary file is hidden so that it is never mistaken for
+// a step.
+func writeFileAtomic(filename string, buf []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	cleanup := func(err error) error {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		return cleanup(err)
+	}
+	if err := f.Sync(); err != nil {
+		return cleanup(err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		return cleanup(err)
+	}
+	if err := f.Close(); err != nil {
+		return cleanup(err)
+	}
+	if beforeRename != nil {
+		if err := beforeRename(tmp); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// readCompacted returns the completed steps stored in the session's
+// compacted file, if any.
+func (ds *directorySession) readCompacted() ([]stepState, error) {
+	filename := filepath.Join(ds.session, compactedFile)
+	buf, err := readFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var states []stepState
+	if err := ds.opts.unmarshal(buf, &states); err != nil {
+		return nil, fmt.Errorf("failed to decode json data from %v: %v", filename, err)
+	}
+	return states, nil
+}
+
+func (ds *directorySession) writeCompacted(states []stepState) error {
+	filename := filepath.Join(ds.session, compactedFile)
+	if len(states) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return ds.parseTime(states[i].Created).Before(ds.parseTime(states[j].Created))
+	})
+	buf, err := ds.opts.marshal(states)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, buf, 0400)
+}
+
+// isCompacted returns true if the step is recorded in the compacted file.
+func (ds *directorySession) isCompacted(step string) (bool, error) {
+	states, err := ds.readCompacted()
+	if err != nil {
+		return false, err
+	}
+	for _, state := range states {
+		if state.key() == step {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isCompleted returns true if the step has been completed, whether
+// it is stored in its own file or in the compacted file. Failed steps
+// are not considered to be complete.
+func (ds *directorySession) isCompleted(step string) (bool, error) {
+	buf, err := readFile(ds.stepFile(step))
+	if err == nil {
+		// A step that failed must be rerun.
+		var state stepState
+		if ds.opts.unmarshal(buf, &state) == nil && len(state.Failed) > 0 {
+			return false, nil
+		}
+		return true, nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+	return ds.isCompacted(step)
+}
+
+// deleteCompacted removes the specified steps from the compacted file.
+func (ds *directorySession) deleteCompacted(steps ...string) error {
+	states, err := ds.readCompacted()
+	if err != nil || len(states) == 0 {
+		return err
+	}
+	remove := map[string]bool{}
+	for _, step := range steps {
+		remove[step] = true
+	}
+	retained := make([]stepState, 0, len(states))
+	for _, state := range states {
+		if !remove[state.key()] {
+			retained = append(retained, state)
+		}
+	}
+	if len(retained) == len(states) {
+		return nil
+	}
+	return ds.writeCompacted(retained)
+}
+
+// Compact implements checkpointstate.Compactor. The state for all
+// completed steps is consolidated into a single file, the in-progress
+// step, if any, is left untouched. The consolidated file is written
+// before the individual step files are removed and hence if compaction
+// is interrupted a step may be recorded in both places, in which
+// case the individual file takes precedence.
+func (ds *directorySession) Compact(ctx context.Context) error {
+	unlock, err := ds.opts.lock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	states, err := ds.readCompacted()
+	if err != nil {
+		return err
+	}
+	index := map[string]int{}
+	for i, state := range states {
+		index[state.key()] = i
+	}
+	var files, names []string
+	err = filepath.Walk(ds.session, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != ds.session {
+			// Subdirectories, such as that for concurrent steps, never
+			// contain completed steps.
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() || isSymlink(info) || !ds.isStepFile(info.Name()) || info.Name() == currentStepFile {
+			return nil
+		}
+		buf, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		var state stepState
+		if err := ds.opts.unmarshal(buf, &state); err != nil || len(state.Completed) == 0 {
+			return nil
+		}
+		if i, ok := index[state.key()]; ok {
+			states[i] = state
+		} else {
+			index[state.key()] = len(states)
+			states = append(states, state)
+		}
+		files = append(files, path)
+		names = append(names, state.key())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if err := ds.writeCompacted(states); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return ds.updateIndex(nil, names...)
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// concurrentDir contains a marker file, named for the step, for each
+// step started in a concurrency group that is in progress. It is hidden
+// so that it is never mistaken for a step.
+const concurrentDir = ".concurrent"
+
+// markerFile returns the name of the marker file for the specified step.
+func (ds *directorySession) markerFile(step string) string {
+	return filepath.Join(ds.session, concurrentDir, stepFileName(step))
+}
+
+// readMarker returns the state of the specified concurrent step, if it
+// is in progress.
+func (ds *directorySession) readMarker(step string) (stepState, bool, error) {
+	state, ok, err := ds.readStepFile(ds.markerFile(step))
+	if err != nil {
+		return stepState{}, false, fmt.Errorf("failed to read state for concurrent step %v: %v", step, err)
+	}
+	return state, ok, nil
+}
+
+// concurrentSteps returns the state of all in-progress concurrent steps.
+func (ds *directorySession) concurrentSteps() ([]stepState, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(ds.session, concurrentDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var states []stepState
+	for _, entry := range entries {
+		if entry.IsDir() || isSymlink(entry) || !ds.isStepFile(entry.Name()) {
+			continue
+		}
+		state, ok, err := ds.readStepFile(filepath.Join(ds.session, concurrentDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read state for concurrent step %v: %v", entry.Name(), err)
+		}
+		if ok {
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+// startConcurrent marks the specified, incomplete, step as in progress
+// in the group specified by opts. Starting a concurrent step that is
+// already in progress has no effect.
+func (ds *directorySession) startConcurrent(step string, opts checkpointstate.StepOptions) error {
+	key := opts.Key(step)
+	if current, ok, err := ds.readCurrent(); err != nil || (ok && current.key() == key) {
+		if err == nil {
+			err = fmt.Errorf("step %v is already in progress", key)
+		}
+		return err
+	}
+	if _, ok, err := ds.readMarker(key); err != nil || ok {
+		return err
+	}
+	stepFile := ds.stepFile(key)
+	// Discard the record of any previous, failed, attempt.
+	if err := os.Remove(stepFile); err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := ds.updateIndex(nil, key); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(ds.session, concurrentDir), 0700); err != nil {
+		return err
+	}
+	buf, _ := ds.opts.marshal(stepState{
+		Step:        step,
+		ContentHash: opts.ContentHash,
+		Created:     ds.now(),
+		StepFile:    stepFile,
+		Artifacts:   opts.Artifacts,
+		Group:       opts.Group,
+		Phase:       opts.Phase,
+		Command:     opts.Command,
+		ExitCode:    opts.ExitCode,
+	})
+	return writeFileAtomic(ds.markerFile(key), buf, 0600)
+}
+
+// Complete implements checkpointstate.Session.
+func (ds *directorySession) Complete(ctx context.Context, step string, opts ...checkpointstate.StepOption) error {
+	// Hooks are run after the lock is released.
+	var completed *stepState
+	defer func() {
+		if completed != nil {
+			ds.runStepHooks(*completed)
+		}
+	}()
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	o := checkpointstate.NewStepOptions(opts...)
+	key := o.Key(step)
+	state, ok, err := ds.readMarker(key)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		current, ok, err := ds.readCurrent()
+		if err != nil {
+			return err
+		}
+		if !ok || current.key() != key {
+			// Completing a step that has already been completed is a no-op.
+			if done, err := ds.isCompleted(key); err != nil || done {
+				return err
+			}
+			return fmt.Errorf("step %v is not in progress", key)
+		}
+		state, ok, err := ds.markDone(ctx, "", o)
+		if ok {
+			completed = &state
+		}
+		return err
+	}
+	state.Completed = ds.now()
+	for k, v := range o.Artifacts {
+		if state.Artifacts == nil {
+			state.Artifacts = map[string]string{}
+		}
+		state.Artifacts[k] = v
+	}
+	state.setCommand(o)
+	buf, _ := ds.opts.marshal(state)
+	if err := writeFileAtomic(state.StepFile, buf, 0400); err != nil {
+		return err
+	}
+	if err := os.Remove(ds.markerFile(key)); err != nil {
+		return err
+	}
+	completed = &state
+	if err := ds.appendLog(state); err != nil {
+		return err
+	}
+	return ds.updateIndex([]stepState{state})
+}
+
+// failConcurrent marks the specified concurrent step as having failed.
+// It returns false if the step is not in progress.
+func (ds *directorySession) failConcurrent(step, reason string) (bool, error) {
+	state, ok, err := ds.readMarker(step)
+	if err != nil || !ok {
+		return false, err
+	}
+	state.Failed = ds.now()
+	state.Reason = reason
+	buf, _ := ds.opts.marshal(state)
+	if err := writeFileAtomic(state.StepFile, buf, 0400); err != nil {
+		return true, err
+	}
+	if err := ds.updateIndex([]stepState{state}); err != nil {
+		return true, err
+	}
+	return true, os.Remove(ds.markerFile(step))
+}
+
+// removeMarkers removes the markers for the specified steps, or all of
+// them if none are specified.
+func (ds *directorySession) removeMarkers(steps ...string) error {
+	if len(steps) == 0 {
+		return os.RemoveAll(filepath.Join(ds.session, concurrentDir))
+	}
+	for _, step := range steps {
+		if err := os.Remove(ds.markerFile(step)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -9,124 +9,405 @@ package directory
 
 import (
 	"context"
-	"crypto/sha256"
-	"encoding/hex"
+	"crypto/cipher"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/cosnicolaou/checkpoint/checkpointstate"
-	"golang.org/x/sys/unix"
 )
 
 type directoryManager struct {
 	root string
+	opts options
+}
+
+// Option represents an option to NewManager.
+type Option func(o *options)
+
+type options struct {
+	namespace     string
+	timeFormat    string
+	lockFiles     bool
+	noLocking     bool
+	explicitAck   bool
+	noFastPath    bool
+	stepIndex     bool
+	metadataCache bool
+	stepHooks     []StepHook
+	lockHooks     []LockHook
+	completionLog bool
+	sharded       bool
+	ids           checkpointstate.IDGenerator
+
+	encryptionKey   []byte
+	decryptionKeys  [][]byte
+	encryptionKeyID string
+	ciphers         map[string]cipher.AEAD
+
+	// flockUnsupported is set, atomically, once flock has been found to
+	// be unsupported, after which lock files are used instead.
+	flockUnsupported int32
+}
+
+// WithNamespace requests that all sessions be created within the specified
+// namespace. Sessions in different namespaces are stored in separate
+// subdirectories of the root directory and hence are isolated from each
+// other, in particular, List will only return sessions in the current
+// namespace.
+func WithNamespace(ns string) Option {
+	return func(o *options) {
+		o.namespace = ns
+	}
 }
 
 const (
 	currentStepFile = "in-progress"
 	metadataFile    = "metadata"
+	compactedFile   = "compacted"
 	timeFormat      = time.RFC3339Nano
+	// namespacesDir is hidden so that it can never be mistaken for a
+	// session directory.
+	namespacesDir = ".namespaces"
 )
 
+// WithImplicitAck controls whether starting a step implicitly marks the
+// step that is in progress, if any, as completed, which is the default.
+// When disabled, each step must be explicitly completed, via Step with
+// an empty step name or via Complete, and requesting a step that has not
+// been completed whilst another step is in progress fails rather than
+// completing it. Steps that have already been completed are reported as
+// such, and steps may be started in concurrency groups, regardless of
+// any step that is in progress.
+func WithImplicitAck(enabled bool) Option {
+	return func(o *options) {
+		o.explicitAck = !enabled
+	}
+}
+
+// WithFastPath controls whether Step determines that a step has already
+// been completed without locking the session, when it is safe to do so,
+// which is the default, see isCompletedFast. Disabling it is only useful
+// for measuring its benefit.
+func WithFastPath(enabled bool) Option {
+	return func(o *options) {
+		o.noFastPath = !enabled
+	}
+}
+
+// WithTimeFormat specifies the layout, as understood by time.Format, used
+// to persist timestamps. Timestamps are always persisted in UTC. The
+// default is time.RFC3339Nano; note that layouts that do not include
+// fractional seconds will reduce the precision of the persisted times.
+// Timestamps that cannot be parsed using the layout are parsed using
+// time.RFC3339Nano so that existing sessions remain readable.
+func WithTimeFormat(layout string) Option {
+	return func(o *options) {
+		o.timeFormat = layout
+	}
+}
+
 // NewManager returns a new instance of a checkpointstate.Manager that
 // manages checkpoints in a local, POSIX-compliant, filesystem directory.
-func NewManager(dir string) checkpointstate.Manager {
-	if err := os.MkdirAll(dir, 0777); err != nil {
-		log.Fatalf("failed to create directory: %v", dir)
+// The directory is created when the first session is created rather than
+// by NewManager so that read-only operations, such as List, may be used
+// with a directory that does not exist, or cannot be created, and will
+// behave as if there are no sessions.
+func NewManager(dir string, opts ...Option) checkpointstate.Manager {
+	o := options{timeFormat: timeFormat, ids: checkpointstate.HashIDs}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	if len(o.namespace) > 0 {
+		if strings.ContainsRune(o.namespace, filepath.Separator) || o.namespace == "." || o.namespace == ".." {
+			log.Fatalf("invalid namespace: %q", o.namespace)
+		}
+		dir = filepath.Join(dir, namespacesDir, o.namespace)
+	}
+	if err := o.configureEncryption(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	o.configureLocking(existingAncestor(dir))
+	return &directoryManager{root: dir, opts: o}
+}
+
+// Init implements checkpointstate.Initializer. The root directory, and
+// any of its ancestors that do not exist, are created so as to be
+// accessible only by the current user.
+func (dm *directoryManager) Init(ctx context.Context) (string, error) {
+	if _, err := os.Stat(dm.root); err == nil || !os.IsNotExist(err) {
+		return dm.root, err
 	}
-	return &directoryManager{root: dir}
+	if err := os.MkdirAll(dm.root, 0700); err != nil {
+		return dm.root, fmt.Errorf("failed to create directory: %v: %v", dm.root, err)
+	}
+	if err := writeVersion(dm.root, formatVersion); err != nil {
+		return dm.root, err
+	}
+	return dm.root, dm.initLayout()
 }
 
 type directorySession struct {
 	session string
+	opts    *options
+	cache   metadataCache
 }
 
-func lock(name string) (func(), error) {
-	f, err := os.Open(name)
-	if err != nil {
-		return func() {}, err
+// existingAncestor returns dir, or its closest ancestor that exists.
+func existingAncestor(dir string) string {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+		dir = parent
 	}
-	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
-		return func() {}, err
+}
+
+// WithIDGenerator specifies the strategy used to create session IDs,
+// the default is checkpointstate.HashIDs. Since session IDs are used
+// as directory names, IDs that are not valid directory names, or that
+// would be hidden, are rejected by Use.
+func WithIDGenerator(gen checkpointstate.IDGenerator) Option {
+	return func(o *options) {
+		o.ids = gen
 	}
-	return func() {
-		unix.Flock(int(f.Fd()), unix.LOCK_UN)
-	}, nil
 }
 
 // SessionID implements checkpointstate.Manager.
 func (dm *directoryManager) SessionID(keys ...string) string {
-	h := sha256.New()
-	for _, k := range keys {
-		dgst := sha256.Sum256([]byte(k))
-		h.Write(dgst[:])
+	return checkpointstate.ValidSessionID(dm.opts.ids, keys...)
+}
+
+// maxSessionIDLength is the longest file name supported by common
+// filesystems.
+const maxSessionIDLength = 255
+
+// validateSessionID returns an error if id cannot be safely used as the
+// name of a session directory.
+func validateSessionID(id string) error {
+	switch {
+	case len(id) == 0:
+		return checkpointstate.ErrEmptySessionID
+	case len(id) > maxSessionIDLength:
+		return fmt.Errorf("invalid session id %q: longer than %v bytes", id, maxSessionIDLength)
+	case strings.ContainsRune(id, filepath.Separator) || strings.ContainsRune(id, '/'):
+		return fmt.Errorf("invalid session id %q: contains a path separator", id)
+	case strings.HasPrefix(id, "."):
+		return fmt.Errorf("invalid session id %q: starts with a .", id)
 	}
-	return hex.EncodeToString(h.Sum(nil))
+	return nil
 }
 
 // Use implements checkpointstate.Manager.
 func (dm *directoryManager) Use(ctx context.Context, id string, reset bool) (checkpointstate.Session, error) {
-	if len(id) == 0 {
-		return nil, fmt.Errorf("empty session id")
+	return dm.use(ctx, id, reset, nil)
+}
+
+// UseWithMetadata implements checkpointstate.Manager. When reset is true
+// the metadata is initialized whilst the root directory, which is used to
+// serialize the creation of sessions, is locked; the session itself is
+// locked in either case.
+func (dm *directoryManager) UseWithMetadata(ctx context.Context, id string, reset bool, initMetadata map[string]interface{}) (checkpointstate.Session, bool, error) {
+	created := false
+	sess, err := dm.use(ctx, id, reset, func(ds *directorySession) error {
+		var err error
+		created, err = ds.initMetadata(ctx, initMetadata)
+		return err
+	})
+	return sess, created, err
+}
+
+// use implements Use, calling init, if not nil, with the session before
+// returning it and, if reset is true, before unlocking the root directory.
+func (dm *directoryManager) use(ctx context.Context, id string, reset bool, init func(*directorySession) error) (checkpointstate.Session, error) {
+	if err := validateSessionID(id); err != nil {
+		return nil, err
 	}
-	unlock, err := lock(dm.root)
+	if !reset {
+		sessionDir := dm.sessionDir(id)
+		// The root directory need not be locked since nothing is
+		// modified, which allows for sessions to be used concurrently.
+		if _, err := os.Stat(sessionDir); err != nil {
+			if os.IsNotExist(err) {
+				return nil, checkpointstate.ErrNoSuchSession
+			}
+			return nil, err
+		}
+		if err := dm.checkSessionDir(sessionDir); err != nil {
+			return nil, err
+		}
+		sess := &directorySession{session: sessionDir, opts: &dm.opts}
+		if init != nil {
+			if err := init(sess); err != nil {
+				return nil, err
+			}
+		}
+		return sess, nil
+	}
+	_, err := os.Stat(dm.root)
+	newStore := os.IsNotExist(err)
+	if err := os.MkdirAll(dm.root, 0777); err != nil {
+		return nil, fmt.Errorf("failed to create directory: %v: %v", dm.root, err)
+	}
+	unlock, err := dm.opts.lock(ctx, dm.root)
 	defer unlock()
 	if err != nil {
 		return nil, err
 	}
-	sessionDir := filepath.Join(dm.root, id)
-	if reset {
-		if err := os.Mkdir(sessionDir, 0700); err != nil && !os.IsExist(err) {
+	if newStore {
+		if err := writeVersion(dm.root, formatVersion); err != nil {
 			return nil, err
 		}
-		if err := os.Remove(filepath.Join(sessionDir, currentStepFile)); err != nil && !os.IsNotExist(err) {
+		if err := dm.initLayout(); err != nil {
 			return nil, err
 		}
 	}
-	return &directorySession{session: sessionDir}, nil
+	sessionDir := dm.sessionDir(id)
+	if err := os.MkdirAll(filepath.Dir(sessionDir), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(sessionDir, 0700); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+	if err := dm.checkSessionDir(sessionDir); err != nil {
+		return nil, err
+	}
+	if sealed, err := isSealed(sessionDir); err != nil || sealed {
+		if err == nil {
+			err = checkpointstate.ErrSealed
+		}
+		return nil, err
+	}
+	if err := os.Remove(filepath.Join(sessionDir, currentStepFile)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	sess := &directorySession{session: sessionDir, opts: &dm.opts}
+	if err := sess.removeMarkers(); err != nil {
+		return nil, err
+	}
+	if init != nil {
+		if err := init(sess); err != nil {
+			return nil, err
+		}
+	}
+	return sess, nil
 }
 
 // List implements checkpointstate.Manager.
 func (dm *directoryManager) List(ctx context.Context) ([]string, error) {
 	dirs := []string{}
-	err := filepath.Walk(dm.root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
-		}
-		if info.IsDir() && path != dm.root {
-			dirs = append(dirs, info.Name())
-		}
+	err := dm.walkSessions(func(path, id string) error {
+		dirs = append(dirs, id)
 		return nil
 	})
 	sort.Strings(dirs)
 	return dirs, err
 }
 
+// Walk implements checkpointstate.Manager.
+func (dm *directoryManager) Walk(ctx context.Context, fn func(id string, sess checkpointstate.Session) error) error {
+	return dm.walkSessions(func(path, id string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(id, &directorySession{session: path, opts: &dm.opts})
+	})
+}
+
 type stepState struct {
-	Step     string
-	StepFile string
+	Step        string
+	ContentHash string `json:",omitempty"`
+	StepFile    string
 	// RFC3339Nano formatted times.
 	Created   string
 	Completed string
+	Artifacts map[string]string      `json:",omitempty"`
+	Failed    string                 `json:",omitempty"`
+	Reason    string                 `json:",omitempty"`
+	Metadata  map[string]interface{} `json:",omitempty"`
+	Result    json.RawMessage        `json:",omitempty"`
+	Order     int                    `json:",omitempty"`
+	Group     string                 `json:",omitempty"`
+	Phase     string                 `json:",omitempty"`
+	Command   []string               `json:",omitempty"`
+	ExitCode  *int                   `json:",omitempty"`
+}
+
+// setCommand records the command and exit status, if any, from opts.
+func (s *stepState) setCommand(opts checkpointstate.StepOptions) {
+	if len(opts.Command) > 0 {
+		s.Command = opts.Command
+	}
+	if opts.ExitCode != nil {
+		s.ExitCode = opts.ExitCode
+	}
+}
+
+// key returns the name under which the step is stored, its content hash
+// if it has one, its display name otherwise.
+func (s stepState) key() string {
+	if len(s.ContentHash) > 0 {
+		return s.ContentHash
+	}
+	return s.Step
 }
 
 // Step implements checkpointstate.Session
-func (ds *directorySession) Step(ctx context.Context, step string) (bool, error) {
-	unlock, err := lock(ds.session)
+func (ds *directorySession) Step(ctx context.Context, step string, opts ...checkpointstate.StepOption) (bool, error) {
+	o := checkpointstate.NewStepOptions(opts...)
+	if !ds.opts.noFastPath && ds.isCompletedFast(step, o) {
+		return true, nil
+	}
+	// Hooks are run after the lock is released.
+	var completed *stepState
+	defer func() {
+		if completed != nil {
+			ds.runStepHooks(*completed)
+		}
+	}()
+	unlock, err := ds.lockUnsealed(ctx)
 	defer unlock()
 	if err != nil {
 		return false, err
 	}
+	key := o.Key(step)
 
-	// Mark the prior step, if any, as done.
-	if err := ds.markDone(ctx, step); err != nil {
-		return false, err
+	// A step that is in progress in a concurrency group can only be
+	// completed via Complete.
+	if len(step) > 0 && len(o.Group) == 0 {
+		if marker, ok, err := ds.readMarker(key); err != nil || ok {
+			if err == nil {
+				err = fmt.Errorf("step %v is in progress in group %v", key, marker.Group)
+			}
+			return false, err
+		}
+	}
+
+	// Mark the prior step, if any, as done, annotating it with the
+	// options if no next step was requested. When implicit acknowledgment
+	// is disabled the prior step is only marked as done if no next step
+	// was requested.
+	if !ds.opts.explicitAck || len(step) == 0 {
+		var doneOpts checkpointstate.StepOptions
+		if len(step) == 0 {
+			doneOpts = o
+		}
+		prev, ok, err := ds.markDone(ctx, key, doneOpts)
+		if ok {
+			completed = &prev
+		}
+		if err != nil {
+			return false, err
+		}
 	}
 
 	// No next step was requested.
@@ -136,88 +417,368 @@ func (ds *directorySession) Step(ctx context.Context, step string) (bool, error)
 
 	// Determine if the requested step has been completed,
 	// ie. the associated file exists.
-	stepFile := filepath.Join(ds.session, step)
-	_, err = ioutil.ReadFile(stepFile)
-	if err == nil {
-		return true, nil
+	stepFile := ds.stepFile(key)
+	done, err := ds.isCompleted(key)
+	if err != nil || done {
+		return done, err
 	}
-	if !os.IsNotExist(err) {
+	if len(o.Group) > 0 {
+		return false, ds.startConcurrent(step, o)
+	}
+	if ds.opts.explicitAck {
+		current, ok, err := ds.readCurrent()
+		if err != nil {
+			return false, err
+		}
+		if ok && current.key() != key {
+			return false, fmt.Errorf("step %v is in progress and must be completed before step %v is started", current.key(), key)
+		}
+	}
+	// Discard the record of any previous, failed, attempt.
+	if err := os.Remove(stepFile); err != nil {
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	} else if err := ds.updateIndex(nil, key); err != nil {
 		return false, err
 	}
-	buf, _ := json.Marshal(stepState{
-		Step:     step,
-		Created:  time.Now().Format(timeFormat),
-		StepFile: stepFile,
+	buf, _ := ds.opts.marshal(stepState{
+		Step:        step,
+		ContentHash: o.ContentHash,
+		Created:     ds.now(),
+		StepFile:    stepFile,
+		Artifacts:   o.Artifacts,
+		Phase:       o.Phase,
+		Command:     o.Command,
+		ExitCode:    o.ExitCode,
 	})
 	// Mark the requested step as in process.
-	return false, ioutil.WriteFile(filepath.Join(ds.session, currentStepFile), buf, 0600)
+	return false, writeFileAtomic(filepath.Join(ds.session, currentStepFile), buf, 0600)
+}
+
+// IsComplete implements checkpointstate.Session.
+func (ds *directorySession) IsComplete(ctx context.Context, step string, opts ...checkpointstate.StepOption) (bool, error) {
+	unlock, err := ds.opts.rlock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return false, err
+	}
+	return ds.isCompleted(checkpointstate.NewStepOptions(opts...).Key(step))
+}
+
+// isCompletedFast returns true if the requested step is stored in its own
+// file and has been completed and there is no in-progress step, ie. if
+// Step has nothing to do but report the step as complete. This is the
+// common case when a script is rerun and is determined without locking
+// the session, and with minimal I/O, since completed step files are
+// written atomically and never modified and the absence of an in-progress
+// step means that there is no transition to be made; Step then behaves
+// as if it had been called before any concurrent change to the session.
+// A false return means only that the locked path must be taken.
+func (ds *directorySession) isCompletedFast(step string, o checkpointstate.StepOptions) bool {
+	if len(step) == 0 || len(o.Group) > 0 {
+		return false
+	}
+	if _, err := os.Lstat(filepath.Join(ds.session, currentStepFile)); !os.IsNotExist(err) {
+		return false
+	}
+	buf, err := readFile(ds.stepFile(o.Key(step)))
+	if err != nil {
+		return false
+	}
+	var state stepState
+	if err := ds.opts.unmarshal(buf, &state); err != nil || len(state.Completed) == 0 {
+		return false
+	}
+	// Sealed sessions cannot be used, even for completed steps.
+	sealed, err := isSealed(ds.session)
+	return err == nil && !sealed
 }
 
+// Steps implements checkpointstate.Session. The session is read under a
+// shared lock, other than the index, if enabled, which is read without
+// the lock and, if it must be rebuilt, is rebuilt under an exclusive one
+// beforehand.
 func (ds *directorySession) Steps(ctx context.Context) ([]checkpointstate.Step, error) {
-	steps := []checkpointstate.Step{}
-	err := filepath.Walk(ds.session, func(path string, info os.FileInfo, err error) error {
-		if err != nil || info.IsDir() || info.Name() == metadataFile {
-			return nil
+	var states []stepState
+	var err error
+	if ds.opts.stepIndex {
+		if states, err = ds.indexedSteps(ctx); err != nil {
+			return nil, err
 		}
-		buf, err := ioutil.ReadFile(path)
-		if err != nil {
-			return err
+	}
+	unlock, err := ds.opts.rlock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+	compacted, err := ds.readCompacted()
+	if err != nil {
+		return nil, err
+	}
+	if !ds.opts.stepIndex {
+		if states, err = ds.walkSteps(); err != nil {
+			return nil, err
 		}
-		var state stepState
-		if err := json.Unmarshal(buf, &state); err != nil {
-			return nil
-		}
-		var created, completed time.Time
-		created, _ = time.Parse(timeFormat, state.Created)
-		if len(state.Completed) > 0 {
-			completed, _ = time.Parse(timeFormat, state.Completed)
-		}
-		steps = append(steps, checkpointstate.Step{
-			Name:      state.Step,
-			Created:   created,
-			Completed: completed,
-		})
-		return nil
-	})
-	sort.Slice(steps, func(i, j int) bool {
-		return steps[i].Created.Before(steps[j].Created)
+	}
+	if current, ok, err := ds.readCurrent(); err == nil && ok {
+		states = append(states, current)
+	}
+	concurrent, err := ds.concurrentSteps()
+	if err != nil {
+		return nil, err
+	}
+	states = append(states, concurrent...)
+	seen := map[string]bool{}
+	for _, state := range states {
+		seen[state.key()] = true
+	}
+	// A step may appear in both layouts if compaction was interrupted.
+	for _, state := range compacted {
+		if !seen[state.key()] {
+			states = append(states, state)
+		}
+	}
+	steps := make([]checkpointstate.Step, 0, len(states))
+	for _, state := range states {
+		steps = append(steps, ds.toStep(state))
+	}
+	sortSteps(steps)
+	return steps, nil
+}
+
+// WalkSteps implements checkpointstate.StepWalker. Completed and failed
+// steps are visited as their step files are read, in lexical order of
+// the files' names, followed by the in-progress and concurrent steps and
+// finally any compacted steps; the index, if enabled, is not used. The
+// session's shared lock is held throughout, as it is by Steps.
+func (ds *directorySession) WalkSteps(ctx context.Context, fn func(checkpointstate.Step) error) error {
+	unlock, err := ds.opts.rlock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	compacted, err := ds.readCompacted()
+	if err != nil {
+		return err
+	}
+	// A step may appear in both layouts if compaction was interrupted.
+	seen := map[string]bool{}
+	err = ds.visitSteps(func(state stepState) error {
+		if len(compacted) > 0 {
+			seen[state.key()] = true
+		}
+		return fn(ds.toStep(state))
 	})
-	return steps, err
+	if err != nil {
+		return err
+	}
+	var states []stepState
+	if current, ok, err := ds.readCurrent(); err == nil && ok {
+		states = append(states, current)
+	}
+	concurrent, err := ds.concurrentSteps()
+	if err != nil {
+		return err
+	}
+	states = append(states, concurrent...)
+	for _, state := range states {
+		seen[state.key()] = true
+		if err := fn(ds.toStep(state)); err != nil {
+			return err
+		}
+	}
+	for _, state := range compacted {
+		if seen[state.key()] {
+			continue
+		}
+		if err := fn(ds.toStep(state)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (ds *directorySession) markDone(ctx context.Context, step string) error {
-	current := filepath.Join(ds.session, currentStepFile)
-	buf, err := ioutil.ReadFile(current)
+// Current implements checkpointstate.Session. Only the in-progress step
+// file is read.
+func (ds *directorySession) Current(ctx context.Context) (*checkpointstate.Step, error) {
+	state, ok, err := ds.readCurrent()
+	if err != nil || !ok {
+		return nil, err
+	}
+	step := ds.toStep(state)
+	return &step, nil
+}
+
+// Summary implements checkpointstate.Session.
+func (ds *directorySession) Summary(ctx context.Context) (checkpointstate.Summary, error) {
+	steps, err := ds.Steps(ctx)
+	if err != nil {
+		return checkpointstate.Summary{}, err
+	}
+	return checkpointstate.NewSummary(steps), nil
+}
+
+// Phases implements checkpointstate.Session.
+func (ds *directorySession) Phases(ctx context.Context) ([]checkpointstate.Phase, error) {
+	steps, err := ds.Steps(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return checkpointstate.NewPhases(steps), nil
+}
+
+// isStepFile returns true if the named file within a session directory
+// may contain the state for a single step. The completion log is only
+// excluded when it is enabled since, otherwise, a file named log may
+// be that of a step written before step file names were encoded.
+func (ds *directorySession) isStepFile(name string) bool {
+	if name == logFile && ds.opts.completionLog {
+		return false
+	}
+	return name != metadataFile && name != compactedFile && !strings.HasPrefix(name, ".")
+}
+
+// now returns the current time, in UTC, formatted for persistence.
+func (ds *directorySession) now() string {
+	return time.Now().UTC().Format(ds.opts.timeFormat)
+}
+
+func (ds *directorySession) parseTime(v string) time.Time {
+	t, err := time.Parse(ds.opts.timeFormat, v)
+	if err != nil {
+		t, _ = time.Parse(timeFormat, v)
+	}
+	return t
+}
+
+func (ds *directorySession) toStep(s stepState) checkpointstate.Step {
+	var completed, failed time.Time
+	if len(s.Completed) > 0 {
+		completed = ds.parseTime(s.Completed)
+	}
+	if len(s.Failed) > 0 {
+		failed = ds.parseTime(s.Failed)
+	}
+	return checkpointstate.Step{
+		Name:        s.Step,
+		ContentHash: s.ContentHash,
+		Created:     ds.parseTime(s.Created),
+		Completed:   completed,
+		Artifacts:   s.Artifacts,
+		Failed:      failed,
+		Reason:      s.Reason,
+		Metadata:    s.Metadata,
+		Result:      s.Result,
+		Order:       s.Order,
+		Group:       s.Group,
+		Phase:       s.Phase,
+		Command:     s.Command,
+		ExitCode:    s.ExitCode,
+	}
+}
+
+// readCurrent returns the state of the in-progress step, if any.
+func (ds *directorySession) readCurrent() (stepState, bool, error) {
+	buf, err := readFile(filepath.Join(ds.session, currentStepFile))
 	if err != nil {
 		if os.IsNotExist(err) {
-			// treat a non-existent step as success.
-			return nil
+			return stepState{}, false, nil
 		}
-		return err
+		return stepState{}, false, err
 	}
 	var state stepState
-	if err := json.Unmarshal(buf, &state); err != nil {
-		return fmt.Errorf("failed to unmarshal state for current step %v", err)
+	if err := ds.opts.unmarshal(buf, &state); err != nil {
+		return stepState{}, false, fmt.Errorf("failed to unmarshal state for current step %v", err)
 	}
-	if state.StepFile == filepath.Join(ds.session, step) {
-		return nil
+	return state, true, nil
+}
+
+// readStepFile returns the state stored in the named step file, if
+// it exists.
+func (ds *directorySession) readStepFile(filename string) (stepState, bool, error) {
+	buf, err := readFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return stepState{}, false, nil
+		}
+		return stepState{}, false, err
 	}
-	if _, err := os.Stat(state.StepFile); err == nil || !os.IsNotExist(err) {
+	var state stepState
+	if err := ds.opts.unmarshal(buf, &state); err != nil {
+		return stepState{}, false, err
+	}
+	return state, true, nil
+}
+
+// markDone marks the in-progress step, if any, as completed unless it is
+// the specified step. It returns the state of the completed step and
+// true if a step was completed.
+func (ds *directorySession) markDone(ctx context.Context, step string, opts checkpointstate.StepOptions) (stepState, bool, error) {
+	current := filepath.Join(ds.session, currentStepFile)
+	state, ok, err := ds.readCurrent()
+	if err != nil {
+		return stepState{}, false, err
+	}
+	if !ok {
+		// treat a non-existent step as success.
+		return stepState{}, false, nil
+	}
+	if state.StepFile == ds.stepFile(step) {
+		// The requested step is the current one. Its record may exist if
+		// completing it was interrupted, in which case the current step
+		// is stale and is removed so that the step is not reported as
+		// being both in progress and completed.
+		existing, exists, err := ds.readStepFile(state.StepFile)
+		if err == nil && exists && existing.Created == state.Created && len(existing.Completed) > 0 {
+			err = os.Remove(current)
+		}
+		return stepState{}, false, err
+	}
+	// A record of the step may legitimately exist if completing it was
+	// interrupted after its record was written, or if it is that of an
+	// earlier attempt that failed. The step is only being reused if the
+	// record is of a different, completed, attempt.
+	if existing, exists, err := ds.readStepFile(state.StepFile); err != nil || exists {
+		switch {
+		case err != nil:
+			return stepState{}, false, fmt.Errorf("step %v is being reused or it could not be accessed: %v", state.StepFile, err)
+		case existing.Created == state.Created && len(existing.Completed) > 0:
+			return stepState{}, false, os.Remove(current)
+		case len(existing.Completed) > 0:
+			return stepState{}, false, fmt.Errorf("step %v is being reused", state.StepFile)
+		}
+	}
+	if compacted, err := ds.isCompacted(state.key()); err != nil || compacted {
 		if err == nil {
-			return fmt.Errorf("step %v is being reused", state.StepFile)
+			return stepState{}, false, fmt.Errorf("step %v is being reused", state.StepFile)
 		}
-		return fmt.Errorf("step %v is being reused or it could not be accessed: %v", state.StepFile, err)
+		return stepState{}, false, err
+	}
+	state.Completed = ds.now()
+	for k, v := range opts.Artifacts {
+		if state.Artifacts == nil {
+			state.Artifacts = map[string]string{}
+		}
+		state.Artifacts[k] = v
+	}
+	state.setCommand(opts)
+	buf, _ := ds.opts.marshal(state)
+	if err := writeFileAtomic(state.StepFile, buf, 0400); err != nil {
+		return stepState{}, false, err
+	}
+	if err := os.Remove(current); err != nil {
+		return stepState{}, false, err
+	}
+	if err := ds.appendLog(state); err != nil {
+		return state, true, err
 	}
-	state.Completed = time.Now().Format(timeFormat)
-	err = os.Rename(current, state.StepFile)
-	buf, _ = json.Marshal(state)
-	ioutil.WriteFile(state.StepFile, buf, 0400)
-	return err
+	return state, true, ds.updateIndex([]stepState{state})
 }
 
 // Delete implements checkpointstate.Session,
 func (ds *directorySession) Delete(ctx context.Context, steps ...string) error {
-	unlock, err := lock(ds.session)
+	unlock, err := ds.lockUnsealed(ctx)
 	defer unlock()
 	if err != nil {
 		return err
@@ -227,37 +788,219 @@ func (ds *directorySession) Delete(ctx context.Context, steps ...string) error {
 		// lock on it is released.
 		return os.RemoveAll(ds.session)
 	}
+	return ds.deleteSteps(steps...)
+}
+
+// DeleteMatching implements checkpointstate.MatchingDeleter. The step files
+// are always read, rather than the index, since the index may only be
+// rebuilt by a caller that does not already hold the session's lock.
+func (ds *directorySession) DeleteMatching(ctx context.Context, match func(checkpointstate.Step) bool) ([]checkpointstate.Step, error) {
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+	states, err := ds.walkSteps()
+	if err != nil {
+		return nil, err
+	}
+	compacted, err := ds.readCompacted()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	matched := []checkpointstate.Step{}
+	var keys []string
+	for _, state := range append(states, compacted...) {
+		// A step may appear in both layouts if compaction was interrupted.
+		if seen[state.key()] {
+			continue
+		}
+		seen[state.key()] = true
+		if step := ds.toStep(state); match(step) {
+			matched = append(matched, step)
+			keys = append(keys, state.key())
+		}
+	}
+	if len(keys) == 0 {
+		return matched, nil
+	}
+	sortSteps(matched)
+	return matched, ds.deleteSteps(keys...)
+}
+
+// deleteSteps deletes the specified steps; the session must be locked.
+func (ds *directorySession) deleteSteps(steps ...string) error {
 	for _, step := range steps {
-		if err := os.Remove(filepath.Join(ds.session, step)); err != nil && !os.IsNotExist(err) {
+		if err := os.Remove(ds.stepFile(step)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := ds.removeMarkers(steps...); err != nil {
+		return err
+	}
+	if err := ds.updateIndex(nil, steps...); err != nil {
+		return err
+	}
+	return ds.deleteCompacted(steps...)
+}
+
+// Fail implements checkpointstate.Session.
+func (ds *directorySession) Fail(ctx context.Context, step, reason string) error {
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	state, ok, err := ds.readCurrent()
+	if err != nil {
+		return err
+	}
+	current := ok && (len(step) == 0 || state.key() == step)
+	if !current && len(step) > 0 {
+		if failed, err := ds.failConcurrent(step, reason); err != nil || failed {
 			return err
 		}
 	}
+	switch {
+	case current:
+	case len(step) == 0:
+		return fmt.Errorf("no step is in progress")
+	default:
+		done, err := ds.isCompleted(step)
+		if err != nil {
+			return err
+		}
+		if done {
+			return fmt.Errorf("step %v has already been completed", step)
+		}
+		state = stepState{
+			Step:     step,
+			StepFile: ds.stepFile(step),
+			Created:  ds.now(),
+		}
+	}
+	state.Failed = ds.now()
+	state.Reason = reason
+	buf, _ := ds.opts.marshal(state)
+	if err := writeFileAtomic(state.StepFile, buf, 0400); err != nil {
+		return err
+	}
+	if err := ds.updateIndex([]stepState{state}); err != nil {
+		return err
+	}
+	if current {
+		return os.Remove(filepath.Join(ds.session, currentStepFile))
+	}
+	return nil
+}
+
+// Abort implements checkpointstate.Session.
+func (ds *directorySession) Abort(ctx context.Context) error {
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(ds.session, currentStepFile)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("no step is in progress")
+		}
+		return err
+	}
 	return nil
 }
 
 // SetMetadata implements checkpointstate.Session,
 func (ds *directorySession) SetMetadata(ctx context.Context, metadata map[string]interface{}) error {
-	unlock, err := lock(ds.session)
+	unlock, err := ds.lockUnsealed(ctx)
 	defer unlock()
 	if err != nil {
 		return err
 	}
-	buf, err := json.Marshal(metadata)
+	return ds.writeMetadata(metadata)
+}
+
+// UpdateMetadata implements checkpointstate.MetadataUpdater.
+func (ds *directorySession) UpdateMetadata(ctx context.Context, fn func(map[string]interface{}) (map[string]interface{}, error)) error {
+	unlock, err := ds.opts.lock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	md, err := ds.readMetadata()
+	if err != nil {
+		return err
+	}
+	updated, err := fn(md)
+	if err != nil || updated == nil {
+		return err
+	}
+	if sealed, err := isSealed(ds.session); err != nil || sealed {
+		if err == nil {
+			err = checkpointstate.ErrSealed
+		}
+		return err
+	}
+	return ds.writeMetadata(updated)
+}
+
+func (ds *directorySession) writeMetadata(metadata map[string]interface{}) error {
+	buf, err := ds.opts.marshal(metadata)
 	if err != nil {
 		return fmt.Errorf("failed to json encode metadata: %v", err)
 	}
-	return ioutil.WriteFile(filepath.Join(ds.session, metadataFile), buf, 0600)
+	filename := filepath.Join(ds.session, metadataFile)
+	ds.cache.invalidate()
+	return writeFileAtomic(filename, buf, 0600)
 }
 
 // Metadata implements checkpointstate.Session,
 func (ds *directorySession) Metadata(ctx context.Context) (map[string]interface{}, error) {
-	unlock, err := lock(ds.session)
+	unlock, err := ds.opts.rlock(ctx, ds.session)
 	defer unlock()
 	if err != nil {
 		return nil, err
 	}
+	return ds.readMetadata()
+}
+
+// initMetadata initializes, or updates, the session's metadata as per
+// checkpointstate.InitMetadata and returns true if it was initialized.
+func (ds *directorySession) initMetadata(ctx context.Context, initMetadata map[string]interface{}) (bool, error) {
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return false, err
+	}
+	md, err := ds.readMetadata()
+	if err != nil {
+		return false, err
+	}
+	md, created := checkpointstate.InitMetadata(md, initMetadata, time.Now().UTC())
+	return created, ds.writeMetadata(md)
+}
+
+// readMetadata returns the session's metadata, or nil if it has none;
+// the session must be locked.
+func (ds *directorySession) readMetadata() (map[string]interface{}, error) {
 	filename := filepath.Join(ds.session, metadataFile)
-	buf, err := ioutil.ReadFile(filename)
+	var (
+		info os.FileInfo
+		err  error
+	)
+	if ds.opts.metadataCache {
+		if info, err = os.Lstat(filename); err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if md, ok := ds.cache.get(info); ok {
+			return md, nil
+		}
+	}
+	buf, err := readFile(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, nil
@@ -265,8 +1008,128 @@ func (ds *directorySession) Metadata(ctx context.Context) (map[string]interface{
 		return nil, err
 	}
 	var md map[string]interface{}
-	if err := json.Unmarshal(buf, &md); err != nil {
+	if err := ds.opts.unmarshal(buf, &md); err != nil {
 		return nil, fmt.Errorf("failed to decode json data from %v: %v", filename, err)
 	}
+	if ds.opts.metadataCache {
+		ds.cache.set(info, md)
+	}
 	return md, nil
 }
+
+// lookupStep returns the state of the named step, whether it is in
+// progress, completed or failed, together with a function that will
+// persist changes to that state in the same location.
+func (ds *directorySession) lookupStep(step string) (stepState, func(stepState) error, error) {
+	current, ok, err := ds.readCurrent()
+	if err != nil {
+		return stepState{}, nil, err
+	}
+	if ok && current.key() == step {
+		return current, func(state stepState) error {
+			buf, _ := ds.opts.marshal(state)
+			return writeFileAtomic(filepath.Join(ds.session, currentStepFile), buf, 0600)
+		}, nil
+	}
+	if marker, ok, err := ds.readMarker(step); err != nil || ok {
+		return marker, func(state stepState) error {
+			buf, _ := ds.opts.marshal(state)
+			return writeFileAtomic(ds.markerFile(step), buf, 0600)
+		}, err
+	}
+	stepFile := ds.stepFile(step)
+	buf, err := readFile(stepFile)
+	if err == nil {
+		var state stepState
+		if err := ds.opts.unmarshal(buf, &state); err != nil {
+			return stepState{}, nil, fmt.Errorf("failed to decode json data from %v: %v", stepFile, err)
+		}
+		return state, func(state stepState) error {
+			buf, _ := ds.opts.marshal(state)
+			if err := writeFileAtomic(stepFile, buf, 0400); err != nil {
+				return err
+			}
+			return ds.updateIndex([]stepState{state})
+		}, nil
+	}
+	if !os.IsNotExist(err) {
+		return stepState{}, nil, err
+	}
+	states, err := ds.readCompacted()
+	if err != nil {
+		return stepState{}, nil, err
+	}
+	for i, state := range states {
+		if state.key() == step {
+			return state, func(state stepState) error {
+				states[i] = state
+				return ds.writeCompacted(states)
+			}, nil
+		}
+	}
+	return stepState{}, nil, fmt.Errorf("step %v does not exist", step)
+}
+
+// SetStepMetadata implements checkpointstate.Session.
+func (ds *directorySession) SetStepMetadata(ctx context.Context, step string, metadata map[string]interface{}) error {
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	if _, err := json.Marshal(metadata); err != nil {
+		return fmt.Errorf("failed to json encode metadata: %v", err)
+	}
+	state, write, err := ds.lookupStep(step)
+	if err != nil {
+		return err
+	}
+	state.Metadata = metadata
+	return write(state)
+}
+
+// StepMetadata implements checkpointstate.Session.
+func (ds *directorySession) StepMetadata(ctx context.Context, step string) (map[string]interface{}, error) {
+	unlock, err := ds.opts.rlock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+	state, _, err := ds.lookupStep(step)
+	if err != nil {
+		return nil, err
+	}
+	return state.Metadata, nil
+}
+
+// SetStepResult implements checkpointstate.Session.
+func (ds *directorySession) SetStepResult(ctx context.Context, step string, result json.RawMessage) error {
+	if err := checkpointstate.ValidateResult(result); err != nil {
+		return err
+	}
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	state, write, err := ds.lookupStep(step)
+	if err != nil {
+		return err
+	}
+	state.Result = result
+	return write(state)
+}
+
+// StepResult implements checkpointstate.Session.
+func (ds *directorySession) StepResult(ctx context.Context, step string) (json.RawMessage, error) {
+	unlock, err := ds.opts.rlock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+	state, _, err := ds.lookupStep(step)
+	if err != nil {
+		return nil, err
+	}
+	return state.Result, nil
+}
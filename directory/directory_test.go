@@ -4,20 +4,28 @@
 package directory_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
 	"runtime"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/cosnicolaou/checkpoint/checkpointstatetest"
 	"github.com/cosnicolaou/checkpoint/directory"
+	"golang.org/x/sys/unix"
 )
 
 func list(root string) []string {
@@ -42,8 +50,9 @@ func TestIDs(t *testing.T) {
 		input []string
 		id    string
 	}{
-		{nil, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
-		{[]string{}, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		// No inputs result in the empty ID, which Use rejects.
+		{nil, ""},
+		{[]string{}, ""},
 		{[]string{"a", "b"}, "e5a01fee14e0ed5c48714f22180f25ad8365b53f9779f79dc4a3d7e93963f94a"},
 		{[]string{"b", "a"}, "18d79cb747ea174c59f3a3b41768672526d56fecc58360a99d283d0f9b0a3cc0"},
 	} {
@@ -53,224 +62,3126 @@ func TestIDs(t *testing.T) {
 	}
 }
 
-func TestMetadata(t *testing.T) {
+func TestIDGenerator(t *testing.T) {
 	ctx := context.Background()
 	dir, err := ioutil.TempDir("", "local-file")
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithIDGenerator(checkpointstate.SlugIDs))
+	id := mgr.SessionID("my", "project")
+	if got, want := id, "my-project"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := mgr.Use(ctx, id, true); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list(dir), []string{filepath.Join(dir, "my-project")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids, []string{"my-project"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// IDs created by custom generators must be safe to use as directory
+	// names.
+	mgr = directory.NewManager(dir, directory.WithIDGenerator(
+		checkpointstate.IDGeneratorFunc(func(inputs ...string) string {
+			return strings.Join(inputs, "")
+		})))
+	for _, tc := range []struct {
+		inputs []string
+		err    string
+	}{
+		{nil, "empty session id"},
+		{[]string{"..", "/x"}, "contains a path separator"},
+		{[]string{"a/b"}, "contains a path separator"},
+		{[]string{"."}, "starts with a ."},
+		{[]string{".namespaces"}, "starts with a ."},
+		{[]string{strings.Repeat("x", 256)}, "longer than 255 bytes"},
+	} {
+		_, err := mgr.Use(ctx, mgr.SessionID(tc.inputs...), true)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: missing or unexpected error: %v", tc.inputs, err)
+		}
+	}
+	if got, want := list(dir), []string{filepath.Join(dir, "my-project")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts []directory.Option
+	}{
+		{"default", nil},
+		{"step-index", []directory.Option{directory.WithStepIndex()}},
+		{"metadata-cache", []directory.Option{directory.WithMetadataCache()}},
+		{"completion-log", []directory.Option{directory.WithCompletionLog()}},
+		{"encrypted", []directory.Option{directory.WithEncryptionKey([]byte("0123456789abcdef")), directory.WithStepIndex()}},
+		{"slug-ids", []directory.Option{directory.WithIDGenerator(checkpointstate.SlugIDs)}},
+		{"sharded", []directory.Option{directory.WithShardedLayout()}},
+	} {
+		opts := tc.opts
+		t.Run(tc.name, func(t *testing.T) {
+			checkpointstatetest.RunConformance(t, func(t *testing.T) checkpointstate.Manager {
+				dir, err := ioutil.TempDir("", "local-file")
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { os.RemoveAll(dir) })
+				return directory.NewManager(dir, opts...)
+			})
+		})
+	}
+}
+
+func TestDirectory(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	id := mgr.SessionID("/a/b/c")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionDir := filepath.Join(dir, id)
+	if got, want := list(dir), []string{sessionDir}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, step := range []string{"a", "b"} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := list(sessionDir), []string{
+		filepath.Join(sessionDir, "a"),
+		filepath.Join(sessionDir, "in-progress"),
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := sess.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list(dir), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := directory.NewManager(dir)
+	nsA := directory.NewManager(dir, directory.WithNamespace("a"))
+	nsB := directory.NewManager(dir, directory.WithNamespace("b"))
+
+	id := root.SessionID("a", "b")
+	for _, mgr := range []checkpointstate.Manager{root, nsA, nsB} {
+		if got, want := mgr.SessionID("a", "b"), id; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	sessA, err := nsA.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := sessA.Step(ctx, "s1"); err != nil || ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	}
+	if ok, err := sessA.Step(ctx, "s2"); err != nil || ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	}
+
+	// The same session ID in a different namespace is independent.
+	sessB, err := nsB.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := sessB.Step(ctx, "s1"); err != nil || ok {
+		t.Errorf("unexpected result: %v, %v", ok, err)
+	}
+	id1 := nsB.SessionID("c")
+	if _, err := nsB.Use(ctx, id1, true); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, tc := range []struct {
+		mgr checkpointstate.Manager
+		ids []string
+	}{
+		{root, []string{}},
+		{nsA, []string{id}},
+		{nsB, []string{id1, id}},
+	} {
+		ids, err := tc.mgr.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := ids, tc.ids; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+
+	steps, err := sessA.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(steps), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestArtifacts(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	id := mgr.SessionID("artifacts")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A step file written before artifacts were supported.
+	legacy := filepath.Join(dir, id, "legacy")
+	now := time.Now().Add(-time.Minute)
+	buf := fmt.Sprintf(`{"Step":"legacy","StepFile":%q,"Created":%q,"Completed":%q}`,
+		legacy, now.Format(time.RFC3339Nano), now.Add(time.Second).Format(time.RFC3339Nano))
+	if err := ioutil.WriteFile(legacy, []byte(buf), 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := sess.Step(ctx, "a", checkpointstate.WithArtifact("out", "/tmp/a.tar")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Step(ctx, "b", checkpointstate.WithArtifact("out", "/tmp/b.tar")); err != nil {
+		t.Fatal(err)
+	}
+	// Annotate the step being completed.
+	if _, err := sess.Step(ctx, "", checkpointstate.WithArtifact("size", "42")); err != nil {
+		t.Fatal(err)
+	}
+	// Options are ignored for steps that are already complete.
+	if ok, err := sess.Step(ctx, "a", checkpointstate.WithArtifact("ignored", "true")); err != nil || !ok {
+		t.Fatalf("unexpected result: %v, %v", ok, err)
+	}
+
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(steps), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, tc := range []struct {
+		name      string
+		artifacts map[string]string
+	}{
+		{"legacy", nil},
+		{"a", map[string]string{"out": "/tmp/a.tar"}},
+		{"b", map[string]string{"out": "/tmp/b.tar", "size": "42"}},
+	} {
+		if got, want := steps[i].Name, tc.name; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := steps[i].Artifacts, tc.artifacts; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+
+	// Step files written before step metadata was supported.
+	if md, err := sess.StepMetadata(ctx, "legacy"); err != nil || md != nil {
+		t.Errorf("unexpected result: %v, %v", md, err)
+	}
+	md := map[string]interface{}{"Command": "legacy"}
+	if err := sess.SetStepMetadata(ctx, "legacy", md); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sess.StepMetadata(ctx, "legacy"); err != nil || !reflect.DeepEqual(got, md) {
+		t.Errorf("unexpected result: %v, %v", got, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	id := mgr.SessionID("compact")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"a", "b", "c"} {
+		if ok, err := sess.Step(ctx, step, checkpointstate.WithArtifact("name", step)); err != nil || ok {
+			t.Fatalf("unexpected result: %v, %v", ok, err)
+		}
+	}
+	before, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compactor, ok := sess.(checkpointstate.Compactor)
+	if !ok {
+		t.Fatalf("%T does not implement checkpointstate.Compactor", sess)
+	}
+	if err := compactor.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	sessionDir := filepath.Join(dir, id)
+	if got, want := list(sessionDir), []string{
+		filepath.Join(sessionDir, "compacted"),
+		filepath.Join(sessionDir, "in-progress"),
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	after, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := after, before; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Compacted steps are visited after the in-progress step.
+	var walked []checkpointstate.Step
+	err = sess.(checkpointstate.StepWalker).WalkSteps(ctx, func(step checkpointstate.Step) error {
+		walked = append(walked, step)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := walked, []checkpointstate.Step{before[2], before[0], before[1]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Compacted steps are still recognised as complete.
+	sess, err = mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		step string
+		done bool
+	}{
+		{"a", true}, {"b", true}, {"c", false}, {"d", false},
+	} {
+		if ok, err := sess.Step(ctx, tc.step); err != nil || ok != tc.done {
+			t.Errorf("%v: unexpected result: %v, %v", tc.step, ok, err)
+		}
+	}
+
+	// Compacting again merges the newly completed steps.
+	if err := compactor.Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, step := range steps {
+		names = append(names, step.Name)
+	}
+	if got, want := names, []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := steps[0].Artifacts, map[string]string{"name": "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Metadata may be set for compacted steps.
+	md := map[string]interface{}{"Command": "b"}
+	if err := sess.SetStepMetadata(ctx, "b", md); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sess.StepMetadata(ctx, "b"); err != nil || !reflect.DeepEqual(got, md) {
+		t.Errorf("unexpected result: %v, %v", got, err)
+	}
+
+	// Deleting steps removes them from the compacted file.
+	if err := sess.Delete(ctx, "a", "c"); err != nil {
+		t.Fatal(err)
+	}
+	steps, err = sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names = nil
+	for _, step := range steps {
+		names = append(names, step.Name)
+	}
+	if got, want := names, []string{"b", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestUTCTimes(t *testing.T) {
+	ctx := context.Background()
+	local := time.Local
+	time.Local = time.FixedZone("UTC+5", 5*60*60)
+	defer func() { time.Local = local }()
+
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const layout = "2006-01-02 15:04:05.000000000Z07:00"
+	for i, tc := range []struct {
+		root   string
+		layout string
+		opts   []directory.Option
+	}{
+		{filepath.Join(dir, "default"), time.RFC3339Nano, nil},
+		{filepath.Join(dir, "custom"), layout, []directory.Option{directory.WithTimeFormat(layout)}},
+	} {
+		mgr := directory.NewManager(tc.root, tc.opts...)
+		id := mgr.SessionID("utc")
+		sess, err := mgr.Use(ctx, id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sess.Step(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sess.Step(ctx, "b"); err != nil {
+			t.Fatal(err)
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(tc.root, id, "a"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state struct{ Created, Completed string }
+		if err := json.Unmarshal(buf, &state); err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{state.Created, state.Completed} {
+			if !strings.HasSuffix(v, "Z") {
+				t.Errorf("%v: %v is not in UTC", i, v)
+			}
+			if _, err := time.Parse(tc.layout, v); err != nil {
+				t.Errorf("%v: %v", i, err)
+			}
+		}
+		steps, err := sess.Steps(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(steps), 2; got != want {
+			t.Fatalf("%v: got %v, want %v", i, got, want)
+		}
+		if steps[0].Created.IsZero() || steps[0].Completed.IsZero() {
+			t.Errorf("%v: failed to parse times: %v", i, steps[0])
+		}
+	}
+}
+
+func TestLocked(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	id := mgr.SessionID("locked")
+	if _, err := mgr.Use(ctx, id, true); err != nil {
+		t.Fatal(err)
+	}
+	inspector := mgr.(checkpointstate.LockInspector)
+	if locked, err := inspector.Locked(ctx, id); err != nil || locked {
+		t.Errorf("unexpected result: %v, %v", locked, err)
+	}
+	f, err := os.Open(filepath.Join(dir, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := inspector.Locked(ctx, id); err != nil || !locked {
+		t.Errorf("unexpected result: %v, %v", locked, err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_UN); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := inspector.Locked(ctx, id); err != nil || locked {
+		t.Errorf("unexpected result: %v, %v", locked, err)
+	}
+	if _, err := inspector.Locked(ctx, mgr.SessionID("nonexistent")); err == nil {
+		t.Errorf("expected an error for a nonexistent session")
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	id := mgr.SessionID("unlock")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Step(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	inspector := mgr.(checkpointstate.LockInspector)
+
+	f, err := os.Open(filepath.Join(dir, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	if err := inspector.ForceUnlock(ctx, id); err == nil || !strings.Contains(err.Error(), "locked by a live process") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_UN); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list(filepath.Join(dir, id)), []string{filepath.Join(dir, id, "in-progress")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := inspector.ForceUnlock(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := list(filepath.Join(dir, id)), []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Unlocking an unlocked session is not an error.
+	if err := inspector.ForceUnlock(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockFiles(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithLockFiles())
+	id := mgr.SessionID("lockfiles")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionDir := filepath.Join(dir, id)
+	lockFile := filepath.Join(sessionDir, ".lock")
+	inspector := mgr.(checkpointstate.LockInspector)
+
+	writeLock := func(pid int, expires time.Time) {
+		host, _ := os.Hostname()
+		buf := fmt.Sprintf(`{"PID":%v,"Host":%q,"Expires":%q}`, pid, host, expires.Format(time.RFC3339Nano))
+		if err := ioutil.WriteFile(lockFile, []byte(buf), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Concurrent steps are serialized and leave no lock files behind.
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			_, err := sess.Step(ctx, fmt.Sprintf("s%v", i))
+			errs <- err
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		t.Errorf("lock file was not removed: %v", err)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(steps), 10; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A lock file held by a live process.
+	writeLock(os.Getpid(), time.Now().Add(time.Minute))
+	if locked, err := inspector.Locked(ctx, id); err != nil || !locked {
+		t.Errorf("unexpected result: %v, %v", locked, err)
+	}
+	if err := inspector.ForceUnlock(ctx, id); err == nil {
+		t.Errorf("expected an error")
+	}
+	done := make(chan error)
+	go func() {
+		_, err := sess.Step(ctx, "after")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("step did not wait for the lock: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	os.Remove(lockFile)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock files with an expired lease, or whose owner no longer exists,
+	// are stale.
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		pid     int
+		expires time.Time
+	}{
+		{os.Getpid(), time.Now().Add(-time.Second)},
+		{cmd.Process.Pid, time.Now().Add(time.Minute)},
+	} {
+		writeLock(tc.pid, tc.expires)
+		if locked, err := inspector.Locked(ctx, id); err != nil || locked {
+			t.Errorf("unexpected result: %v, %v", locked, err)
+		}
+		if _, err := sess.Steps(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := sess.Step(ctx, "after"); err != nil || ok {
+			t.Errorf("unexpected result: %v, %v", ok, err)
+		}
+	}
+	writeLock(os.Getpid(), time.Now().Add(-time.Second))
+	if err := inspector.ForceUnlock(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		t.Errorf("lock file was not removed: %v", err)
+	}
+}
+
+func stepNames(t testing.TB, sess checkpointstate.Session) []string {
+	steps, err := sess.Steps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, step := range steps {
+		names = append(names, step.Name)
+	}
+	return names
+}
+
+func TestStaleLockFileRace(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	host, _ := os.Hostname()
+	expired := fmt.Sprintf(`{"PID":%v,"Host":%q,"Expires":%q}`, os.Getpid(), host, time.Now().Add(-time.Minute).Format(time.RFC3339Nano))
+	const concurrency = 20
+	for i := 0; i < 20; i++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, ".lock"), []byte(expired), 0600); err != nil {
+			t.Fatal(err)
+		}
+		// Every goroutine finds the same expired lock file, but only one
+		// of them may take it over; the others wait until they time out
+		// since the lock is not released until all of them are done.
+		var wg sync.WaitGroup
+		unlocks := make(chan func(), concurrency)
+		wg.Add(concurrency)
+		for j := 0; j < concurrency; j++ {
+			go func() {
+				defer wg.Done()
+				tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+				defer cancel()
+				if unlock, err := directory.LockFile(tctx, dir); err == nil {
+					unlocks <- unlock
+				}
+			}()
+		}
+		wg.Wait()
+		close(unlocks)
+		if got, want := len(unlocks), 1; got != want {
+			t.Errorf("%v: got %v, want %v: processes acquired the lock", i, got, want)
+		}
+		for unlock := range unlocks {
+			unlock()
+		}
+	}
+}
+
+func TestLockFileLease(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const lease = 100 * time.Millisecond
+	defer directory.SetLockLease(lease)()
+	unlock, err := directory.LockFile(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The lease is renewed for as long as the lock is held.
+	time.Sleep(5 * lease)
+	tctx, cancel := context.WithTimeout(ctx, 2*lease)
+	defer cancel()
+	if _, err := directory.LockFile(tctx, dir); err != context.DeadlineExceeded {
+		t.Fatalf("a lock held for longer than its lease was taken over: %v", err)
+	}
+	unlock()
+	unlock, err = directory.LockFile(ctx, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A lock file that has been replaced by another process's is left
+	// in place when released.
+	lockFile := filepath.Join(dir, ".lock")
+	other := fmt.Sprintf(`{"PID":1,"Host":"elsewhere","Expires":%q}`, time.Now().Add(time.Hour).Format(time.RFC3339Nano))
+	if err := ioutil.WriteFile(lockFile, []byte(other), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unlock()
+	if buf, err := ioutil.ReadFile(lockFile); err != nil || string(buf) != other {
+		t.Errorf("another process's lock file was removed or modified: %s: %v", buf, err)
+	}
+}
+
+func TestStepIndex(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithStepIndex())
+	id := mgr.SessionID("index")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionDir := filepath.Join(dir, id)
+	index := filepath.Join(sessionDir, ".index")
+	readIndex := func() []string {
+		buf, err := ioutil.ReadFile(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var states []struct{ Step string }
+		if err := json.Unmarshal(buf, &states); err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, state := range states {
+			names = append(names, state.Step)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	for _, step := range []string{"a", "b", "c"} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The index is created by the first call to Steps.
+	if _, err := os.Stat(index); !os.IsNotExist(err) {
+		t.Errorf("index should not exist yet: %v", err)
+	}
+	if got, want := stepNames(t, sess), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := readIndex(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// And is then updated incrementally.
+	if _, err := sess.Step(ctx, "d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Fail(ctx, "", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Delete(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readIndex(), []string{"b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(steps), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if steps[2].Failed.IsZero() || steps[2].Reason != "oops" {
+		t.Errorf("step was not marked as failed: %v", steps[2])
+	}
+
+	// A stale index, ie. one that does not refer to exactly the existing
+	// step files, is rebuilt.
+	legacy := filepath.Join(sessionDir, "legacy")
+	now := time.Now().Add(time.Minute)
+	buf := fmt.Sprintf(`{"Step":"legacy","StepFile":%q,"Created":%q,"Completed":%q}`,
+		legacy, now.Format(time.RFC3339Nano), now.Add(time.Second).Format(time.RFC3339Nano))
+	if err := ioutil.WriteFile(legacy, []byte(buf), 0400); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(sessionDir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stepNames(t, sess), []string{"c", "d", "legacy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := readIndex(), []string{"c", "d", "legacy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Compacted steps are removed from the index.
+	if err := sess.(checkpointstate.Compactor).Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readIndex(), []string{"d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stepNames(t, sess), []string{"c", "d", "legacy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func BenchmarkSteps(b *testing.B) {
+	ctx := context.Background()
+	const nsteps = 1000
+	for _, bm := range []struct {
+		name string
+		opts []directory.Option
+	}{
+		{"walk", nil},
+		{"index", []directory.Option{directory.WithStepIndex()}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "local-file")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			mgr := directory.NewManager(dir, bm.opts...)
+			sess, err := mgr.Use(ctx, mgr.SessionID("benchmark"), true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < nsteps; i++ {
+				if _, err := sess.Step(ctx, fmt.Sprintf("s%04d", i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if got, want := len(stepNames(b, sess)), nsteps; got != want {
+				b.Fatalf("got %v, want %v", got, want)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := sess.Steps(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestStepFastPath(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The results are the same whether or not the fast path is used.
+	for _, fast := range []bool{true, false} {
+		mgr := directory.NewManager(dir, directory.WithFastPath(fast))
+		sess, err := mgr.Use(ctx, mgr.SessionID("fast", fmt.Sprint(fast)), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range []string{"a", "b", ""} {
+			if _, err := sess.Step(ctx, step); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// A completed step must still complete an in-progress step.
+		if done, err := sess.Step(ctx, "c"); err != nil || done {
+			t.Fatalf("c: %v, %v", done, err)
+		}
+		if done, err := sess.Step(ctx, "a"); err != nil || !done {
+			t.Fatalf("a: %v, %v", done, err)
+		}
+		if got, want := stepNames(t, sess), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// Nor may it be used to bypass a seal.
+		if err := sess.(checkpointstate.Sealer).Seal(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sess.Step(ctx, "a"); !errors.Is(err, checkpointstate.ErrSealed) {
+			t.Errorf("unexpected or missing error: %v", err)
+		}
+	}
+}
+
+func BenchmarkCompletedStep(b *testing.B) {
+	ctx := context.Background()
+	const nsteps = 100
+	for _, bm := range []struct {
+		name string
+		fast bool
+	}{
+		{"locked", false},
+		{"fast", true},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "local-file")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			mgr := directory.NewManager(dir, directory.WithFastPath(bm.fast))
+			id := mgr.SessionID("benchmark")
+			sess, err := mgr.Use(ctx, id, true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for i := 0; i < nsteps; i++ {
+				if _, err := sess.Step(ctx, fmt.Sprintf("s%04d", i)); err != nil {
+					b.Fatal(err)
+				}
+			}
+			if _, err := sess.Step(ctx, ""); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				done, err := sess.Step(ctx, fmt.Sprintf("s%04d", i%nsteps))
+				if err != nil || !done {
+					b.Fatalf("%v, %v", done, err)
+				}
+			}
+		})
+	}
+}
+
+func TestMetadataCache(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithMetadataCache())
+	id := mgr.SessionID("cache")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(want map[string]interface{}) {
+		_, file, line, _ := runtime.Caller(1)
+		loc := fmt.Sprintf("%v:%v", filepath.Base(file), line)
+		got, err := sess.Metadata(ctx)
+		if err != nil {
+			t.Fatalf("%v: %v", loc, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", loc, got, want)
+		}
+	}
+	expect(nil)
+	md := map[string]interface{}{"Tags": []interface{}{"a"}}
+	if err := sess.SetMetadata(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+	expect(md)
+
+	// Modifying the returned metadata does not modify the cached copy.
+	cached, err := sess.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached["Tags"].([]interface{})[0] = "modified"
+	cached["New"] = true
+	expect(md)
+
+	// SetMetadata invalidates the cache.
+	md = map[string]interface{}{"Tags": []interface{}{"a", "b"}}
+	if err := sess.SetMetadata(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+	expect(md)
+
+	// As do writes via other sessions.
+	other, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md = map[string]interface{}{"Tags": []interface{}{"a", "b", "c"}}
+	if err := other.SetMetadata(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+	expect(md)
+}
+
+func BenchmarkMetadata(b *testing.B) {
+	ctx := context.Background()
+	md := map[string]interface{}{}
+	for i := 0; i < 100; i++ {
+		md[fmt.Sprintf("key%03d", i)] = []interface{}{"a", "b", fmt.Sprintf("%v", i)}
+	}
+	for _, bm := range []struct {
+		name string
+		opts []directory.Option
+	}{
+		{"uncached", nil},
+		{"cached", []directory.Option{directory.WithMetadataCache()}},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "local-file")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			mgr := directory.NewManager(dir, bm.opts...)
+			sess, err := mgr.Use(ctx, mgr.SessionID("benchmark"), true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := sess.SetMetadata(ctx, md); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := sess.Metadata(ctx); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMissingRoot(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "a", "b")
+	mgr := directory.NewManager(root)
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Fatalf("%v should not exist: %v", root, err)
+	}
+
+	// Read-only operations treat a missing root as having no sessions.
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids, []string{}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	err = mgr.Walk(ctx, func(id string, sess checkpointstate.Session) error {
+		t.Errorf("unexpected session: %v", id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := mgr.SessionID("missing")
+	if _, err := mgr.Use(ctx, id, false); err != checkpointstate.ErrNoSuchSession {
+		t.Errorf("got %v, want %v", err, checkpointstate.ErrNoSuchSession)
+	}
+	if _, err := os.Stat(root); !os.IsNotExist(err) {
+		t.Fatalf("%v should not exist: %v", root, err)
+	}
+
+	// Creating a session creates the root.
+	if _, err := mgr.Use(ctx, id, true); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err = mgr.List(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids, []string{id}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStepHook(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	type event struct {
+		id   string
+		step checkpointstate.Step
+	}
+	var events []event
+	var mgr checkpointstate.Manager
+	mgr = directory.NewManager(dir, directory.WithStepHook(func(id string, step checkpointstate.Step) {
+		events = append(events, event{id, step})
+		// The session's lock must have been released.
+		sess, err := mgr.Use(ctx, id, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.SetStepMetadata(ctx, step.Name, map[string]interface{}{"hooked": true}); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	id := mgr.SessionID("hooks")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"a", "b", "a", ""} {
+		if _, err := sess.Step(ctx, step, checkpointstate.WithArtifact("out", step)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sess.Fail(ctx, "c", "failed"); err != nil {
+		t.Fatal(err)
+	}
+	// Only completed steps are reported, b is implicitly completed by
+	// the second call for a.
+	if got, want := len(events), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, want := range []struct {
+		name      string
+		artifacts map[string]string
+	}{
+		{"a", map[string]string{"out": "a"}},
+		{"b", map[string]string{"out": "b"}},
+	} {
+		ev := events[i]
+		if got := ev.id; got != id {
+			t.Errorf("%v: got %v, want %v", i, got, id)
+		}
+		if got := ev.step.Name; got != want.name {
+			t.Errorf("%v: got %v, want %v", i, got, want.name)
+		}
+		if ev.step.Completed.IsZero() || ev.step.Completed.Before(ev.step.Created) {
+			t.Errorf("%v: bad times: %v, %v", i, ev.step.Created, ev.step.Completed)
+		}
+		if got := ev.step.Artifacts; !reflect.DeepEqual(got, want.artifacts) {
+			t.Errorf("%v: got %v, want %v", i, got, want.artifacts)
+		}
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range steps[:2] {
+		if got, want := step.Metadata["hooked"], true; got != want {
+			t.Errorf("%v: got %v, want %v", step.Name, got, want)
+		}
+	}
+}
+
+func TestSquash(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithStepIndex())
+	sess, err := mgr.Use(ctx, mgr.SessionID("squash"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step := func(name string, done bool) {
+		ok, err := sess.Step(ctx, name, checkpointstate.WithArtifact(name, "out"))
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if got, want := ok, done; got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+	}
+	step("a", false)
+	step("b", false)
+	// Squashed steps may be compacted.
+	if err := sess.(checkpointstate.Compactor).Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	step("c", false)
+	step("d", false)
+	original, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	squasher := sess.(checkpointstate.Squasher)
+	for _, tc := range []struct {
+		name  string
+		steps []string
+		err   string
+	}{
+		{"all", []string{"a", "d"}, "step d is in progress"},
+		{"all", []string{"a", "x"}, "step x has not been completed"},
+		{"b", []string{"a"}, "step b already exists"},
+		{"d", []string{"a"}, "step d is in progress"},
+		{"", []string{"a"}, "invalid step name"},
+	} {
+		if err := squasher.Squash(ctx, tc.name, tc.steps...); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v %v: missing or unexpected error: %v", tc.name, tc.steps, err)
+		}
+	}
+
+	if err := squasher.Squash(ctx, "build", "c", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stepNames(t, sess), []string{"build", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build := steps[0]
+	if got, want := build.Created, original[0].Created; !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := build.Completed, original[2].Completed; !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := build.Artifacts, map[string]string{"a": "out", "b": "out", "c": "out"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A squash may reuse the name of one of the squashed steps.
+	step("e", false)
+	if err := squasher.Squash(ctx, "build", "build", "d"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stepNames(t, sess), []string{"build", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The squashed steps no longer exist, the new one is complete.
+	if sess, err = mgr.Use(ctx, mgr.SessionID("squash"), true); err != nil {
+		t.Fatal(err)
+	}
+	step("build", true)
+	step("a", false)
+}
+
+func TestReorder(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithStepIndex())
+	sess, err := mgr.Use(ctx, mgr.SessionID("reorder"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"fetch", "build", "test"} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reordered steps may be compacted.
+	if err := sess.(checkpointstate.Compactor).Compact(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Step(ctx, "deploy"); err != nil {
+		t.Fatal(err)
+	}
+	reorderer := sess.(checkpointstate.Reorderer)
+	for _, tc := range []struct {
+		steps []string
+		err   string
+	}{
+		{[]string{"deploy"}, "step deploy is in progress"},
+		{[]string{"build", "build"}, "step build is specified more than once"},
+		{[]string{"lint"}, "step lint does not exist"},
+	} {
+		if err := reorderer.Reorder(ctx, tc.steps...); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: missing or unexpected error: %v", tc.steps, err)
+		}
+	}
+	for _, tc := range []struct {
+		steps []string
+		want  []string
+	}{
+		{[]string{"test", "build", "fetch"}, []string{"test", "build", "fetch", "deploy"}},
+		// Unordered steps follow the ordered ones, in order of creation.
+		{[]string{"build"}, []string{"build", "fetch", "test", "deploy"}},
+		{nil, []string{"fetch", "build", "test", "deploy"}},
+	} {
+		if err := reorderer.Reorder(ctx, tc.steps...); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := stepNames(t, sess), tc.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", tc.steps, got, want)
+		}
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	newKey := []byte("fedcba9876543210fedcba9876543210")
+
+	use := func(opts ...directory.Option) checkpointstate.Session {
+		mgr := directory.NewManager(dir, opts...)
+		sess, err := mgr.Use(ctx, mgr.SessionID("encrypted"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+	// grep returns the files in the session that contain s.
+	grep := func(s string) []string {
+		var found []string
+		for _, filename := range list(dir) {
+			if buf, err := ioutil.ReadFile(filename); err == nil && strings.Contains(string(buf), s) {
+				found = append(found, filepath.Base(filename))
+			}
+		}
+		return found
+	}
+
+	// A session written before encryption was enabled.
+	mgr := directory.NewManager(dir)
+	sess, err := mgr.Use(ctx, mgr.SessionID("encrypted"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"plaintext", ""} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sess = use(directory.WithEncryptionKey(oldKey))
+	if err := sess.SetMetadata(ctx, map[string]interface{}{"secret": "hunter2"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"old-secret", ""} {
+		if _, err := sess.Step(ctx, step, checkpointstate.WithArtifact("token", "hunter2")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := grep("hunter2"); len(got) != 0 {
+		t.Errorf("plaintext found in: %v", got)
+	}
+	if got, want := grep(directory.KeyID(oldKey)), []string{"metadata", "old-secret"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Rotate the key, files written with the old key remain readable.
+	sess = use(directory.WithEncryptionKey(newKey), directory.WithDecryptionKey(oldKey))
+	if _, err := sess.Step(ctx, "new-secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Step(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := grep(directory.KeyID(newKey)), []string{"new-secret"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	md, err := sess.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md["secret"], "hunter2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(steps), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := steps[0].Name, "plaintext"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := steps[1].Artifacts["token"], "hunter2"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Encrypted files cannot be read without the key used to encrypt them.
+	for _, opts := range [][]directory.Option{
+		nil,
+		{directory.WithEncryptionKey(newKey)},
+	} {
+		sess := use(opts...)
+		if _, err := sess.Steps(ctx); err == nil || !strings.Contains(err.Error(), "has not been supplied") {
+			t.Errorf("missing or unexpected error: %v", err)
+		}
+	}
+	sess = use(directory.WithEncryptionKey(oldKey))
+	if _, err := sess.Metadata(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestCompletionLog(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithCompletionLog())
+	id := mgr.SessionID("log")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"b", "a", "with space", "b", "c", ""} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Failed and aborted steps are not logged.
+	if err := sess.Fail(ctx, "d", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Step(ctx, "e"); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Abort(ctx); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, id, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	var names []string
+	var prev time.Time
+	for _, line := range lines {
+		parts := strings.SplitN(line, " ", 2)
+		completed, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			t.Fatalf("%v: %v", line, err)
+		}
+		if completed.Before(prev) {
+			t.Errorf("%v: out of order", line)
+		}
+		prev = completed
+		rest := parts[1]
+		idx := strings.LastIndex(rest, " ")
+		names = append(names, rest[:idx])
+		if _, err := time.ParseDuration(rest[idx+1:]); err != nil {
+			t.Errorf("%v: %v", line, err)
+		}
+	}
+	if got, want := names, []string{`"b"`, `"a"`, `"with space"`, `"c"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stepNames(t, sess), []string{"b", "a", "with space", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// A file named log is that of a step, written before step file names
+	// were encoded, when the completion log is not enabled.
+	mgr = directory.NewManager(dir)
+	id = mgr.SessionID("no-log")
+	sess, err = mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"log", ""} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Rename(filepath.Join(dir, id, directory.StepFileName("log")), filepath.Join(dir, id, "log")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stepNames(t, sess), []string{"log"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestInterruptedWrite(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	id := mgr.SessionID("interrupted")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := map[string]interface{}{"ID": id}
+	if err := sess.SetMetadata(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"a", "b"} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restore := directory.SetBeforeRename(func(string) error {
+		return fmt.Errorf("interrupted")
+	})
+	if _, err := sess.Step(ctx, "c"); err == nil || err.Error() != "interrupted" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if err := sess.SetMetadata(ctx, map[string]interface{}{"ID": "changed"}); err == nil || err.Error() != "interrupted" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	restore()
+
+	// The interrupted writes must have left no trace.
+	for _, name := range list(dir) {
+		if strings.HasPrefix(filepath.Base(name), ".") {
+			t.Errorf("temporary file %v was not removed", name)
+		}
+	}
+	got, err := sess.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := md; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(steps), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if steps[0].Completed.IsZero() || !steps[1].Completed.IsZero() {
+		t.Errorf("unexpected steps: %v", steps)
+	}
+
+	// and the session remains usable.
+	if _, err := sess.Step(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stepNames(t, sess), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRawDump(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	id := mgr.SessionID("raw")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.SetMetadata(ctx, map[string]interface{}{"ID": id}); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"a", "b"} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A corrupt step file is included as is.
+	corrupt := []byte("{not json")
+	if err := ioutil.WriteFile(filepath.Join(dir, id, "corrupt"), corrupt, 0400); err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join(dir, id, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := sess.(checkpointstate.RawDumper).RawDump(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	contents := map[string][]byte{}
+	modes := map[string]os.FileMode{}
+	for _, f := range files {
+		names = append(names, f.Name)
+		contents[f.Name] = f.Contents
+		modes[f.Name] = f.Mode
+	}
+	if got, want := names, []string{"a", "corrupt", "in-progress", "metadata"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := contents["a"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := contents["corrupt"], corrupt; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got, want := modes["a"], os.FileMode(0400); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !strings.Contains(string(contents["in-progress"]), `"Step":"b"`) {
+		t.Errorf("unexpected in-progress file: %s", contents["in-progress"])
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithStepIndex())
+	newSession := func(name string) (string, checkpointstate.Session) {
+		id := mgr.SessionID(name)
+		sess, err := mgr.Use(ctx, id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.SetMetadata(ctx, map[string]interface{}{"ID": id}); err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range []string{"a", "b", "c", "d"} {
+			if _, err := sess.Step(ctx, step); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return filepath.Join(dir, id), sess
+	}
+	verify := func(sess checkpointstate.Session, fix bool) []string {
+		t.Helper()
+		problems, err := sess.(checkpointstate.Verifier).Verify(ctx, fix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out []string
+		for _, p := range problems {
+			out = append(out, fmt.Sprintf("%v: %v: %v", p.File, p.Fixed, p.Description))
+		}
+		return out
+	}
+	write := func(filename, contents string) {
+		os.Remove(filename)
+		if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, sess := newSession("consistent")
+	if got := verify(sess, false); len(got) != 0 {
+		t.Errorf("unexpected problems: %v", got)
+	}
+
+	// Seed each inconsistency.
+	session, sess := newSession("inconsistent")
+	write(filepath.Join(session, ".a.123456"), "partial")
+	write(filepath.Join(session, "a"), "{not json")
+	buf, err := ioutil.ReadFile(filepath.Join(session, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(session, "b"), strings.Replace(string(buf), session, "/elsewhere", 1))
+	write(filepath.Join(session, "c"), strings.Replace(string(buf), `"Step":"b"`, `"Step":"x"`, 1))
+	buf, err = ioutil.ReadFile(filepath.Join(session, "in-progress"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(session, "in-progress"), strings.Replace(string(buf), session, "/elsewhere", 1))
+	write(filepath.Join(session, "metadata"), `{"ID":"wrong"}`)
+	write(filepath.Join(session, ".index"), "{not json")
+
+	want := []string{
+		`.a.123456: false: temporary file left by an interrupted write`,
+		`.index: false: failed to parse index: invalid character`,
+		`a: false: failed to parse step: invalid character 'n'`,
+		`b: false: step is recorded as being stored in /elsewhere/b`,
+		`c: false: file records step x`,
+		`metadata: false: metadata records the session ID as wrong rather than ` + filepath.Base(session),
+		`in-progress: false: in-progress step d is recorded as being stored in /elsewhere/d`,
+	}
+	check := func(got, want []string) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		for i := range got {
+			if !strings.HasPrefix(got[i], want[i]) {
+				t.Errorf("got %v, want %v", got[i], want[i])
+			}
+		}
+	}
+	check(verify(sess, false), want)
+	for i := range want {
+		if strings.HasPrefix(want[i], "a:") || strings.HasPrefix(want[i], "c:") {
+			continue
+		}
+		want[i] = strings.Replace(want[i], ": false: ", ": true: ", 1)
+	}
+	check(verify(sess, true), want)
+	check(verify(sess, false), []string{
+		`a: false: failed to parse step`,
+		`c: false: file records step x`,
+	})
+	md, err := sess.Metadata(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := md["ID"], filepath.Base(session); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// An in-progress step that has already been completed.
+	session, sess = newSession("completed")
+	buf, err = ioutil.ReadFile(filepath.Join(session, "in-progress"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join(session, "in-progress"), strings.Replace(string(buf), `"Step":"d"`, `"Step":"a"`, 1))
+	check(verify(sess, true), []string{`in-progress: true: in-progress step a has already been completed`})
+	check(verify(sess, false), nil)
+	if _, err := os.Stat(filepath.Join(session, "in-progress")); !os.IsNotExist(err) {
+		t.Errorf("in-progress file was not removed: %v", err)
+	}
+}
+
+func TestStepReuse(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+
+	// newSession returns a session with step a in progress and the
+	// state recorded for it.
+	newSession := func(name string) (string, checkpointstate.Session, map[string]interface{}) {
+		id := mgr.SessionID(name)
+		sess, err := mgr.Use(ctx, id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sess.Step(ctx, "a"); err != nil {
+			t.Fatal(err)
+		}
+		session := filepath.Join(dir, id)
+		buf, err := ioutil.ReadFile(filepath.Join(session, "in-progress"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state map[string]interface{}
+		if err := json.Unmarshal(buf, &state); err != nil {
+			t.Fatal(err)
+		}
+		return session, sess, state
+	}
+	writeStep := func(filename string, state map[string]interface{}) {
+		buf, err := json.Marshal(state)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filename, buf, 0400); err != nil {
+			t.Fatal(err)
+		}
+	}
+	earlier := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)
+
+	// Completing step a was interrupted after its record was written
+	// but before the in-progress record was removed.
+	session, sess, state := newSession("interrupted")
+	state["Completed"] = time.Now().UTC().Format(time.RFC3339Nano)
+	writeStep(filepath.Join(session, "a"), state)
+	if _, err := sess.Step(ctx, "b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := stepNames(t, sess), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Requesting step a again, twice, after its completion was
+	// interrupted reports it as completed and discards the stale
+	// in-progress record without rewriting its completion time.
+	session, sess, state = newSession("interrupted-again")
+	state["Completed"] = time.Now().UTC().Format(time.RFC3339Nano)
+	writeStep(filepath.Join(session, "a"), state)
+	for i := 0; i < 2; i++ {
+		if done, err := sess.Step(ctx, "a"); err != nil || !done {
+			t.Errorf("%v: %v %v", i, done, err)
+		}
+	}
+	if current, err := sess.Current(ctx); err != nil || current != nil {
+		t.Errorf("unexpected current step: %v %v", current, err)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 1 || steps[0].Completed.UTC().Format(time.RFC3339Nano) != state["Completed"] {
+		t.Errorf("unexpected steps: %v", steps)
+	}
+
+	// A record of an earlier, failed, attempt at step a was left behind.
+	session, sess, state = newSession("failed")
+	failed := map[string]interface{}{}
+	for k, v := range state {
+		failed[k] = v
+	}
+	failed["Created"], failed["Failed"], failed["Reason"] = earlier, earlier, "oops"
+	writeStep(filepath.Join(session, "a"), failed)
+	if _, err := sess.Step(ctx, "b"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	steps, err = sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || steps[0].Name != "a" || steps[0].Completed.IsZero() || !steps[0].Failed.IsZero() {
+		t.Errorf("unexpected steps: %v", steps)
+	}
+
+	// A different, completed, attempt at step a is still detected.
+	session, sess, state = newSession("reused")
+	state["Created"], state["Completed"] = earlier, earlier
+	writeStep(filepath.Join(session, "a"), state)
+	if _, err := sess.Step(ctx, "b"); err == nil || !strings.Contains(err.Error(), "is being reused") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestConcurrentSteps(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithStepIndex())
+	id := mgr.SessionID("concurrent")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inProgress := func() []string {
+		steps, err := sess.Steps(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, step := range steps {
+			if step.InProgress() {
+				names = append(names, step.Name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+	var all []string
+	for i := 0; i < 10; i++ {
+		all = append(all, fmt.Sprintf("s%v", i))
+	}
+	sort.Strings(all)
+
+	// All of the steps are in progress at the same time.
+	errs := make(chan error, len(all))
+	for _, step := range all {
+		go func(step string) {
+			_, err := sess.Step(ctx, step, checkpointstate.WithGroup("g"))
+			errs <- err
+		}(step)
+	}
+	for range all {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := inProgress(), all; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	markers := filepath.Join(dir, id, ".concurrent")
+	var files []string
+	for _, step := range all {
+		files = append(files, filepath.Join(markers, step))
+	}
+	if got, want := list(markers), files; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// And may be completed in any order.
+	for _, step := range all {
+		go func(step string) {
+			errs <- sess.Complete(ctx, step, checkpointstate.WithArtifact("step", step))
+		}(step)
+	}
+	for range all {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := inProgress(); len(got) != 0 {
+		t.Errorf("unexpected in-progress steps: %v", got)
+	}
+	if got := list(markers); len(got) != 0 {
+		t.Errorf("unexpected markers: %v", got)
+	}
+	for _, step := range all {
+		done, err := sess.Step(ctx, step, checkpointstate.WithGroup("g"))
+		if err != nil || !done {
+			t.Errorf("%v: unexpected result: %v, %v", step, done, err)
+		}
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range steps {
+		if got, want := step.Artifacts["step"], step.Name; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := step.Group, "g"; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	problems, err := sess.(checkpointstate.Verifier).Verify(ctx, false)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("unexpected result: %v, %v", problems, err)
+	}
+
+	// Markers left behind by a crashed process are removed by ForceUnlock.
+	if _, err := sess.Step(ctx, "crashed", checkpointstate.WithGroup("g")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.(checkpointstate.LockInspector).ForceUnlock(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if got := inProgress(); len(got) != 0 {
+		t.Errorf("unexpected in-progress steps: %v", got)
+	}
+}
+
+func TestFlockUnsupported(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer directory.SetFlock(func(fd, how int) error {
+		return unix.ENOTSUP
+	})()
+
+	// flock failing with ENOTSUP falls back to lock files.
 	mgr := directory.NewManager(dir)
-	ids, err := mgr.List(ctx)
+	id := mgr.SessionID("unsupported")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"a", "b"} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lockFile := filepath.Join(dir, id, ".lock")
+	if _, err := os.Stat(lockFile); !os.IsNotExist(err) {
+		t.Errorf("lock file was not removed: %v", err)
+	}
+	host, _ := os.Hostname()
+	buf := fmt.Sprintf(`{"PID":%v,"Host":%q,"Expires":%q}`, os.Getpid(), host, time.Now().Add(time.Minute).Format(time.RFC3339Nano))
+	if err := ioutil.WriteFile(lockFile, []byte(buf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	inspector := mgr.(checkpointstate.LockInspector)
+	if locked, err := inspector.Locked(ctx, id); err != nil || !locked {
+		t.Errorf("unexpected result: %v, %v", locked, err)
+	}
+	tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := sess.Step(tctx, "c"); err != context.DeadlineExceeded {
+		t.Errorf("the lock file was ignored: %v", err)
+	}
+
+	// Any other error is still fatal.
+	defer directory.SetFlock(func(fd, how int) error {
+		return unix.EIO
+	})()
+	os.Remove(lockFile)
+	sess, err = directory.NewManager(dir).Use(ctx, id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Step(ctx, "c"); err != unix.EIO {
+		t.Errorf("unexpected or missing error: %v", err)
+	}
+
+	// No locks are acquired when locking is disabled.
+	if err := ioutil.WriteFile(lockFile, []byte(buf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	unlocked := directory.NewManager(dir, directory.WithoutLocking())
+	sess, err = unlocked.Use(ctx, id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Step(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if locked, err := unlocked.(checkpointstate.LockInspector).Locked(ctx, id); err != nil || locked {
+		t.Errorf("unexpected result: %v, %v", locked, err)
+	}
+}
+
+func TestSharedLock(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithStepIndex())
+	id := mgr.SessionID("shared")
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.SetMetadata(ctx, map[string]interface{}{"a": "b"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"a", "b"} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Build the index so that reading the steps needs no exclusive lock.
+	stepNames(t, sess)
+
+	// Hold a shared lock, as another reader would.
+	f, err := os.Open(filepath.Join(dir, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_SH); err != nil {
+		t.Fatal(err)
+	}
+	for i, fn := range []func(ctx context.Context) error{
+		func(ctx context.Context) error { _, err := sess.Metadata(ctx); return err },
+		func(ctx context.Context) error { _, err := sess.Steps(ctx); return err },
+		func(ctx context.Context) error { _, err := sess.StepMetadata(ctx, "a"); return err },
+		func(ctx context.Context) error {
+			return sess.(checkpointstate.StepWalker).WalkSteps(ctx, func(checkpointstate.Step) error { return nil })
+		},
+		func(ctx context.Context) error {
+			_, err := sess.(checkpointstate.Verifier).Verify(ctx, false)
+			return err
+		},
+	} {
+		tctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		err := fn(tctx)
+		cancel()
+		if err != nil {
+			t.Errorf("%v: reader was blocked by another reader: %v", i, err)
+		}
+	}
+	// Writers must still be excluded by readers.
+	tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := sess.SetMetadata(tctx, map[string]interface{}{"a": "c"}); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// And readers by writers.
+	if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	tctx, cancel = context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := sess.(checkpointstate.StepWalker).WalkSteps(tctx, func(checkpointstate.Step) error { return nil }); err != context.DeadlineExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, lockFiles := range []bool{false, true} {
+		var lockErrs []error
+		opts := []directory.Option{
+			directory.WithLockHook(func(dir string, wait time.Duration, err error) {
+				lockErrs = append(lockErrs, err)
+			}),
+		}
+		if lockFiles {
+			opts = append(opts, directory.WithLockFiles())
+		}
+		mgr := directory.NewManager(dir, opts...)
+		id := mgr.SessionID("timeout", fmt.Sprintf("%v", lockFiles))
+		sess, err := mgr.Use(ctx, id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Hold the lock, as another process would.
+		session := filepath.Join(dir, id)
+		release := func() {}
+		if lockFiles {
+			host, _ := os.Hostname()
+			buf := fmt.Sprintf(`{"PID":%v,"Host":%q,"Expires":%q}`, os.Getpid(), host, time.Now().Add(time.Minute).Format(time.RFC3339Nano))
+			if err := ioutil.WriteFile(filepath.Join(session, ".lock"), []byte(buf), 0600); err != nil {
+				t.Fatal(err)
+			}
+			release = func() { os.Remove(filepath.Join(session, ".lock")) }
+		} else {
+			f, err := os.Open(session)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := unix.Flock(int(f.Fd()), unix.LOCK_EX); err != nil {
+				t.Fatal(err)
+			}
+			release = func() { f.Close() }
+		}
+		tctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		start := time.Now()
+		_, err = sess.Step(tctx, "a")
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("lock files %v: unexpected error: %v", lockFiles, err)
+		}
+		if time.Since(start) > 10*time.Second {
+			t.Errorf("lock files %v: the lock was not abandoned", lockFiles)
+		}
+		// The lock hook observes the failure to acquire the lock.
+		if n := len(lockErrs); n == 0 || lockErrs[n-1] != context.DeadlineExceeded {
+			t.Errorf("lock files %v: unexpected lock errors: %v", lockFiles, lockErrs)
+		}
+		release()
+		if _, err := sess.Step(ctx, "a"); err != nil {
+			t.Errorf("lock files %v: unexpected error: %v", lockFiles, err)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Seed a session in the format used before it was versioned, with
+	// timestamps that are not in UTC, step file locations from before
+	// the store was moved and a step stored under a name that is now
+	// encoded.
+	session := filepath.Join(dir, "old")
+	if err := os.Mkdir(session, 0700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name, contents string, perm os.FileMode) {
+		if err := ioutil.WriteFile(filepath.Join(session, name), []byte(contents), perm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("metadata", `{"ID":"old"}`, 0600)
+	write("a", `{"Step":"a","StepFile":"/moved/old/a","Created":"2020-06-01T10:00:00.5+02:00","Completed":"2020-06-01T10:01:00+02:00"}`, 0400)
+	write("x:y", `{"Step":"x:y","StepFile":"/moved/old/x:y","Created":"2020-06-01T10:01:30+02:00","Completed":"2020-06-01T10:01:40+02:00"}`, 0400)
+	write("in-progress", `{"Step":"b","StepFile":"/moved/old/b","Created":"2020-06-01T10:02:00+02:00","Completed":""}`, 0600)
+	write("compacted", `[{"Step":"z","StepFile":"/moved/old/z","Created":"2020-06-01T09:00:00+05:00","Completed":"2020-06-01T09:30:00+05:00"}]`, 0400)
+
+	mgr := directory.NewManager(dir)
+	migrator := mgr.(checkpointstate.Migrator)
+	version := func(mgr checkpointstate.Manager) int {
+		t.Helper()
+		store, current, err := mgr.(checkpointstate.Migrator).FormatVersion(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := current, 2; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		return store
+	}
+	if got, want := version(mgr), 0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	migrated, err := migrator.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := migrated, []string{"old"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := version(mgr), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(session, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf), `{"Step":"a","StepFile":"`+filepath.Join(session, "a")+`","Created":"2020-06-01T08:00:00.5Z","Completed":"2020-06-01T08:01:00Z"}`; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	sess, err := mgr.Use(ctx, "old", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, step := range steps {
+		names = append(names, step.Name)
+	}
+	if got, want := names, []string{"z", "a", "x:y", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := steps[1].Created, time.Date(2020, 6, 1, 8, 0, 0, 5e8, time.UTC); !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(session, "x%3Ay")); err != nil {
+		t.Errorf("step was not renamed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(session, "x:y")); !os.IsNotExist(err) {
+		t.Errorf("step was not renamed: %v", err)
+	}
+	problems, err := sess.(checkpointstate.Verifier).Verify(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+
+	// The in-progress step is completed in its new location.
+	if _, err := sess.Step(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(session, "b")); err != nil {
+		t.Errorf("in-progress step was not completed: %v", err)
+	}
+
+	// Migration is idempotent.
+	migrated, err = migrator.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrated) != 0 {
+		t.Errorf("unexpected migration: %v", migrated)
+	}
+
+	// New stores are created with the current version.
+	newDir := filepath.Join(dir, "new")
+	mgr = directory.NewManager(newDir)
+	if got, want := version(mgr), 2; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := mgr.Use(ctx, "new", true); err != nil {
+		t.Fatal(err)
+	}
+	buf, err = ioutil.ReadFile(filepath.Join(newDir, ".version"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf), "2\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestShardedLayout(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ids := []string{"a", "ab", "abc", "xyz"}
+	create := func(mgr checkpointstate.Manager) {
+		t.Helper()
+		for _, id := range ids {
+			sess, err := mgr.Use(ctx, id, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sess.SetMetadata(ctx, map[string]interface{}{"ID": id}); err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range []string{"s1", "s2"} {
+				if _, err := sess.Step(ctx, step); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	check := func(mgr checkpointstate.Manager, ids ...string) {
+		t.Helper()
+		got, err := mgr.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, ids) {
+			t.Errorf("got %v, want %v", got, ids)
+		}
+		for _, id := range ids {
+			sess, err := mgr.Use(ctx, id, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			md, err := sess.Metadata(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := md["ID"], id; got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			steps, err := sess.Steps(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(steps), 2; got != want || steps[1].Name != "s2" || !steps[1].InProgress() {
+				t.Errorf("%v: unexpected steps: %v", id, steps)
+			}
+			problems, err := sess.(checkpointstate.Verifier).Verify(ctx, false)
+			if err != nil || len(problems) != 0 {
+				t.Errorf("%v: unexpected problems: %v, %v", id, problems, err)
+			}
+		}
+	}
+
+	// New stores are sharded, using the first two characters of each ID,
+	// and may be read without requesting the sharded layout.
+	sharded := filepath.Join(dir, "sharded")
+	mgr := directory.NewManager(sharded, directory.WithShardedLayout())
+	create(mgr)
+	check(mgr, ids...)
+	check(directory.NewManager(sharded), ids...)
+	for _, path := range []string{"a/a", "ab/ab", "ab/abc", "xy/xyz"} {
+		if fi, err := os.Stat(filepath.Join(sharded, path)); err != nil || !fi.IsDir() {
+			t.Errorf("%v: missing session directory: %v", path, err)
+		}
+	}
+	if locked, err := mgr.(checkpointstate.LockInspector).Locked(ctx, "abc"); err != nil || locked {
+		t.Errorf("unexpected result: %v, %v", locked, err)
+	}
+	sess, err := mgr.Use(ctx, "abc", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check(mgr, "a", "ab", "xyz")
+
+	// Unsharded stores are not sharded until they are migrated.
+	flat := filepath.Join(dir, "flat")
+	create(directory.NewManager(flat))
+	mgr = directory.NewManager(flat, directory.WithShardedLayout())
+	if _, err := mgr.Use(ctx, "new", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(flat, "new")); err != nil {
+		t.Errorf("session was not created in the unsharded layout: %v", err)
+	}
+	migrated, err := mgr.(checkpointstate.Migrator).Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := migrated, []string{"a", "ab", "abc", "new", "xyz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(flat, "ne", "new")); err != nil {
+		t.Errorf("session was not sharded: %v", err)
+	}
+	if sess, err = mgr.Use(ctx, "new", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	check(directory.NewManager(flat), "a", "ab", "abc", "xyz")
+	migrated, err = mgr.(checkpointstate.Migrator).Migrate(ctx)
+	if err != nil || len(migrated) != 0 {
+		t.Errorf("unexpected migration: %v, %v", migrated, err)
+	}
+
+	// A store whose root cannot be read is not marked as sharded, which
+	// would hide the sessions that could not be moved.
+	unreadable := filepath.Join(dir, "unreadable")
+	create(directory.NewManager(unreadable))
+	restore := directory.SetReadDir(func(dir string) ([]os.FileInfo, error) {
+		if dir == unreadable {
+			return nil, unix.EIO
+		}
+		return ioutil.ReadDir(dir)
+	})
+	mgr = directory.NewManager(unreadable, directory.WithShardedLayout())
+	if _, err := mgr.(checkpointstate.Migrator).Migrate(ctx); err == nil || !strings.Contains(err.Error(), "input/output error") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	restore()
+	if _, err := os.Stat(filepath.Join(unreadable, ".sharded")); !os.IsNotExist(err) {
+		t.Errorf("store was marked as sharded: %v", err)
+	}
+	check(directory.NewManager(unreadable), ids...)
+
+	// An interrupted migration is completed by the next one, even if the
+	// sharded layout is no longer requested.
+	interrupted := filepath.Join(dir, "interrupted")
+	create(directory.NewManager(interrupted))
+	if err := os.Mkdir(filepath.Join(interrupted, ".sharding"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a", "ab", "xyz"} {
+		if err := os.Rename(filepath.Join(interrupted, id), filepath.Join(interrupted, ".sharding", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(interrupted, "ab"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(interrupted, "abc"), filepath.Join(interrupted, "ab", "abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(interrupted, ".sharded"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mgr = directory.NewManager(interrupted)
+	migrated, err = mgr.(checkpointstate.Migrator).Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := migrated, []string{"a", "ab", "xyz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(interrupted, ".sharding")); !os.IsNotExist(err) {
+		t.Errorf("staging directory was not removed: %v", err)
+	}
+	listed, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listed, ids) {
+		t.Errorf("got %v, want %v", listed, ids)
+	}
+}
+
+func TestInit(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "a", "store")
+	mgr := directory.NewManager(root)
+	for i := 0; i < 2; i++ {
+		location, err := mgr.(checkpointstate.Initializer).Init(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := location, root; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		info, err := os.Stat(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := info.Mode().Perm(), os.FileMode(0700); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		store, current, err := mgr.(checkpointstate.Migrator).FormatVersion(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if store != current {
+			t.Errorf("got %v, want %v", store, current)
+		}
+	}
+}
+
+func TestStepFileNames(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		key, name string
+	}{
+		{"simple-name_1.0", "simple-name_1.0"},
+		{"build & test (stage 1)", "build & test (stage 1)"},
+		{"a/b\\c", "a%2Fb%5Cc"},
+		{"100%", "100%25"},
+		{".hidden", "%2Ehidden"},
+		{"..", "%2E%2E"},
+		{" padded ", "%20padded%20"},
+		{"trailing.", "trailing%2E"},
+		{"metadata", "%6Detadata"},
+		{"metadata.old", "metadata.old"},
+		{"in-progress", "%69n-progress"},
+		{"a:b*c?", "a%3Ab%2Ac%3F"},
+		{"naïve", "na%C3%AFve"},
+		{"tab\t", "tab%09"},
+	} {
+		if got, want := directory.StepFileName(tc.key), tc.name; got != want {
+			t.Errorf("%q: got %v, want %v", tc.key, got, want)
+		}
+		key, err := url.PathUnescape(tc.name)
+		if err != nil {
+			t.Errorf("%q: %v", tc.key, err)
+		}
+		if got, want := key, tc.key; got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithStepIndex())
+	sess, err := mgr.Use(ctx, "names", true)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got, want := ids, []string{}; !reflect.DeepEqual(got, want) {
+	names := []string{"a/b", "metadata", "日本語"}
+	for _, name := range names {
+		if _, err := sess.Step(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := sess.Step(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a%2Fb", "%6Detadata", "%E6%97%A5%E6%9C%AC%E8%AA%9E"} {
+		if _, err := os.Stat(filepath.Join(dir, "names", name)); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+	if got, want := stepNames(t, sess), names; !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
+	problems, err := sess.(checkpointstate.Verifier).Verify(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Errorf("unexpected problems: %v", problems)
+	}
+}
 
-	id := mgr.SessionID("a", "b")
-	sess, err := mgr.Use(ctx, id, true)
+func TestSymlinks(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "symlinks")
 	if err != nil {
 		t.Fatal(err)
 	}
-	now := time.Now()
-	md := map[string]interface{}{
-		"Input": []string{"a", "b"},
-		"ID":    id,
-		"Date":  now.Format(time.RFC3339),
+	defer os.RemoveAll(dir)
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+	mgr := directory.NewManager(root)
+	steps := func(sess checkpointstate.Session) []string {
+		t.Helper()
+		all, err := sess.Steps(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, step := range all {
+			names = append(names, step.Name)
+		}
+		return names
 	}
 
-	if err := sess.SetMetadata(ctx, md); err != nil {
+	// A session, outside of the store, to which symbolic links are made.
+	other := directory.NewManager(outside)
+	id := mgr.SessionID("session")
+	for _, m := range []checkpointstate.Manager{mgr, other} {
+		sess, err := m.Use(ctx, id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range []string{"a", "b", ""} {
+			if _, err := sess.Step(ctx, step); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	session := filepath.Join(root, id)
+	outsideSession := filepath.Join(outside, id)
+	outsideStep := filepath.Join(outsideSession, directory.StepFileName("b"))
+	before, err := ioutil.ReadFile(outsideStep)
+	if err != nil {
 		t.Fatal(err)
 	}
 
-	nmd, err := sess.Metadata(ctx)
+	// Symbolic links to a session outside of the store, and to the store
+	// itself, which would cause a walk that follows links to loop.
+	link := "linked-session"
+	if err := os.Symlink(outsideSession, filepath.Join(root, link)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(root, filepath.Join(root, "loop")); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := mgr.List(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if got, want := ids, []string{id}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, reset := range []bool{false, true} {
+		if _, err := mgr.Use(ctx, link, reset); err == nil || !strings.Contains(err.Error(), "is a symbolic link") {
+			t.Errorf("%v: expected a symbolic link error: %v", reset, err)
+		}
+	}
 
-	if got, want := len(nmd), len(md); got != want {
+	// A step file that is a symbolic link to one outside of the store.
+	linkedStep := directory.StepFileName("c")
+	if err := os.Symlink(filepath.Join(outsideSession, directory.StepFileName("a")), filepath.Join(session, linkedStep)); err != nil {
+		t.Fatal(err)
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := steps(sess), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
-	if got, want := nmd["ID"], md["ID"]; got != want {
+	if _, err := sess.Step(ctx, "c"); err == nil || !strings.Contains(err.Error(), "is a symbolic link") {
+		t.Errorf("expected a symbolic link error: %v", err)
+	}
+
+	problems, err := sess.(checkpointstate.Verifier).Verify(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(problems), 1; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, problems)
+	}
+	if got, want := problems[0].File, linkedStep; got != want || !problems[0].Fixed {
+		t.Errorf("got %v, want %v: %v", got, want, problems[0])
+	}
+	if _, err := os.Lstat(filepath.Join(session, linkedStep)); !os.IsNotExist(err) {
+		t.Errorf("symbolic link was not removed: %v", err)
+	}
+	if _, err := sess.Step(ctx, "c"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sess.Step(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := steps(sess), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 
-	id1 := mgr.SessionID("c")
-	_, err = mgr.Use(ctx, id1, true)
+	// Nothing outside of the store was modified.
+	after, err := ioutil.ReadFile(outsideStep)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("step file outside of the store was modified")
+	}
+	osess, err := other.Use(ctx, id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := steps(osess), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
 
-	ids, err = mgr.List(ctx)
+	// The root directory itself may be a symbolic link.
+	linkedRoot := filepath.Join(dir, "linked-root")
+	if err := os.Symlink(root, linkedRoot); err != nil {
+		t.Fatal(err)
+	}
+	ids, err = directory.NewManager(linkedRoot).List(ctx)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if got, want := ids, []string{id1, id}; !reflect.DeepEqual(got, want) {
+	if got, want := ids, []string{id}; !reflect.DeepEqual(got, want) {
 		t.Errorf("got %v, want %v", got, want)
 	}
 }
 
-func TestDirectory(t *testing.T) {
+func TestTrash(t *testing.T) {
 	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		opts []directory.Option
+	}{
+		{"flat", nil},
+		{"sharded", []directory.Option{directory.WithShardedLayout()}},
+		{"lockfiles", []directory.Option{directory.WithLockFiles()}},
+	} {
+		dir, err := ioutil.TempDir("", "local-file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		mgr := directory.NewManager(dir, tc.opts...)
+		trasher := mgr.(checkpointstate.Trasher)
+		id := mgr.SessionID("trash")
+		newSession := func(steps ...string) checkpointstate.Session {
+			sess, err := mgr.Use(ctx, id, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range append(steps, "") {
+				if _, err := sess.Step(ctx, step); err != nil {
+					t.Fatal(err)
+				}
+			}
+			return sess
+		}
+		trashedIDs := func() []string {
+			trashed, err := trasher.Trashed(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, s := range trashed {
+				ids = append(ids, s.ID)
+			}
+			return ids
+		}
 
-	fail := func(err error) {
-		_, file, line, _ := runtime.Caller(1)
-		loc := fmt.Sprintf("%v:%v", filepath.Base(file), line)
+		// Trashed sessions can no longer be used, but each copy is kept.
+		newSession("a")
+		if err := trasher.Trash(ctx, id); err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if _, err := mgr.Use(ctx, id, false); err != checkpointstate.ErrNoSuchSession {
+			t.Errorf("%v: unexpected or missing error: %v", tc.name, err)
+		}
+		newSession("b")
+		if err := trasher.Trash(ctx, id); err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if ids, err := mgr.List(ctx); err != nil || len(ids) != 0 {
+			t.Errorf("%v: unexpected result: %v, %v", tc.name, ids, err)
+		}
+		if got, want := trashedIDs(), []string{id, id}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", tc.name, got, want)
+		}
+		if err := trasher.Trash(ctx, id); err != checkpointstate.ErrNoSuchSession {
+			t.Errorf("%v: unexpected or missing error: %v", tc.name, err)
+		}
+
+		// The most recently trashed copy is restored, and only if the
+		// session does not already exist.
+		if err := trasher.Restore(ctx, id); err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		sess, err := mgr.Use(ctx, id, false)
 		if err != nil {
-			t.Errorf("%v: unexpected error: %v", loc, err)
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		if got, want := stepNames(t, sess), []string{"b"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", tc.name, got, want)
+		}
+		if _, err := sess.Step(ctx, "c"); err != nil {
+			t.Errorf("%v: restored session is not usable: %v", tc.name, err)
+		}
+		if err := trasher.Restore(ctx, id); err == nil || !strings.Contains(err.Error(), "already exists") {
+			t.Errorf("%v: unexpected or missing error: %v", tc.name, err)
+		}
+		if err := trasher.Restore(ctx, "missing"); err == nil || !strings.Contains(err.Error(), "is not in the trash") {
+			t.Errorf("%v: unexpected or missing error: %v", tc.name, err)
+		}
+
+		// Sealed sessions cannot be trashed.
+		if err := sess.(checkpointstate.Sealer).Seal(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := trasher.Trash(ctx, id); err != checkpointstate.ErrSealed {
+			t.Errorf("%v: unexpected or missing error: %v", tc.name, err)
+		}
+
+		// Emptying the trash deletes the remaining copy permanently.
+		deleted, err := trasher.EmptyTrash(ctx, "other")
+		if err != nil || len(deleted) != 0 {
+			t.Errorf("%v: unexpected result: %v, %v", tc.name, deleted, err)
+		}
+		deleted, err = trasher.EmptyTrash(ctx)
+		if err != nil || len(deleted) != 1 || deleted[0].ID != id {
+			t.Errorf("%v: unexpected result: %v, %v", tc.name, deleted, err)
+		}
+		if got := trashedIDs(); len(got) != 0 {
+			t.Errorf("%v: trash is not empty: %v", tc.name, got)
+		}
+		if err := trasher.Restore(ctx, id); err == nil {
+			t.Errorf("%v: expected an error", tc.name)
 		}
 	}
+}
 
+func TestPaths(t *testing.T) {
+	ctx := context.Background()
 	dir, err := ioutil.TempDir("", "local-file")
-	fail(err)
-
-	mgr := directory.NewManager(dir)
-	id := mgr.SessionID("/a/b/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir, directory.WithLockFiles())
+	id := mgr.SessionID("paths")
 	sess, err := mgr.Use(ctx, id, true)
-	fail(err)
-	if got, want := list(dir), []string{filepath.Join(dir, id)}; !reflect.DeepEqual(got, want) {
-		t.Errorf("got %v, want %v", got, want)
+	if err != nil {
+		t.Fatal(err)
 	}
-	var gotOk bool
-	var gotError error
-	var gotSteps []checkpointstate.Step
-
-	expect := func(ticked bool, err string) {
-		_, file, line, _ := runtime.Caller(1)
-		loc := fmt.Sprintf("%v:%v", filepath.Base(file), line)
-
-		if got, want := gotOk, ticked; got != want {
-			t.Errorf("%v: %v, want %v", loc, got, want)
+	if err := sess.SetMetadata(ctx, map[string]interface{}{"ID": id}); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"a", "b"} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
 		}
-		if len(err) == 0 {
-			if gotError != nil {
-				t.Errorf("%v: unexpected error: %v", loc, gotError)
-			}
-			return
+	}
+	if _, err := sess.Step(ctx, "c", checkpointstate.WithGroup("g")); err != nil {
+		t.Fatal(err)
+	}
+	paths, err := sess.(checkpointstate.PathLister).Paths(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := sess.(checkpointstate.RawDumper).RawDump(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(paths), len(files); got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, paths)
+	}
+	if !sort.StringsAreSorted(paths) {
+		t.Errorf("paths are not sorted: %v", paths)
+	}
+	// Each path exists, is within the session's directory and has the
+	// same contents as reported by RawDump.
+	contents := map[string][]byte{}
+	for _, f := range files {
+		contents[f.Name] = f.Contents
+	}
+	sessionDir := filepath.Join(dir, id)
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			t.Errorf("%v: is not an absolute path", path)
+		}
+		rel, err := filepath.Rel(sessionDir, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			t.Errorf("%v: is not within %v: %v", path, sessionDir, err)
+			continue
 		}
-		if got, want := gotError, err; !strings.Contains(got.Error(), err) {
-			t.Errorf("%v: %v does not contain %v", loc, got, want)
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("%v: %v", path, err)
+			continue
+		}
+		want, ok := contents[rel]
+		if !ok || !bytes.Equal(buf, want) {
+			t.Errorf("%v: got %s, want %s", rel, buf, want)
+		}
+	}
+	for _, name := range []string{"a", "b", "metadata", filepath.Join(".concurrent", "c")} {
+		if _, ok := contents[name]; !ok {
+			t.Errorf("%v: is missing from %v", name, paths)
 		}
 	}
+}
 
-	expectSteps := func(names ...string) {
-		_, file, line, _ := runtime.Caller(1)
-		loc := fmt.Sprintf("%v:%v", filepath.Base(file), line)
-		if gotError != nil {
-			t.Errorf("%v: unexpected error: %v", loc, gotError)
+func TestImplicitAck(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	current := func(sess checkpointstate.Session) string {
+		steps, err := sess.Steps(ctx)
+		if err != nil {
+			t.Fatal(err)
 		}
-		var gotNames []string
-		for _, v := range gotSteps {
-			gotNames = append(gotNames, v.Name)
+		for _, step := range steps {
+			if step.InProgress() && len(step.Group) == 0 {
+				return step.Name
+			}
 		}
-		if got, want := gotNames, names; !reflect.DeepEqual(got, want) {
-			t.Errorf("%v: got %v, want %v", loc, got, want)
+		return ""
+	}
+	step := func(sess checkpointstate.Session, name string, opts ...checkpointstate.StepOption) bool {
+		done, err := sess.Step(ctx, name, opts...)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
 		}
+		return done
 	}
 
-	gotSteps, gotError = sess.Steps(ctx)
-	expectSteps()
-
-	gotOk, gotError = sess.Step(ctx, "a")
-	expect(false, "")
-
-	gotSteps, gotError = sess.Steps(ctx)
-	expectSteps("a")
-
-	gotOk, gotError = sess.Step(ctx, "b")
-	expect(false, "")
-
-	gotSteps, gotError = sess.Steps(ctx)
-	expectSteps("a", "b")
-
-	gotOk, gotError = sess.Step(ctx, "a")
-	expect(true, "")
-
-	gotOk, gotError = sess.Step(ctx, "b")
-	expect(true, "")
-
-	sess, err = mgr.Use(ctx, id, true)
-	fail(err)
-
-	gotOk, gotError = sess.Step(ctx, "a")
-	expect(true, "")
-
-	gotOk, gotError = sess.Step(ctx, "b")
-	expect(true, "")
-
-	// make sure that reseting the current step can be overridden.
-	sess, err = mgr.Use(ctx, id, false)
-	fail(err)
-
-	gotOk, gotError = sess.Step(ctx, "c")
-	expect(false, "")
-
-	gotOk, gotError = sess.Step(ctx, "")
-	expect(true, "")
-
-	gotOk, gotError = sess.Step(ctx, "c")
-	expect(true, "")
-
-	sess.Delete(ctx)
-
-	sess, err = mgr.Use(ctx, id, true)
-	fail(err)
-
-	gotOk, gotError = sess.Step(ctx, "a")
-	expect(false, "")
-
-	gotOk, gotError = sess.Step(ctx, "b")
-	expect(false, "")
-
-	sess, err = mgr.Use(ctx, id, true)
-	fail(err)
-
-	gotOk, gotError = sess.Step(ctx, "a")
-	expect(true, "")
-
-	gotOk, gotError = sess.Step(ctx, "b")
-	expect(false, "")
-
-	gotOk, gotError = sess.Step(ctx, "")
-	expect(true, "")
+	// Starting a step completes the previous one by default.
+	implicit, err := directory.NewManager(dir).Use(ctx, "implicit", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step(implicit, "a")
+	step(implicit, "b")
+	if got, want := current(implicit), "b"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stepNames(t, implicit), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
 
-	sess, err = mgr.Use(ctx, id, true)
-	fail(err)
+	// With implicit acknowledgment disabled, steps must be completed
+	// explicitly.
+	explicit, err := directory.NewManager(dir, directory.WithImplicitAck(false)).Use(ctx, "explicit", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step(explicit, "a")
+	if _, err := explicit.Step(ctx, "b"); err == nil || !strings.Contains(err.Error(), "step a is in progress and must be completed") {
+		t.Errorf("unexpected or missing error: %v", err)
+	}
+	if got, want := current(explicit), "a"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Steps may be started in a group without completing the current step.
+	step(explicit, "g1", checkpointstate.WithGroup("g"))
+	if got, want := current(explicit), "a"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := explicit.Complete(ctx, "g1"); err != nil {
+		t.Fatal(err)
+	}
+	// An explicit acknowledgment completes the current step.
+	if !step(explicit, "") {
+		t.Errorf("the step was not completed")
+	}
+	if got, want := current(explicit), ""; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	step(explicit, "b")
+	if err := explicit.Complete(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	// Completed steps are reported as such whilst another is in progress.
+	step(explicit, "c")
+	if !step(explicit, "a") {
+		t.Errorf("a: was not reported as completed")
+	}
+	if got, want := current(explicit), "c"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := stepNames(t, explicit), []string{"a", "g1", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
 
-	gotOk, gotError = sess.Step(ctx, "a")
-	expect(true, "")
+func TestTransaction(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	sess, err := mgr.Use(ctx, "tx", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := func() checkpointstate.Tx {
+		tx, err := sess.(checkpointstate.Transactor).Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tx
+	}
+	step := func(tx checkpointstate.Tx, name string) bool {
+		done, err := tx.Step(ctx, name)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		return done
+	}
+	if done, err := sess.Step(ctx, "a"); err != nil || done {
+		t.Fatalf("a: %v %v", done, err)
+	}
+	if _, err := sess.Step(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
 
-	gotOk, gotError = sess.Step(ctx, "b")
-	expect(true, "")
+	// Steps completed within a transaction are not visible until it
+	// is committed.
+	tx := begin()
+	if !step(tx, "a") {
+		t.Errorf("a: should already be complete")
+	}
+	for _, name := range []string{"b", "c"} {
+		if step(tx, name) {
+			t.Errorf("%v: should not be complete", name)
+		}
+	}
+	if !step(tx, "b") {
+		t.Errorf("b: should be complete within the transaction")
+	}
+	if got, want := stepNames(t, sess), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stepNames(t, sess), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, name := range []string{"b", "c"} {
+		if done, err := sess.Step(ctx, name); err != nil || !done {
+			t.Errorf("%v: %v %v", name, done, err)
+		}
+	}
+	if err := tx.Commit(ctx); err != checkpointstate.ErrTxDone {
+		t.Errorf("unexpected or missing error: %v", err)
+	}
+	if err := tx.Rollback(ctx); err != checkpointstate.ErrTxDone {
+		t.Errorf("unexpected or missing error: %v", err)
+	}
+	if _, err := tx.Step(ctx, "d"); err != checkpointstate.ErrTxDone {
+		t.Errorf("unexpected or missing error: %v", err)
+	}
 
-	id1 := mgr.SessionID("xyz")
-	sess, err = mgr.Use(ctx, id1, true)
-	fail(err)
+	// Steps completed within a transaction that is rolled back are
+	// discarded.
+	tx = begin()
+	step(tx, "d")
+	step(tx, "e")
+	step(tx, "")
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stepNames(t, sess), []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if done, err := sess.Step(ctx, "d"); err != nil || done {
+		t.Errorf("d: %v %v", done, err)
+	}
+	if _, err := sess.Step(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
 
-	gotSteps, gotError = sess.Steps(ctx)
-	expectSteps()
+	// As are those within a transaction whose context is canceled.
+	cctx, cancel := context.WithCancel(ctx)
+	tx, err = sess.(checkpointstate.Transactor).Begin(cctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	step(tx, "e")
+	cancel()
+	if err := tx.Commit(cctx); err == nil {
+		t.Errorf("expected an error")
+	}
+	if got, want := stepNames(t, sess), []string{"a", "b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
 
-	sess.Step(ctx, "zz")
-	sess.Step(ctx, "xx")
-	gotSteps, gotError = sess.Steps(ctx)
-	expectSteps("zz", "xx")
-	if gotSteps[0].Completed.IsZero() {
-		t.Errorf("completed state has no completion time")
+	// No staging areas are left behind and the session verifies cleanly.
+	staging, err := ioutil.ReadDir(filepath.Join(dir, "tx", ".transactions"))
+	if err != nil {
+		t.Fatal(err)
 	}
-	if !gotSteps[1].Completed.IsZero() {
-		t.Errorf("current state has completion time")
+	if len(staging) != 0 {
+		t.Errorf("staging areas were left behind: %v", len(staging))
 	}
+	problems, err := sess.(checkpointstate.Verifier).Verify(ctx, false)
+	if err != nil || len(problems) != 0 {
+		t.Errorf("%v: %v", problems, err)
+	}
+}
 
-	time.Sleep(time.Second)
-	sess.Step(ctx, "ww")
-	gotSteps, gotError = sess.Steps(ctx)
-	expectSteps("zz", "xx", "ww")
-	if !gotSteps[2].Completed.IsZero() {
-		t.Errorf("current state has completion time")
+func TestIsComplete(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "local-file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	sess, err := mgr.Use(ctx, "query", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []string{"x", ""} {
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session := filepath.Join(dir, "query")
+	before := list(session)
+	if len(before) == 0 {
+		t.Fatalf("%v is empty or does not exist", session)
+	}
+	for _, step := range []string{"a", "a", "b"} {
+		if done, err := sess.IsComplete(ctx, step); err != nil || done {
+			t.Errorf("%v: %v %v", step, done, err)
+		}
+	}
+	if done, err := sess.IsComplete(ctx, "x"); err != nil || !done {
+		t.Errorf("x: %v %v", done, err)
+	}
+	// No in-progress, or any other, file is created by the query.
+	if got, want := list(session), before; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
 	}
-	duration := gotSteps[1].Completed.Sub(gotSteps[0].Completed)
-	if from, to := time.Second, time.Minute; duration < from || duration > to {
-		t.Errorf("step duration is out of expected range: %v: %v...%v", duration, from, to)
+	if _, err := os.Stat(filepath.Join(session, "in-progress")); !os.IsNotExist(err) {
+		t.Errorf("in-progress file exists: %v", err)
 	}
 }
@@ -0,0 +1,134 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// encryptedMagic prefixes the contents of all encrypted files and is
+// followed by the ID of the key used to encrypt them, a newline, the
+// nonce and the ciphertext. Since it can never appear at the start of
+// a json encoded value, files written before encryption was enabled
+// remain readable.
+const encryptedMagic = "checkpoint-aes-gcm\n"
+
+// WithEncryptionKey requests that the contents of all step, metadata
+// and index files be encrypted, using AES-GCM, with the specified key
+// which must be 16, 24 or 32 bytes long. Files are transparently
+// decrypted when read. Each encrypted file records the ID of the key
+// used to encrypt it, see KeyID, so that keys may be rotated by
+// supplying the previous keys via WithDecryptionKey. Session IDs, and
+// hence the names of session directories, are not encrypted.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *options) {
+		o.encryptionKey = key
+	}
+}
+
+// WithDecryptionKey supplies an additional key that is used only to
+// decrypt files that were encrypted with it, typically a key that has
+// been replaced by the one supplied via WithEncryptionKey.
+func WithDecryptionKey(key []byte) Option {
+	return func(o *options) {
+		o.decryptionKeys = append(o.decryptionKeys, key)
+	}
+}
+
+// KeyID returns the ID recorded in files encrypted with key. It is
+// derived from, but does not reveal, the key.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// configureEncryption creates the ciphers for all of the configured keys.
+func (o *options) configureEncryption() error {
+	keys := o.decryptionKeys
+	if o.encryptionKey != nil {
+		keys = append([][]byte{o.encryptionKey}, keys...)
+		o.encryptionKeyID = KeyID(o.encryptionKey)
+	}
+	for _, key := range keys {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return fmt.Errorf("invalid encryption key %v: %v", KeyID(key), err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		if o.ciphers == nil {
+			o.ciphers = map[string]cipher.AEAD{}
+		}
+		o.ciphers[KeyID(key)] = aead
+	}
+	return nil
+}
+
+// marshal json encodes v and encrypts the result if an encryption key
+// has been configured.
+func (o *options) marshal(v interface{}) ([]byte, error) {
+	buf, err := json.Marshal(v)
+	if err != nil || len(o.encryptionKeyID) == 0 {
+		return buf, err
+	}
+	aead := o.ciphers[o.encryptionKeyID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(encryptedMagic)+len(o.encryptionKeyID)+1+len(nonce)+len(buf)+aead.Overhead())
+	out = append(out, encryptedMagic...)
+	out = append(out, o.encryptionKeyID...)
+	out = append(out, '\n')
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, buf, []byte(o.encryptionKeyID)), nil
+}
+
+// isEncrypted returns true if buf contains encrypted data.
+func isEncrypted(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(encryptedMagic))
+}
+
+// unmarshal decrypts buf, if it is encrypted, and json decodes the
+// result into v.
+func (o *options) unmarshal(buf []byte, v interface{}) error {
+	if isEncrypted(buf) {
+		var err error
+		if buf, err = o.decrypt(buf[len(encryptedMagic):]); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(buf, v)
+}
+
+func (o *options) decrypt(buf []byte) ([]byte, error) {
+	idx := bytes.IndexByte(buf, '\n')
+	if idx < 0 {
+		return nil, fmt.Errorf("malformed encrypted data: missing key id")
+	}
+	id := string(buf[:idx])
+	aead, ok := o.ciphers[id]
+	if !ok {
+		return nil, fmt.Errorf("data is encrypted with key %v which has not been supplied", id)
+	}
+	buf = buf[idx+1:]
+	if len(buf) < aead.NonceSize() {
+		return nil, fmt.Errorf("malformed encrypted data: missing nonce")
+	}
+	plaintext, err := aead.Open(nil, buf[:aead.NonceSize()], buf[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data encrypted with key %v: %v", id, err)
+	}
+	return plaintext, nil
+}
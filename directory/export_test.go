@@ -0,0 +1,48 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetBeforeRename sets the hook called by writeFileAtomic before it
+// renames a temporary file and returns a function that removes it.
+func SetBeforeRename(fn func(tmp string) error) func() {
+	beforeRename = fn
+	return func() { beforeRename = nil }
+}
+
+// StepFileName exports stepFileName for testing.
+var StepFileName = stepFileName
+
+// SetFlock sets the function used to call flock and returns a function
+// that restores it.
+func SetFlock(fn func(fd int, how int) error) func() {
+	flockSyscall = fn
+	return func() { flockSyscall = unix.Flock }
+}
+
+// LockFile exports lockFile for testing.
+var LockFile = lockFile
+
+// SetLockLease sets the lease used for lock files and returns a function
+// that restores it.
+func SetLockLease(lease time.Duration) func() {
+	prev := lockLease
+	lockLease = lease
+	return func() { lockLease = prev }
+}
+
+// SetReadDir sets the function used to read directories by walkDirs and
+// returns a function that restores it.
+func SetReadDir(fn func(dir string) ([]os.FileInfo, error)) func() {
+	readDir = fn
+	return func() { readDir = ioutil.ReadDir }
+}
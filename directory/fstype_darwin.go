@@ -0,0 +1,33 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"bytes"
+
+	"golang.org/x/sys/unix"
+)
+
+// networkFilesystems are the filesystems on which flock may not provide
+// mutual exclusion.
+var networkFilesystems = map[string]bool{
+	"nfs":     true,
+	"smbfs":   true,
+	"afpfs":   true,
+	"webdav":  true,
+	"osxfuse": true,
+	"macfuse": true,
+}
+
+// networkFilesystem returns the name of the network filesystem that dir
+// is stored on, if any.
+func networkFilesystem(dir string) (string, bool) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return "", false
+	}
+	name := string(bytes.TrimRight(st.Fstypename[:], "\x00"))
+	return name, networkFilesystems[name]
+}
@@ -0,0 +1,30 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import "golang.org/x/sys/unix"
+
+// networkFilesystems are the filesystems, keyed by their statfs magic
+// number, on which flock may not provide mutual exclusion.
+var networkFilesystems = map[int64]string{
+	unix.NFS_SUPER_MAGIC:  "nfs",
+	unix.SMB_SUPER_MAGIC:  "smb",
+	unix.SMB2_SUPER_MAGIC: "smb2",
+	unix.CIFS_SUPER_MAGIC: "cifs",
+	unix.AFS_SUPER_MAGIC:  "afs",
+	unix.CODA_SUPER_MAGIC: "coda",
+	unix.FUSE_SUPER_MAGIC: "fuse",
+}
+
+// networkFilesystem returns the name of the network filesystem that dir
+// is stored on, if any.
+func networkFilesystem(dir string) (string, bool) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return "", false
+	}
+	name, ok := networkFilesystems[int64(st.Type)]
+	return name, ok
+}
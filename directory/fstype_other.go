@@ -0,0 +1,14 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin
+// +build !linux,!darwin
+
+package directory
+
+// networkFilesystem always returns false on systems where network
+// filesystems cannot be detected.
+func networkFilesystem(dir string) (string, bool) {
+	return "", false
+}
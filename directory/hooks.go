@@ -0,0 +1,57 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// StepHook is called with the ID of a session and one of its steps.
+type StepHook func(sessionID string, step checkpointstate.Step)
+
+// WithStepHook registers a function to be called whenever a step is
+// completed, for example, to send a notification or emit a metric. Hooks
+// are called in the order in which they were registered, by the goroutine
+// that completed the step, once the completed step has been written and
+// the session's lock released; they may therefore safely access the
+// session themselves.
+func WithStepHook(fn StepHook) Option {
+	return func(o *options) {
+		o.stepHooks = append(o.stepHooks, fn)
+	}
+}
+
+// LockHook is called with the name of a directory that was locked, or
+// that could not be locked, the time spent waiting for the lock and the
+// error, if any, that prevented it from being acquired.
+type LockHook func(dir string, wait time.Duration, err error)
+
+// WithLockHook registers a function to be called whenever an attempt
+// to lock a session, or the root directory, completes; it is intended
+// for diagnosing contention and must not itself access the store.
+func WithLockHook(fn LockHook) Option {
+	return func(o *options) {
+		o.lockHooks = append(o.lockHooks, fn)
+	}
+}
+
+func (o *options) runLockHooks(dir string, wait time.Duration, err error) {
+	for _, fn := range o.lockHooks {
+		fn(dir, wait, err)
+	}
+}
+
+func (ds *directorySession) runStepHooks(state stepState) {
+	if len(ds.opts.stepHooks) == 0 {
+		return
+	}
+	id, step := filepath.Base(ds.session), ds.toStep(state)
+	for _, fn := range ds.opts.stepHooks {
+		fn(id, step)
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"os"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// Import implements checkpointstate.Importer. Completed steps are added
+// to the compacted file, so that importing many steps creates only a
+// single file, and failed steps are written to their own step files, as
+// for Fail.
+func (ds *directorySession) Import(ctx context.Context, steps []checkpointstate.Step) error {
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	var completed, failed []stepState
+	imported := map[string]bool{}
+	for _, step := range steps {
+		if step.Completed.IsZero() && step.Failed.IsZero() {
+			continue
+		}
+		state := stepState{
+			Step:        step.Name,
+			ContentHash: step.ContentHash,
+			Created:     step.Created.UTC().Format(ds.opts.timeFormat),
+			Artifacts:   step.Artifacts,
+			Reason:      step.Reason,
+			Metadata:    step.Metadata,
+			Result:      step.Result,
+			Order:       step.Order,
+			Group:       step.Group,
+			Phase:       step.Phase,
+			Command:     step.Command,
+			ExitCode:    step.ExitCode,
+		}
+		state.StepFile = ds.stepFile(state.key())
+		imported[state.key()] = true
+		if !step.Completed.IsZero() {
+			state.Completed = step.Completed.UTC().Format(ds.opts.timeFormat)
+			completed = append(completed, state)
+			continue
+		}
+		state.Failed = step.Failed.UTC().Format(ds.opts.timeFormat)
+		failed = append(failed, state)
+	}
+	if len(imported) == 0 {
+		return nil
+	}
+	compacted, err := ds.readCompacted()
+	if err != nil {
+		return err
+	}
+	retained := make([]stepState, 0, len(compacted)+len(completed))
+	for _, state := range compacted {
+		if !imported[state.key()] {
+			retained = append(retained, state)
+		}
+	}
+	if err := ds.writeCompacted(append(retained, completed...)); err != nil {
+		return err
+	}
+	// The step files for the imported steps, if any, would otherwise take
+	// precedence over the compacted file.
+	for key := range imported {
+		if err := os.Remove(ds.stepFile(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for _, state := range failed {
+		buf, _ := ds.opts.marshal(state)
+		if err := writeFileAtomic(state.StepFile, buf, 0400); err != nil {
+			return err
+		}
+	}
+	for _, state := range completed {
+		if err := ds.appendLog(state); err != nil {
+			return err
+		}
+	}
+	return ds.updateIndex(append(completed, failed...))
+}
@@ -0,0 +1,185 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// indexFile caches the state of all of the steps stored in their own
+// files. It is hidden so that it is never mistaken for a step.
+const indexFile = ".index"
+
+// WithStepIndex requests that the state of a session's steps be cached
+// in an index file that is updated incrementally as steps are started,
+// completed, failed or deleted. Steps then reads the index, rather than
+// every step file, provided that the index is consistent with the step
+// files that exist; if it is missing or stale it is rebuilt from the
+// step files.
+func WithStepIndex() Option {
+	return func(o *options) {
+		o.stepIndex = true
+	}
+}
+
+// readIndex returns the contents of the index, if it exists.
+func (ds *directorySession) readIndex() ([]stepState, bool, error) {
+	filename := filepath.Join(ds.session, indexFile)
+	buf, err := readFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	var states []stepState
+	if err := ds.opts.unmarshal(buf, &states); err != nil {
+		return nil, false, fmt.Errorf("failed to decode json data from %v: %v", filename, err)
+	}
+	return states, true, nil
+}
+
+func (ds *directorySession) writeIndex(states []stepState) error {
+	buf, err := ds.opts.marshal(states)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(ds.session, indexFile), buf, 0600)
+}
+
+// updateIndex updates an existing index to reflect steps that have been
+// written or removed. It must be called with the session locked. A
+// missing index is left to be rebuilt by the next call to Steps.
+func (ds *directorySession) updateIndex(written []stepState, removed ...string) error {
+	if !ds.opts.stepIndex {
+		return nil
+	}
+	states, ok, err := ds.readIndex()
+	if err != nil || !ok {
+		return err
+	}
+	drop := map[string]bool{}
+	for _, step := range removed {
+		drop[step] = true
+	}
+	for _, state := range written {
+		drop[state.key()] = true
+	}
+	updated := make([]stepState, 0, len(states)+len(written))
+	for _, state := range states {
+		if !drop[state.key()] {
+			updated = append(updated, state)
+		}
+	}
+	return ds.writeIndex(append(updated, written...))
+}
+
+// stepFileNames returns the names of all of the step files, other than
+// that for the in-progress step, without reading their contents.
+func (ds *directorySession) stepFileNames() (map[string]bool, error) {
+	f, err := os.Open(ds.session)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]bool{}
+	for _, name := range names {
+		if ds.isStepFile(name) && name != currentStepFile {
+			files[name] = true
+		}
+	}
+	return files, nil
+}
+
+// indexIsCurrent returns true if the index refers to exactly the step
+// files that exist.
+func (ds *directorySession) indexIsCurrent(states []stepState) (bool, error) {
+	files, err := ds.stepFileNames()
+	if err != nil {
+		return false, err
+	}
+	if len(files) != len(states) {
+		return false, nil
+	}
+	for _, state := range states {
+		if !files[stepFileName(state.key())] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// walkSteps reads the state of every step file, other than that for the
+// in-progress step.
+func (ds *directorySession) walkSteps() ([]stepState, error) {
+	states := []stepState{}
+	err := ds.visitSteps(func(state stepState) error {
+		states = append(states, state)
+		return nil
+	})
+	return states, err
+}
+
+// visitSteps calls fn with the state of every step file, other than that
+// for the in-progress step, in lexical order of the step files' names,
+// reading each file only as it is visited.
+func (ds *directorySession) visitSteps(fn func(stepState) error) error {
+	return filepath.Walk(ds.session, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && path != ds.session {
+			// Subdirectories, such as that for concurrent steps, never
+			// contain completed steps.
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() || isSymlink(info) || !ds.isStepFile(info.Name()) || info.Name() == currentStepFile {
+			return nil
+		}
+		buf, err := readFile(path)
+		if err != nil {
+			return err
+		}
+		var state stepState
+		if err := ds.opts.unmarshal(buf, &state); err != nil {
+			// Partially written files are ignored, but encrypted
+			// files that cannot be decrypted are not.
+			if isEncrypted(buf) {
+				return fmt.Errorf("%v: %v", path, err)
+			}
+			return nil
+		}
+		return fn(state)
+	})
+}
+
+// indexedSteps returns the state of every step file, other than that for
+// the in-progress step, from the index if it is current, or by reading
+// all of the step files and rebuilding the index otherwise.
+func (ds *directorySession) indexedSteps(ctx context.Context) ([]stepState, error) {
+	states, ok, err := ds.readIndex()
+	if err == nil && ok {
+		current, err := ds.indexIsCurrent(states)
+		if err != nil {
+			return nil, err
+		}
+		if current {
+			return states, nil
+		}
+	}
+	unlock, err := ds.opts.lock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+	if states, err = ds.walkSteps(); err != nil {
+		return nil, err
+	}
+	return states, ds.writeIndex(states)
+}
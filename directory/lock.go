@@ -0,0 +1,489 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFileName is the name of the file used to lock a directory when
+// lock files are used in place of flock.
+const lockFileName = ".lock"
+
+// lockLease is the time after which a lock file is considered to be stale
+// and may be removed by another process. The lease is renewed for as long
+// as the lock is held, see lockFile.
+var lockLease = time.Minute
+
+// lockFileRetry is the interval at which acquiring a held lock, whether
+// a lock file or flock, is retried.
+var lockFileRetry = 10 * time.Millisecond
+
+// lockFileSeq is used to create unique names for the files used to take
+// over stale lock files and to renew the leases of held ones.
+var lockFileSeq uint64
+
+var warnOnce, fallbackOnce, noLockOnce sync.Once
+
+// flockSyscall is used to call flock and may be overridden by tests to
+// simulate filesystems that do not support it.
+var flockSyscall = unix.Flock
+
+// WithLockFiles requests that lock files, rather than flock, be used
+// to serialize access to sessions. Lock files are used by default on
+// network filesystems, such as NFS, where flock may not provide mutual
+// exclusion.
+func WithLockFiles() Option {
+	return func(o *options) {
+		o.lockFiles = true
+	}
+}
+
+// WithoutLocking requests that sessions not be locked at all, for use on
+// filesystems that support neither flock nor the atomic creation of lock
+// files. Concurrent access to the same session is then unsafe and a
+// warning is logged the first time that a lock would have been acquired.
+func WithoutLocking() Option {
+	return func(o *options) {
+		o.noLocking = true
+	}
+}
+
+// configureLocking determines whether lock files are to be used for
+// dir based on the filesystem that it is stored on.
+func (o *options) configureLocking(dir string) {
+	if o.lockFiles {
+		return
+	}
+	if fstype, ok := networkFilesystem(dir); ok {
+		warnOnce.Do(func() {
+			log.Printf("warning: %v is on a %v filesystem, using lock files rather than flock", dir, fstype)
+		})
+		o.lockFiles = true
+	}
+}
+
+// useLockFiles returns true if lock files are to be used, either because
+// they were requested, or because flock was found to be unsupported.
+func (o *options) useLockFiles() bool {
+	return o.lockFiles || atomic.LoadInt32(&o.flockUnsupported) != 0
+}
+
+// isFlockUnsupported returns true if err indicates that the filesystem
+// does not support flock, rather than that the lock could not be acquired.
+func isFlockUnsupported(err error) bool {
+	return err == unix.ENOTSUP || err == unix.EOPNOTSUPP || err == unix.EINVAL
+}
+
+// fallbackToLockFiles records that flock is not supported for name and
+// that lock files are to be used instead from now on.
+func (o *options) fallbackToLockFiles(name string, err error) {
+	fallbackOnce.Do(func() {
+		log.Printf("warning: flock is not supported for %v: %v, using lock files instead", name, err)
+	})
+	atomic.StoreInt32(&o.flockUnsupported, 1)
+}
+
+// lock acquires an exclusive lock on the named directory and returns
+// a function to release it. Waiting for a lock that is held by another
+// process is abandoned, and ctx.Err() returned, if ctx is canceled.
+func (o *options) lock(ctx context.Context, name string) (func(), error) {
+	return o.acquire(ctx, name, unix.LOCK_EX)
+}
+
+// rlock acquires a shared lock on the named directory, for use by
+// operations that only read it, and returns a function to release it.
+// Any number of shared locks may be held at once, but they exclude, and
+// are excluded by, an exclusive lock. Lock files do not support shared
+// locks and so rlock is the same as lock when they are in use. Note
+// that, as for lock, the same process may not hold a shared and an
+// exclusive lock on the same directory at once.
+func (o *options) rlock(ctx context.Context, name string) (func(), error) {
+	return o.acquire(ctx, name, unix.LOCK_SH)
+}
+
+// acquire acquires a lock of the specified type, LOCK_EX or LOCK_SH, on
+// the named directory.
+func (o *options) acquire(ctx context.Context, name string, how int) (func(), error) {
+	if o.noLocking {
+		noLockOnce.Do(func() {
+			log.Printf("warning: locking is disabled, concurrent access to %v is unsafe", name)
+		})
+		return func() {}, nil
+	}
+	start := time.Now()
+	var unlock func()
+	var err error
+	if o.useLockFiles() {
+		unlock, err = lockFile(ctx, name)
+	} else {
+		unlock, err = flock(ctx, name, how)
+		if err != nil && isFlockUnsupported(err) {
+			o.fallbackToLockFiles(name, err)
+			unlock, err = lockFile(ctx, name)
+		}
+	}
+	o.runLockHooks(name, time.Since(start), err)
+	return unlock, err
+}
+
+// retryLock waits before the next attempt to acquire a held lock.
+func retryLock(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(lockFileRetry):
+		return nil
+	}
+}
+
+// isLocked determines if the named directory is currently locked.
+func (o *options) isLocked(name string) (bool, error) {
+	if o.noLocking {
+		return false, nil
+	}
+	if o.useLockFiles() {
+		return isLockFileHeld(name)
+	}
+	locked, err := isFlocked(name)
+	if err != nil && isFlockUnsupported(err) {
+		o.fallbackToLockFiles(name, err)
+		return isLockFileHeld(name)
+	}
+	return locked, err
+}
+
+// flock acquires the lock, of type how, using a non-blocking flock that
+// is retried until it succeeds, since a blocking flock cannot be canceled.
+// An error for which isFlockUnsupported is true is returned as is so that
+// the caller may fall back to using lock files.
+func flock(ctx context.Context, name string, how int) (func(), error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return func() {}, err
+	}
+	for {
+		err := flockSyscall(int(f.Fd()), how|unix.LOCK_NB)
+		if err == nil {
+			break
+		}
+		if err != unix.EWOULDBLOCK {
+			f.Close()
+			return func() {}, err
+		}
+		if err := retryLock(ctx); err != nil {
+			f.Close()
+			return func() {}, err
+		}
+	}
+	return func() {
+		flockSyscall(int(f.Fd()), unix.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// isFlocked determines if name is currently locked by attempting
+// a non-blocking lock on it.
+func isFlocked(name string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	switch err := flockSyscall(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB); err {
+	case nil:
+		flockSyscall(int(f.Fd()), unix.LOCK_UN)
+		return false, nil
+	case unix.EWOULDBLOCK:
+		return true, nil
+	default:
+		return false, err
+	}
+}
+
+// lockFileState is stored in a lock file to identify its owner and
+// the time after which it may be considered stale.
+type lockFileState struct {
+	PID     int
+	Host    string
+	Expires time.Time
+}
+
+// stale returns true if the lock file's lease has expired or if it
+// was created by a process on this host that no longer exists.
+func (s lockFileState) stale(now time.Time) bool {
+	if now.After(s.Expires) {
+		return true
+	}
+	host, _ := os.Hostname()
+	if s.Host == host && s.PID > 0 {
+		return unix.Kill(s.PID, 0) == unix.ESRCH
+	}
+	return false
+}
+
+func readLockFile(filename string) (lockFileState, error) {
+	var state lockFileState
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return state, err
+	}
+	// A lock file that cannot be parsed, most likely because it is in the
+	// process of being written, is treated as being held until its lease
+	// would have expired.
+	if err := json.Unmarshal(buf, &state); err != nil {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return state, err
+		}
+		state.Expires = info.ModTime().Add(lockLease)
+	}
+	return state, nil
+}
+
+// same returns true if s and o describe the same lock file.
+func (s lockFileState) same(o lockFileState) bool {
+	return s.PID == o.PID && s.Host == o.Host && s.Expires.Equal(o.Expires)
+}
+
+// lockFileTemp returns a unique name, in the same directory as filename,
+// for a file that is to replace, or be replaced by, filename.
+func lockFileTemp(filename, purpose string) string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v.%v.%v.%v.%v", filename, purpose, host, os.Getpid(), atomic.AddUint64(&lockFileSeq, 1))
+}
+
+// removeStaleLockFile removes filename provided that it is still the
+// stale lock file described by stale. Since another process may have
+// removed the same stale lock file, and created its own, since stale was
+// read, filename is first renamed to a unique name and then read again;
+// a lock file that turns out to be held by another process is restored,
+// unless yet another process has created one in the meantime.
+func removeStaleLockFile(filename string, stale lockFileState) error {
+	tmp := lockFileTemp(filename, "stale")
+	if err := os.Rename(filename, tmp); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(tmp)
+	state, err := readLockFile(tmp)
+	if err == nil && state.same(stale) {
+		return nil
+	}
+	if lerr := os.Link(tmp, filename); lerr != nil && !os.IsExist(lerr) {
+		return lerr
+	}
+	return err
+}
+
+// heldLockFile is a lock file held by this process whose lease is renewed,
+// until it is released, so that operations that hold the lock for longer
+// than the lease cannot have it taken over by another process.
+type heldLockFile struct {
+	filename string
+	state    lockFileState
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// renewals renews the lease every third of its duration until release is
+// called or the lock file is found to be no longer held by this process.
+func (h *heldLockFile) renewals() {
+	defer close(h.done)
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-time.After(lockLease / 3):
+		}
+		if err := h.renew(); err != nil {
+			log.Printf("warning: failed to renew lock file %v: %v", h.filename, err)
+			return
+		}
+	}
+}
+
+// renew replaces the lock file with one whose lease expires a full lease
+// from now, provided that it is still held by this process.
+func (h *heldLockFile) renew() error {
+	current, err := readLockFile(h.filename)
+	if err != nil {
+		return err
+	}
+	if !current.same(h.state) {
+		return fmt.Errorf("the lock is no longer held by this process")
+	}
+	state := h.state
+	state.Expires = time.Now().Add(lockLease)
+	buf, _ := json.Marshal(state)
+	tmp := lockFileTemp(h.filename, "renew")
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, h.filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	h.state = state
+	return nil
+}
+
+// release stops renewing the lease and removes the lock file, provided
+// that it is still held by this process.
+func (h *heldLockFile) release() {
+	close(h.stop)
+	<-h.done
+	if current, err := readLockFile(h.filename); err == nil && current.same(h.state) {
+		os.Remove(h.filename)
+	}
+}
+
+// lockFile acquires a lock on the named directory by atomically creating
+// a lock file within it. Stale lock files, ie. those whose lease has
+// expired or that were created by a process that no longer exists, are
+// removed. The lease is renewed for as long as the lock is held.
+func lockFile(ctx context.Context, name string) (func(), error) {
+	filename := filepath.Join(name, lockFileName)
+	host, _ := os.Hostname()
+	for {
+		f, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err == nil {
+			state := lockFileState{
+				PID:     os.Getpid(),
+				Host:    host,
+				Expires: time.Now().Add(lockLease),
+			}
+			buf, _ := json.Marshal(state)
+			_, err = f.Write(buf)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(filename)
+				return func() {}, err
+			}
+			// Use the state as read back from the file so that it may be
+			// compared with the file's contents when renewed or released.
+			if err := json.Unmarshal(buf, &state); err != nil {
+				os.Remove(filename)
+				return func() {}, err
+			}
+			held := &heldLockFile{
+				filename: filename,
+				state:    state,
+				stop:     make(chan struct{}),
+				done:     make(chan struct{}),
+			}
+			go held.renewals()
+			return held.release, nil
+		}
+		if !os.IsExist(err) {
+			return func() {}, err
+		}
+		state, err := readLockFile(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return func() {}, err
+		}
+		if state.stale(time.Now()) {
+			if err := removeStaleLockFile(filename, state); err != nil && !os.IsNotExist(err) {
+				return func() {}, err
+			}
+			continue
+		}
+		if err := retryLock(ctx); err != nil {
+			return func() {}, err
+		}
+	}
+}
+
+// isLockFileHeld determines if the named directory is locked by a lock
+// file that is not stale.
+func isLockFileHeld(name string) (bool, error) {
+	if _, err := os.Stat(name); err != nil {
+		return false, err
+	}
+	state, err := readLockFile(filepath.Join(name, lockFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return !state.stale(time.Now()), nil
+}
+
+// Locked implements checkpointstate.LockInspector.
+func (dm *directoryManager) Locked(ctx context.Context, id string) (bool, error) {
+	if len(id) == 0 {
+		return false, fmt.Errorf("empty session id")
+	}
+	return dm.opts.isLocked(dm.sessionDir(id))
+}
+
+// tryLock is like lock except that it returns errLockHeld, rather than
+// waiting, if the lock is held by another process.
+func (o *options) tryLock(name string) (func(), error) {
+	// Both flock and lockFile make one attempt to acquire the lock before
+	// checking for cancelation.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	unlock, err := o.lock(ctx, name)
+	if err == context.Canceled {
+		return unlock, errLockHeld
+	}
+	return unlock, err
+}
+
+// errLockHeld is returned by tryLock if the lock is held.
+var errLockHeld = fmt.Errorf("locked by a live process")
+
+// ForceUnlock implements checkpointstate.LockInspector. The session is
+// locked, without waiting, whilst the in-progress markers left by a
+// crashed process are removed, and stale lock files are removed when
+// acquiring that lock. Note that flock locks are released when the
+// process holding them exits, and are only held whilst a checkpoint
+// command is running rather than for the duration of a step, so that
+// ForceUnlock cannot distinguish a script that is part way through a
+// step from one that crashed.
+func (dm *directoryManager) ForceUnlock(ctx context.Context, id string) error {
+	if len(id) == 0 {
+		return fmt.Errorf("empty session id")
+	}
+	dir := dm.sessionDir(id)
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+	unlock, err := dm.opts.tryLock(dir)
+	defer unlock()
+	if err == errLockHeld {
+		return fmt.Errorf("session %v is locked by a live process", id)
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{currentStepFile, concurrentDir} {
+		if err := os.RemoveAll(filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
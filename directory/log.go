@@ -0,0 +1,48 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// logFile contains one line for each completed step.
+const logFile = "log"
+
+// WithCompletionLog requests that a human readable line be appended to
+// a file named log within each session's directory whenever one of its
+// steps is completed, so that a session's history may be read without
+// using this package. Each line contains the completion time, the quoted
+// name of the step and its duration. Note that the log is never encrypted.
+func WithCompletionLog() Option {
+	return func(o *options) {
+		o.completionLog = true
+	}
+}
+
+// appendLog appends a line for the completed step to the session's log.
+// It must be called with the session locked.
+func (ds *directorySession) appendLog(state stepState) error {
+	if !ds.opts.completionLog {
+		return nil
+	}
+	completed := ds.parseTime(state.Completed)
+	line := fmt.Sprintf("%v %q %v\n", completed.Format(timeFormat), state.Step, completed.Sub(ds.parseTime(state.Created)))
+	filename := filepath.Join(ds.session, logFile)
+	if err := checkNotSymlink(filename); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,369 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionFile records the format version of the store in its root
+// directory. It is hidden so that it is never mistaken for a session.
+// Stores without a version file predate it and are version 0.
+const versionFile = ".version"
+
+// formatVersion is the format version used for new stores; it must be
+// equal to len(migrations).
+const formatVersion = 2
+
+// migrations[i] upgrades a session from format version i to i+1 and
+// returns true if it was modified. Migrations must be idempotent since
+// a migration that is interrupted will be rerun.
+var migrations = []func(ds *directorySession) (bool, error){
+	(*directorySession).migrateV0,
+	(*directorySession).migrateV1,
+}
+
+func readVersion(root string) (int, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(root, versionFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid format version in %v: %v", filepath.Join(root, versionFile), err)
+	}
+	return version, nil
+}
+
+func writeVersion(root string, version int) error {
+	return writeFileAtomic(filepath.Join(root, versionFile), []byte(fmt.Sprintf("%d\n", version)), 0600)
+}
+
+// FormatVersion implements checkpointstate.Migrator. A store that does
+// not exist yet is considered to be at the current version.
+func (dm *directoryManager) FormatVersion(ctx context.Context) (int, int, error) {
+	if _, err := os.Stat(dm.root); err != nil {
+		if os.IsNotExist(err) {
+			return formatVersion, formatVersion, nil
+		}
+		return 0, formatVersion, err
+	}
+	version, err := readVersion(dm.root)
+	return version, formatVersion, err
+}
+
+// Migrate implements checkpointstate.Migrator. The root directory is
+// locked for the duration of the migration, and each session whilst it
+// is being migrated. The version file is only updated once all sessions
+// have been migrated. Once the store is at the current version it is
+// sharded if WithShardedLayout was specified and it is not already
+// sharded, in which case the IDs of all of its sessions are returned.
+func (dm *directoryManager) Migrate(ctx context.Context) ([]string, error) {
+	if _, err := os.Stat(dm.root); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	unlock, err := dm.opts.lock(ctx, dm.root)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+	version, err := readVersion(dm.root)
+	if err != nil {
+		return nil, err
+	}
+	if version > formatVersion {
+		return nil, fmt.Errorf("store format version %v is newer than the supported version %v", version, formatVersion)
+	}
+	migrated, err := dm.migrateSessions(ctx, version)
+	if err != nil || !dm.needsSharding() {
+		return migrated, err
+	}
+	sharded, err := dm.shardSessions(ctx)
+	return mergeIDs(migrated, sharded), err
+}
+
+// migrateSessions migrates every session from the specified format
+// version to the current one.
+func (dm *directoryManager) migrateSessions(ctx context.Context, version int) ([]string, error) {
+	if version == formatVersion {
+		return nil, nil
+	}
+	var migrated []string
+	err := dm.walkSessionsStrict(func(path, id string) error {
+		ds := &directorySession{session: path, opts: &dm.opts}
+		modified, err := ds.migrate(ctx, version)
+		if err != nil {
+			return fmt.Errorf("failed to migrate session %v: %v", id, err)
+		}
+		if modified {
+			migrated = append(migrated, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return migrated, err
+	}
+	return migrated, writeVersion(dm.root, formatVersion)
+}
+
+// mergeIDs returns the sorted union of a and b, which must be sorted.
+func mergeIDs(a, b []string) []string {
+	merged := make([]string, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			merged, a = append(merged, a[0]), a[1:]
+		case a[0] > b[0]:
+			merged, b = append(merged, b[0]), b[1:]
+		default:
+			merged, a, b = append(merged, a[0]), a[1:], b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// migrate upgrades the session from the specified format version to the
+// current one. Sealed sessions are migrated since their contents are
+// unchanged.
+func (ds *directorySession) migrate(ctx context.Context, version int) (bool, error) {
+	unlock, err := ds.opts.lock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return false, err
+	}
+	modified := false
+	for _, fn := range migrations[version:] {
+		changed, err := fn(ds)
+		if err != nil {
+			return modified, err
+		}
+		modified = modified || changed
+	}
+	return modified, nil
+}
+
+// migrateV0 upgrades sessions written before the format was versioned,
+// which may contain timestamps that are not in UTC, or not in the
+// configured layout, and step file locations that are no longer valid
+// because the store has been moved. The index, if any, is removed so
+// that it will be rebuilt from the upgraded step files.
+func (ds *directorySession) migrateV0() (bool, error) {
+	modified := false
+	rewrite := func(filename string, state stepState, stepFile string, perm os.FileMode) error {
+		upgraded, changed := ds.upgradeState(state, stepFile)
+		if !changed {
+			return nil
+		}
+		modified = true
+		buf, err := ds.opts.marshal(upgraded)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(filename, buf, perm)
+	}
+	entries, err := ioutil.ReadDir(ds.session)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || isSymlink(entry) || !ds.isStepFile(name) || name == currentStepFile {
+			continue
+		}
+		filename := filepath.Join(ds.session, name)
+		buf, err := readFile(filename)
+		if err != nil {
+			return modified, err
+		}
+		var state stepState
+		if err := ds.opts.unmarshal(buf, &state); err != nil {
+			// Partially written files are left for verify to report,
+			// but encrypted files that cannot be decrypted are not.
+			if isEncrypted(buf) {
+				return modified, fmt.Errorf("%v: %v", filename, err)
+			}
+			continue
+		}
+		if err := rewrite(filename, state, filename, 0400); err != nil {
+			return modified, err
+		}
+	}
+	if state, ok, err := ds.readCurrent(); err != nil || ok {
+		if err != nil {
+			return modified, err
+		}
+		if err := rewrite(filepath.Join(ds.session, currentStepFile), state, filepath.Join(ds.session, state.key()), 0600); err != nil {
+			return modified, err
+		}
+	}
+	concurrent, err := ds.concurrentSteps()
+	if err != nil {
+		return modified, err
+	}
+	for _, state := range concurrent {
+		if err := rewrite(ds.markerFile(state.key()), state, filepath.Join(ds.session, state.key()), 0600); err != nil {
+			return modified, err
+		}
+	}
+	compacted, err := ds.readCompacted()
+	if err != nil {
+		return modified, err
+	}
+	compactedChanged := false
+	for i, state := range compacted {
+		var changed bool
+		if compacted[i], changed = ds.upgradeState(state, filepath.Join(ds.session, state.key())); changed {
+			compactedChanged = true
+		}
+	}
+	if compactedChanged {
+		modified = true
+		if err := ds.writeCompacted(compacted); err != nil {
+			return modified, err
+		}
+	}
+	if modified {
+		if err := os.Remove(filepath.Join(ds.session, indexFile)); err != nil && !os.IsNotExist(err) {
+			return modified, err
+		}
+	}
+	return modified, nil
+}
+
+// upgradeState returns state with its timestamps in UTC, using the
+// configured layout, and its step file location set to stepFile. It
+// returns true if state was changed.
+func (ds *directorySession) upgradeState(state stepState, stepFile string) (stepState, bool) {
+	changed := false
+	for _, v := range []*string{&state.Created, &state.Completed, &state.Failed} {
+		if len(*v) == 0 {
+			continue
+		}
+		t, err := time.Parse(ds.opts.timeFormat, *v)
+		if err != nil {
+			if t, err = time.Parse(timeFormat, *v); err != nil {
+				continue
+			}
+		}
+		if utc := t.UTC().Format(ds.opts.timeFormat); utc != *v {
+			*v, changed = utc, true
+		}
+	}
+	if state.StepFile != stepFile {
+		state.StepFile, changed = stepFile, true
+	}
+	return state, changed
+}
+
+// migrateV1 upgrades sessions written before step files were named
+// using stepFileName, rather than the step's key as is, by renaming
+// the files of steps whose keys are now encoded and updating the step
+// file location recorded by every step. The index, if any, is removed
+// so that it will be rebuilt from the renamed step files.
+func (ds *directorySession) migrateV1() (bool, error) {
+	modified := false
+	move := func(from, to string, state stepState, perm os.FileMode) error {
+		if from == to && state.StepFile == ds.stepFile(state.key()) {
+			return nil
+		}
+		if from != to {
+			if _, err := os.Lstat(to); err == nil {
+				return fmt.Errorf("cannot rename %v to %v: file exists", from, to)
+			}
+		}
+		modified = true
+		state.StepFile = ds.stepFile(state.key())
+		buf, err := ds.opts.marshal(state)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(to, buf, perm); err != nil {
+			return err
+		}
+		if from != to {
+			return os.Remove(from)
+		}
+		return nil
+	}
+	for _, dir := range []string{ds.session, filepath.Join(ds.session, concurrentDir)} {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return modified, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || isSymlink(entry) || !ds.isStepFile(name) || name == currentStepFile {
+				continue
+			}
+			filename := filepath.Join(dir, name)
+			buf, err := readFile(filename)
+			if err != nil {
+				return modified, err
+			}
+			var state stepState
+			if err := ds.opts.unmarshal(buf, &state); err != nil {
+				if isEncrypted(buf) {
+					return modified, fmt.Errorf("%v: %v", filename, err)
+				}
+				continue
+			}
+			to, perm := ds.stepFile(state.key()), os.FileMode(0400)
+			if dir != ds.session {
+				to, perm = ds.markerFile(state.key()), 0600
+			}
+			if err := move(filename, to, state, perm); err != nil {
+				return modified, err
+			}
+		}
+	}
+	if state, ok, err := ds.readCurrent(); err != nil || ok {
+		if err != nil {
+			return modified, err
+		}
+		current := filepath.Join(ds.session, currentStepFile)
+		if err := move(current, current, state, 0600); err != nil {
+			return modified, err
+		}
+	}
+	compacted, err := ds.readCompacted()
+	if err != nil {
+		return modified, err
+	}
+	compactedChanged := false
+	for i, state := range compacted {
+		if stepFile := ds.stepFile(state.key()); state.StepFile != stepFile {
+			compacted[i].StepFile, compactedChanged = stepFile, true
+		}
+	}
+	if compactedChanged {
+		modified = true
+		if err := ds.writeCompacted(compacted); err != nil {
+			return modified, err
+		}
+	}
+	if modified {
+		if err := os.Remove(filepath.Join(ds.session, indexFile)); err != nil && !os.IsNotExist(err) {
+			return modified, err
+		}
+	}
+	return modified, nil
+}
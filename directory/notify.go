@@ -0,0 +1,85 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Notify implements checkpointstate.Notifier by watching the session
+// directory for changes to its step files. Since step files may be
+// observed before they have been completely written, each file is read
+// whenever it changes and a step is only sent the first time that it
+// is seen to be in progress or completed. Failed steps and changes
+// to compacted steps are not reported.
+func (ds *directorySession) Notify(ctx context.Context) (<-chan checkpointstate.Step, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(ds.session); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %v: %v", ds.session, err)
+	}
+	ch := make(chan checkpointstate.Step)
+	go func() {
+		defer close(ch)
+		defer watcher.Close()
+		sent := map[string]bool{}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-watcher.Errors:
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if ev.Op&(fsnotify.Create|fsnotify.Write) == 0 || !ds.isStepFile(filepath.Base(ev.Name)) {
+					continue
+				}
+				state, ok := ds.changedStep(ev.Name)
+				if !ok {
+					continue
+				}
+				// Distinguish the in-progress and completed states of
+				// the same step.
+				key := state.key() + "\x00" + state.Created + "\x00" + state.Completed
+				if sent[key] {
+					continue
+				}
+				sent[key] = true
+				select {
+				case ch <- ds.toStep(state):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// changedStep returns the state of the step stored in filename if it is
+// either in progress or completed.
+func (ds *directorySession) changedStep(filename string) (stepState, bool) {
+	buf, err := readFile(filename)
+	if err != nil {
+		return stepState{}, false
+	}
+	var state stepState
+	if err := ds.opts.unmarshal(buf, &state); err != nil || len(state.Failed) > 0 {
+		return stepState{}, false
+	}
+	if filepath.Base(filename) == currentStepFile {
+		return state, len(state.Completed) == 0
+	}
+	return state, len(state.Completed) > 0
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// RawDump implements checkpointstate.RawDumper. All of the files in
+// the session directory are returned, including those, such as lock and
+// temporary files, that are hidden, and the markers for in-progress
+// concurrent steps; the contents of encrypted files are returned as is.
+func (ds *directorySession) RawDump(ctx context.Context) ([]checkpointstate.RawFile, error) {
+	files, err := ds.rawFiles("")
+	if err != nil {
+		return nil, err
+	}
+	concurrent, err := ds.rawFiles(concurrentDir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(files, concurrent...), nil
+}
+
+// rawFiles returns the files in the named subdirectory of the session.
+func (ds *directorySession) rawFiles(dir string) ([]checkpointstate.RawFile, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(ds.session, dir))
+	if err != nil {
+		return nil, err
+	}
+	var files []checkpointstate.RawFile
+	for _, entry := range entries {
+		if entry.IsDir() || isSymlink(entry) {
+			continue
+		}
+		name := filepath.Join(dir, entry.Name())
+		buf, err := readFile(filepath.Join(ds.session, name))
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, checkpointstate.RawFile{
+			Name:     name,
+			Mode:     entry.Mode(),
+			Contents: buf,
+		})
+	}
+	return files, nil
+}
+
+// Paths implements checkpointstate.PathLister. As for RawDump, hidden
+// files and the markers for in-progress concurrent steps are included,
+// but lock files, which exist only whilst a session is locked, are not.
+func (ds *directorySession) Paths(ctx context.Context) ([]string, error) {
+	session, err := filepath.Abs(ds.session)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, dir := range []string{"", concurrentDir} {
+		entries, err := ioutil.ReadDir(filepath.Join(session, dir))
+		if err != nil {
+			if len(dir) > 0 && os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || isSymlink(entry) || entry.Name() == lockFileName {
+				continue
+			}
+			paths = append(paths, filepath.Join(session, dir, entry.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// sortSteps sorts steps with an explicit order first, in that order,
+// followed by all other steps in order of creation.
+func sortSteps(steps []checkpointstate.Step) {
+	sort.SliceStable(steps, func(i, j int) bool {
+		oi, oj := steps[i].Order, steps[j].Order
+		switch {
+		case oi > 0 && oj > 0:
+			return oi < oj
+		case oi > 0 || oj > 0:
+			return oi > 0
+		}
+		return steps[i].Created.Before(steps[j].Created)
+	})
+}
+
+// Reorder implements checkpointstate.Reorderer. The order is recorded
+// in the state of each step, only the step files whose order changes
+// are rewritten.
+func (ds *directorySession) Reorder(ctx context.Context, steps ...string) error {
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	current, inProgress, err := ds.readCurrent()
+	if err != nil {
+		return err
+	}
+	order := map[string]int{}
+	for i, step := range steps {
+		if inProgress && current.key() == step {
+			return fmt.Errorf("step %v is in progress", step)
+		}
+		if _, ok := order[step]; ok {
+			return fmt.Errorf("step %v is specified more than once", step)
+		}
+		order[step] = i + 1
+	}
+	states, err := ds.walkSteps()
+	if err != nil {
+		return err
+	}
+	compacted, err := ds.readCompacted()
+	if err != nil {
+		return err
+	}
+	found := map[string]bool{}
+	for _, state := range states {
+		found[state.key()] = true
+	}
+	for _, state := range compacted {
+		found[state.key()] = true
+	}
+	for _, step := range steps {
+		if !found[step] {
+			return fmt.Errorf("step %v does not exist", step)
+		}
+	}
+	var written []stepState
+	for _, state := range states {
+		if state.Order == order[state.key()] {
+			continue
+		}
+		state.Order = order[state.key()]
+		buf, err := ds.opts.marshal(state)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(ds.stepFile(state.key()), buf, 0400); err != nil {
+			return err
+		}
+		written = append(written, state)
+	}
+	changed := false
+	for i, state := range compacted {
+		if state.Order != order[state.key()] {
+			compacted[i].Order = order[state.key()]
+			changed = true
+		}
+	}
+	if changed {
+		if err := ds.writeCompacted(compacted); err != nil {
+			return err
+		}
+	}
+	return ds.updateIndex(written)
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// sealedFile is the marker file for a sealed session; it is hidden so
+// that it is never mistaken for a step.
+const sealedFile = ".sealed"
+
+func isSealed(session string) (bool, error) {
+	_, err := os.Stat(filepath.Join(session, sealedFile))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+// lockUnsealed locks the session and returns ErrSealed if it is sealed.
+// The returned function must always be called to release the lock.
+func (ds *directorySession) lockUnsealed(ctx context.Context) (func(), error) {
+	unlock, err := ds.opts.lock(ctx, ds.session)
+	if err != nil {
+		return unlock, err
+	}
+	sealed, err := isSealed(ds.session)
+	if err == nil && sealed {
+		err = checkpointstate.ErrSealed
+	}
+	return unlock, err
+}
+
+// Seal implements checkpointstate.Sealer. A session is sealed by the
+// presence of a marker file within its directory; the permissions of
+// the directory are not changed.
+func (ds *directorySession) Seal(ctx context.Context) error {
+	unlock, err := ds.opts.lock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(ds.session, sealedFile), []byte(ds.now()), 0400)
+}
+
+// Unseal implements checkpointstate.Sealer.
+func (ds *directorySession) Unseal(ctx context.Context) error {
+	unlock, err := ds.opts.lock(ctx, ds.session)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(ds.session, sealedFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Sealed implements checkpointstate.Sealer.
+func (ds *directorySession) Sealed(ctx context.Context) (bool, error) {
+	return isSealed(ds.session)
+}
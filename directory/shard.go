@@ -0,0 +1,263 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// shardedFile marks a store whose sessions are stored in shard
+	// subdirectories of the root directory. It is hidden so that it is
+	// never mistaken for a session.
+	shardedFile = ".sharded"
+	// shardLength is the number of characters of a session's ID used
+	// to name its shard.
+	shardLength = 2
+)
+
+// WithShardedLayout requests that new stores shard their sessions into
+// subdirectories named for the first two characters of each session's ID,
+// ie. root/ab/abcdef... rather than root/abcdef..., in the same manner as
+// git stores objects, so as to avoid a single directory with very large
+// numbers of entries. The layout of an existing store is recorded within
+// it and is always honoured, regardless of this option, so that stores
+// may be read by any Manager; an existing unsharded store is only sharded
+// by Migrate. Note that the empty shard directories left behind when
+// sessions are deleted are not removed.
+func WithShardedLayout() Option {
+	return func(o *options) {
+		o.sharded = true
+	}
+}
+
+// shard returns the name of the shard directory for the session id.
+func shard(id string) string {
+	runes := []rune(id)
+	if len(runes) > shardLength {
+		runes = runes[:shardLength]
+	}
+	return string(runes)
+}
+
+// isSharded returns true if the store uses the sharded layout.
+func (dm *directoryManager) isSharded() bool {
+	_, err := os.Stat(filepath.Join(dm.root, shardedFile))
+	return err == nil
+}
+
+// sessionDir returns the directory used to store the session id.
+func (dm *directoryManager) sessionDir(id string) string {
+	if dm.isSharded() {
+		return filepath.Join(dm.root, shard(id), id)
+	}
+	return filepath.Join(dm.root, id)
+}
+
+// initLayout records the requested layout for a new store.
+func (dm *directoryManager) initLayout() error {
+	if !dm.opts.sharded {
+		return nil
+	}
+	return writeFileAtomic(filepath.Join(dm.root, shardedFile), nil, 0600)
+}
+
+// walkSessions calls fn for each session directory in the order in which
+// they are stored, rather than lexical order of their IDs, so that the
+// root directory, and each shard, is read incrementally and memory use
+// is bounded however many sessions there are. A root directory that does
+// not exist contains no sessions.
+func (dm *directoryManager) walkSessions(fn func(path, id string) error) error {
+	return dm.visitSessions(false, fn)
+}
+
+// walkSessionsStrict is like walkSessions except that errors encountered
+// reading the root directory, or its shards, are returned rather than
+// ignored, for use by operations, such as migrations, that must not
+// silently skip any sessions. A directory that does not exist is still
+// not an error.
+func (dm *directoryManager) walkSessionsStrict(fn func(path, id string) error) error {
+	return dm.visitSessions(true, fn)
+}
+
+func (dm *directoryManager) visitSessions(strict bool, fn func(path, id string) error) error {
+	if !dm.isSharded() {
+		return streamDirs(dm.root, strict, fn)
+	}
+	return streamDirs(dm.root, strict, func(path, _ string) error {
+		return streamDirs(path, strict, fn)
+	})
+}
+
+// streamBatch is the number of directory entries read at a time by
+// streamDirs.
+const streamBatch = 256
+
+// dirError returns nil for errors encountered reading a directory that
+// are to be ignored, ie. all of them unless strict is true, in which case
+// only those for a directory, or entry, that does not exist are ignored.
+func dirError(strict bool, err error) error {
+	if !strict || os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// streamDirs is like walkDirs except that it reads dir streamBatch entries
+// at a time, rather than reading and sorting all of them first, and hence
+// calls fn in the order in which the subdirectories are stored. The
+// subdirectories themselves are never read. Errors encountered reading
+// dir are ignored unless strict is true, see dirError.
+func streamDirs(dir string, strict bool, fn func(path, name string) error) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return dirError(strict, err)
+	}
+	defer f.Close()
+	for {
+		names, err := f.Readdirnames(streamBatch)
+		for _, name := range names {
+			if name[0] == '.' {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			// Lstat rather than Stat so that symbolic links are skipped;
+			// entries removed since they were read are skipped too.
+			info, err := os.Lstat(path)
+			if err != nil {
+				if err := dirError(strict, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if !info.IsDir() {
+				continue
+			}
+			if err := fn(path, name); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// walkDirs calls fn for each subdirectory of dir, in lexical order. Hidden
+// directories, such as those used for namespaces, are never sessions or
+// shards and are skipped, as are symbolic links, which are never
+// followed; dir itself may be a symbolic link. A directory that cannot
+// be read contains no subdirectories.
+func walkDirs(dir string, fn func(path, name string) error) error {
+	return visitDirs(dir, false, fn)
+}
+
+// walkDirsStrict is like walkDirs except that an error reading dir, other
+// than it not existing, is returned.
+func walkDirsStrict(dir string, fn func(path, name string) error) error {
+	return visitDirs(dir, true, fn)
+}
+
+// readDir is used to read directories by walkDirs and may be overridden
+// by tests to simulate directories that cannot be read.
+var readDir = ioutil.ReadDir
+
+func visitDirs(dir string, strict bool, fn func(path, name string) error) error {
+	entries, err := readDir(dir)
+	if err != nil {
+		return dirError(strict, err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name()[0] == '.' {
+			continue
+		}
+		if err := fn(filepath.Join(dir, entry.Name()), entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardingDir holds the sessions of a store that is being sharded. It
+// is hidden so that its contents are never mistaken for sessions.
+const shardingDir = ".sharding"
+
+// needsSharding returns true if the store is to be sharded, or its
+// sharding was interrupted.
+func (dm *directoryManager) needsSharding() bool {
+	if _, err := os.Stat(filepath.Join(dm.root, shardingDir)); err == nil {
+		return true
+	}
+	return dm.opts.sharded && !dm.isSharded()
+}
+
+// shardSessions moves every session in an unsharded store into its shard
+// and returns their IDs; the root directory must be locked. The sessions
+// are first moved to a hidden staging directory, since a session whose ID
+// is no longer than a shard's name has the same name as its shard, after
+// which, and only once all of them have been moved, the store is marked
+// as sharded and each session is moved into its shard and the step file
+// locations recorded by its steps updated. The store is marked before
+// the sessions are moved into their shards so that, should that be
+// interrupted, the shards are never mistaken for sessions.
+// A move that is interrupted is completed when shardSessions is rerun,
+// but the recorded step file locations of the session being moved at the
+// time may need to be repaired using Verify.
+func (dm *directoryManager) shardSessions(ctx context.Context) ([]string, error) {
+	staging := filepath.Join(dm.root, shardingDir)
+	if !dm.isSharded() {
+		if err := os.MkdirAll(staging, 0700); err != nil {
+			return nil, err
+		}
+		// Errors reading the root are returned, rather than ignored, since
+		// any session left in it once the store is marked as sharded
+		// would no longer be found.
+		err := walkDirsStrict(dm.root, func(path, id string) error {
+			return os.Rename(path, filepath.Join(staging, id))
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(filepath.Join(dm.root, shardedFile), nil, 0600); err != nil {
+			return nil, err
+		}
+	}
+	var moved []string
+	err := walkDirsStrict(staging, func(path, id string) error {
+		to := filepath.Join(dm.root, shard(id), id)
+		if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+			return err
+		}
+		if _, err := os.Stat(to); err == nil {
+			return fmt.Errorf("cannot move session %v to %v: directory exists", id, to)
+		}
+		if err := os.Rename(path, to); err != nil {
+			return err
+		}
+		ds := &directorySession{session: to, opts: &dm.opts}
+		unlock, err := ds.opts.lock(ctx, ds.session)
+		defer unlock()
+		if err != nil {
+			return err
+		}
+		if _, err := ds.migrateV1(); err != nil {
+			return fmt.Errorf("failed to update session %v: %v", id, err)
+		}
+		moved = append(moved, id)
+		return nil
+	})
+	if err != nil {
+		return moved, err
+	}
+	return moved, os.Remove(staging)
+}
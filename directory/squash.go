@@ -0,0 +1,147 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Squash implements checkpointstate.Squasher. The artifacts and metadata
+// of the squashed steps are merged, with those of later steps taking
+// precedence. The new step is written before the squashed steps are
+// removed and hence if squashing is interrupted the squashed steps
+// may be recorded alongside the new step, but none will be lost.
+func (ds *directorySession) Squash(ctx context.Context, name string, steps ...string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("invalid step name: %q", name)
+	}
+	if len(steps) == 0 {
+		return fmt.Errorf("no steps to squash")
+	}
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	current, inProgress, err := ds.readCurrent()
+	if err != nil {
+		return err
+	}
+	compacted, err := ds.readCompacted()
+	if err != nil {
+		return err
+	}
+	squashed := map[string]bool{}
+	var states []stepState
+	for _, step := range steps {
+		if squashed[step] {
+			continue
+		}
+		squashed[step] = true
+		if inProgress && current.key() == step {
+			return fmt.Errorf("step %v is in progress", step)
+		}
+		state, ok, err := ds.completedStep(step, compacted)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("step %v has not been completed", step)
+		}
+		states = append(states, state)
+	}
+	if !squashed[name] {
+		if inProgress && current.key() == name {
+			return fmt.Errorf("step %v is in progress", name)
+		}
+		if _, err := os.Stat(ds.stepFile(name)); err == nil {
+			return fmt.Errorf("step %v already exists", name)
+		}
+		if exists, err := ds.isCompacted(name); err != nil || exists {
+			if err == nil {
+				return fmt.Errorf("step %v already exists", name)
+			}
+			return err
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return ds.parseTime(states[i].Created).Before(ds.parseTime(states[j].Created))
+	})
+	squash := stepState{
+		Step:     name,
+		StepFile: ds.stepFile(name),
+		Created:  states[0].Created,
+	}
+	var latest, latestResult time.Time
+	for _, state := range states {
+		t := ds.parseTime(state.Completed)
+		if t.After(latest) {
+			latest, squash.Completed = t, state.Completed
+		}
+		if len(state.Result) > 0 && t.After(latestResult) {
+			latestResult, squash.Result = t, state.Result
+		}
+		for k, v := range state.Artifacts {
+			if squash.Artifacts == nil {
+				squash.Artifacts = map[string]string{}
+			}
+			squash.Artifacts[k] = v
+		}
+		for k, v := range state.Metadata {
+			if squash.Metadata == nil {
+				squash.Metadata = map[string]interface{}{}
+			}
+			squash.Metadata[k] = v
+		}
+	}
+	buf, err := ds.opts.marshal(squash)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(squash.StepFile, buf, 0400); err != nil {
+		return err
+	}
+	var removed []string
+	for step := range squashed {
+		removed = append(removed, step)
+		if step == name {
+			continue
+		}
+		if err := os.Remove(ds.stepFile(step)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := ds.deleteCompacted(removed...); err != nil {
+		return err
+	}
+	return ds.updateIndex([]stepState{squash}, removed...)
+}
+
+// completedStep returns the state of the specified step if it has been
+// completed, whether it is stored in its own file or in the compacted
+// file.
+func (ds *directorySession) completedStep(step string, compacted []stepState) (stepState, bool, error) {
+	buf, err := readFile(ds.stepFile(step))
+	if err == nil {
+		var state stepState
+		if err := ds.opts.unmarshal(buf, &state); err != nil {
+			return stepState{}, false, fmt.Errorf("failed to unmarshal state for step %v: %v", step, err)
+		}
+		return state, len(state.Completed) > 0, nil
+	}
+	if !os.IsNotExist(err) {
+		return stepState{}, false, err
+	}
+	for _, state := range compacted {
+		if state.key() == step {
+			return state, true, nil
+		}
+	}
+	return stepState{}, false, nil
+}
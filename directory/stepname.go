@@ -0,0 +1,57 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// stepFileName returns the name of the file used to store the step
+// identified by key. Printable ASCII characters are used as is, other
+// than those that are not valid in file names on common platforms, and
+// all other bytes, which includes non-ASCII characters whose encoding
+// may be normalized by some filesystems, are percent encoded, as is
+// the % character itself. In addition, the first character of keys
+// that would be hidden, or that are the names of the session's other
+// files, and leading and trailing spaces and trailing periods are
+// encoded. The encoding is
+// therefore stable and may be reversed using url.PathUnescape.
+func stepFileName(key string) string {
+	var out strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		encode := c < 0x20 || c >= 0x7f || strings.IndexByte(`/\%:*?"<>|`, c) >= 0
+		switch {
+		case i == 0:
+			encode = encode || c == '.' || c == ' ' || isReservedFile(key)
+		case i == len(key)-1:
+			encode = encode || c == ' ' || c == '.'
+		}
+		if encode {
+			fmt.Fprintf(&out, "%%%02X", c)
+			continue
+		}
+		out.WriteByte(c)
+	}
+	return out.String()
+}
+
+// isReservedFile returns true if name is that of one of the files, other
+// than step files, that may appear in a session directory.
+func isReservedFile(name string) bool {
+	switch name {
+	case metadataFile, compactedFile, logFile, currentStepFile:
+		return true
+	}
+	return false
+}
+
+// stepFile returns the name of the file used to store the step
+// identified by key.
+func (ds *directorySession) stepFile(key string) string {
+	return filepath.Join(ds.session, stepFileName(key))
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Symbolic links within a store are never followed, since a crafted store
+// could otherwise cause files outside of it to be read, or written, or
+// a walk of the store to loop. Session directories that are symbolic
+// links are skipped by List and Walk and refused by Use, step files that
+// are symbolic links are skipped when the steps of a session are read and
+// refused when read by name, and all such links are reported by Verify.
+// The root directory itself may be a symbolic link.
+
+// isSymlink returns true if info, as returned by os.Lstat, describes a
+// symbolic link.
+func isSymlink(info os.FileInfo) bool {
+	return info.Mode()&os.ModeSymlink != 0
+}
+
+// checkNotSymlink returns an error if filename exists and is a symbolic
+// link.
+func checkNotSymlink(filename string) error {
+	info, err := os.Lstat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if isSymlink(info) {
+		return fmt.Errorf("%v: is a symbolic link", filename)
+	}
+	return nil
+}
+
+// checkSessionDir returns an error if the session directory, or the shard
+// directory containing it, is a symbolic link.
+func (dm *directoryManager) checkSessionDir(dir string) error {
+	if err := checkNotSymlink(dir); err != nil {
+		return err
+	}
+	if parent := filepath.Dir(dir); parent != filepath.Clean(dm.root) {
+		return checkNotSymlink(parent)
+	}
+	return nil
+}
+
+// readFile is like ioutil.ReadFile except that it refuses to read a
+// symbolic link, or a file that is replaced by one while it is being
+// opened. Errors for files that do not exist satisfy os.IsNotExist.
+func readFile(filename string) ([]byte, error) {
+	info, err := os.Lstat(filename)
+	if err != nil {
+		return nil, err
+	}
+	if isSymlink(info) {
+		return nil, fmt.Errorf("%v: is a symbolic link", filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	opened, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !os.SameFile(info, opened) {
+		return nil, fmt.Errorf("%v: was replaced while being opened", filename)
+	}
+	return ioutil.ReadAll(f)
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+const (
+	// trashDir holds the sessions that have been moved to the trash, each
+	// as <trashDir>/<id>/<time trashed>. It is hidden so that it is never
+	// mistaken for a session directory.
+	trashDir = ".trash"
+	// trashTimeFormat is a fixed width layout so that the copies of a
+	// session are trashed in lexical order.
+	trashTimeFormat = "20060102T150405.000000000Z"
+)
+
+// trashedSession is a checkpointstate.TrashedSession and its location.
+type trashedSession struct {
+	checkpointstate.TrashedSession
+	path string
+}
+
+// trashed returns the sessions in the trash in lexical order of their IDs
+// and then of the times that they were trashed. Entries whose names are
+// not valid times are ignored.
+func (dm *directoryManager) trashed() ([]trashedSession, error) {
+	var trashed []trashedSession
+	err := walkDirs(filepath.Join(dm.root, trashDir), func(path, id string) error {
+		return walkDirs(path, func(path, name string) error {
+			when, err := time.Parse(trashTimeFormat, name)
+			if err != nil {
+				return nil
+			}
+			trashed = append(trashed, trashedSession{
+				TrashedSession: checkpointstate.TrashedSession{ID: id, Trashed: when},
+				path:           path,
+			})
+			return nil
+		})
+	})
+	return trashed, err
+}
+
+// Trash implements checkpointstate.Trasher. The session's directory is
+// renamed into the trash whilst it is locked.
+func (dm *directoryManager) Trash(ctx context.Context, id string) error {
+	sess, err := dm.Use(ctx, id, false)
+	if err != nil {
+		return err
+	}
+	ds := sess.(*directorySession)
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(dm.root, trashDir, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	trashed := filepath.Join(dir, time.Now().UTC().Format(trashTimeFormat))
+	if err := os.Rename(ds.session, trashed); err != nil {
+		return err
+	}
+	// A lock file, if one is in use, is renamed along with the session
+	// and must not be restored with it.
+	os.Remove(filepath.Join(trashed, lockFileName))
+	return nil
+}
+
+// Trashed implements checkpointstate.Trasher.
+func (dm *directoryManager) Trashed(ctx context.Context) ([]checkpointstate.TrashedSession, error) {
+	trashed, err := dm.trashed()
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]checkpointstate.TrashedSession, len(trashed))
+	for i, t := range trashed {
+		sessions[i] = t.TrashedSession
+	}
+	return sessions, nil
+}
+
+// Restore implements checkpointstate.Trasher. The root directory is locked,
+// as it is when creating a session, so that the restored session cannot
+// collide with one that is being created.
+func (dm *directoryManager) Restore(ctx context.Context, id string) error {
+	if err := validateSessionID(id); err != nil {
+		return err
+	}
+	trashed, err := dm.trashed()
+	if err != nil {
+		return err
+	}
+	latest := ""
+	for _, t := range trashed {
+		if t.ID == id {
+			latest = t.path
+		}
+	}
+	if len(latest) == 0 {
+		return fmt.Errorf("session %v is not in the trash", id)
+	}
+	unlock, err := dm.opts.lock(ctx, dm.root)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	sessionDir := dm.sessionDir(id)
+	if _, err := os.Lstat(sessionDir); err == nil {
+		return fmt.Errorf("session %v already exists", id)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(sessionDir), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(latest, sessionDir); err != nil {
+		return err
+	}
+	// Remove the session's directory within the trash if it is now empty.
+	os.Remove(filepath.Dir(latest))
+	return nil
+}
+
+// EmptyTrash implements checkpointstate.Trasher.
+func (dm *directoryManager) EmptyTrash(ctx context.Context, ids ...string) ([]checkpointstate.TrashedSession, error) {
+	trashed, err := dm.trashed()
+	if err != nil {
+		return nil, err
+	}
+	selected := map[string]bool{}
+	for _, id := range ids {
+		selected[id] = true
+	}
+	deleted := []checkpointstate.TrashedSession{}
+	for _, t := range trashed {
+		if len(ids) > 0 && !selected[t.ID] {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		if err := os.RemoveAll(t.path); err != nil {
+			return deleted, err
+		}
+		os.Remove(filepath.Dir(t.path))
+		deleted = append(deleted, t.TrashedSession)
+	}
+	return deleted, nil
+}
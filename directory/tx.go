@@ -0,0 +1,237 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// txDir holds a subdirectory per transaction in which the steps completed
+// within that transaction are staged. It is hidden so that staged steps
+// are never mistaken for completed ones. The staging directory of a
+// process that exits without committing or rolling back its transaction
+// is left behind, but its steps are never committed.
+const txDir = ".transactions"
+
+// directoryTx implements checkpointstate.Tx. Steps completed within the
+// transaction are staged as files in its own directory, the step that is
+// in progress within it is held in memory only, and hence neither is
+// visible to other users of the session until the transaction is
+// committed, at which point the staged steps are added to the session's
+// compacted file, which is written atomically.
+type directoryTx struct {
+	ds       *directorySession
+	dir      string
+	finished chan struct{}
+
+	mu      sync.Mutex
+	done    bool
+	current *stepState
+	staged  map[string]bool
+}
+
+// Begin implements checkpointstate.Transactor.
+func (ds *directorySession) Begin(ctx context.Context) (checkpointstate.Tx, error) {
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(ds.session, txDir), 0700); err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(filepath.Join(ds.session, txDir), "")
+	if err != nil {
+		return nil, err
+	}
+	tx := &directoryTx{
+		ds:       ds,
+		dir:      dir,
+		finished: make(chan struct{}),
+		staged:   map[string]bool{},
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			tx.Rollback(context.Background())
+		case <-tx.finished:
+		}
+	}()
+	return tx, nil
+}
+
+// stage records the step in progress within the transaction, if any, as
+// completed in the transaction's directory.
+func (tx *directoryTx) stage(opts checkpointstate.StepOptions) error {
+	if tx.current == nil {
+		return nil
+	}
+	state := *tx.current
+	state.Completed = tx.ds.now()
+	for k, v := range opts.Artifacts {
+		if state.Artifacts == nil {
+			state.Artifacts = map[string]string{}
+		}
+		state.Artifacts[k] = v
+	}
+	state.setCommand(opts)
+	buf, _ := tx.ds.opts.marshal(state)
+	if err := writeFileAtomic(filepath.Join(tx.dir, stepFileName(state.key())), buf, 0600); err != nil {
+		return err
+	}
+	tx.staged[state.key()] = true
+	tx.current = nil
+	return nil
+}
+
+// Step implements checkpointstate.Tx.
+func (tx *directoryTx) Step(ctx context.Context, step string, opts ...checkpointstate.StepOption) (bool, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return false, checkpointstate.ErrTxDone
+	}
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	o := checkpointstate.NewStepOptions(opts...)
+	if len(o.Group) > 0 {
+		return false, fmt.Errorf("step %v: steps in concurrency groups cannot be started within a transaction", step)
+	}
+	key := o.Key(step)
+	if len(step) == 0 {
+		return true, tx.stage(o)
+	}
+	if tx.current != nil && tx.current.key() == key {
+		// The step is being restarted.
+		tx.current.Created = tx.ds.now()
+		return false, nil
+	}
+	if err := tx.stage(checkpointstate.StepOptions{}); err != nil {
+		return false, err
+	}
+	if tx.staged[key] {
+		return true, nil
+	}
+	unlock, err := tx.ds.opts.rlock(ctx, tx.ds.session)
+	done, err := func() (bool, error) {
+		defer unlock()
+		if err != nil {
+			return false, err
+		}
+		return tx.ds.isCompleted(key)
+	}()
+	if err != nil || done {
+		return done, err
+	}
+	tx.current = &stepState{
+		Step:        step,
+		ContentHash: o.ContentHash,
+		Created:     tx.ds.now(),
+		StepFile:    tx.ds.stepFile(key),
+		Artifacts:   o.Artifacts,
+		Phase:       o.Phase,
+		Command:     o.Command,
+		ExitCode:    o.ExitCode,
+	}
+	return false, nil
+}
+
+// finish marks the transaction as done and removes its directory.
+func (tx *directoryTx) finish() error {
+	tx.done = true
+	close(tx.finished)
+	return os.RemoveAll(tx.dir)
+}
+
+// Commit implements checkpointstate.Tx. The staged steps are read back
+// from the transaction's directory and added to the compacted file, and
+// any records of earlier, failed, attempts at them removed, whilst the
+// session is locked.
+func (tx *directoryTx) Commit(ctx context.Context) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return checkpointstate.ErrTxDone
+	}
+	if err := ctx.Err(); err != nil {
+		tx.finish()
+		return err
+	}
+	if err := tx.stage(checkpointstate.StepOptions{}); err != nil {
+		return err
+	}
+	ds := tx.ds
+	unlock, err := ds.lockUnsealed(ctx)
+	defer unlock()
+	if err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(tx.dir)
+	if err != nil {
+		return err
+	}
+	var committed []stepState
+	for _, entry := range entries {
+		if !tx.ds.isStepFile(entry.Name()) {
+			continue
+		}
+		buf, err := readFile(filepath.Join(tx.dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		var state stepState
+		if err := ds.opts.unmarshal(buf, &state); err != nil {
+			return fmt.Errorf("failed to decode staged step %v: %v", entry.Name(), err)
+		}
+		done, err := ds.isCompleted(state.key())
+		if err != nil {
+			return err
+		}
+		if !done {
+			committed = append(committed, state)
+		}
+	}
+	if len(committed) > 0 {
+		compacted, err := ds.readCompacted()
+		if err != nil {
+			return err
+		}
+		if err := ds.writeCompacted(append(compacted, committed...)); err != nil {
+			return err
+		}
+	}
+	// The compacted file now records the steps as completed, whatever
+	// happens from here on.
+	for _, state := range committed {
+		if err := os.Remove(state.StepFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := ds.appendLog(state); err != nil {
+			return err
+		}
+	}
+	if err := ds.updateIndex(committed); err != nil {
+		return err
+	}
+	return tx.finish()
+}
+
+// Rollback implements checkpointstate.Tx.
+func (tx *directoryTx) Rollback(ctx context.Context) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return checkpointstate.ErrTxDone
+	}
+	return tx.finish()
+}
@@ -0,0 +1,283 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package directory
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// verifier accumulates the problems found by Verify.
+type verifier struct {
+	ds       *directorySession
+	fix      bool
+	problems []checkpointstate.Problem
+}
+
+// report records a problem with the named file and, if fixing, calls
+// repair, if any, to repair it.
+func (v *verifier) report(name string, repair func() error, format string, args ...interface{}) error {
+	p := checkpointstate.Problem{File: name, Description: fmt.Sprintf(format, args...)}
+	if v.fix && repair != nil {
+		if err := repair(); err != nil {
+			return fmt.Errorf("failed to repair %v: %v", name, err)
+		}
+		p.Fixed = true
+	}
+	v.problems = append(v.problems, p)
+	return nil
+}
+
+// rewrite returns a repair function that replaces the contents of the
+// named file with val.
+func (v *verifier) rewrite(name string, val interface{}, perm os.FileMode) func() error {
+	return func() error {
+		buf, err := v.ds.opts.marshal(val)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(filepath.Join(v.ds.session, name), buf, perm)
+	}
+}
+
+// remove returns a repair function that removes the named file.
+func (v *verifier) remove(name string) func() error {
+	return func() error {
+		return os.Remove(filepath.Join(v.ds.session, name))
+	}
+}
+
+// Verify implements checkpointstate.Verifier. It reports temporary files
+// left behind by interrupted writes, files that cannot be parsed, step
+// files whose recorded location or name differs from their actual
+// location, in-progress steps, including concurrent ones, that are
+// recorded as being stored outside of the session or that have already
+// been completed, and metadata whose ID differs from that of the session.
+// Symbolic links, which are never followed, are also reported and may be
+// removed. All but step, compacted and metadata files that cannot be parsed, or
+// step files that record a different step, can be repaired without
+// losing information.
+func (ds *directorySession) Verify(ctx context.Context, fix bool) ([]checkpointstate.Problem, error) {
+	var unlock func()
+	var err error
+	if fix {
+		unlock, err = ds.lockUnsealed(ctx)
+	} else {
+		unlock, err = ds.opts.rlock(ctx, ds.session)
+	}
+	defer unlock()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(ds.session)
+	if err != nil {
+		return nil, err
+	}
+	v := &verifier{ds: ds, fix: fix}
+	stepsRepaired := false
+	for _, entry := range entries {
+		name := entry.Name()
+		if isSymlink(entry) {
+			if err := v.report(name, v.remove(name), "symbolic link, which is never followed"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if entry.IsDir() {
+			if name == concurrentDir {
+				if err := v.verifyConcurrent(); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if name == txDir {
+				// Transactions that are in progress stage their steps here.
+				continue
+			}
+			if err := v.report(name, nil, "unexpected directory"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		switch {
+		case name == sealedFile || name == lockFileName || name == logFile || name == currentStepFile:
+			continue
+		case name == indexFile:
+			err = v.verifyIndex()
+		case strings.HasPrefix(name, "."):
+			err = v.report(name, v.remove(name), "temporary file left by an interrupted write")
+		case name == compactedFile:
+			var states []stepState
+			if uerr := v.unmarshal(name, &states); uerr != nil {
+				err = v.report(name, nil, "failed to parse compacted steps: %v", uerr)
+			}
+		case name == metadataFile:
+			err = v.verifyMetadata()
+		default:
+			var repaired bool
+			repaired, err = v.verifyStep(name)
+			stepsRepaired = stepsRepaired || repaired
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := v.verifyCurrent(); err != nil {
+		return nil, err
+	}
+	// The index is rebuilt from the repaired step files when next read.
+	if stepsRepaired {
+		if err := os.Remove(filepath.Join(ds.session, indexFile)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return v.problems, nil
+}
+
+func (v *verifier) unmarshal(name string, val interface{}) error {
+	buf, err := readFile(filepath.Join(v.ds.session, name))
+	if err != nil {
+		return err
+	}
+	return v.ds.opts.unmarshal(buf, val)
+}
+
+func (v *verifier) verifyIndex() error {
+	var states []stepState
+	if err := v.unmarshal(indexFile, &states); err != nil {
+		// The index is rebuilt from the step files if it does not exist.
+		return v.report(indexFile, v.remove(indexFile), "failed to parse index: %v", err)
+	}
+	return nil
+}
+
+func (v *verifier) verifyMetadata() error {
+	var md map[string]interface{}
+	if err := v.unmarshal(metadataFile, &md); err != nil {
+		return v.report(metadataFile, nil, "failed to parse metadata: %v", err)
+	}
+	id := filepath.Base(v.ds.session)
+	recorded, ok := md["ID"].(string)
+	if !ok || recorded == id {
+		return nil
+	}
+	md["ID"] = id
+	rewrite := v.rewrite(metadataFile, md, 0600)
+	return v.report(metadataFile, func() error {
+		v.ds.cache.invalidate()
+		return rewrite()
+	}, "metadata records the session ID as %v rather than %v", recorded, id)
+}
+
+// verifyStep verifies the named step file and returns true if it
+// was repaired.
+func (v *verifier) verifyStep(name string) (bool, error) {
+	var state stepState
+	if err := v.unmarshal(name, &state); err != nil {
+		return false, v.report(name, nil, "failed to parse step: %v", err)
+	}
+	if stepFileName(state.key()) != name {
+		return false, v.report(name, nil, "file records step %v", state.key())
+	}
+	filename := filepath.Join(v.ds.session, name)
+	if state.StepFile == filename {
+		return false, nil
+	}
+	recorded := state.StepFile
+	state.StepFile = filename
+	return v.fix, v.report(name, v.rewrite(name, state, 0400), "step is recorded as being stored in %v", recorded)
+}
+
+func (v *verifier) verifyCurrent() error {
+	state, ok, err := v.ds.readCurrent()
+	if err != nil {
+		return v.report(currentStepFile, v.remove(currentStepFile), "%v", err)
+	}
+	if !ok {
+		return nil
+	}
+	done, err := v.ds.isCompleted(state.key())
+	if err != nil {
+		return err
+	}
+	if done {
+		return v.report(currentStepFile, v.remove(currentStepFile), "in-progress step %v has already been completed", state.key())
+	}
+	stepFile := v.ds.stepFile(state.key())
+	if state.StepFile == stepFile {
+		return nil
+	}
+	recorded := state.StepFile
+	state.StepFile = stepFile
+	return v.report(currentStepFile, v.rewrite(currentStepFile, state, 0600), "in-progress step %v is recorded as being stored in %v", state.key(), recorded)
+}
+
+// verifyConcurrent verifies the markers for in-progress concurrent steps.
+func (v *verifier) verifyConcurrent() error {
+	entries, err := ioutil.ReadDir(filepath.Join(v.ds.session, concurrentDir))
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := filepath.Join(concurrentDir, entry.Name())
+		if isSymlink(entry) {
+			if err := v.report(name, v.remove(name), "symbolic link, which is never followed"); err != nil {
+				return err
+			}
+			continue
+		}
+		if entry.IsDir() {
+			if err := v.report(name, nil, "unexpected directory"); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), ".") {
+			if err := v.report(name, v.remove(name), "temporary file left by an interrupted write"); err != nil {
+				return err
+			}
+			continue
+		}
+		var state stepState
+		if err := v.unmarshal(name, &state); err != nil {
+			if err := v.report(name, v.remove(name), "failed to parse concurrent step: %v", err); err != nil {
+				return err
+			}
+			continue
+		}
+		if stepFileName(state.key()) != entry.Name() {
+			if err := v.report(name, nil, "file records concurrent step %v", state.key()); err != nil {
+				return err
+			}
+			continue
+		}
+		done, err := v.ds.isCompleted(state.key())
+		if err != nil {
+			return err
+		}
+		if done {
+			if err := v.report(name, v.remove(name), "concurrent step %v has already been completed", state.key()); err != nil {
+				return err
+			}
+			continue
+		}
+		stepFile := v.ds.stepFile(state.key())
+		if state.StepFile == stepFile {
+			continue
+		}
+		recorded := state.StepFile
+		state.StepFile = stepFile
+		if err := v.report(name, v.rewrite(name, state, 0600), "concurrent step %v is recorded as being stored in %v", state.key(), recorded); err != nil {
+			return err
+		}
+	}
+	return nil
+}
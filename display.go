@@ -0,0 +1,76 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+const inProgress = "in progress"
+
+// relativeTime returns a human friendly description of t relative to now,
+// eg. "3 minutes ago".
+func relativeTime(t, now time.Time) string {
+	d := now.Sub(t)
+	suffix := "ago"
+	if d < 0 {
+		d, suffix = -d, "from now"
+	}
+	plural := func(n int64, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("1 %s %s", unit, suffix)
+		}
+		return fmt.Sprintf("%d %ss %s", n, unit, suffix)
+	}
+	switch {
+	case d < time.Second:
+		return "just now"
+	case d < time.Minute:
+		return plural(int64(d/time.Second), "second")
+	case d < time.Hour:
+		return plural(int64(d/time.Minute), "minute")
+	case d < 24*time.Hour:
+		return plural(int64(d/time.Hour), "hour")
+	}
+	return plural(int64(d/(24*time.Hour)), "day")
+}
+
+// relativeStep returns a representation of step, suitable for encoding
+// as JSON, with its timestamps relative to now and the completion time
+// of the in-progress step displayed as "in progress".
+func relativeStep(step checkpointstate.Step, now time.Time) map[string]interface{} {
+	buf, _ := json.Marshal(step)
+	var r map[string]interface{}
+	json.Unmarshal(buf, &r)
+	r["Created"] = relativeTime(step.Created, now)
+	switch {
+	case !step.Completed.IsZero():
+		r["Completed"] = relativeTime(step.Completed, now)
+	case !step.Failed.IsZero():
+		r["Failed"] = relativeTime(step.Failed, now)
+	default:
+		r["Completed"] = inProgress
+	}
+	return r
+}
+
+// relativeMetadata returns a copy of md with all RFC3339 timestamps
+// displayed relative to now.
+func relativeMetadata(md map[string]interface{}, now time.Time) map[string]interface{} {
+	r := make(map[string]interface{}, len(md))
+	for k, v := range md {
+		r[k] = v
+		if s, ok := v.(string); ok {
+			if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+				r[k] = relativeTime(t, now)
+			}
+		}
+	}
+	return r
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDumpNDJSON(t *testing.T) {
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(t, 1)
+	defer cleanup()
+	id := mgr.SessionID("session-0000")
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for i := 0; i < 100; i++ {
+		step := fmt.Sprintf("step-%03d", i)
+		if _, err := sess.Step(ctx, step); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, step)
+	}
+	if err := sess.Fail(ctx, want[len(want)-1], "oops"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, relative := range []bool{false, true} {
+		args := []string{"--ndjson", id}
+		if relative {
+			args = append([]string{"--relative"}, args...)
+		}
+		out := &bytes.Buffer{}
+		if _, err := runStatusCmds(ctx, mgr, out, "dump", args); err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		var got []string
+		for i, line := range lines {
+			var step map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &step); err != nil {
+				t.Fatalf("%v: line %v is not valid json: %v: %q", relative, i, err, line)
+			}
+			name, _ := step["Name"].(string)
+			got = append(got, name)
+			if _, failed := step["Failed"]; failed != (name == want[len(want)-1]) {
+				t.Errorf("%v: %v: unexpected failed state: %v", relative, name, line)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", relative, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		verb string
+		args []string
+		err  string
+	}{
+		{"state", []string{"--ndjson", id}, "--ndjson is only supported by dump"},
+		{"dump", []string{"--ndjson", "--reverse", id}, "cannot be used with"},
+		{"dump", []string{"--ndjson", "--format=json", id}, "cannot be used with"},
+		{"dump", []string{"--ndjson", "--raw", id}, "cannot be used with"},
+	} {
+		_, err := runStatusCmds(ctx, mgr, &bytes.Buffer{}, tc.verb, tc.args)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v %v: missing or unexpected error: %v", tc.verb, tc.args, err)
+		}
+	}
+}
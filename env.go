@@ -0,0 +1,59 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime/debug"
+	"text/tabwriter"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// version returns the version of the module that the binary was built
+// from, or "(devel)" if it was not built from a released version.
+func version() string {
+	if info, ok := debug.ReadBuildInfo(); ok && len(info.Main.Version) > 0 {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+// runEnvCmd displays the configuration resolved from the environment,
+// using the same functions as the other commands so that it always
+// reflects what they would use.
+func runEnvCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	if len(args) != 0 {
+		return true, fmt.Errorf("env does not accept any arguments")
+	}
+	backend := backendName()
+	none := func(v string) string {
+		if len(v) == 0 {
+			return "none"
+		}
+		return v
+	}
+	tw := tabwriter.NewWriter(out, 0, 4, 1, ' ', 0)
+	fmt.Fprintf(tw, "backend:\t%v\n", backend)
+	for _, root := range storeLocations(storeSuffixes[backend]) {
+		fmt.Fprintf(tw, "store:\t%v\n", root)
+	}
+	fmt.Fprintf(tw, "namespace:\t%v\n", none(os.Getenv(checkpointNamespaceEnvVar)))
+	if id, source := defaultSessionID(); len(id) > 0 {
+		fmt.Fprintf(tw, "session:\t%v (%v)\n", id, source)
+	} else {
+		fmt.Fprintf(tw, "session:\tnone\n")
+	}
+	if shell, err := detectShell(); err == nil {
+		fmt.Fprintf(tw, "shell:\t%v\n", shell)
+	} else {
+		fmt.Fprintf(tw, "shell:\t%v\n", err)
+	}
+	fmt.Fprintf(tw, "version:\t%v\n", version())
+	return true, tw.Flush()
+}
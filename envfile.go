@@ -0,0 +1,29 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// writeEnvFile appends the session ID, as NAME=value, to filename, creating
+// it if need be. The file is appended to, rather than overwritten, since CI
+// systems, such as GitHub Actions via $GITHUB_ENV, share a single such file
+// between all of the steps of a job.
+func writeEnvFile(filename, id, funcName string) error {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open env file: %v", err)
+	}
+	if _, err := fmt.Fprintf(f, "%s=%s\n", sessionIDEnvVar(funcName), id); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write env file %v: %v", filename, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write env file %v: %v", filename, err)
+	}
+	return nil
+}
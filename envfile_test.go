@@ -0,0 +1,50 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnvFile(t *testing.T) {
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(t, 0)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "envfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "env")
+	use := func(args ...string) {
+		out := &bytes.Buffer{}
+		if _, err := runUseCmd(ctx, mgr, out, append([]string{"--quiet", "--env-file", filename}, args...)); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		// The shell function is not written.
+		if got := out.String(); len(got) != 0 {
+			t.Errorf("%v: unexpected output: %q", args, got)
+		}
+	}
+	use("build")
+	use("--name", "test", "build", "test")
+	use("build")
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	build, test := mgr.SessionID("build"), mgr.SessionID("build", "test")
+	if got, want := string(contents), "CHECKPOINT_SESSION_ID="+build+"\nCHECKPOINT_SESSION_ID_TEST="+test+"\nCHECKPOINT_SESSION_ID="+build+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := runUseCmd(ctx, mgr, ioutil.Discard, []string{"--env-file", filepath.Join(dir, "missing", "env"), "build"}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
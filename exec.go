@@ -0,0 +1,84 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// readPipeline returns the commands in the specified pipeline file, one
+// per line, ignoring blank lines and those starting with #.
+func readPipeline(filename string) ([]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var commands []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commands = append(commands, line)
+	}
+	return commands, sc.Err()
+}
+
+func runExecCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	args, progressOut, err := extractProgressFD(args)
+	if err != nil {
+		return true, err
+	}
+	args, threshold, notify, err := extractNotify(args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) != 1 {
+		return true, fmt.Errorf("a single pipeline file must be specified")
+	}
+	filename, err := filepath.Abs(args[0])
+	if err != nil {
+		return true, err
+	}
+	commands, err := readPipeline(filename)
+	if err != nil {
+		return true, fmt.Errorf("failed to read pipeline %v: %v", filename, err)
+	}
+	id := mgr.SessionID(filename)
+	sess, _, err := mgr.UseWithMetadata(ctx, id, true, map[string]interface{}{
+		"Tags": []string{filename},
+		"ID":   id,
+	})
+	if err != nil {
+		return true, fmt.Errorf("failed to use/create session for %v: %v", filename, err)
+	}
+	sess = journalSession(id, sess)
+	progress := newProgressReporter(id, progressOut)
+	notifier := newStepNotifier(id, threshold, notify)
+	// Each step is named for its command and identified by that command
+	// and its position in the pipeline so that the same command may
+	// appear more than once and editing a line causes it to be rerun.
+	for i, command := range commands {
+		if err := ctx.Err(); err != nil {
+			return true, err
+		}
+		key := checkpointstate.WithContentKey(strconv.Itoa(i), command)
+		if err := runCommandStep(ctx, sess, out, progress, notifier, command, []string{"sh", "-c", command}, key); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,332 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package federation provides a checkpointstate.Manager that presents the
+// sessions of several stores, such as a project specific store and the
+// user's own, as a single store.
+//
+// The stores are ordered by precedence, the first being the primary
+// store. An existing session is always found in, and used from, the
+// first store that contains it, so that a session in one store shadows
+// any session with the same ID in the stores that follow it. New sessions
+// are always created in the primary store. List and Walk return every
+// session that is not shadowed, once, and Locate reports the store that
+// each session is found in and the stores that it shadows.
+package federation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// Store is one of the stores presented by a Manager.
+type Store struct {
+	// Root is the location of the store, it is used only to identify
+	// the store.
+	Root    string
+	Manager checkpointstate.Manager
+}
+
+// Location records the store that a session is found in.
+type Location struct {
+	ID string
+	// Root is the root of the store that the session is used from.
+	Root string
+	// Shadowed lists the roots of the stores, in order of precedence,
+	// that also contain the session, but are not used since Root takes
+	// precedence over them.
+	Shadowed []string `json:",omitempty"`
+}
+
+// Manager is a checkpointstate.Manager for a set of stores.
+type Manager struct {
+	stores []Store
+}
+
+// NewManager returns a Manager for the specified stores, in order of
+// precedence; primary is the store in which new sessions are created.
+func NewManager(primary Store, others ...Store) *Manager {
+	return &Manager{stores: append([]Store{primary}, others...)}
+}
+
+// Stores returns the stores, in order of precedence.
+func (m *Manager) Stores() []Store {
+	return append([]Store(nil), m.stores...)
+}
+
+// SessionID implements checkpointstate.Manager using the primary store.
+func (m *Manager) SessionID(inputs ...string) string {
+	return m.stores[0].Manager.SessionID(inputs...)
+}
+
+// find returns the first store that contains the session id and the
+// session itself, or ok as false if no store contains it.
+func (m *Manager) find(ctx context.Context, id string) (store Store, sess checkpointstate.Session, ok bool, err error) {
+	for _, store := range m.stores {
+		sess, err := store.Manager.Use(ctx, id, false)
+		switch err {
+		case nil:
+			return store, sess, true, nil
+		case checkpointstate.ErrNoSuchSession:
+			continue
+		}
+		return Store{}, nil, false, fmt.Errorf("%v: %v", store.Root, err)
+	}
+	return Store{}, nil, false, nil
+}
+
+// storeFor returns the store that the session id is to be used from,
+// ie. the first that contains it, or the primary store if none do.
+func (m *Manager) storeFor(ctx context.Context, id string) (Store, error) {
+	store, _, ok, err := m.find(ctx, id)
+	if err != nil || ok {
+		return store, err
+	}
+	return m.stores[0], nil
+}
+
+// Use implements checkpointstate.Manager. The returned session is that
+// returned by the Manager of the store that contains it and hence
+// implements the same optional interfaces.
+func (m *Manager) Use(ctx context.Context, id string, reset bool) (checkpointstate.Session, error) {
+	if len(id) == 0 {
+		return nil, checkpointstate.ErrEmptySessionID
+	}
+	if !reset {
+		_, sess, ok, err := m.find(ctx, id)
+		if err == nil && !ok {
+			err = checkpointstate.ErrNoSuchSession
+		}
+		return sess, err
+	}
+	store, err := m.storeFor(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return store.Manager.Use(ctx, id, reset)
+}
+
+// UseWithMetadata implements checkpointstate.Manager.
+func (m *Manager) UseWithMetadata(ctx context.Context, id string, reset bool, initMetadata map[string]interface{}) (checkpointstate.Session, bool, error) {
+	if len(id) == 0 {
+		return nil, false, checkpointstate.ErrEmptySessionID
+	}
+	store, err := m.storeFor(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+	return store.Manager.UseWithMetadata(ctx, id, reset, initMetadata)
+}
+
+// Locate returns the location of every session, in lexical order of
+// the sessions' IDs.
+func (m *Manager) Locate(ctx context.Context) ([]Location, error) {
+	index := map[string]int{}
+	var locations []Location
+	for _, store := range m.stores {
+		ids, err := store.Manager.List(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", store.Root, err)
+		}
+		for _, id := range ids {
+			if i, ok := index[id]; ok {
+				locations[i].Shadowed = append(locations[i].Shadowed, store.Root)
+				continue
+			}
+			index[id] = len(locations)
+			locations = append(locations, Location{ID: id, Root: store.Root})
+		}
+	}
+	sort.SliceStable(locations, func(i, j int) bool {
+		return locations[i].ID < locations[j].ID
+	})
+	return locations, nil
+}
+
+// List implements checkpointstate.Manager. Sessions that are present in
+// more than one store are listed once.
+func (m *Manager) List(ctx context.Context) ([]string, error) {
+	locations, err := m.Locate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(locations))
+	for i, l := range locations {
+		ids[i] = l.ID
+	}
+	return ids, nil
+}
+
+// Walk implements checkpointstate.Manager. Unlike the Walk methods of the
+// underlying stores it must first list the sessions of all of the stores
+// in order to determine which are shadowed.
+func (m *Manager) Walk(ctx context.Context, fn func(id string, sess checkpointstate.Session) error) error {
+	locations, err := m.Locate(ctx)
+	if err != nil {
+		return err
+	}
+	stores := map[string]checkpointstate.Manager{}
+	for _, store := range m.stores {
+		stores[store.Root] = store.Manager
+	}
+	for _, l := range locations {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sess, err := stores[l.Root].Use(ctx, l.ID, false)
+		if err == checkpointstate.ErrNoSuchSession {
+			// The session was deleted after it was listed.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(l.ID, sess); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Locked implements checkpointstate.LockInspector for those stores whose
+// Managers implement it.
+func (m *Manager) Locked(ctx context.Context, id string) (bool, error) {
+	inspector, err := m.lockInspector(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	return inspector.Locked(ctx, id)
+}
+
+// ForceUnlock implements checkpointstate.LockInspector for those stores
+// whose Managers implement it.
+func (m *Manager) ForceUnlock(ctx context.Context, id string) error {
+	inspector, err := m.lockInspector(ctx, id)
+	if err != nil {
+		return err
+	}
+	return inspector.ForceUnlock(ctx, id)
+}
+
+func (m *Manager) lockInspector(ctx context.Context, id string) (checkpointstate.LockInspector, error) {
+	store, err := m.storeFor(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	inspector, ok := store.Manager.(checkpointstate.LockInspector)
+	if !ok {
+		return nil, fmt.Errorf("%v: lock inspection is not supported", store.Root)
+	}
+	return inspector, nil
+}
+
+// trasher returns the checkpointstate.Trasher implemented by the Manager
+// for store.
+func trasher(store Store) (checkpointstate.Trasher, error) {
+	trasher, ok := store.Manager.(checkpointstate.Trasher)
+	if !ok {
+		return nil, fmt.Errorf("%v: the trash is not supported", store.Root)
+	}
+	return trasher, nil
+}
+
+// Trash implements checkpointstate.Trasher for those stores whose Managers
+// implement it. The session is moved to the trash of the store that it is
+// used from.
+func (m *Manager) Trash(ctx context.Context, id string) error {
+	store, _, ok, err := m.find(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return checkpointstate.ErrNoSuchSession
+	}
+	t, err := trasher(store)
+	if err != nil {
+		return err
+	}
+	return t.Trash(ctx, id)
+}
+
+// Trashed implements checkpointstate.Trasher, returning the sessions in
+// the trash of every store whose Manager implements it.
+func (m *Manager) Trashed(ctx context.Context) ([]checkpointstate.TrashedSession, error) {
+	var trashed []checkpointstate.TrashedSession
+	for _, store := range m.stores {
+		t, err := trasher(store)
+		if err != nil {
+			continue
+		}
+		sessions, err := t.Trashed(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", store.Root, err)
+		}
+		trashed = append(trashed, sessions...)
+	}
+	sort.SliceStable(trashed, func(i, j int) bool {
+		if trashed[i].ID == trashed[j].ID {
+			return trashed[i].Trashed.Before(trashed[j].Trashed)
+		}
+		return trashed[i].ID < trashed[j].ID
+	})
+	return trashed, nil
+}
+
+// Restore implements checkpointstate.Trasher. The session is restored
+// to the store whose trash contains its most recently trashed copy.
+func (m *Manager) Restore(ctx context.Context, id string) error {
+	var latest checkpointstate.Trasher
+	var when time.Time
+	for _, store := range m.stores {
+		t, err := trasher(store)
+		if err != nil {
+			continue
+		}
+		sessions, err := t.Trashed(ctx)
+		if err != nil {
+			return fmt.Errorf("%v: %v", store.Root, err)
+		}
+		for _, s := range sessions {
+			if s.ID == id && (latest == nil || s.Trashed.After(when)) {
+				latest, when = t, s.Trashed
+			}
+		}
+	}
+	if latest == nil {
+		return fmt.Errorf("session %v is not in the trash", id)
+	}
+	return latest.Restore(ctx, id)
+}
+
+// EmptyTrash implements checkpointstate.Trasher, emptying the trash of
+// every store whose Manager implements it.
+func (m *Manager) EmptyTrash(ctx context.Context, ids ...string) ([]checkpointstate.TrashedSession, error) {
+	deleted := []checkpointstate.TrashedSession{}
+	for _, store := range m.stores {
+		t, err := trasher(store)
+		if err != nil {
+			continue
+		}
+		sessions, err := t.EmptyTrash(ctx, ids...)
+		deleted = append(deleted, sessions...)
+		if err != nil {
+			return deleted, fmt.Errorf("%v: %v", store.Root, err)
+		}
+	}
+	return deleted, nil
+}
+
+// Init implements checkpointstate.Initializer by initializing the primary
+// store, provided that its Manager implements it.
+func (m *Manager) Init(ctx context.Context) (string, error) {
+	initializer, ok := m.stores[0].Manager.(checkpointstate.Initializer)
+	if !ok {
+		return "", fmt.Errorf("%v: initialization is not supported", m.stores[0].Root)
+	}
+	return initializer.Init(ctx)
+}
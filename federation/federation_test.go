@@ -0,0 +1,222 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package federation_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/cosnicolaou/checkpoint/checkpointstatetest"
+	"github.com/cosnicolaou/checkpoint/directory"
+	"github.com/cosnicolaou/checkpoint/federation"
+)
+
+func newStores(t *testing.T, n int) []federation.Store {
+	dir, err := ioutil.TempDir("", "federation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	stores := make([]federation.Store, n)
+	for i := range stores {
+		root := filepath.Join(dir, string(rune('a'+i)))
+		stores[i] = federation.Store{Root: root, Manager: directory.NewManager(root)}
+	}
+	return stores
+}
+
+func TestConformance(t *testing.T) {
+	checkpointstatetest.RunConformance(t, func(t *testing.T) checkpointstate.Manager {
+		stores := newStores(t, 2)
+		return federation.NewManager(stores[0], stores[1])
+	})
+}
+
+func TestFederation(t *testing.T) {
+	ctx := context.Background()
+	stores := newStores(t, 2)
+	project, home := stores[0], stores[1]
+	mgr := federation.NewManager(project, home)
+
+	newSession := func(mgr checkpointstate.Manager, tag string, steps ...string) string {
+		id := mgr.SessionID(tag)
+		sess, err := mgr.Use(ctx, id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range append(steps, "") {
+			if _, err := sess.Step(ctx, step); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return id
+	}
+	steps := func(id string) []string {
+		sess, err := mgr.Use(ctx, id, false)
+		if err != nil {
+			t.Fatalf("%v: %v", id, err)
+		}
+		steps, err := sess.Steps(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, step := range steps {
+			names = append(names, step.Name)
+		}
+		return names
+	}
+
+	local := newSession(project.Manager, "local", "build")
+	global := newSession(home.Manager, "global", "fetch")
+	both := newSession(project.Manager, "both", "project")
+	if got := newSession(home.Manager, "both", "home"); got != both {
+		t.Fatalf("got %v, want %v", got, both)
+	}
+
+	// Sessions in either store can be used, with the project store taking
+	// precedence for sessions that are in both.
+	for _, tc := range []struct {
+		id    string
+		steps []string
+	}{
+		{local, []string{"build"}},
+		{global, []string{"fetch"}},
+		{both, []string{"project"}},
+	} {
+		if got, want := steps(tc.id), tc.steps; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", tc.id, got, want)
+		}
+	}
+
+	locations, err := mgr.Locate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []federation.Location{
+		{ID: local, Root: project.Root},
+		{ID: global, Root: home.Root},
+		{ID: both, Root: project.Root, Shadowed: []string{home.Root}},
+	}
+	byID := map[string]federation.Location{}
+	for _, l := range locations {
+		byID[l.ID] = l
+	}
+	if got, want := len(locations), len(want); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, w := range want {
+		if got := byID[w.ID]; !reflect.DeepEqual(got, w) {
+			t.Errorf("got %v, want %v", got, w)
+		}
+	}
+
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var walked []string
+	if err := mgr.Walk(ctx, func(id string, sess checkpointstate.Session) error {
+		walked = append(walked, id)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(ids), 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(ids, walked) {
+		t.Errorf("got %v, want %v", walked, ids)
+	}
+
+	// Existing sessions are used from the store that they are found in,
+	// new sessions are created in the primary store.
+	for _, id := range []string{global, mgr.SessionID("new")} {
+		if _, err := mgr.Use(ctx, id, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		store checkpointstate.Manager
+		want  int
+	}{
+		{project.Manager, 3},
+		{home.Manager, 2},
+	} {
+		ids, err := tc.store.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(ids), tc.want; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+
+	// Deleting a session from the primary store exposes the one that
+	// it shadowed.
+	sess, err := mgr.Use(ctx, both, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Delete(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := steps(both), []string{"home"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if _, err := mgr.Use(ctx, mgr.SessionID("missing"), false); err != checkpointstate.ErrNoSuchSession {
+		t.Errorf("unexpected or missing error: %v", err)
+	}
+}
+
+func TestFederationTrash(t *testing.T) {
+	ctx := context.Background()
+	stores := newStores(t, 2)
+	project, home := stores[0], stores[1]
+	mgr := federation.NewManager(project, home)
+
+	id := home.Manager.SessionID("global")
+	if _, err := home.Manager.Use(ctx, id, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := mgr.Trash(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mgr.Use(ctx, id, false); err != checkpointstate.ErrNoSuchSession {
+		t.Errorf("unexpected or missing error: %v", err)
+	}
+	trashed, err := mgr.Trashed(ctx)
+	if err != nil || len(trashed) != 1 || trashed[0].ID != id {
+		t.Errorf("unexpected result: %v, %v", trashed, err)
+	}
+
+	// The session is restored to the store that it was trashed from.
+	if err := mgr.Restore(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := home.Manager.Use(ctx, id, false); err != nil {
+		t.Errorf("session was not restored to its original store: %v", err)
+	}
+	if err := mgr.Trash(ctx, mgr.SessionID("missing")); err != checkpointstate.ErrNoSuchSession {
+		t.Errorf("unexpected or missing error: %v", err)
+	}
+
+	if err := mgr.Trash(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := mgr.EmptyTrash(ctx)
+	if err != nil || len(deleted) != 1 {
+		t.Errorf("unexpected result: %v, %v", deleted, err)
+	}
+	if err := mgr.Restore(ctx, id); err == nil {
+		t.Errorf("expected an error")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// expiresAtField is the metadata field, set by use --ttl, that records
+// the time after which a session may be removed by gc.
+const expiresAtField = "ExpiresAt"
+
+func runGCCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "display, but do not delete, the expired sessions")
+	idle := fs.Duration("idle", 0, "also delete sessions in which no step has been started, completed or failed for this long")
+	if _, err := parseFlags(fs, args); err != nil {
+		return true, err
+	}
+	if *idle < 0 {
+		return true, fmt.Errorf("--idle must not be negative")
+	}
+	now := time.Now()
+	var expired []string
+	err := mgr.Walk(ctx, func(id string, sess checkpointstate.Session) error {
+		md, err := sess.Metadata(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to obtain metadata for session %v: %v", id, err)
+		}
+		if expiresAt, ok := metadataTime(md, expiresAtField); ok && expiresAt.Before(now) {
+			expired = append(expired, id)
+			return nil
+		}
+		if *idle == 0 {
+			return nil
+		}
+		lastActive, ok, err := lastActivity(ctx, sess, md)
+		if err != nil {
+			return fmt.Errorf("failed to summarize session %v: %v", id, err)
+		}
+		if ok && now.Sub(lastActive) > *idle {
+			expired = append(expired, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return true, fmt.Errorf("failed to list sessions: %v", err)
+	}
+	// Sessions are deleted once the walk is complete so as to not
+	// modify the store whilst it is being walked, and in lexical order
+	// since Walk need not visit them in any particular order.
+	sort.Strings(expired)
+	for _, id := range expired {
+		if !*dryRun {
+			if err := deleteSession(ctx, mgr, id); err != nil {
+				return true, err
+			}
+		}
+		fmt.Fprintln(out, id)
+	}
+	return true, nil
+}
+
+// lastActivity returns the time at which a step was last started,
+// completed or failed in sess, as determined by its Summary, or, if it
+// has no steps, the time at which it was last used, or created, as
+// recorded in its metadata, md. It returns false if none of these times
+// are known.
+func lastActivity(ctx context.Context, sess checkpointstate.Session, md map[string]interface{}) (time.Time, bool, error) {
+	summary, err := sess.Summary(ctx)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	if !summary.LastActive.IsZero() {
+		return summary.LastActive, true, nil
+	}
+	for _, field := range []string{"Accessed", "Created"} {
+		if when, ok := metadataTime(md, field); ok {
+			return when, true, nil
+		}
+	}
+	return time.Time{}, false, nil
+}
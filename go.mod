@@ -3,6 +3,8 @@ module github.com/cosnicolaou/checkpoint
 go 1.13
 
 require (
+	github.com/fsnotify/fsnotify v1.6.0
+	go.etcd.io/bbolt v1.3.9
 	golang.org/x/sys v0.7.0
 	v.io/x/lib v0.1.8
 )
@@ -0,0 +1,142 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+const ganttWidth = 50
+
+func runHistoryCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	gantt := fs.Bool("gantt", false, "display the history as a gantt chart")
+	relative := fs.Bool("relative", false, "display timestamps relative to now")
+	reverse := fs.Bool("reverse", false, "display the most recent steps first")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	steps, err := sessionSteps(ctx, sess, *reverse)
+	if err != nil {
+		return true, fmt.Errorf("failed to get session steps %v: %v", id, err)
+	}
+	now := time.Now()
+	if *gantt {
+		printGantt(out, steps, now)
+		return true, nil
+	}
+	printHistory(out, steps, now, *relative)
+	return true, nil
+}
+
+func printHistory(out io.Writer, steps []checkpointstate.Step, now time.Time, relative bool) {
+	format := func(t time.Time) string {
+		if relative {
+			return relativeTime(t, now)
+		}
+		return t.Local().Format(time.RFC3339)
+	}
+	for _, step := range steps {
+		command := formatCommand(step)
+		if !step.Failed.IsZero() {
+			fmt.Fprintf(out, "%v: %v -> failed %v (%v): %v%v\n", step.Name, format(step.Created), format(step.Failed), step.Failed.Sub(step.Created).Round(time.Millisecond), step.Reason, command)
+			continue
+		}
+		if step.InProgress() {
+			fmt.Fprintf(out, "%v: %v -> %v (%v elapsed)%v\n", step.Name, format(step.Created), inProgress, now.Sub(step.Created).Round(time.Millisecond), command)
+			continue
+		}
+		fmt.Fprintf(out, "%v: %v -> %v (%v)%v\n", step.Name, format(step.Created), format(step.Completed), step.Completed.Sub(step.Created).Round(time.Millisecond), command)
+	}
+}
+
+// printGantt displays each step as a bar, scaled to the overall duration
+// of the session, with completed steps drawn using '#', failed steps
+// using 'x' and the in-progress step, which extends to now, using '>'.
+func printGantt(out io.Writer, steps []checkpointstate.Step, now time.Time) {
+	if len(steps) == 0 {
+		return
+	}
+	start, end := steps[0].Created, steps[0].Created
+	nameWidth := 0
+	for _, step := range steps {
+		if step.Created.Before(start) {
+			start = step.Created
+		}
+		finished := stepFinished(step, now)
+		if finished.After(end) {
+			end = finished
+		}
+		if l := len(step.Name); l > nameWidth {
+			nameWidth = l
+		}
+	}
+	total := end.Sub(start)
+	column := func(t time.Time) int {
+		if total <= 0 {
+			return 0
+		}
+		return int(int64(ganttWidth) * int64(t.Sub(start)) / int64(total))
+	}
+	for _, step := range steps {
+		finished, mark, suffix := stepFinished(step, now), "#", ""
+		switch {
+		case !step.Failed.IsZero():
+			mark, suffix = "x", " (failed)"
+		case step.InProgress():
+			mark, suffix = ">", " (in progress)"
+		}
+		// Steps that finished before they were created, due to clock skew
+		// or as imported, are drawn as starting and finishing at once.
+		from, to := clampColumn(column(step.Created)), clampColumn(column(finished))
+		if to < from {
+			to = from
+		}
+		if to == from && to < ganttWidth {
+			to++
+		}
+		bar := strings.Repeat(" ", from) + strings.Repeat(mark, to-from) + strings.Repeat(" ", ganttWidth-to)
+		fmt.Fprintf(out, "%-*s |%s| %v%s\n", nameWidth, step.Name, bar, finished.Sub(step.Created).Round(time.Millisecond), suffix)
+	}
+}
+
+// clampColumn limits col to the columns of a gantt chart.
+func clampColumn(col int) int {
+	switch {
+	case col < 0:
+		return 0
+	case col > ganttWidth:
+		return ganttWidth
+	}
+	return col
+}
+
+// stepFinished returns the time at which the step completed or failed,
+// or now if it is still in progress.
+func stepFinished(step checkpointstate.Step, now time.Time) time.Time {
+	switch {
+	case !step.Completed.IsZero():
+		return step.Completed
+	case !step.Failed.IsZero():
+		return step.Failed
+	}
+	return now
+}
@@ -0,0 +1,104 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sessionIDFromFD is the session ID read from the file descriptor
+// specified via --id-fd, if any.
+var sessionIDFromFD string
+
+// extractIDFD removes --id-fd, and its value, from args, wherever it
+// appears before any "--", and reads the session ID from the specified
+// file descriptor. The flag is accepted anywhere so that it may be
+// supplied to any command, or to a step, without each of them having to
+// define it.
+func extractIDFD(args []string) ([]string, error) {
+	args, fd, ok, err := extractFDFlag(args, "id-fd")
+	if err != nil || !ok {
+		return args, err
+	}
+	if sessionIDFromFD, err = readSessionIDFD(fd); err != nil {
+		return nil, err
+	}
+	return args, nil
+}
+
+// extractFDFlag removes the first occurrence of --<name>, and its value,
+// a file descriptor, from args, provided that it appears before any "--",
+// and returns that file descriptor and true if it was found.
+func extractFDFlag(args []string, name string) ([]string, int, bool, error) {
+	args, value, ok, err := extractFlagValue(args, name, "a file descriptor")
+	if err != nil || !ok {
+		return args, 0, ok, err
+	}
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 0 {
+		return nil, 0, false, fmt.Errorf("--%v requires a file descriptor: %q", name, value)
+	}
+	return args, fd, true, nil
+}
+
+// extractFlagValue removes the first occurrence of --<name>, and its
+// value, from args, provided that it appears before any "--", and returns
+// that value and true if it was found. what describes the value in the
+// error returned when it is missing.
+func extractFlagValue(args []string, name, what string) ([]string, string, bool, error) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		switch {
+		case strings.HasPrefix(arg, "--"+name+"="):
+			value := strings.TrimPrefix(arg, "--"+name+"=")
+			return append(args[:i:i], args[i+1:]...), value, true, nil
+		case arg == "--"+name:
+			if i+1 >= len(args) {
+				return nil, "", false, fmt.Errorf("--%v requires %v", name, what)
+			}
+			return append(args[:i:i], args[i+2:]...), args[i+1], true, nil
+		}
+	}
+	return args, "", false, nil
+}
+
+// readSessionIDFD reads a session ID, ignoring surrounding white space,
+// from the specified file descriptor until it is closed.
+func readSessionIDFD(fd int) (string, error) {
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %v", fd))
+	if f == nil {
+		return "", fmt.Errorf("invalid file descriptor: %v", fd)
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the session id from file descriptor %v: %v", fd, err)
+	}
+	id := strings.TrimSpace(string(buf))
+	if len(id) == 0 {
+		return "", fmt.Errorf("no session id was read from file descriptor %v", fd)
+	}
+	return id, nil
+}
+
+// defaultSessionID returns the session ID to be used when none is
+// specified as an argument, namely the one read via --id-fd, if any,
+// or that specified via the CHECKPOINT_SESSION_ID environment variable,
+// along with a description of where it was obtained from.
+func defaultSessionID() (string, string) {
+	if len(sessionIDFromFD) > 0 {
+		return sessionIDFromFD, "id-fd"
+	}
+	return os.Getenv(checkpointSessionIDEnvVar), checkpointSessionIDEnvVar
+}
+
+// errNoSession is returned when no session ID has been specified.
+var errNoSession = fmt.Errorf("no session found either as an argument, via --id-fd or as environment variable %v", checkpointSessionIDEnvVar)
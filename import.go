@@ -0,0 +1,276 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// importProgressInterval is the number of sessions between the progress
+// reports written by import --bulk.
+const importProgressInterval = 100
+
+// exportedSession is a session as written by dump --format=json.
+type exportedSession struct {
+	Metadata map[string]interface{} `json:"metadata"`
+	Steps    []checkpointstate.Step `json:"steps"`
+}
+
+// importingKey is the metadata key that marks a session as being in the
+// process of being imported. It is written before the session's steps are
+// imported and is replaced by the session's own metadata once they have
+// been, so that a session whose import failed part way can be recognized
+// as such, rather than being confused with one created without metadata.
+const importingKey = "Importing"
+
+// isPartialImport returns true if md marks a session whose import failed
+// part way.
+func isPartialImport(md map[string]interface{}) bool {
+	importing, _ := md[importingKey].(bool)
+	return importing
+}
+
+// importSession creates the session described by exported, with the same
+// ID, metadata and completed and failed steps. An existing session with
+// the same ID is left as is, and false returned, unless it is one whose
+// import failed part way or force is true, in which case it is moved to
+// the trash, if supported, and replaced.
+func importSession(ctx context.Context, mgr checkpointstate.Manager, exported exportedSession, force bool) (string, bool, error) {
+	id, _ := exported.Metadata["ID"].(string)
+	if len(id) == 0 {
+		return "", false, fmt.Errorf("the session's metadata does not contain its ID")
+	}
+	if existing, err := mgr.Use(ctx, id, false); err == nil {
+		md, err := existing.Metadata(ctx)
+		if err != nil {
+			return id, false, fmt.Errorf("failed to read metadata for %v: %v", id, err)
+		}
+		if !isPartialImport(md) && !force {
+			return id, false, nil
+		}
+		if err := removeSession(ctx, mgr, id, false); err != nil {
+			return id, false, err
+		}
+	}
+	sess, err := mgr.Use(ctx, id, true)
+	if err != nil {
+		return id, false, fmt.Errorf("failed to create session %v: %v", id, err)
+	}
+	importer, ok := sess.(checkpointstate.Importer)
+	if !ok {
+		sess.Delete(ctx)
+		return id, false, fmt.Errorf("import is not supported")
+	}
+	if err := sess.SetMetadata(ctx, map[string]interface{}{importingKey: true}); err != nil {
+		return id, false, fmt.Errorf("failed to mark %v as being imported: %v", id, err)
+	}
+	if err := importer.Import(ctx, exported.Steps); err != nil {
+		return id, false, fmt.Errorf("failed to import steps for %v: %v", id, err)
+	}
+	if err := sess.SetMetadata(ctx, exported.Metadata); err != nil {
+		return id, false, fmt.Errorf("failed to write metadata for %v: %v", id, err)
+	}
+	return id, true, nil
+}
+
+// openExport opens filename, or stdin if filename is -.
+func openExport(filename string) (io.ReadCloser, error) {
+	if filename == "-" {
+		return ioutil.NopCloser(os.Stdin), nil
+	}
+	return os.Open(filename)
+}
+
+// exportFiles returns the files named by paths, replacing each directory
+// with the files, other than hidden ones, that it contains.
+func exportFiles(paths []string) ([]string, error) {
+	var files []string
+	for _, path := range paths {
+		if path == "-" {
+			files = append(files, path)
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+// importResult is the outcome of importing a session, or of failing to
+// read it from source.
+type importResult struct {
+	source   string
+	id       string
+	imported bool
+	err      error
+}
+
+// readExports passes a function that imports each of the sessions in each
+// of files to send, in order. send blocks until a worker is ready for it,
+// so that no more than one session per worker is held in memory at once.
+// A file that cannot be read, or decoded, is reported on results and the
+// rest of its sessions are skipped. Any session with the same ID as one
+// that has already been read is reported as having failed, rather than
+// being imported, since the two would otherwise be imported concurrently.
+func readExports(mgr checkpointstate.Manager, files []string, force bool, send func(func(context.Context) error) error, results chan<- importResult) error {
+	dispatched := map[string]string{}
+	for _, file := range files {
+		file := file
+		var serr error
+		err := func() error {
+			rd, err := openExport(file)
+			if err != nil {
+				return err
+			}
+			defer rd.Close()
+			dec := json.NewDecoder(rd)
+			for {
+				var exported exportedSession
+				if err := dec.Decode(&exported); err != nil {
+					if err == io.EOF {
+						return nil
+					}
+					return fmt.Errorf("failed to decode session: %v", err)
+				}
+				if id, _ := exported.Metadata["ID"].(string); len(id) > 0 {
+					if prev, ok := dispatched[id]; ok {
+						results <- importResult{source: file, id: id, err: fmt.Errorf("duplicate of the session in %v", prev)}
+						continue
+					}
+					dispatched[id] = file
+				}
+				serr = send(func(ctx context.Context) error {
+					id, imported, err := importSession(ctx, mgr, exported, force)
+					results <- importResult{source: file, id: id, imported: imported, err: err}
+					return nil
+				})
+				if serr != nil {
+					return serr
+				}
+			}
+		}()
+		if serr != nil {
+			return serr
+		}
+		if err != nil {
+			results <- importResult{source: file, err: err}
+		}
+	}
+	return nil
+}
+
+// bulkImport imports all of the sessions in files using parallel workers,
+// displaying any failures and a summary on out and reporting progress on
+// progress. It returns an error if any session could not be imported.
+func bulkImport(ctx context.Context, mgr checkpointstate.Manager, out, progress io.Writer, files []string, parallel int, force bool) error {
+	results := make(chan importResult, parallel)
+	go func() {
+		defer close(results)
+		// Failures are reported on results and so the only error that
+		// runParallel can return is ctx.Err(), which is checked below.
+		runParallel(ctx, parallel, func(send func(func(context.Context) error) error) error {
+			return readExports(mgr, files, force, send, results)
+		})
+	}()
+	var imported, skipped, failed int
+	for result := range results {
+		switch {
+		case result.err != nil:
+			failed++
+			if len(result.id) > 0 {
+				fmt.Fprintf(out, "%v: %v: failed: %v\n", result.source, result.id, result.err)
+			} else {
+				fmt.Fprintf(out, "%v: failed: %v\n", result.source, result.err)
+			}
+		case result.imported:
+			imported++
+		default:
+			skipped++
+		}
+		if n := imported + skipped + failed; n%importProgressInterval == 0 {
+			fmt.Fprintf(progress, "import: %v sessions processed\n", n)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "imported: %v, skipped: %v, failed: %v\n", imported, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to import %v sessions", failed)
+	}
+	return nil
+}
+
+func runImportCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	bulk := fs.Bool("bulk", false, "import all of the sessions in the specified files and directories")
+	force := fs.Bool("force", false, "replace existing sessions with the same IDs, moving them to the trash if supported")
+	parallel := fs.Int("parallel", runtime.NumCPU(), "the number of sessions to import concurrently with --bulk")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if !*bulk {
+		if len(args) != 1 {
+			return true, fmt.Errorf("import requires a single file, use --bulk to import more than one session")
+		}
+		rd, err := openExport(args[0])
+		if err != nil {
+			return true, err
+		}
+		defer rd.Close()
+		var exported exportedSession
+		if err := json.NewDecoder(rd).Decode(&exported); err != nil {
+			return true, fmt.Errorf("failed to decode session from %v: %v", args[0], err)
+		}
+		id, imported, err := importSession(ctx, mgr, exported, *force)
+		if err != nil {
+			return true, err
+		}
+		if !imported {
+			return true, fmt.Errorf("session %v already exists, use --force to replace it", id)
+		}
+		fmt.Fprintln(out, id)
+		return true, nil
+	}
+	if len(args) == 0 {
+		return true, fmt.Errorf("import --bulk requires at least one file or directory")
+	}
+	if *parallel < 1 {
+		return true, fmt.Errorf("invalid --parallel: %v", *parallel)
+	}
+	files, err := exportFiles(args)
+	if err != nil {
+		return true, err
+	}
+	return true, bulkImport(ctx, mgr, out, os.Stderr, files, *parallel, *force)
+}
@@ -0,0 +1,261 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/cosnicolaou/checkpoint/directory"
+)
+
+func TestBulkImport(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := directory.NewManager(filepath.Join(dir, "src"))
+	dst := directory.NewManager(filepath.Join(dir, "dst"))
+	exports := filepath.Join(dir, "exports")
+	if err := os.Mkdir(exports, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// Create, and export, several sessions, the last two of them to the
+	// same file.
+	const nsessions = 5
+	var ids []string
+	for i := 0; i < nsessions; i++ {
+		tags := []string{fmt.Sprintf("session-%v", i)}
+		id := src.SessionID(tags...)
+		sess, _, err := src.UseWithMetadata(ctx, id, true, map[string]interface{}{"ID": id, "Tags": tags})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j <= i; j++ {
+			if _, err := sess.Step(ctx, fmt.Sprintf("step-%v", j)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := sess.Fail(ctx, "", "oops"); err != nil {
+			t.Fatal(err)
+		}
+		out := &bytes.Buffer{}
+		if _, err := runStatusCmds(ctx, src, out, "dump", []string{"--format=json", id}); err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("%v.json", i)
+		if i == nsessions-1 {
+			name = fmt.Sprintf("%v.json", i-1)
+		}
+		f, err := os.OpenFile(filepath.Join(exports, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(out.Bytes())
+		f.Close()
+		ids = append(ids, id)
+	}
+	// Hidden files are ignored.
+	if err := ioutil.WriteFile(filepath.Join(exports, ".ignored"), []byte("not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	bulk := func(args ...string) (string, error) {
+		out := &bytes.Buffer{}
+		files, err := exportFiles(args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bulkImport(ctx, dst, out, ioutil.Discard, files, 2, false)
+		return out.String(), err
+	}
+	summary, err := bulk(exports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := summary, "imported: 5, skipped: 0, failed: 0\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The imported sessions have the same metadata and steps as the
+	// originals.
+	for _, id := range ids {
+		state := func(mgr checkpointstate.Manager) (map[string]interface{}, []checkpointstate.Step) {
+			sess, err := mgr.Use(ctx, id, false)
+			if err != nil {
+				t.Fatalf("%v: %v", id, err)
+			}
+			md, err := sess.Metadata(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			steps, err := sess.Steps(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return md, steps
+		}
+		srcMD, srcSteps := state(src)
+		dstMD, dstSteps := state(dst)
+		if got, want := dstMD, srcMD; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", id, got, want)
+		}
+		if got, want := len(dstSteps), len(srcSteps); got != want {
+			t.Fatalf("%v: got %v, want %v", id, got, want)
+		}
+		for i := range srcSteps {
+			got, want := dstSteps[i], srcSteps[i]
+			if got.Name != want.Name || !got.Created.Equal(want.Created) || !got.Completed.Equal(want.Completed) || !got.Failed.Equal(want.Failed) || got.Reason != want.Reason {
+				t.Errorf("%v: got %v, want %v", id, got, want)
+			}
+		}
+	}
+
+	// Existing sessions are skipped and unreadable files reported.
+	bad := filepath.Join(dir, "bad.json")
+	if err := ioutil.WriteFile(bad, []byte(`{"metadata": {}}{`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = bulk(exports, bad)
+	if err == nil || !strings.Contains(err.Error(), "failed to import 2 sessions") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		"bad.json: failed: the session's metadata does not contain its ID\n",
+		"bad.json: failed: failed to decode session: unexpected EOF\n",
+		"imported: 0, skipped: 5, failed: 2\n",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("%q does not contain %q", summary, want)
+		}
+	}
+
+	// Sessions whose import failed part way, and hence are marked as
+	// being imported, are replaced, but sessions that merely lack
+	// metadata, or their ID, are left as is.
+	for i, md := range []map[string]interface{}{
+		{importingKey: true},
+		nil,
+		{"Tags": []string{"no-id"}},
+	} {
+		sess, err := dst.Use(ctx, ids[i+1], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.SetMetadata(ctx, md); err != nil {
+			t.Fatal(err)
+		}
+	}
+	summary, err = bulk(exports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := summary, "imported: 1, skipped: 4, failed: 0\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	for i, id := range ids[1:4] {
+		sess, err := dst.Use(ctx, id, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		md, err := sess.Metadata(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := md["ID"] == id, i == 0; got != want {
+			t.Errorf("%v: got imported %v, want %v: %v", id, got, want, md)
+		}
+	}
+	if trashed, err := dst.(checkpointstate.Trasher).Trashed(ctx); err != nil || len(trashed) != 1 {
+		t.Errorf("unexpected trash: %v: %v", trashed, err)
+	}
+
+	// Sessions that appear more than once are only imported once.
+	dup := filepath.Join(dir, "dup.json")
+	buf, err := ioutil.ReadFile(filepath.Join(exports, "0.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dup, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	summary, err = bulk(exports, dup)
+	if err == nil || !strings.Contains(err.Error(), "failed to import 1 sessions") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("dup.json: %v: failed: duplicate of the session in %v\n", ids[0], filepath.Join(exports, "0.json")),
+		"imported: 0, skipped: 5, failed: 1\n",
+	} {
+		if !strings.Contains(summary, want) {
+			t.Errorf("%q does not contain %q", summary, want)
+		}
+	}
+
+	// --force replaces existing sessions.
+	out := &bytes.Buffer{}
+	if _, err := runImportCmd(ctx, dst, out, []string{filepath.Join(exports, "0.json")}); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if _, err := runImportCmd(ctx, dst, out, []string{"--force", filepath.Join(exports, "0.json")}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), ids[0]+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if trashed, err := dst.(checkpointstate.Trasher).Trashed(ctx); err != nil || len(trashed) != 2 {
+		t.Errorf("unexpected trash: %v: %v", trashed, err)
+	}
+}
+
+func TestImportWithoutTags(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	export := filepath.Join(dir, "export.json")
+	if err := ioutil.WriteFile(export, []byte(`{"metadata":{"ID":"abc"},"steps":[]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runImportCmd(ctx, mgr, ioutil.Discard, []string{export}); err != nil {
+		t.Fatal(err)
+	}
+	// Sessions without tags, whether imported as such or left by an
+	// import that failed part way, are displayed without them.
+	for _, md := range []map[string]interface{}{nil, {importingKey: true}} {
+		if md != nil {
+			sess, err := mgr.Use(ctx, "abc", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sess.SetMetadata(ctx, md); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, verb := range []string{"state", "status"} {
+			out := &bytes.Buffer{}
+			if _, err := runStatusCmds(ctx, mgr, out, verb, []string{"abc"}); err != nil {
+				t.Errorf("%v: %v: %v", md, verb, err)
+			}
+			if got, want := out.String(), ": "; !strings.HasPrefix(got, want) {
+				t.Errorf("%v: %v: got %q, want prefix %q", md, verb, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// initRCFiles are the files in which each supported shell's persistent
+// setup is conventionally placed.
+var initRCFiles = map[string]string{
+	"bash": "~/.bashrc",
+	"zsh":  "~/.zshrc",
+	"fish": "~/.config/fish/config.fish",
+}
+
+func runInitCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	shell := fs.String("shell", filepath.Base(os.Getenv("SHELL")), "the shell to display the setup for, one of bash, zsh or fish")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) != 0 {
+		return true, fmt.Errorf("init does not accept any arguments")
+	}
+	rcFile, ok := initRCFiles[*shell]
+	if !ok {
+		return true, fmt.Errorf("unsupported shell: %q", *shell)
+	}
+	switch *shell {
+	case "bash":
+		err = checkBashVersion()
+	case "zsh":
+		err = checkZshVersion()
+	}
+	if err != nil {
+		return true, err
+	}
+	initializer, ok := mgr.(checkpointstate.Initializer)
+	if !ok {
+		return true, fmt.Errorf("initialization is not supported")
+	}
+	location, err := initializer.Init(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to initialize the checkpoint store: %v", err)
+	}
+	// The output consists of comments and commands so that it may be
+	// appended to the shell's startup file as is.
+	cmd := filepath.Base(os.Args[0])
+	fmt.Fprintf(out, "# checkpoint store: %v\n", location)
+	fmt.Fprintf(out, "# Add the following to %v to enable command line completion:\n", rcFile)
+	if *shell == "fish" {
+		fmt.Fprintf(out, "%v completion fish | source\n", cmd)
+		fmt.Fprintf(out, "# Note that scripts that use checkpoint must be run by bash or zsh.\n")
+		return true, nil
+	}
+	fmt.Fprintf(out, "source <(%v completion %v)\n", cmd, *shell)
+	fmt.Fprintf(out, `# Scripts record their progress by using a session named for the script
+# and then calling completed before each step, eg:
+#   source <(%v use $0)
+#   completed step1 || <action>
+`, cmd)
+	return true, nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+// Package journal provides a checkpointstate.Manager that records each
+// step transition, ie. a step being started, completed, failed or
+// aborted, in the system log whilst delegating the storage of sessions
+// to another Manager.
+package journal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// Writer represents the system log; it is implemented by *syslog.Writer.
+type Writer interface {
+	Info(msg string) error
+	Warning(msg string) error
+}
+
+type manager struct {
+	checkpointstate.Manager
+	w Writer
+}
+
+// NewManager returns a checkpointstate.Manager that records the step
+// transitions of the sessions returned by mgr's Use, UseWithMetadata and
+// Walk methods in w. Note that those sessions do not implement any of the
+// optional interfaces, such as checkpointstate.Sealer, that may be
+// implemented by mgr's sessions, NewSession may be used to record the
+// transitions of individual sessions instead.
+func NewManager(mgr checkpointstate.Manager, w Writer) checkpointstate.Manager {
+	return &manager{Manager: mgr, w: w}
+}
+
+// Use implements checkpointstate.Manager.
+func (m *manager) Use(ctx context.Context, id string, reset bool) (checkpointstate.Session, error) {
+	sess, err := m.Manager.Use(ctx, id, reset)
+	if err != nil {
+		return nil, err
+	}
+	return NewSession(id, sess, m.w), nil
+}
+
+// UseWithMetadata implements checkpointstate.Manager.
+func (m *manager) UseWithMetadata(ctx context.Context, id string, reset bool, initMetadata map[string]interface{}) (checkpointstate.Session, bool, error) {
+	sess, created, err := m.Manager.UseWithMetadata(ctx, id, reset, initMetadata)
+	if err != nil {
+		return nil, false, err
+	}
+	return NewSession(id, sess, m.w), created, nil
+}
+
+// Walk implements checkpointstate.Manager.
+func (m *manager) Walk(ctx context.Context, fn func(id string, sess checkpointstate.Session) error) error {
+	return m.Manager.Walk(ctx, func(id string, sess checkpointstate.Session) error {
+		return fn(id, NewSession(id, sess, m.w))
+	})
+}
+
+type session struct {
+	checkpointstate.Session
+	id   string
+	w    Writer
+	tags *string
+}
+
+// NewSession returns a checkpointstate.Session that records the step
+// transitions of sess, whose ID is id, in w. Each entry includes the
+// session's tags, the step's name and, for completed and failed steps,
+// the time since the step was started. Errors writing to w are ignored
+// since the log is purely observational.
+func NewSession(id string, sess checkpointstate.Session, w Writer) checkpointstate.Session {
+	return &session{Session: sess, id: id, w: w}
+}
+
+// stepKey returns the key that identifies step, see StepOptions.Key.
+func stepKey(step checkpointstate.Step) string {
+	if len(step.ContentHash) > 0 {
+		return step.ContentHash
+	}
+	return step.Name
+}
+
+// sessionTags returns the session's tags, as recorded in its metadata by
+// the checkpoint command, read once and then cached.
+func (s *session) sessionTags(ctx context.Context) string {
+	if s.tags != nil {
+		return *s.tags
+	}
+	var tags []string
+	if md, err := s.Session.Metadata(ctx); err == nil {
+		if list, ok := md["Tags"].([]interface{}); ok {
+			for _, tag := range list {
+				tags = append(tags, fmt.Sprintf("%v", tag))
+			}
+		}
+	}
+	joined := strings.Join(tags, ",")
+	s.tags = &joined
+	return joined
+}
+
+// record writes an entry for the specified step's transition; started,
+// if not zero, is the time at which the step was started.
+func (s *session) record(ctx context.Context, warning bool, step, event string, started time.Time, extra ...string) {
+	msg := fmt.Sprintf("session=%v tags=%q step=%q event=%v", s.id, s.sessionTags(ctx), step, event)
+	if !started.IsZero() {
+		msg += fmt.Sprintf(" duration=%v", time.Since(started).Round(time.Millisecond))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		msg += fmt.Sprintf(" %v=%q", extra[i], extra[i+1])
+	}
+	if warning {
+		s.w.Warning(msg)
+		return
+	}
+	s.w.Info(msg)
+}
+
+// inProgress returns the in-progress step identified by key, or the
+// current step if key is empty.
+func (s *session) inProgress(ctx context.Context, key string) *checkpointstate.Step {
+	if current, err := s.Session.Current(ctx); err == nil && current != nil {
+		if len(key) == 0 || stepKey(*current) == key {
+			return current
+		}
+	}
+	if len(key) == 0 {
+		return nil
+	}
+	steps, err := s.Session.Steps(ctx)
+	if err != nil {
+		return nil
+	}
+	for _, step := range steps {
+		if step.InProgress() && stepKey(step) == key {
+			return &step
+		}
+	}
+	return nil
+}
+
+// Step implements checkpointstate.Session. Starting a step, or requesting
+// no step, completes the current step, if any.
+func (s *session) Step(ctx context.Context, step string, opts ...checkpointstate.StepOption) (bool, error) {
+	current := s.inProgress(ctx, "")
+	done, err := s.Session.Step(ctx, step, opts...)
+	if err != nil {
+		return done, err
+	}
+	o := checkpointstate.NewStepOptions(opts...)
+	key := o.Key(step)
+	if current != nil && stepKey(*current) != key {
+		s.record(ctx, false, current.Name, "completed", current.Created)
+	}
+	if len(step) > 0 && !done && (current == nil || stepKey(*current) != key) {
+		if len(o.Group) > 0 {
+			s.record(ctx, false, step, "started", time.Time{}, "group", o.Group)
+		} else {
+			s.record(ctx, false, step, "started", time.Time{})
+		}
+	}
+	return done, nil
+}
+
+// Complete implements checkpointstate.Session.
+func (s *session) Complete(ctx context.Context, step string, opts ...checkpointstate.StepOption) error {
+	key := checkpointstate.NewStepOptions(opts...).Key(step)
+	started := s.inProgress(ctx, key)
+	if err := s.Session.Complete(ctx, step, opts...); err != nil {
+		return err
+	}
+	// Completing a step that was not in progress, ie. one that has
+	// already been completed, is a no-op and is not recorded.
+	if started != nil {
+		s.record(ctx, false, step, "completed", started.Created)
+	}
+	return nil
+}
+
+// Fail implements checkpointstate.Session.
+func (s *session) Fail(ctx context.Context, step, reason string) error {
+	started := s.inProgress(ctx, step)
+	if err := s.Session.Fail(ctx, step, reason); err != nil {
+		return err
+	}
+	var created time.Time
+	if started != nil {
+		step, created = started.Name, started.Created
+	}
+	s.record(ctx, true, step, "failed", created, "reason", reason)
+	return nil
+}
+
+// Abort implements checkpointstate.Session.
+func (s *session) Abort(ctx context.Context) error {
+	current := s.inProgress(ctx, "")
+	if err := s.Session.Abort(ctx); err != nil {
+		return err
+	}
+	if current != nil {
+		s.record(ctx, true, current.Name, "aborted", current.Created)
+	}
+	return nil
+}
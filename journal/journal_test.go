@@ -0,0 +1,96 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package journal_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"testing"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/cosnicolaou/checkpoint/directory"
+	"github.com/cosnicolaou/checkpoint/journal"
+)
+
+type fakeWriter struct {
+	entries []string
+}
+
+var durationRE = regexp.MustCompile(`duration=[^ ]+`)
+
+func (fw *fakeWriter) write(level, msg string) error {
+	fw.entries = append(fw.entries, level+": "+durationRE.ReplaceAllString(msg, "duration=d"))
+	return nil
+}
+
+func (fw *fakeWriter) Info(msg string) error {
+	return fw.write("info", msg)
+}
+
+func (fw *fakeWriter) Warning(msg string) error {
+	return fw.write("warning", msg)
+}
+
+func TestJournal(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fw := &fakeWriter{}
+	mgr := journal.NewManager(directory.NewManager(dir), fw)
+	sess, err := mgr.Use(ctx, "id", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.SetMetadata(ctx, map[string]interface{}{"Tags": []interface{}{"a", "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	step := func(name string, opts ...checkpointstate.StepOption) {
+		t.Helper()
+		if _, err := sess.Step(ctx, name, opts...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	step("s1")
+	step("s2")
+	if err := sess.Fail(ctx, "", "oops"); err != nil {
+		t.Fatal(err)
+	}
+	step("s3", checkpointstate.WithGroup("g"))
+	if err := sess.Complete(ctx, "s3"); err != nil {
+		t.Fatal(err)
+	}
+	step("s4")
+	if err := sess.Abort(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// Neither completed steps nor requesting no step, when no step is
+	// in progress, are transitions.
+	step("s1")
+	step("")
+	// Failed operations are not recorded.
+	if err := sess.Abort(ctx); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	prefix := `session=id tags="a,b" `
+	if got, want := fw.entries, []string{
+		"info: " + prefix + `step="s1" event=started`,
+		"info: " + prefix + `step="s1" event=completed duration=d`,
+		"info: " + prefix + `step="s2" event=started`,
+		"warning: " + prefix + `step="s2" event=failed duration=d reason="oops"`,
+		"info: " + prefix + `step="s3" event=started group="g"`,
+		"info: " + prefix + `step="s3" event=completed duration=d`,
+		"info: " + prefix + `step="s4" event=started`,
+		"warning: " + prefix + `step="s4" event=aborted duration=d`,
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %#v, want %#v", got, want)
+	}
+}
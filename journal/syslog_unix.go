@@ -0,0 +1,16 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package journal
+
+import "log/syslog"
+
+// Dial returns a Writer for the local system log, which on systems that
+// use systemd is forwarded to journald, using tag to identify entries.
+func Dial(tag string) (Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_USER, tag)
+}
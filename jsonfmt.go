@@ -0,0 +1,43 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// defaultJSONIndent is the indentation used by list and dump unless
+// --indent or --compact is specified.
+const defaultJSONIndent = " "
+
+// jsonIndent, if not nil, is the indentation specified by the --indent or
+// --compact global flags. It applies to all commands that display json,
+// other than those that display one object per line, which are always
+// compact. An empty indentation results in compact, single line, output.
+var jsonIndent *string
+
+// setJSONIndent sets the indentation to the specified number of spaces,
+// or leaves each command's default in place if indent is negative.
+func setJSONIndent(indent int) {
+	if indent < 0 {
+		jsonIndent = nil
+		return
+	}
+	s := strings.Repeat(" ", indent)
+	jsonIndent = &s
+}
+
+// marshalJSON encodes v using the indentation specified by --indent or
+// --compact or, if neither was specified, using indent.
+func marshalJSON(v interface{}, indent string) ([]byte, error) {
+	if jsonIndent != nil {
+		indent = *jsonIndent
+	}
+	if len(indent) == 0 {
+		return json.Marshal(v)
+	}
+	return json.MarshalIndent(v, "", indent)
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONIndent(t *testing.T) {
+	defer setJSONIndent(-1)
+	v := map[string]interface{}{"a": []interface{}{"b"}}
+	for i, tc := range []struct {
+		args   []string
+		indent string
+		output string
+	}{
+		{nil, " ", "{\n \"a\": [\n  \"b\"\n ]\n}"},
+		{nil, "", `{"a":["b"]}`},
+		{[]string{"--compact"}, " ", `{"a":["b"]}`},
+		{[]string{"--indent", "0"}, " ", `{"a":["b"]}`},
+		{[]string{"--indent=4"}, "", "{\n    \"a\": [\n        \"b\"\n    ]\n}"},
+		{[]string{"--compact", "--indent", "0"}, " ", `{"a":["b"]}`},
+	} {
+		gf, args, err := parseGlobalFlags(append(tc.args, "list"))
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if got, want := args, []string{"list"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		setJSONIndent(gf.indent)
+		buf, err := marshalJSON(v, tc.indent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := string(buf), tc.output; got != want {
+			t.Errorf("%v: got %q, want %q", i, got, want)
+		}
+	}
+	for _, args := range [][]string{
+		{"--compact", "--indent", "2"},
+		{"--indent", "-1"},
+		{"--indent", "x"},
+		{"--compact=true"},
+		{"--no-lock=true"},
+	} {
+		if _, _, err := parseGlobalFlags(append(args, "list")); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+}
+
+func TestListJSONShape(t *testing.T) {
+	defer setJSONIndent(-1)
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(t, 3)
+	defer cleanup()
+	list := func(indent int) []string {
+		setJSONIndent(indent)
+		out := &bytes.Buffer{}
+		if _, err := runListCmd(ctx, mgr, out, nil); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(out.String()), "\n")
+	}
+
+	// Compact output has a single line per session.
+	lines := list(0)
+	if got, want := len(lines), 3; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, lines)
+	}
+	for _, line := range lines {
+		if !strings.HasSuffix(line, "}") || !strings.Contains(line, `: {"ID":`) {
+			t.Errorf("unexpected compact output: %v", line)
+		}
+	}
+
+	// Indented output starts at column zero and is indented as requested.
+	for _, indent := range []int{-1, 2} {
+		lines := list(indent)
+		if got, want := len(lines), 3*6; got != want {
+			t.Fatalf("%v: got %v, want %v: %v", indent, got, want, lines)
+		}
+		prefix := " "
+		if indent > 0 {
+			prefix = strings.Repeat(" ", indent)
+		}
+		for i, line := range lines {
+			switch i % 6 {
+			case 0:
+				if !strings.HasSuffix(line, ": {") {
+					t.Errorf("%v: %v: unexpected output: %q", indent, i, line)
+				}
+			case 1:
+				if !strings.HasPrefix(line, prefix+`"ID": `) || strings.HasPrefix(line, prefix+" ") {
+					t.Errorf("%v: %v: unexpected output: %q", indent, i, line)
+				}
+			case 5:
+				if line != "}" {
+					t.Errorf("%v: %v: unexpected output: %q", indent, i, line)
+				}
+			}
+		}
+	}
+}
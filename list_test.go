@@ -0,0 +1,174 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/cosnicolaou/checkpoint/directory"
+)
+
+func newSyntheticStore(t testing.TB, nsessions int) (checkpointstate.Manager, func()) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mgr := directory.NewManager(dir)
+	for i := 0; i < nsessions; i++ {
+		tag := fmt.Sprintf("session-%04d", i)
+		id := mgr.SessionID(tag)
+		sess, err := mgr.Use(ctx, id, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sess.SetMetadata(ctx, map[string]interface{}{"ID": id, "Tags": []interface{}{tag}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return mgr, func() { os.RemoveAll(dir) }
+}
+
+func TestReadMetadata(t *testing.T) {
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(t, 100)
+	defer cleanup()
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := readMetadata(ctx, mgr, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range serial {
+		if got, want := s.id, ids[i]; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := s.md["ID"], ids[i]; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+	for _, parallel := range []int{2, 8, 200} {
+		sessions, err := readMetadata(ctx, mgr, parallel, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := sessions, serial; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", parallel, got, want)
+		}
+	}
+}
+
+func TestReadIncomplete(t *testing.T) {
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(t, 6)
+	defer cleanup()
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Leave a step in progress in the first two sessions, fail a step in
+	// the third and complete all of the steps in the fourth and fifth.
+	for i, id := range ids[:5] {
+		sess, err := mgr.Use(ctx, id, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, step := range []string{"a", "b"} {
+			if _, err := sess.Step(ctx, step); err != nil {
+				t.Fatal(err)
+			}
+		}
+		switch i {
+		case 2:
+			err = sess.Fail(ctx, "", "oops")
+		case 3, 4:
+			_, err = sess.Step(ctx, "")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, parallel := range []int{1, 4} {
+		sessions, err := readMetadata(ctx, mgr, parallel, isIncomplete)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, s := range sessions {
+			if len(s.id) > 0 {
+				got = append(got, s.id)
+			}
+		}
+		if want := ids[:3]; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", parallel, got, want)
+		}
+	}
+}
+
+func TestListIDsOnly(t *testing.T) {
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(t, 10)
+	defer cleanup()
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, flag := range []string{"--ids-only", "--no-metadata"} {
+		out := &bytes.Buffer{}
+		if _, err := runListCmd(ctx, mgr, out, []string{flag}); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := strings.Fields(out.String()), ids; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", flag, got, want)
+		}
+	}
+	if _, err := runListCmd(ctx, mgr, ioutil.Discard, []string{"--ids-only", "--incomplete"}); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func BenchmarkReadMetadata(b *testing.B) {
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(b, 1000)
+	defer cleanup()
+	for _, parallel := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("parallel-%v", parallel), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := readMetadata(ctx, mgr, parallel, nil); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkList(b *testing.B) {
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(b, 1000)
+	defer cleanup()
+	for _, mode := range [][]string{nil, {"--ids-only"}} {
+		name := "metadata"
+		if len(mode) > 0 {
+			name = "ids-only"
+		}
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := runListCmd(ctx, mgr, ioutil.Discard, mode); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
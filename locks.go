@@ -0,0 +1,64 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+func runLocksCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	inspector, ok := mgr.(checkpointstate.LockInspector)
+	if !ok {
+		return true, fmt.Errorf("lock inspection is not supported")
+	}
+	ids := args
+	if len(ids) == 0 {
+		var err error
+		if ids, err = mgr.List(ctx); err != nil {
+			return true, fmt.Errorf("failed to list sessions: %v", err)
+		}
+	}
+	for _, id := range ids {
+		locked, err := inspector.Locked(ctx, id)
+		if err != nil {
+			return true, fmt.Errorf("failed to determine lock state for session %v: %v", id, err)
+		}
+		state := "free"
+		if locked {
+			state = "held"
+		}
+		fmt.Fprintf(out, "%v: %v\n", id, state)
+	}
+	return true, nil
+}
+
+func runUnlockCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("unlock", flag.ContinueOnError)
+	force := fs.Bool("force", false, "must be specified to confirm that the session is to be unlocked")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) != 1 {
+		return true, fmt.Errorf("a single session must be specified")
+	}
+	if !*force {
+		return true, fmt.Errorf("--force must be specified to unlock a session")
+	}
+	inspector, ok := mgr.(checkpointstate.LockInspector)
+	if !ok {
+		return true, fmt.Errorf("unlocking is not supported")
+	}
+	id := args[0]
+	if err := inspector.ForceUnlock(ctx, id); err != nil {
+		return true, fmt.Errorf("failed to unlock session %v: %v", id, err)
+	}
+	return true, nil
+}
@@ -5,37 +5,158 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
+	"github.com/cosnicolaou/checkpoint/bbolt"
 	"github.com/cosnicolaou/checkpoint/checkpointstate"
 	"github.com/cosnicolaou/checkpoint/directory"
+	"github.com/cosnicolaou/checkpoint/federation"
 )
 
-type factory func() checkpointstate.Manager
+// factory creates a Manager; timeout, if non-zero, is the time allowed
+// for the command being run and hence for any blocking initialization.
+type factory func(timeout time.Duration) checkpointstate.Manager
 
 var (
 	managers = map[string]factory{}
+	// storeSuffixes are the suffixes appended to the store locations
+	// used by each backend, see storePath.
+	storeSuffixes = map[string]string{"directory": "", "bbolt": ".db"}
+	// lockingDisabled is set by --no-lock.
+	lockingDisabled bool
 )
 
 func init() {
-	// For now only support directory based checkpoints, but in the future
-	// it should be possible to support different ones such as dynamodb for use
-	// from within AWS lambda's. Choice of the factory will be made via an environment
-	// variable or some other out-of-band mechanism.
-	managers["directory"] = func() checkpointstate.Manager {
-		return directory.NewManager(os.ExpandEnv("$HOME/.checkpointstate"))
+	// Directory based checkpoints are used by default, a bbolt database
+	// may be used instead; in the future it should be possible to support
+	// others such as dynamodb for use from within AWS lambda's. The choice
+	// of factory is made via the CHECKPOINT_BACKEND environment variable.
+	managers["directory"] = func(time.Duration) checkpointstate.Manager {
+		keys, err := encryptionKeys(os.Getenv(checkpointKeyEnvVar))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "FAILED: %v: %v\n", checkpointKeyEnvVar, err)
+			os.Exit(2)
+		}
+		opts := append(keys,
+			directory.WithNamespace(os.Getenv(checkpointNamespaceEnvVar)),
+			directory.WithIDGenerator(idGenerator()))
+		if len(os.Getenv(checkpointShardedEnvVar)) > 0 {
+			opts = append(opts, directory.WithShardedLayout())
+		}
+		if lockingDisabled {
+			opts = append(opts, directory.WithoutLocking())
+		}
+		if debugLog != nil {
+			opts = append(opts, directory.WithLockHook(func(dir string, wait time.Duration, err error) {
+				debugLog.log("lock", "dir", dir, "wait", wait, "error", err)
+			}))
+		}
+		return newStoreManager(storeSuffixes["directory"], func(root string) checkpointstate.Manager {
+			return directory.NewManager(root, opts...)
+		})
+	}
+	managers["bbolt"] = func(timeout time.Duration) checkpointstate.Manager {
+		return newStoreManager(storeSuffixes["bbolt"], func(root string) checkpointstate.Manager {
+			return bbolt.NewManager(root,
+				bbolt.WithIDGenerator(idGenerator()),
+				bbolt.WithTimeout(timeout))
+		})
+	}
+}
+
+// backendName returns the name of the backend requested via
+// CHECKPOINT_BACKEND, or the default, directory, if none is requested.
+func backendName() string {
+	if backend := os.Getenv(checkpointBackendEnvVar); len(backend) > 0 {
+		return backend
+	}
+	return "directory"
+}
+
+// storeLocations returns the locations of the stores to be used, in order
+// of precedence, ie. those listed in CHECKPOINT_PATH or the default store.
+func storeLocations(suffix string) []string {
+	if roots := storeRoots(os.Getenv, runtime.GOOS, suffix); len(roots) > 0 {
+		return roots
+	}
+	return []string{storePath(os.Getenv, runtime.GOOS, suffix)}
+}
+
+// newStoreManager returns the Manager, created by newManager, for the
+// default store or, if more than one store is listed in CHECKPOINT_PATH,
+// a Manager that federates them, see storeLocations.
+func newStoreManager(suffix string, newManager func(root string) checkpointstate.Manager) checkpointstate.Manager {
+	roots := storeLocations(suffix)
+	if len(roots) == 1 {
+		return newManager(roots[0])
+	}
+	stores := make([]federation.Store, len(roots))
+	for i, root := range roots {
+		stores[i] = federation.Store{Root: root, Manager: newManager(root)}
 	}
+	return federation.NewManager(stores[0], stores[1:]...)
 }
 
 const (
 	checkpointSessionIDEnvVar = "CHECKPOINT_SESSION_ID"
+	checkpointNamespaceEnvVar = "CHECKPOINT_NAMESPACE"
+	checkpointBackendEnvVar   = "CHECKPOINT_BACKEND"
+	checkpointKeyEnvVar       = "CHECKPOINT_KEY"
+	checkpointIDsEnvVar       = "CHECKPOINT_IDS"
+	checkpointShardedEnvVar   = "CHECKPOINT_SHARDED"
 )
 
+// idGenerator returns the session ID generator requested via the
+// CHECKPOINT_IDS environment variable.
+func idGenerator() checkpointstate.IDGenerator {
+	switch v := os.Getenv(checkpointIDsEnvVar); v {
+	case "", "hash":
+		return checkpointstate.HashIDs
+	case "slug":
+		return checkpointstate.SlugIDs
+	default:
+		fmt.Fprintf(os.Stderr, "FAILED: %v: unsupported session id generator: %q\n", checkpointIDsEnvVar, v)
+		os.Exit(2)
+	}
+	return nil
+}
+
+// encryptionKeys parses a comma separated list of base64 encoded keys,
+// the first of which is used to encrypt and all of which are used to
+// decrypt.
+func encryptionKeys(v string) ([]directory.Option, error) {
+	var opts []directory.Option
+	if len(v) == 0 {
+		return nil, nil
+	}
+	for i, encoded := range strings.Split(v, ",") {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 encoded key: %v", err)
+		}
+		if i == 0 {
+			opts = append(opts, directory.WithEncryptionKey(key))
+			continue
+		}
+		opts = append(opts, directory.WithDecryptionKey(key))
+	}
+	return opts, nil
+}
+
 const usage = `
 checkpoint: a simple means of recording and acting
 on checkpoints in shell scripts (https://github.com/cosnicolaou/checkpoint).
@@ -49,55 +170,500 @@ Example:
 
 source <(checkpoint use $0)
 completed step1 || <action>
-completed step2 || <action>
+completed step2 --artifact out=/tmp/result.tar || <action>
+completed step3 || <action> || completed --fail step3 <reason>
+completed --content-key "$input" step4 || <action>
+completed --skip-if "test -f out.tar" step4a || <action>
+completed --porcelain step4b || <action>
+completed --phase build step4c || <action>
+completed --group g step5a || { <action>; completed --done step5a; } &
+completed --group g step5b || { <action>; completed --done step5b; } &
+wait
+completed -- --step6 || <action>
 completed
 completed state
 
+Arguments to completed that are not its flags, such as a step named -x,
+are step names; all arguments following -- are step names, or the reason
+for a failure, even if they are the same as its flags.
+
 Sessions and checkpoints may be managed as follows:
+ init [--shell bash|zsh|fish]
+           - create the checkpoint store and display the setup, such as
+             command line completion, recommended for the specified shell,
+             which defaults to that specified by $SHELL
+ use [--func-name|--name <name>] [--tag <tag>]... <tag>...
+           - use, or create, the checkpoint
+             for the specified tags, defining the shell function 'completed',
+             or <name>, and exporting CHECKPOINT_SESSION_ID, or
+             CHECKPOINT_SESSION_ID_<NAME>; functions with different names
+             may be used concurrently in the same shell
+             --ttl <duration> records an expiration time for the checkpoint
+             which is extended on each subsequent use unless --refresh-ttl=false
+             is specified; a warning, giving the checkpoint's creation and
+             last access times, is written to stderr when an existing
+             checkpoint is resumed, unless --quiet is specified;
+             --env-file <file> appends CHECKPOINT_SESSION_ID=<id>, or
+             CHECKPOINT_SESSION_ID_<NAME>=<id>, to <file> instead of writing
+             the shell function, for CI systems that load variables from such
+             a file, e.g. $GITHUB_ENV
+ subsession [--func-name <name>] [--quiet] <parent-id> <tag>...
+           - use, or create, a subsession of the specified checkpoint for
+             the specified tags, defining the shell function 'subcompleted',
+             or <name>, and exporting CHECKPOINT_SESSION_ID_<NAME>; state
+             displays the parent and the subsessions of a checkpoint
  list        - list all checkpoints
+ list --since <time|duration> [--by created|accessed] [--include-missing]
+             - list checkpoints created or accessed since the specified time
+ list --parallel <n> - read up to n checkpoints concurrently
+ list --ids-only|--no-metadata - list only the IDs of all checkpoints, which
+             is much faster than reading their metadata
+ list --incomplete - list only checkpoints with a step that is in progress
+             or has failed, ie. those that may be resumed
  state       - display summary state of current checkpoint
  state <id>  - display summary state of specified checkpoint
  dump        - display full state, in json format
  dump <id>   - display full state, in json format, of specified checkpoint
- delete      - delete current checkpoint
- delete <id> - delete the specified session
+ dump --format=json [<id>] - display full state as a single json document
+ dump --raw [<id>] - display the name, permissions and unparsed contents of
+             each file used to store the checkpoint, directory backend only
+ dump --ndjson [<id>] - display each step as a single line of json as it
+             is read, in no particular order, for very large checkpoints
+ state|dump|history --relative - display timestamps relative to now
+ state|dump|history --reverse - display the most recent steps first
+ paths [<id>] - display the paths of the files used to store the current,
+             or specified, checkpoint, directory backend only
+ history [--gantt] [<id>] - display the timeline of steps for the current,
+               or specified, checkpoint, optionally as a gantt chart
+ steps [--tag <tag>]... [--step <name>]... [--json]
+           - display the steps of all checkpoints, optionally only those
+             with the specified tags or step names, as csv or json
+ slow [--top <n>] [--step <name>]... [--json] [<id>]
+           - display the n slowest completed steps of the specified
+             checkpoint, or of all checkpoints, in order of decreasing duration
+ digest [--results] [--store] [<id>]
+           - display a digest of the sequence of completed steps of the
+             current, or specified, checkpoint, and, with --results, of
+             their results, so that runs that followed the same path have
+             the same digest; --store records it in the checkpoint's metadata
+ trace [--folded] [<id>] - display the steps of the current, or specified,
+             checkpoint as a chrome trace, or in folded stack format, for
+             use with chrome://tracing, speedscope or flamegraph tools
+ top [--interval <duration>] [--iterations <n>]
+           - display the checkpoints that have a step in progress, and for
+             how long, refreshing the display at the specified interval
+             until interrupted
+ replay [<id>] - display the sequence of completed invocations that
+             recreate the steps of the current, or specified, checkpoint
+ compact [<id>] - consolidate the storage used for the completed steps of
+             the current, or specified, checkpoint
+ result [--set <json>|--clear] [<id>] <step>
+           - display the result recorded for the step of the current, or
+             specified, checkpoint, or record or remove it
+ squash <id> <new-step> <step>...
+           - replace the specified completed steps with a single step that
+             spans all of them
+ reorder <id> [<step>...]
+           - display the specified steps first, in the order given, followed
+             by all other steps in the order in which they were created; no
+             steps restores the default ordering
+ template [--unset] [<id>] - mark the current, or specified, checkpoint as
+             a template for new checkpoints
+ new --from-template <template-id> <tag>...
+           - create, and display the ID of, a new checkpoint for the
+             specified tags whose steps are those of the template; the steps
+             are displayed as pending by state until they are run
+ seal [<id>] - prevent any further changes to the current, or specified,
+             checkpoint until it is unsealed
+ unseal [<id>] - allow changes to a sealed checkpoint
+ locks [<id>...] - display whether the specified, or all, checkpoints
+             are currently locked
+ unlock --force <id> - clear the stale lock state and in-progress step of a
+             checkpoint left behind by a crashed process; a script that is
+             part way through a step cannot be distinguished from one that
+             crashed, so it must only be used when no scripts are running
+ verify [--fix] [<id>] - report, and optionally repair, inconsistencies in the
+             storage used for the specified, or all, checkpoints, directory
+             backend only
+ import [--force] <file>|-
+           - create a checkpoint, with the same ID, metadata and completed
+             and failed steps, from the output of dump --format=json; an
+             existing checkpoint with the same ID is only replaced, and
+             moved to the trash, if --force is specified, or if its import
+             failed part way
+ import --bulk [--force] [--parallel <n>] <file|dir>...
+           - import all of the checkpoints in the specified files, each of
+             which may contain any number of them, and in the files in the
+             specified directories, importing up to n, by default the number
+             of CPUs, concurrently; existing checkpoints are skipped unless
+             --force is specified, progress is written to stderr and any
+             failures and a summary are displayed
+ migrate [--dry-run] - upgrade all checkpoints to the current storage format,
+             and move a store in $HOME to its preferred location, or only
+             display the format versions with --dry-run, directory backend
+             only
+ gc [--dry-run] [--idle <duration>]
+           - delete all checkpoints whose expiration time has passed and,
+             with --idle, those in which no step has been run for the
+             specified duration
+ retain --group-by-tag <key> --keep <n> [--tag <tag>]... [--dry-run]
+           [--force] [--hard]
+           - group the checkpoints with all of the specified tags by the
+             value of their <key>=<value> tag and delete, or move to the
+             trash, all but the n most recently created in each group;
+             --force is required when n is zero
+ env - display the configuration resolved from the environment: the
+             backend, the store or stores, the namespace, the current
+             checkpoint, the shell and the version
+ --timeout <duration> <command> ... - fail any of the above commands,
+             rather than waiting indefinitely, if it does not complete within
+             the specified duration, eg. because a checkpoint is locked
+ --id-fd <fd> - may be specified with any of the above commands, or with
+             a step, to read the ID of the checkpoint to be used, when none
+             is given as an argument, from the specified file descriptor in
+             preference to CHECKPOINT_SESSION_ID
+ --debug <command> ... - write a json object describing each operation
+             performed by any of the above commands, or by a step, to stderr,
+             as does setting CHECKPOINT_DEBUG
+ --no-lock <command> ... - access checkpoints without locking them, with
+             a warning, for use on filesystems that support neither flock
+             nor lock files; concurrent access is unsafe, directory backend
+             only
+ --output <file> <command> ... - write the output of any of the above
+             commands to the specified file rather than stdout
+ --indent <n> <command> ... - indent the json displayed by any of the
+             above commands by n spaces, rather than one, or, for summary,
+             rather than displaying it on a single line
+ --compact <command> ... - display the json displayed by any of the above
+             commands on a single line, as does --indent 0
+ completion bash|zsh|fish - display a shell completion script, eg.
+             source <(checkpoint completion bash)
+ run [--progress-fd <fd>] [--notify <duration>] <id> <step> -- <command> [<arg>...]
+           - run the command unless the step has already been completed,
+             marking the step as completed if the command succeeds and as
+             failed, and exiting with the command's exit status, otherwise
+ auto [--progress-fd <fd>] [--notify <duration>] [<id>] -- <command> [<arg>...]
+           - as for run, but for the current, or specified, checkpoint and
+             with the step identified by a hash of the command and its
+             arguments, so that the same command is always the same step
+ exec [--progress-fd <fd>] [--notify <duration>] <pipeline-file>
+           - run each line of the pipeline file as a step named for that
+             line, in the checkpoint for that file, stopping at the first
+             failure; rerunning resumes from the first incomplete step
+ --progress-fd <fd> - write a line of json to the specified file
+             descriptor as each step run by run, auto or exec is started,
+             completed, failed or skipped
+ --notify <duration> - display a desktop notification, via notify-send or,
+             on macOS, osascript, when a step run by run, auto or exec
+             completes, or fails, having taken longer than the duration
+ summary [--json] [<id>] - display the number of steps, and of completed
+             steps, of the current, or specified, checkpoint, whether a step
+             is in progress and when the first step was created and the last
+             one completed
+ current [<id>] - display the name of the in-progress step, if any, of the
+             current, or specified, checkpoint
+ is-complete [--content-key <input>]... [<id>] <step>
+           - exit with a status of zero if the step of the current, or
+             specified, checkpoint has been completed and one otherwise;
+             unlike completed, the step is never marked as in progress
+ is-complete --phase <phase> [<id>]
+           - exit with a status of zero if all of the steps of the phase,
+             of which there must be at least one, have been completed
+ phases [--json] [<id>] - display the number of steps, and of completed and
+             failed steps, in each phase of the current, or specified,
+             checkpoint, as recorded by completed --phase, and how long
+             each completed phase took; state also displays these roll-ups
+ abort [<id>] - abandon the in-progress step of the current, or specified,
+             checkpoint without recording it, so that it is rerun afresh
+ delete [--hard] - move the current checkpoint to the trash, or, with
+             --hard, or for the bbolt backend, delete it permanently
+ delete [--hard] <id> - move the specified checkpoint to the trash, or
+             delete it permanently
  delete <id> step... -- delete the specified steps from the specified session
+ delete [<id>] --glob <pattern> [--dry-run]
+           - delete the completed or failed steps, of the current or specified
+             session, whose names match the glob pattern; * and ? do not match /
+ delete --all [--tag <tag>]... [--before <time|duration>] [--by created|accessed]
+           [--dry-run] [--force] [--hard]
+           - delete, or move to the trash, every checkpoint with all of the
+             specified tags that was last accessed, or created, before the
+             specified time; --force is required to delete every checkpoint
+             when no filters are given
+ list --trash - list the checkpoints in the trash and when they were moved
+             there
+ restore [<id>] - restore the most recently trashed copy of the current, or
+             specified, checkpoint from the trash
+ empty-trash [<id>...] - permanently delete all, or the specified,
+             checkpoints in the trash
+
+Sessions may be segregated into independent namespaces by setting the
+CHECKPOINT_NAMESPACE environment variable. Sessions are stored in the
+directory $HOME/.checkpointstate by default, setting the
+CHECKPOINT_BACKEND environment variable to bbolt will store them in a
+bbolt database, $HOME/.checkpointstate.db, instead. If XDG_STATE_HOME,
+or failing that XDG_DATA_HOME, is set they are stored in checkpoint and
+checkpoint.db within that directory instead, as they are within
+%LOCALAPPDATA% on windows and ~/Library/Application Support on macOS,
+though any existing store in $HOME is used until migrate moves it there.
+Setting CHECKPOINT_DIR overrides all of these locations, the store is
+then CHECKPOINT_DIR, or CHECKPOINT_DIR.db for bbolt. CHECKPOINT_PATH may
+be set to a colon separated list of stores, named in the same way, and
+with an empty element denoting the default store, to be used together:
+sessions are used from the first store that contains them and created in
+the first store, and list displays the store that each session is found
+in. The contents of directory based checkpoints are encrypted, using
+AES-GCM, if the CHECKPOINT_KEY environment variable is set to a base64
+encoded 16, 24 or 32 byte key; when rotating keys the previous keys may
+be appended as a comma separated list so that existing checkpoints
+remain readable. Setting CHECKPOINT_SHARDED stores the sessions of new
+directory based stores in subdirectories named for the first two
+characters of their IDs, running 'migrate' with it set shards an
+existing store. Checkpoint IDs are a hash of the tags supplied to 'use'
+by default, setting the CHECKPOINT_IDS environment variable to slug will
+instead use human readable IDs derived from the tags, eg. 'use my
+project' will use the checkpoint 'my-project'. Tags may not be empty or
+longer than 1024 bytes. Setting the CHECKPOINT_SYSLOG environment
+variable records each step that is started, completed, failed or aborted
+in the system log.
 
 `
 
 func main() {
-	ctx := context.Background()
-	fn := managers["directory"]
-	mgr := fn()
-	if ok, err := runCmd(ctx, mgr); ok {
+	ctx, interrupted, stop := signalContext(context.Background())
+	backend := backendName()
+	fn, supported := managers[backend]
+	if !supported {
+		fmt.Fprintf(os.Stderr, "FAILED: unsupported backend: %q\n", backend)
+		os.Exit(2)
+	}
+	gf, args, err := parseGlobalFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+		os.Exit(2)
+	}
+	enableDebug(gf.debug)
+	lockingDisabled = gf.noLock
+	setJSONIndent(gf.indent)
+	enableJournal()
+	if args, err = extractIDFD(args); err != nil {
+		fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+		os.Exit(2)
+	}
+	debugLog.log("command", "args", args, "backend", backend, "timeout", gf.timeout)
+	if gf.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, gf.timeout)
+		defer cancel()
+	}
+	mgr := fn(gf.timeout)
+	out, err := openOutput(gf.output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+		os.Exit(2)
+	}
+	// exit overrides the exit status if the command was interrupted, by
+	// which time any changes it made have either completed or been
+	// abandoned.
+	exit := func(code int) {
+		if sig := interrupted(); sig != nil {
+			fmt.Fprintf(os.Stderr, "FAILED: interrupted by %v\n", sig)
+			code = signalExitCode(sig)
+		}
+		stop()
+		debugLog.log("exit", "code", code)
+		os.Exit(code)
+	}
+	// closeOutput closes the output file, if any, once the command has
+	// written to it, returning err, the command's error, if set.
+	closeOutput := func(err error) error {
+		if out != os.Stdout {
+			if cerr := out.Close(); err == nil && cerr != nil {
+				err = fmt.Errorf("failed to close output file: %v", cerr)
+			}
+		}
+		return err
+	}
+	ok, err := runCmd(ctx, mgr, out, args)
+	if ok {
+		err = closeOutput(err)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
-			os.Exit(2)
+			if !isSilent(err) {
+				fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+			}
+			exit(exitCode(err))
 		}
-		return
+		exit(0)
 	}
 
+	fs := flag.NewFlagSet("completed", flag.ContinueOnError)
+	artifacts := artifactsFlag{}
+	fs.Var(artifacts, "artifact", "a key=value annotation to record against the step, may be repeated")
+	var contentKey tagsFlag
+	fs.Var(&contentKey, "content-key", "identify the step by a hash of this input, rather than by its name, may be repeated")
+	fail := fs.Bool("fail", false, "mark the specified, or current, step as failed, any remaining arguments are used as the reason for the failure")
+	group := fs.String("group", "", "start the step in the named concurrency group, it must then be completed explicitly via --done")
+	phase := fs.String("phase", "", "record the step as belonging to the named phase, such as build or test")
+	done := fs.Bool("done", false, "mark the specified step, which must be in progress, as completed")
+	skipIf := fs.String("skip-if", "", "a command, run via sh -c, that if it succeeds causes the step to be marked as completed without it being run")
+	porcelain := fs.Bool("porcelain", false, "display whether the step was started or had already been completed as a single line of json")
+	args, err = parseStepFlags(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+		exit(2)
+	}
+	if len(*skipIf) > 0 && (*fail || *done || len(*group) > 0) {
+		fmt.Fprintf(os.Stderr, "FAILED: --skip-if cannot be used with --fail, --done or --group\n")
+		exit(2)
+	}
+	if *porcelain && (*fail || *done) {
+		fmt.Fprintf(os.Stderr, "FAILED: --porcelain cannot be used with --fail or --done\n")
+		exit(2)
+	}
+	if *fail {
+		if err := runFail(ctx, mgr, args); err != nil {
+			fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+			exit(2)
+		}
+		exit(0)
+	}
 	step := ""
-	switch len(os.Args) {
-	case 0, 1:
-	case 2:
-		step = os.Args[1]
+	switch len(args) {
+	case 0:
+	case 1:
+		step = args[0]
 	default:
 		fmt.Fprintf(os.Stderr, "FAILED: zero or one step must be specified\n")
-		os.Exit(2)
+		exit(2)
+	}
+	if *porcelain && len(step) == 0 {
+		fmt.Fprintf(os.Stderr, "FAILED: --porcelain requires a step to be specified\n")
+		exit(2)
+	}
+	var opts []checkpointstate.StepOption
+	for k, v := range artifacts {
+		opts = append(opts, checkpointstate.WithArtifact(k, v))
+	}
+	if len(contentKey) > 0 {
+		opts = append(opts, checkpointstate.WithContentKey(contentKey...))
+	}
+	if len(*group) > 0 {
+		opts = append(opts, checkpointstate.WithGroup(*group))
+	}
+	if len(*phase) > 0 {
+		opts = append(opts, checkpointstate.WithPhase(*phase))
+	}
+	if *done {
+		if err := runComplete(ctx, mgr, step, opts...); err != nil {
+			fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
+			exit(2)
+		}
+		exit(0)
 	}
 
-	ok, err := runStep(ctx, mgr, step)
+	if len(*skipIf) > 0 {
+		ok, err = runStepSkipIf(ctx, mgr, step, *skipIf, opts...)
+	} else {
+		ok, err = runStep(ctx, mgr, step, opts...)
+	}
+	if err == nil && *porcelain {
+		err = reportPorcelain(ctx, mgr, out, step, ok)
+	}
+	err = closeOutput(err)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "FAILED: %v\n", err)
-		os.Exit(2)
+		exit(2)
 	}
 	if ok {
 		// done
-		os.Exit(0)
+		exit(0)
 	}
 	// not done.
-	os.Exit(1)
+	exit(1)
+}
+
+// globalFlags represents the flags that may precede any command.
+type globalFlags struct {
+	output  string
+	timeout time.Duration
+	debug   bool
+	noLock  bool
+	// indent is the number of spaces specified by --indent, zero for
+	// --compact, or -1 if neither was specified.
+	indent int
+}
+
+// parseGlobalFlags parses the global flags, in any order, that precede
+// the command and returns the remaining arguments.
+func parseGlobalFlags(args []string) (globalFlags, []string, error) {
+	gf := globalFlags{indent: -1}
+	compact := false
+	for len(args) > 0 {
+		name := strings.SplitN(strings.TrimPrefix(args[0], "--"), "=", 2)[0]
+		if !strings.HasPrefix(args[0], "--") || (name != "output" && name != "timeout" && name != "debug" && name != "indent" && name != "compact" && name != "no-lock") {
+			break
+		}
+		if args[0] == "--debug" {
+			gf.debug, args = true, args[1:]
+			continue
+		}
+		if args[0] == "--no-lock" {
+			gf.noLock, args = true, args[1:]
+			continue
+		}
+		if args[0] == "--compact" {
+			compact, args = true, args[1:]
+			continue
+		}
+		var value string
+		if idx := strings.Index(args[0], "="); idx >= 0 {
+			value, args = args[0][idx+1:], args[1:]
+		} else if len(args) >= 2 {
+			value, args = args[1], args[2:]
+		} else {
+			args = args[1:]
+		}
+		switch name {
+		case "output":
+			if len(value) == 0 {
+				return gf, nil, fmt.Errorf("--output requires a filename")
+			}
+			gf.output = value
+		case "debug", "compact", "no-lock":
+			return gf, nil, fmt.Errorf("--%v does not accept a value", name)
+		case "indent":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return gf, nil, fmt.Errorf("--indent requires a non-negative number of spaces: %q", value)
+			}
+			gf.indent = n
+		case "timeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return gf, nil, fmt.Errorf("--timeout requires a positive duration: %q", value)
+			}
+			gf.timeout = d
+		}
+	}
+	if compact {
+		if gf.indent > 0 {
+			return gf, nil, fmt.Errorf("--compact and --indent cannot both be specified")
+		}
+		gf.indent = 0
+	}
+	return gf, args, nil
+}
+
+// openOutput returns the file that command output is to be written to,
+// as specified by the --output flag, or stdout if no file is specified.
+func openOutput(filename string) (*os.File, error) {
+	if len(filename) == 0 {
+		return os.Stdout, nil
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %v", err)
+	}
+	return f, nil
 }
 
 func deleteSession(ctx context.Context, mgr checkpointstate.Manager, id string, steps ...string) error {
@@ -108,122 +674,636 @@ func deleteSession(ctx context.Context, mgr checkpointstate.Manager, id string,
 	return sess.Delete(ctx, steps...)
 }
 
-func runListCmd(ctx context.Context, mgr checkpointstate.Manager) (bool, error) {
-	sessions, err := mgr.List(ctx)
+func runListCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	sinceFlag := fs.String("since", "", "only list sessions created or accessed since the specified RFC3339 time or duration, eg. 24h")
+	by := fs.String("by", "accessed", "the metadata timestamp used by --since, one of created or accessed")
+	includeMissing := fs.Bool("include-missing", false, "include sessions without the metadata timestamp used by --since")
+	parallel := fs.Int("parallel", 1, "the number of sessions to read concurrently")
+	incomplete := fs.Bool("incomplete", false, "only list sessions with a step that is in progress or has failed")
+	idsOnly := fs.Bool("ids-only", false, "only list the IDs of sessions, without reading their metadata")
+	fs.BoolVar(idsOnly, "no-metadata", false, "an alias for --ids-only")
+	trash := fs.Bool("trash", false, "list the sessions in the trash rather than those in use")
+	if _, err := parseFlags(fs, args); err != nil {
+		return true, err
+	}
+	if *trash {
+		if fs.NFlag() > 1 {
+			return true, fmt.Errorf("--trash cannot be used with any other flags")
+		}
+		return true, listTrash(ctx, mgr, out)
+	}
+	if *idsOnly {
+		if len(*sinceFlag) > 0 || *incomplete {
+			return true, fmt.Errorf("--ids-only cannot be used with --since or --incomplete")
+		}
+		return true, listIDs(ctx, mgr, out)
+	}
+	var since time.Time
+	if len(*sinceFlag) > 0 {
+		var err error
+		if since, err = parseSince(*sinceFlag, time.Now()); err != nil {
+			return true, err
+		}
+	}
+	field, err := metadataTimeField(*by)
+	if err != nil {
+		return true, err
+	}
+	locations, err := sessionLocations(ctx, mgr)
 	if err != nil {
 		return true, fmt.Errorf("failed to list sessions: %v", err)
 	}
-	for _, id := range sessions {
+	display := func(id string, md map[string]interface{}) {
+		if !since.IsZero() {
+			when, ok := metadataTime(md, field)
+			if (!ok && !*includeMissing) || (ok && when.Before(since)) {
+				return
+			}
+		}
+		buf, _ := marshalJSON(md, defaultJSONIndent)
+		fmt.Fprintf(out, "%v%v: %s\n", id, locations[id], buf)
+	}
+	var keep func(context.Context, checkpointstate.Session) (bool, error)
+	if *incomplete {
+		keep = isIncomplete
+	}
+	if *parallel > 1 {
+		sessions, err := readMetadata(ctx, mgr, *parallel, keep)
+		if err != nil {
+			return true, fmt.Errorf("failed to list sessions: %v", err)
+		}
+		for _, s := range sessions {
+			if len(s.id) > 0 {
+				display(s.id, s.md)
+			}
+		}
+		return true, nil
+	}
+	// List, rather than Walk, is used so that the sessions are displayed
+	// in the same order as with --parallel; only their IDs are read up
+	// front, their metadata is read, and displayed, one at a time.
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to list sessions: %v", err)
+	}
+	for _, id := range ids {
 		sess, err := mgr.Use(ctx, id, false)
+		if err == checkpointstate.ErrNoSuchSession {
+			// The session was deleted after it was listed.
+			continue
+		}
 		if err != nil {
 			return true, fmt.Errorf("failed to use session %v: %v", id, err)
 		}
+		if keep != nil {
+			ok, err := keep(ctx, sess)
+			if err != nil {
+				return true, fmt.Errorf("failed to list sessions: failed to obtain state for session %v: %v", id, err)
+			}
+			if !ok {
+				continue
+			}
+		}
 		md, err := sess.Metadata(ctx)
 		if err != nil {
-			return true, fmt.Errorf("failed to obtain metadata for session %v: %v", id, err)
-
+			return true, fmt.Errorf("failed to list sessions: failed to obtain metadata for session %v: %v", id, err)
 		}
-		buf, _ := json.MarshalIndent(md, "  ", "    ")
-		fmt.Printf("%v: %s\n", id, buf)
+		display(id, md)
 	}
 	return true, nil
 }
 
-func runStatusCmds(ctx context.Context, mgr checkpointstate.Manager, verb string) (bool, error) {
-	nargs := len(os.Args)
-	id := os.Getenv(checkpointSessionIDEnvVar)
-	if nargs == 3 {
-		id = os.Args[2]
+// sessionLocations returns an annotation for each session, if mgr
+// federates several stores, that describes the store it is found in and
+// those that it shadows.
+func sessionLocations(ctx context.Context, mgr checkpointstate.Manager) (map[string]string, error) {
+	fm, ok := mgr.(*federation.Manager)
+	if !ok {
+		return nil, nil
 	}
-	if len(id) == 0 {
-		return true, fmt.Errorf("no session found either as an argument or as environment variable %v", checkpointSessionIDEnvVar)
+	locations, err := fm.Locate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	annotations := make(map[string]string, len(locations))
+	for _, l := range locations {
+		if len(l.Shadowed) > 0 {
+			annotations[l.ID] = fmt.Sprintf(" (%v, shadowing %v)", l.Root, strings.Join(l.Shadowed, ", "))
+			continue
+		}
+		annotations[l.ID] = fmt.Sprintf(" (%v)", l.Root)
+	}
+	return annotations, nil
+}
+
+// listIDs displays the ID of every session using only List, which avoids
+// the cost of using each session and reading its metadata.
+func listIDs(ctx context.Context, mgr checkpointstate.Manager, out io.Writer) error {
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %v", err)
+	}
+	for _, id := range ids {
+		fmt.Fprintln(out, id)
+	}
+	return nil
+}
+
+// isIncomplete returns true if the session has a step that has not been
+// completed, ie. one that is in progress or has failed. It uses the
+// session's Summary rather than its Steps since the former may be
+// obtained more cheaply.
+func isIncomplete(ctx context.Context, sess checkpointstate.Session) (bool, error) {
+	summary, err := sess.Summary(ctx)
+	if err != nil {
+		return false, err
+	}
+	return summary.Completed < summary.Total, nil
+}
+
+type sessionMetadata struct {
+	id string
+	md map[string]interface{}
+}
+
+// readMetadata returns the metadata for all sessions, in the same order
+// as List, reading up to parallel sessions concurrently. This is safe
+// since each session is locked independently. If keep is not nil, the
+// metadata is only read for those sessions for which it returns true;
+// the entries for all other sessions are left empty.
+func readMetadata(ctx context.Context, mgr checkpointstate.Manager, parallel int, keep func(context.Context, checkpointstate.Session) (bool, error)) ([]sessionMetadata, error) {
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]sessionMetadata, len(ids))
+	err = runParallel(ctx, parallel, func(send func(func(context.Context) error) error) error {
+		for i, id := range ids {
+			i, id := i, id
+			err := send(func(ctx context.Context) error {
+				sess, err := mgr.Use(ctx, id, false)
+				if err == checkpointstate.ErrNoSuchSession {
+					// The session was deleted after it was listed.
+					return nil
+				}
+				if err != nil {
+					return fmt.Errorf("failed to use session %v: %v", id, err)
+				}
+				if keep != nil {
+					ok, err := keep(ctx, sess)
+					if err != nil {
+						return fmt.Errorf("failed to obtain state for session %v: %v", id, err)
+					}
+					if !ok {
+						return nil
+					}
+				}
+				md, err := sess.Metadata(ctx)
+				if err != nil {
+					return fmt.Errorf("failed to obtain metadata for session %v: %v", id, err)
+				}
+				sessions[i] = sessionMetadata{id: id, md: md}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// parseSince parses either an RFC3339 time or a duration which is
+// interpreted as being relative to now. In addition to the units
+// supported by time.ParseDuration, a whole number of days may be
+// specified, eg. 7d.
+func parseSince(v string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if days := strings.TrimSuffix(v, "d"); days != v {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC3339 time nor a duration", v)
+	}
+	return now.Add(-d), nil
+}
+
+func metadataTimeField(by string) (string, error) {
+	switch by {
+	case "created":
+		return "Created", nil
+	case "accessed":
+		return "Accessed", nil
+	}
+	return "", fmt.Errorf("unsupported metadata timestamp: %q", by)
+}
+
+// metadataTime returns the time stored in the specified metadata field.
+func metadataTime(md map[string]interface{}, field string) (time.Time, bool) {
+	v, ok := md[field].(string)
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	return t, err == nil
+}
+
+// dumpOutput is the single JSON document emitted by dump --format=json.
+type dumpOutput struct {
+	Metadata interface{}   `json:"metadata"`
+	Steps    []interface{} `json:"steps"`
+}
+
+func runStatusCmds(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, verb string, args []string) (bool, error) {
+	fs := flag.NewFlagSet(verb, flag.ContinueOnError)
+	format := fs.String("format", "text", "output format for dump, one of text or json")
+	relative := fs.Bool("relative", false, "display timestamps relative to now")
+	reverse := fs.Bool("reverse", false, "display the most recent steps first")
+	raw := fs.Bool("raw", false, "display the unparsed contents of the files used to store the session")
+	ndjson := fs.Bool("ndjson", false, "display each step as a single line of JSON as it is read, without first reading all of the steps")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if *raw && verb != "dump" {
+		return true, fmt.Errorf("--raw is only supported by dump")
+	}
+	if *ndjson {
+		switch {
+		case verb != "dump":
+			return true, fmt.Errorf("--ndjson is only supported by dump")
+		case *raw || *reverse || *format != "text":
+			return true, fmt.Errorf("--ndjson cannot be used with --raw, --reverse or --format")
+		}
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
 	}
 	sess, err := mgr.Use(ctx, id, false)
 	if err != nil {
 		return true, fmt.Errorf("failed to use session %v: %v", id, err)
 	}
+	if *raw {
+		return true, printRawDump(ctx, out, id, sess)
+	}
+	if *ndjson {
+		return true, printStepsNDJSON(ctx, out, id, sess, *relative)
+	}
 	md, err := sess.Metadata(ctx)
 	if err != nil {
 		return true, fmt.Errorf("failed to get session metadata %v: %v", id, err)
 	}
-	steps, err := sess.Steps(ctx)
+	steps, err := sessionSteps(ctx, sess, *reverse)
 	if err != nil {
 		return true, fmt.Errorf("failed to get session steps %v: %v", id, err)
 	}
+	now := time.Now()
 	if verb == "dump" {
-		buf, _ := json.MarshalIndent(md, "", " ")
-		fmt.Println(string(buf))
-		for _, step := range steps {
-			buf, _ := json.MarshalIndent(step, "", " ")
-			fmt.Println(string(buf))
+		var displayMetadata interface{} = md
+		displaySteps := make([]interface{}, len(steps))
+		for i, step := range steps {
+			displaySteps[i] = step
+		}
+		if *relative {
+			displayMetadata = relativeMetadata(md, now)
+			for i, step := range steps {
+				displaySteps[i] = relativeStep(step, now)
+			}
+		}
+		switch *format {
+		case "text":
+			buf, _ := marshalJSON(displayMetadata, defaultJSONIndent)
+			fmt.Fprintln(out, string(buf))
+			for _, step := range displaySteps {
+				buf, _ := marshalJSON(step, defaultJSONIndent)
+				fmt.Fprintln(out, string(buf))
+			}
+		case "json":
+			buf, err := marshalJSON(dumpOutput{Metadata: displayMetadata, Steps: displaySteps}, defaultJSONIndent)
+			if err != nil {
+				return true, fmt.Errorf("failed to encode session %v: %v", id, err)
+			}
+			fmt.Fprintln(out, string(buf))
+		default:
+			return true, fmt.Errorf("unsupported format: %q", *format)
 		}
 		return true, nil
 	}
-	tags := []string{}
-	for _, v := range md["Tags"].([]interface{}) {
-		tags = append(tags, v.(string))
+	tags := sessionTags(md)
+	annotations := ""
+	if sealer, ok := sess.(checkpointstate.Sealer); ok {
+		if ok, err := sealer.Sealed(ctx); err == nil && ok {
+			annotations = " (sealed)"
+		}
+	}
+	if isTemplate, _ := md[templateField].(bool); isTemplate {
+		annotations += " (template)"
+	}
+	fmt.Fprintf(out, "%v: %v%v\n", strings.Join(tags, ", "), md["ID"], annotations)
+	printRelations(ctx, mgr, out, md)
+	for _, phase := range checkpointstate.NewPhases(steps) {
+		fmt.Fprintf(out, "phase %v\n", formatPhase(phase))
+	}
+	// Steps that are yet to be run are displayed after, or with --reverse
+	// before, those that have been.
+	pending := pendingSteps(md, steps)
+	printPending := func() {
+		for i := range pending {
+			if *reverse {
+				i = len(pending) - 1 - i
+			}
+			fmt.Fprintf(out, "%v: pending\n", pending[i])
+		}
+	}
+	if *reverse {
+		printPending()
 	}
-	fmt.Printf("%v: %v\n", strings.Join(tags, ", "), md["ID"])
 	for _, step := range steps {
-		if step.Completed.IsZero() {
-			fmt.Printf("%v: current: %v... %v\n", step.Name, step.Created, time.Since(step.Created))
+		extra := ""
+		if len(step.Artifacts) > 0 {
+			extra = " [" + formatArtifacts(step.Artifacts) + "]"
+		}
+		extra += formatCommand(step)
+		if !step.Failed.IsZero() {
+			fmt.Fprintf(out, "%v: failed after %v: %v%v\n", step.Name, step.Failed.Sub(step.Created), step.Reason, extra)
+			continue
+		}
+		if step.InProgress() {
+			// Concurrent steps are never the current step.
+			label := "current"
+			if len(step.Group) > 0 {
+				label = "group " + step.Group
+			}
+			if *relative {
+				fmt.Fprintf(out, "%v: %v: %v, started %v%v\n", step.Name, label, inProgress, relativeTime(step.Created, now), extra)
+				continue
+			}
+			fmt.Fprintf(out, "%v: %v: %v since %v... %v%v\n", step.Name, label, inProgress, step.Created.Local(), now.Sub(step.Created), extra)
 			continue
 		}
-		fmt.Printf("%v: %v\n", step.Name, step.Completed.Sub(step.Created))
+		if *relative {
+			fmt.Fprintf(out, "%v: %v, completed %v%v\n", step.Name, step.Completed.Sub(step.Created), relativeTime(step.Completed, now), extra)
+			continue
+		}
+		fmt.Fprintf(out, "%v: %v%v\n", step.Name, step.Completed.Sub(step.Created), extra)
+	}
+	if !*reverse {
+		printPending()
 	}
 	return true, nil
 }
 
-func runUseCmd(ctx context.Context, mgr checkpointstate.Manager) (bool, error) {
-	nargs := len(os.Args)
-	if nargs == 2 {
-		return true, fmt.Errorf("no session name provided")
+// printRawDump displays the name, permissions and unparsed contents of
+// each of the files used to store sess. Contents that are not valid
+// UTF-8, such as those of encrypted files, are displayed base64 encoded.
+func printRawDump(ctx context.Context, out io.Writer, id string, sess checkpointstate.Session) error {
+	dumper, ok := sess.(checkpointstate.RawDumper)
+	if !ok {
+		return fmt.Errorf("raw dump of session %v: %v", id, checkpointstate.ErrNotSupported)
 	}
-	tags := os.Args[2:]
-	id := mgr.SessionID(tags...)
-	sess, err := mgr.Use(ctx, id, true)
+	files, err := dumper.RawDump(ctx)
 	if err != nil {
-		return true, fmt.Errorf("failed to use/create session for %v", tags)
+		return fmt.Errorf("failed to dump session %v: %v", id, err)
 	}
-	metadata, err := sess.Metadata(ctx)
+	for _, f := range files {
+		if !utf8.Valid(f.Contents) {
+			fmt.Fprintf(out, "%v %v %v bytes (base64)\n%v\n", f.Name, f.Mode, len(f.Contents), base64.StdEncoding.EncodeToString(f.Contents))
+			continue
+		}
+		fmt.Fprintf(out, "%v %v %v bytes\n%s\n", f.Name, f.Mode, len(f.Contents), f.Contents)
+	}
+	return nil
+}
+
+func runPathsCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	if len(args) > 1 {
+		return true, fmt.Errorf("paths accepts at most one session")
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
 	if err != nil {
-		return true, fmt.Errorf("failed to access metadata for %v: %v", tags, id)
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
 	}
-	if metadata == nil {
-		metadata = map[string]interface{}{
-			"Tags":    tags,
-			"ID":      id,
-			"Created": time.Now(),
+	lister, ok := sess.(checkpointstate.PathLister)
+	if !ok {
+		return true, fmt.Errorf("paths of session %v: %v", id, checkpointstate.ErrNotSupported)
+	}
+	paths, err := lister.Paths(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to list the paths of session %v: %v", id, err)
+	}
+	for _, path := range paths {
+		fmt.Fprintln(out, path)
+	}
+	return true, nil
+}
+
+// printStepsNDJSON displays each of the steps of sess as a single line
+// of JSON. Steps are written as they are read, using
+// checkpointstate.StepWalker if sess implements it, and hence in no
+// particular order.
+func printStepsNDJSON(ctx context.Context, out io.Writer, id string, sess checkpointstate.Session, relative bool) error {
+	now := time.Now()
+	enc := json.NewEncoder(out)
+	err := checkpointstate.WalkSteps(ctx, sess, func(step checkpointstate.Step) error {
+		if relative {
+			return enc.Encode(relativeStep(step, now))
 		}
+		return enc.Encode(step)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to dump session %v: %v", id, err)
+	}
+	return nil
+}
+
+// sessionSteps returns the steps of sess, with the most recent first
+// if reverse is set.
+func sessionSteps(ctx context.Context, sess checkpointstate.Session, reverse bool) ([]checkpointstate.Step, error) {
+	if reverse {
+		return checkpointstate.StepsNewestFirst(ctx, sess)
 	}
-	metadata["Accessed"] = time.Now()
-	if err := sess.SetMetadata(ctx, metadata); err != nil {
-		return true, fmt.Errorf("failed to write metadata for %v: %v: %v", tags, id, err)
+	return sess.Steps(ctx)
+}
+
+// refreshExpiry extends the expiration time of an existing session to
+// ttl from now.
+func refreshExpiry(ctx context.Context, sess checkpointstate.Session, ttl time.Duration) error {
+	metadata, err := sess.Metadata(ctx)
+	if err != nil {
+		return err
 	}
-	shell := os.Getenv("SHELL")
-	switch {
-	case strings.Contains(shell, "bash"):
-		if err := checkBashVersion(); err != nil {
-			return true, err
+	metadata[expiresAtField] = time.Now().UTC().Add(ttl)
+	return sess.SetMetadata(ctx, metadata)
+}
+
+// existingMetadata returns the metadata of the session id, or nil if it
+// does not exist or its metadata cannot be read.
+func existingMetadata(ctx context.Context, mgr checkpointstate.Manager, id string) map[string]interface{} {
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return nil
+	}
+	md, err := sess.Metadata(ctx)
+	if err != nil {
+		return nil
+	}
+	return md
+}
+
+// warnResumed warns that use is resuming an existing session, rather than
+// creating a new one, since the same tags may have been reused without
+// realising that a session for them already exists. The warning is
+// written to stderr since the output of use is evaluated by the shell.
+func warnResumed(out io.Writer, id string, tags []string, md map[string]interface{}) {
+	fmt.Fprintf(out, "WARNING: resuming existing session %v for %v", id, strings.Join(tags, " "))
+	for _, field := range []string{"Created", "Accessed"} {
+		if t, ok := metadataTime(md, field); ok {
+			fmt.Fprintf(out, ", %v %v", strings.ToLower(field), t.Local().Format(time.RFC3339))
 		}
-	case strings.Contains(shell, "zsh"):
-		if err := checkZshVersion(); err != nil {
-			return true, err
+	}
+	fmt.Fprintln(out)
+}
+
+// defaultFuncName is the name of the shell function emitted by use.
+const defaultFuncName = "completed"
+
+var funcNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func runUseCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("use", flag.ContinueOnError)
+	funcName := fs.String("func-name", defaultFuncName, "the name of the shell function to be defined")
+	fs.StringVar(funcName, "name", defaultFuncName, "an alias for --func-name")
+	var tagFlags tagsFlag
+	fs.Var(&tagFlags, "tag", "a tag for the session, may be repeated; tags specified via --tag precede any positional tags")
+	ttl := fs.Duration("ttl", 0, "the time to live for the session, after which it will be removed by gc")
+	refreshTTL := fs.Bool("refresh-ttl", true, "extend the expiration time of an existing session by --ttl each time that it is used")
+	quiet := fs.Bool("quiet", false, "do not warn when an existing session is resumed")
+	envFile := fs.String("env-file", "", "append the session ID, as NAME=value, to the specified file instead of writing a shell function")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if *ttl < 0 {
+		return true, fmt.Errorf("invalid ttl: %v", *ttl)
+	}
+	tags := append([]string(tagFlags), positional...)
+	if len(tags) == 0 {
+		return true, fmt.Errorf("no session name provided")
+	}
+	if err := checkpointstate.ValidateTags(tags...); err != nil {
+		return true, err
+	}
+	if !funcNameRE.MatchString(*funcName) {
+		return true, fmt.Errorf("invalid function name: %q", *funcName)
+	}
+	id := mgr.SessionID(tags...)
+	debugLog.log("use", "session", id, "tags", tags)
+	initMetadata := map[string]interface{}{
+		"Tags": tags,
+		"ID":   id,
+	}
+	if *ttl > 0 {
+		initMetadata[expiresAtField] = time.Now().UTC().Add(*ttl)
+	}
+	// The metadata of an existing session must be read before it is
+	// used since using it updates its access time.
+	previous := existingMetadata(ctx, mgr, id)
+	sess, created, err := mgr.UseWithMetadata(ctx, id, true, initMetadata)
+	if err != nil {
+		return true, fmt.Errorf("failed to use/create session for %v: %v", tags, err)
+	}
+	if !created && !*quiet {
+		warnResumed(os.Stderr, id, tags, previous)
+	}
+	if *ttl > 0 && !created && *refreshTTL {
+		if err := refreshExpiry(ctx, sess, *ttl); err != nil {
+			return true, fmt.Errorf("failed to write metadata for %v: %v: %v", tags, id, err)
 		}
-	default:
-		return true, fmt.Errorf("unsupported shell: %q", shell)
 	}
-	fmt.Printf("export %s=%s\n", checkpointSessionIDEnvVar, id)
-	fmt.Printf(`function completed() {
-if [[ $? -ne 0 ]]; then
-CHECKPOINT_ERROR=true
+	if len(*envFile) > 0 {
+		return true, writeEnvFile(*envFile, id, *funcName)
+	}
+	return true, writeShellFunction(out, id, *funcName)
+}
+
+// sessionIDEnvVar returns the name of the environment variable that
+// records the session ID for the shell function funcName.
+func sessionIDEnvVar(funcName string) string {
+	if funcName == defaultFuncName {
+		return checkpointSessionIDEnvVar
+	}
+	return checkpointSessionIDEnvVar + "_" + strings.ToUpper(funcName)
+}
+
+// writeShellFunction writes the definition of the shell function, named
+// funcName, that completes the steps of the session id, for evaluation by
+// the shell determined by detectShell.
+func writeShellFunction(out io.Writer, id, funcName string) error {
+	shell, err := detectShell()
+	if err != nil {
+		return err
+	}
+	switch shell {
+	case "bash":
+		err = checkBashVersion()
+	case "zsh":
+		err = checkZshVersion()
+	}
+	if err != nil {
+		return err
+	}
+	// A function with a non-default name uses its own, suffixed, session
+	// ID and error variables so that it does not interfere with
+	// any others defined in the same shell.
+	idVar, errVar, cmd := sessionIDEnvVar(funcName), "CHECKPOINT_ERROR", os.Args[0]
+	if funcName != defaultFuncName {
+		errVar += "_" + strings.ToUpper(funcName)
+		cmd = fmt.Sprintf("%s=$%s %s", checkpointSessionIDEnvVar, idVar, cmd)
+	}
+	fmt.Fprintf(out, "export %s=%s\n", idVar, id)
+	_, err = fmt.Fprintf(out, `function %[1]s() {
+local rc=$?
+if [[ "$1" = "--fail" ]]; then
+%[2]s "$@"
+return $?
+fi
+if [[ $rc -ne 0 ]]; then
+%[3]s=true
 return 0
 fi
-[[ "$CHECKPOINT_ERROR" = "true" ]] && return 0
-%s "$@"
+[[ "$%[3]s" = "true" ]] && return 0
+%[2]s "$@"
 }
-`, os.Args[0])
-	return true, nil
+`, funcName, cmd, errVar)
+	return err
+}
+
+// detectShell returns the shell, bash or zsh, that the output of use is
+// to be evaluated by, as determined by $SHELL.
+func detectShell() (string, error) {
+	shell := os.Getenv("SHELL")
+	switch {
+	case strings.Contains(shell, "bash"):
+		return "bash", nil
+	case strings.Contains(shell, "zsh"):
+		return "zsh", nil
+	}
+	return "", fmt.Errorf("unsupported shell: %q", shell)
 }
 
 func checkBashVersion() error {
@@ -242,52 +1322,579 @@ func checkZshVersion() error {
 	return nil
 }
 
-func runDeleteCmd(ctx context.Context, mgr checkpointstate.Manager) (bool, error) {
-	id := os.Getenv(checkpointSessionIDEnvVar)
-	nargs := len(os.Args)
-	if nargs >= 3 {
-		id = os.Args[2]
+func runCompactCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	compactor, ok := sess.(checkpointstate.Compactor)
+	if !ok {
+		return true, fmt.Errorf("session %v does not support compaction", id)
+	}
+	if err := compactor.Compact(ctx); err != nil {
+		return true, fmt.Errorf("failed to compact session %v: %v", id, err)
+	}
+	return true, nil
+}
+
+func runSquashCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	if len(args) < 3 {
+		return true, fmt.Errorf("a session, the name of the new step and the steps to squash must be specified")
+	}
+	id, name, steps := args[0], args[1], args[2:]
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	squasher, ok := sess.(checkpointstate.Squasher)
+	if !ok {
+		return true, fmt.Errorf("session %v does not support squashing steps", id)
+	}
+	if err := squasher.Squash(ctx, name, steps...); err != nil {
+		return true, fmt.Errorf("failed to squash steps for session %v: %v", id, err)
+	}
+	return true, nil
+}
+
+func runReorderCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	if len(args) == 0 {
+		return true, fmt.Errorf("a session must be specified")
+	}
+	id, steps := args[0], args[1:]
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	reorderer, ok := sess.(checkpointstate.Reorderer)
+	if !ok {
+		return true, fmt.Errorf("session %v does not support reordering steps", id)
+	}
+	if err := reorderer.Reorder(ctx, steps...); err != nil {
+		return true, fmt.Errorf("failed to reorder steps for session %v: %v", id, err)
+	}
+	return true, nil
+}
+
+func runSealCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, verb string, args []string) (bool, error) {
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	sealer, ok := sess.(checkpointstate.Sealer)
+	if !ok {
+		return true, fmt.Errorf("session %v does not support sealing", id)
+	}
+	if verb == "seal" {
+		err = sealer.Seal(ctx)
+	} else {
+		err = sealer.Unseal(ctx)
+	}
+	if err != nil {
+		return true, fmt.Errorf("failed to %v session %v: %v", verb, id, err)
+	}
+	return true, nil
+}
+
+func runAbortCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	if err := journalSession(id, sess).Abort(ctx); err != nil {
+		return true, fmt.Errorf("failed to abort the current step of session %v: %v", id, err)
+	}
+	return true, nil
+}
+
+func runCurrentCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	step, err := sess.Current(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to get the current step of session %v: %v", id, err)
+	}
+	if step != nil {
+		fmt.Fprintln(out, step.Name)
+	}
+	return true, nil
+}
+
+func runIsCompleteCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("is-complete", flag.ContinueOnError)
+	var contentKey tagsFlag
+	fs.Var(&contentKey, "content-key", "identify the step by a hash of this input, rather than by its name, may be repeated")
+	phase := fs.String("phase", "", "determine if all of the steps in the named phase, rather than a single step, are complete")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(*phase) > 0 {
+		if len(contentKey) > 0 {
+			return true, fmt.Errorf("--content-key cannot be used with --phase")
+		}
+		return true, isPhaseComplete(ctx, mgr, *phase, args)
 	}
-	var steps []string
-	if nargs >= 4 {
-		steps = os.Args[3:]
+	var id, step string
+	switch len(args) {
+	case 1:
+		id, _ = defaultSessionID()
+		step = args[0]
+	case 2:
+		id, step = args[0], args[1]
+	default:
+		return true, fmt.Errorf("a step, optionally preceded by a session, must be specified")
 	}
 	if len(id) == 0 {
-		return true, fmt.Errorf("no session found either as an argument or as environment variable %v", checkpointSessionIDEnvVar)
+		return true, errNoSession
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
 	}
-	return true, deleteSession(ctx, mgr, id, steps...)
+	var opts []checkpointstate.StepOption
+	if len(contentKey) > 0 {
+		opts = append(opts, checkpointstate.WithContentKey(contentKey...))
+	}
+	done, err := sess.IsComplete(ctx, step, opts...)
+	if err != nil {
+		return true, fmt.Errorf("failed to determine if step %v of session %v is complete: %v", step, id, err)
+	}
+	if !done {
+		// As for a step that has not been completed.
+		return true, exitCodeError{code: 1}
+	}
+	return true, nil
 }
 
-func runCmd(ctx context.Context, mgr checkpointstate.Manager) (bool, error) {
-	if nargs := len(os.Args); nargs >= 2 {
-		verb := os.Args[1]
+// isPhaseComplete implements is-complete --phase; a phase without any
+// steps is not complete.
+func isPhaseComplete(ctx context.Context, mgr checkpointstate.Manager, name string, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("is-complete --phase accepts at most one session")
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	phases, err := sess.Phases(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to determine if phase %v of session %v is complete: %v", name, id, err)
+	}
+	for _, phase := range phases {
+		if phase.Name == name && phase.Complete() {
+			return nil
+		}
+	}
+	return exitCodeError{code: 1}
+}
+
+func runSummaryCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("summary", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "display the summary as a json object")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	summary, err := sess.Summary(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to summarize session %v: %v", id, err)
+	}
+	if *jsonOutput {
+		buf, err := marshalJSON(summary, "")
+		if err != nil {
+			return true, err
+		}
+		_, err = fmt.Fprintln(out, string(buf))
+		return true, err
+	}
+	fmt.Fprintf(out, "total: %v\n", summary.Total)
+	fmt.Fprintf(out, "completed: %v\n", summary.Completed)
+	fmt.Fprintf(out, "in progress: %v\n", summary.InProgress)
+	if !summary.FirstCreated.IsZero() {
+		fmt.Fprintf(out, "first created: %v\n", summary.FirstCreated.Local().Format(time.RFC3339))
+	}
+	if !summary.LastCompleted.IsZero() {
+		fmt.Fprintf(out, "last completed: %v\n", summary.LastCompleted.Local().Format(time.RFC3339))
+	}
+	if !summary.LastActive.IsZero() {
+		fmt.Fprintf(out, "last active: %v\n", summary.LastActive.Local().Format(time.RFC3339))
+	}
+	return true, nil
+}
+
+func runCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	if len(args) >= 1 {
+		verb, args := args[0], args[1:]
 		switch verb {
 		case "help", "--help", "-help":
 			fmt.Fprintf(os.Stderr, "Usage: %v\n", usage)
 			os.Exit(0)
 		case "list":
-			return runListCmd(ctx, mgr)
+			return runListCmd(ctx, mgr, out, args)
 		case "state", "status", "dump":
-			return runStatusCmds(ctx, mgr, verb)
+			return runStatusCmds(ctx, mgr, out, verb, args)
 		case "use":
-			return runUseCmd(ctx, mgr)
+			return runUseCmd(ctx, mgr, out, args)
+		case "subsession":
+			return runSubsessionCmd(ctx, mgr, out, args)
 		case "delete":
-			return runDeleteCmd(ctx, mgr)
+			return runDeleteCmd(ctx, mgr, out, args)
+		case "run":
+			return runRunCmd(ctx, mgr, out, args)
+		case "auto":
+			return runAutoCmd(ctx, mgr, out, args)
+		case "exec":
+			return runExecCmd(ctx, mgr, out, args)
+		case "abort":
+			return runAbortCmd(ctx, mgr, out, args)
+		case "current":
+			return runCurrentCmd(ctx, mgr, out, args)
+		case "is-complete":
+			return runIsCompleteCmd(ctx, mgr, out, args)
+		case "summary":
+			return runSummaryCmd(ctx, mgr, out, args)
+		case "template":
+			return runTemplateCmd(ctx, mgr, out, args)
+		case "verify":
+			return runVerifyCmd(ctx, mgr, out, args)
+		case "migrate":
+			return runMigrateCmd(ctx, mgr, out, args)
+		case "init":
+			return runInitCmd(ctx, mgr, out, args)
+		case "new":
+			return runNewCmd(ctx, mgr, out, args)
+		case "history":
+			return runHistoryCmd(ctx, mgr, out, args)
+		case "compact":
+			return runCompactCmd(ctx, mgr, out, args)
+		case "squash":
+			return runSquashCmd(ctx, mgr, out, args)
+		case "reorder":
+			return runReorderCmd(ctx, mgr, out, args)
+		case "seal", "unseal":
+			return runSealCmd(ctx, mgr, out, verb, args)
+		case "locks":
+			return runLocksCmd(ctx, mgr, out, args)
+		case "unlock":
+			return runUnlockCmd(ctx, mgr, out, args)
+		case "gc":
+			return runGCCmd(ctx, mgr, out, args)
+		case "retain":
+			return runRetainCmd(ctx, mgr, out, args)
+		case "completion":
+			return runCompletionCmd(ctx, mgr, out, args)
+		case completeCmd:
+			return runCompleteCmd(ctx, mgr, out, args)
+		case "slow":
+			return runSlowCmd(ctx, mgr, out, args)
+		case "top":
+			return runTopCmd(ctx, mgr, out, args)
+		case "import":
+			return runImportCmd(ctx, mgr, out, args)
+		case "phases":
+			return runPhasesCmd(ctx, mgr, out, args)
+		case "digest":
+			return runDigestCmd(ctx, mgr, out, args)
+		case "trace":
+			return runTraceCmd(ctx, mgr, out, args)
+		case "result":
+			return runResultCmd(ctx, mgr, out, args)
+		case "paths":
+			return runPathsCmd(ctx, mgr, out, args)
+		case "env":
+			return runEnvCmd(ctx, mgr, out, args)
+		case "restore":
+			return runRestoreCmd(ctx, mgr, out, args)
+		case "empty-trash":
+			return runEmptyTrashCmd(ctx, mgr, out, args)
+		case "steps":
+			return runStepsCmd(ctx, mgr, out, args)
+		case "replay":
+			return runReplayCmd(ctx, mgr, out, args)
 		}
 	}
 	return false, nil
 }
 
-func runStep(ctx context.Context, mgr checkpointstate.Manager, name string) (bool, error) {
-	id := os.Getenv(checkpointSessionIDEnvVar)
+// parseFlags parses the flags in args, allowing them to be interspersed
+// with positional arguments, and returns the positional arguments. All
+// arguments following a "--" are treated as positional.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		if consumed := len(args) - len(rest); consumed > 0 && args[consumed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// parseStepFlags is like parseFlags except that only arguments that name
+// one of fs's flags are parsed as flags; any other argument, including
+// one that looks like a flag, such as a step named -x, is positional.
+// As for parseFlags, all arguments following a "--" are positional, which
+// allows for steps whose names are the same as those of flags.
+func parseStepFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var flags, positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if dashes := len(arg) - len(name); dashes == 0 || dashes > 2 {
+			positional = append(positional, arg)
+			continue
+		}
+		hasValue := false
+		if idx := strings.Index(name, "="); idx >= 0 {
+			name, hasValue = name[:idx], true
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			positional = append(positional, arg)
+			continue
+		}
+		flags = append(flags, arg)
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && bf.IsBoolFlag()) && i+1 < len(args) {
+			// The flag's value is the next argument.
+			i++
+			flags = append(flags, args[i])
+		}
+	}
+	if err := fs.Parse(flags); err != nil {
+		return nil, err
+	}
+	return positional, nil
+}
+
+// artifactsFlag implements flag.Value for repeated key=value annotations.
+type artifactsFlag map[string]string
+
+func (af artifactsFlag) String() string {
+	return formatArtifacts(af)
+}
+
+func (af artifactsFlag) Set(v string) error {
+	idx := strings.Index(v, "=")
+	if idx <= 0 {
+		return fmt.Errorf("%q is not of the form key=value", v)
+	}
+	af[v[:idx]] = v[idx+1:]
+	return nil
+}
+
+// tagsFlag implements flag.Value for repeated session tags.
+type tagsFlag []string
+
+func (tf *tagsFlag) String() string {
+	return strings.Join(*tf, ", ")
+}
+
+func (tf *tagsFlag) Set(v string) error {
+	*tf = append(*tf, v)
+	return nil
+}
+
+// formatArtifacts returns the artifacts as a sorted, comma separated
+// list of key=value pairs.
+func formatArtifacts(artifacts map[string]string) string {
+	pairs := make([]string, 0, len(artifacts))
+	for k, v := range artifacts {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// quoteCommand returns command as a single string with any arguments
+// that contain spaces or shell metacharacters quoted.
+func quoteCommand(command []string) string {
+	args := make([]string, len(command))
+	for i, arg := range command {
+		if len(arg) == 0 || strings.ContainsAny(arg, " \t\n'\"`$\\") {
+			arg = strconv.Quote(arg)
+		}
+		args[i] = arg
+	}
+	return strings.Join(args, " ")
+}
+
+// formatCommand returns a description of the command, if any, run as the
+// step and of its exit status, if known, eg. ", ran `make build` -> exit 0".
+func formatCommand(step checkpointstate.Step) string {
+	if len(step.Command) == 0 {
+		return ""
+	}
+	desc := ", ran `" + quoteCommand(step.Command) + "`"
+	if step.ExitCode != nil {
+		desc += fmt.Sprintf(" -> exit %v", *step.ExitCode)
+	}
+	return desc
+}
+
+// sessionIDFromArgs returns the session ID specified as the first of args,
+// if any, or that read via --id-fd or, failing that, specified via the
+// CHECKPOINT_SESSION_ID environment variable otherwise.
+func sessionIDFromArgs(args []string) (string, error) {
+	id, _ := defaultSessionID()
+	if len(args) > 0 {
+		id = args[0]
+	}
+	if len(id) == 0 {
+		return "", errNoSession
+	}
+	return id, nil
+}
+
+func runFail(ctx context.Context, mgr checkpointstate.Manager, args []string) error {
+	id, source := defaultSessionID()
+	debugLog.log("session", "id", id, "source", source)
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return fmt.Errorf("failed to access session for %q: %v", id, err)
+	}
+	step, reason := "", ""
+	if len(args) > 0 {
+		step, reason = args[0], strings.Join(args[1:], " ")
+	}
+	err = journalSession(id, sess).Fail(ctx, step, reason)
+	debugLog.log("fail", "session", id, "step", step, "reason", reason, "error", err)
+	if err != nil {
+		return fmt.Errorf("failed to mark step %q as failed: %v", step, err)
+	}
+	return nil
+}
+
+func runComplete(ctx context.Context, mgr checkpointstate.Manager, name string, opts ...checkpointstate.StepOption) error {
+	if len(name) == 0 {
+		return fmt.Errorf("the step to be completed must be specified")
+	}
+	id, source := defaultSessionID()
+	debugLog.log("session", "id", id, "source", source)
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return fmt.Errorf("failed to access session for %q: %v", id, err)
+	}
+	err = journalSession(id, sess).Complete(ctx, name, opts...)
+	debugLog.log("complete", "session", id, "step", name, "key", checkpointstate.NewStepOptions(opts...).Key(name), "error", err)
+	if err != nil {
+		return fmt.Errorf("failed to complete step %v: %v", name, err)
+	}
+	return nil
+}
+
+func runStep(ctx context.Context, mgr checkpointstate.Manager, name string, opts ...checkpointstate.StepOption) (bool, error) {
+	id, source := defaultSessionID()
+	debugLog.log("session", "id", id, "source", source)
 	sess, err := mgr.Use(ctx, id, false)
 	if err != nil {
 		return false, fmt.Errorf("failed to access session for %q: %v", id, err)
 	}
 
-	ok, err := sess.Step(ctx, name)
+	ok, err := journalSession(id, sess).Step(ctx, name, opts...)
+	debugStep(id, name, ok, err, opts...)
 	if err != nil {
 		return false, fmt.Errorf("failed to execute step %v: %v", name, err)
 	}
 	return ok, nil
 }
+
+// runStepSkipIf starts the named step, unless it has already been
+// completed, and then runs predicate via sh -c. If the predicate succeeds
+// the step is marked as completed, annotated with the predicate, and
+// true is returned just as if the step had previously been completed.
+// Otherwise the step is left in progress, to be completed as usual once
+// it has been run, and false is returned.
+func runStepSkipIf(ctx context.Context, mgr checkpointstate.Manager, name, predicate string, opts ...checkpointstate.StepOption) (bool, error) {
+	if len(name) == 0 {
+		return false, fmt.Errorf("--skip-if requires a step to be specified")
+	}
+	id, source := defaultSessionID()
+	debugLog.log("session", "id", id, "source", source)
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return false, fmt.Errorf("failed to access session for %q: %v", id, err)
+	}
+	sess = journalSession(id, sess)
+	ok, err := sess.Step(ctx, name, opts...)
+	debugStep(id, name, ok, err, opts...)
+	if err != nil {
+		return false, fmt.Errorf("failed to execute step %v: %v", name, err)
+	}
+	if ok {
+		return true, nil
+	}
+	cmd := exec.CommandContext(ctx, "sh", "-c", predicate)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	err = cmd.Run()
+	debugLog.log("skip-if", "session", id, "step", name, "predicate", predicate, "error", err)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to run --skip-if predicate %q for step %v: %v", predicate, name, err)
+	}
+	if _, err := sess.Step(ctx, "", checkpointstate.WithArtifact("skip-if", predicate)); err != nil {
+		return false, fmt.Errorf("failed to complete step %v: %v", name, err)
+	}
+	return true, nil
+}
+
+// debugStep records the outcome of a call to Step.
+func debugStep(id, name string, done bool, err error, opts ...checkpointstate.StepOption) {
+	if debugLog == nil {
+		return
+	}
+	o := checkpointstate.NewStepOptions(opts...)
+	decision := "started"
+	switch {
+	case err != nil:
+		decision = "error"
+	case len(name) == 0:
+		decision = "completed-current"
+	case done:
+		decision = "already-complete"
+	}
+	debugLog.log("step", "session", id, "step", name, "key", o.Key(name), "group", o.Group, "decision", decision, "error", err)
+}
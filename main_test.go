@@ -1,14 +1,19 @@
 package main_test
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"v.io/x/lib/gosh"
 )
@@ -48,6 +53,89 @@ func TestLocal(t *testing.T) {
 	testScripts(t, nil)
 }
 
+func TestBBolt(t *testing.T) {
+	setup(t)
+	testScripts(t, map[string]string{"CHECKPOINT_BACKEND": "bbolt"})
+}
+
+func TestCompletion(t *testing.T) {
+	setup(t)
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		script := sh.Cmd(cmd, "completion", shell).Stdout()
+		if !strings.Contains(script, "checkpoint __complete sessions") {
+			t.Errorf("%v: dynamic completion is missing: %v", shell, script)
+		}
+		path, err := exec.LookPath(shell)
+		if err != nil {
+			t.Logf("%v: not found, skipping syntax check", shell)
+			continue
+		}
+		filename := filepath.Join(tmpDir, "completion."+shell)
+		if err := ioutil.WriteFile(filename, []byte(script), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := exec.Command(path, "-n", filename).CombinedOutput(); err != nil {
+			t.Errorf("%v: invalid completion script: %v: %s", shell, err, out)
+		}
+	}
+}
+
+func TestProgressFD(t *testing.T) {
+	setup(t)
+	home := sh.MakeTempDir()
+	pipeline := filepath.Join(home, "progress.pipeline")
+	if err := ioutil.WriteFile(pipeline, []byte("true\nfalse\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	for i := 0; i < 2; i++ {
+		run := exec.Command(cmd, "exec", "--progress-fd", "3", pipeline)
+		run.Env = append(os.Environ(), "HOME="+home, "XDG_STATE_HOME=", "XDG_DATA_HOME=", "CHECKPOINT_DIR=", "CHECKPOINT_PATH=")
+		run.ExtraFiles = []*os.File{wr}
+		if err := run.Run(); err == nil {
+			t.Errorf("%v: expected the pipeline to fail", i)
+		}
+	}
+	wr.Close()
+
+	var got []string
+	dec := json.NewDecoder(rd)
+	for {
+		var event struct {
+			Event, Session, Step, Reason string
+			Time                         time.Time
+			Duration                     float64
+		}
+		if err := dec.Decode(&event); err != nil {
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			break
+		}
+		got = append(got, event.Event+" "+event.Step)
+		if len(event.Session) == 0 || event.Time.IsZero() {
+			t.Errorf("missing session or time: %+v", event)
+		}
+		if timed := event.Event == "completed" || event.Event == "failed"; timed != (event.Duration > 0) {
+			t.Errorf("unexpected duration: %+v", event)
+		}
+		if failed := event.Event == "failed"; failed != (len(event.Reason) > 0) {
+			t.Errorf("unexpected reason: %+v", event)
+		}
+	}
+	want := []string{
+		"started true", "completed true", "started false", "failed false",
+		"skipped true", "started false", "failed false",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
 func TestMain(m *testing.M) {
 	rc := m.Run()
 	if sh != nil {
@@ -67,6 +155,10 @@ func runBashScript(script string, env map[string]string) string {
 	}
 	cmd.Vars["BASH"] = bash
 	cmd.Vars["HOME"] = tmpDir
+	cmd.Vars["XDG_STATE_HOME"] = ""
+	cmd.Vars["XDG_DATA_HOME"] = ""
+	cmd.Vars["CHECKPOINT_DIR"] = ""
+	cmd.Vars["CHECKPOINT_PATH"] = ""
 	cmd.Vars["PATH"] += ":" + tmpDir
 	return strings.TrimSpace(cmd.CombinedOutput())
 }
@@ -109,8 +201,9 @@ func testScripts(t *testing.T, env map[string]string) {
 		output := runBashScript(script, env)
 		lines := strings.Split(output, "\n")
 		for _, p := range pairs {
-			if p.line > len(lines) {
+			if p.line >= len(lines) {
 				t.Errorf("%v: line %v: does not exist in %v", loc, p.line, lines)
+				continue
 			}
 			if got, want := lines[p.line], p.contains; !strings.Contains(got, want) {
 				t.Errorf("%v: line %v: got %v, does not contain %v", loc, p.line, got, want)
@@ -126,9 +219,42 @@ func testScripts(t *testing.T, env map[string]string) {
 		{12, `"Name": "s1"`},
 		{17, `"Name": "s2"`},
 		{22, `"Name": "s3"`},
-		{24, `"Completed": "0001-01-01T00:00:00Z"`},
+		{24, `"Completed": null`},
 	})
 
+	var dump struct {
+		Metadata struct {
+			ID   string
+			Tags []string
+		} `json:"metadata"`
+		Steps []struct {
+			Name      string
+			Created   time.Time
+			Completed time.Time
+		} `json:"steps"`
+	}
+	out := runBashScript("dump-json.bash", env)
+	if err := json.Unmarshal([]byte(out), &dump); err != nil {
+		t.Fatalf("failed to unmarshal %v: %v", out, err)
+	}
+	if got, want := dump.Metadata.Tags, []string{"dump-json.bash"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(dump.Metadata.ID), 64; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := len(dump.Steps), 3; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, name := range []string{"s1", "s2", "s3"} {
+		if got, want := dump.Steps[i].Name, name; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+	if dump.Steps[0].Completed.IsZero() || !dump.Steps[2].Completed.IsZero() {
+		t.Errorf("unexpected completion times: %v", dump.Steps)
+	}
+
 	dumper("state.bash", []pair{
 		{0, "1"},
 		{1, "2"},
@@ -136,9 +262,610 @@ func testScripts(t *testing.T, env map[string]string) {
 		{3, "state.bash: 6b2bd8411dfc68fa79960ae7619f78b74fb40cbb8ea699ffd66186c091fffdd1"},
 		{4, "s1"},
 		{5, "s2"},
-		{6, "s3: current"},
+		{6, "s3: current: in progress since"},
+	})
+
+	dumper("history.bash", []pair{
+		{0, "1"},
+		{1, "2"},
+		{2, "3"},
+		{3, "s1: "},
+		{3, " -> "},
+		{4, "s2: "},
+		{5, "s3: "},
+		{5, "-> in progress"},
+		{6, "s1 |#"},
+		{7, "s2 |"},
+		{8, "s3 |"},
+		{8, ">| "},
+		{8, "(in progress)"},
+		{9, "b |#####"},
+		{9, "| 5s"},
+		{10, "a |"},
+		{10, "| -10s"},
+	})
+
+	dumper("artifacts.bash", []pair{
+		{0, "1"},
+		{1, "2"},
+		{3, "s1: "},
+		{3, "[out=/tmp/result.tar]"},
+		{4, "s2: "},
+		{4, "[rows=10]"},
+	})
+
+	dumper("dashes.bash", []pair{
+		{0, "1"},
+		{1, "2"},
+		{2, "3"},
+		{4, "-x: "},
+		{5, "--done: "},
+		{6, "-y: "},
+		{6, "[out=b]"},
+	})
+
+	dumper("init.bash", []pair{
+		{0, "# checkpoint store: "},
+		{1, "# Add the following to ~/.bashrc to enable command line completion:"},
+		{2, "source <(checkpoint completion bash)"},
+		{5, "#   source <(checkpoint use $0)"},
+		{7, "1"},
+		{8, "1"},
+		{9, "checkpoint completion fish | source"},
+		{10, `unsupported shell: "csh"`},
+	})
+
+	dumper("incomplete.bash", []pair{
+		{0, "1"},
+		{1, "0"},
+		{2, "1"},
+		{3, "1"},
+		{4, "0"},
+	})
+
+	dumper("since.bash", []pair{
+		{0, "1"},
+		{1, "0"},
+		{2, "1"},
+		{3, `unsupported metadata timestamp: "modified"`},
+	})
+
+	dumper("relative.bash", []pair{
+		{3, "s1: "},
+		{3, "completed just now"},
+		{4, "s2: current: in progress, started just now"},
+		{6, `"Accessed": "just now"`},
+		{14, `"Completed": "just now"`},
+		{19, `"Completed": "in progress"`},
+	})
+
+	dumper("fail.bash", []pair{
+		{0, "1"},
+		{2, "s1: "},
+		{3, "s2: failed after "},
+		{3, ": could not do it"},
+	})
+	// The failed step is rerun.
+	dumper("fail.bash", []pair{
+		{1, "s1: "},
+		{2, "s2: failed after "},
+	})
+
+	dumper("funcname.bash", []pair{
+		{0, "6b00c05cc3058797bfb24f524fb930f505ce1638579db8edbe00a37ea94bfc20"},
+		{1, "completed is not defined"},
+		{2, "1"},
+		{3, "2"},
+		{4, "funcname.bash: 6b00c05cc3058797bfb24f524fb930f505ce1638579db8edbe00a37ea94bfc20"},
+		{5, "s1: "},
+		{6, "s2: "},
+	})
+
+	// An error recorded by one function does not affect the others.
+	dumper("multi.bash", []pair{
+		{0, "a1"},
+		{1, "b1"},
+		{2, "c1"},
+		{3, "a2"},
+		{4, "multi.bash, a: f568006519b36f9fa46f3e7c851d882c70b19e24a7522a8c498bd1aad5f710ca"},
+		{5, "s1: "},
+		{6, "s2: "},
+		{7, "multi.bash, b: 1c6c8e5ac2e11224c4968d9eb2a61d5cdb5abddab15ce3a15c0cd7c533ca6f51"},
+		{8, "s1: current: in progress"},
+		{9, "multi.bash, default: ceddd78735295e1dd975972c6652d3f5bd13d2b3d82627bf2e9951fba8efe5b4"},
+		{10, "s1: "},
+	})
+
+	// Tags may be specified via --tag, positionally, or both.
+	dumper("tags.bash", []pair{
+		{0, "e5a01fee14e0ed5c48714f22180f25ad8365b53f9779f79dc4a3d7e93963f94a"},
+		{1, "e5a01fee14e0ed5c48714f22180f25ad8365b53f9779f79dc4a3d7e93963f94a"},
+		{2, "e5a01fee14e0ed5c48714f22180f25ad8365b53f9779f79dc4a3d7e93963f94a"},
+		{3, "e5a01fee14e0ed5c48714f22180f25ad8365b53f9779f79dc4a3d7e93963f94a"},
+		{4, "3d32f6dc5aa7b236a7046097c45d64703c7b1e2c8d291b94bc5fb3b4a795d163"},
+		{5, "FAILED: invalid tags: tag 1 is empty"},
+		{6, "FAILED: invalid tags: tag 1 is longer than 1024 bytes"},
+		{7, "FAILED: failed to use/create session for [!!]: empty session id"},
+	})
+
+	// Resuming an existing session is warned about, unless --quiet is
+	// specified.
+	dumper("resume.bash", []pair{
+		{0, "created"},
+		{1, "WARNING: resuming existing session f2cac130bc97a37b7073aa8aaab29eda2a0ae5954ebb015e4dc9917dbb725c67 for resume.bash, created 20"},
+		{1, ", accessed 20"},
+		{2, "resumed"},
+	})
+
+	dumper("gc.bash", []pair{
+		{0, "1"},
+		{1, "1"},
+		{2, "c566da3c24bf891f6a134e9a6b8866f4251d17f5dc6d1d40d5b7e1c15e417b8b"},
+		{3, "c566da3c24bf891f6a134e9a6b8866f4251d17f5dc6d1d40d5b7e1c15e417b8b"},
+		{4, "2"},
+		{5, "ff133e054dd2374604b1237e88879f3f6ed9d1b5a8ddac1fecc4b4558f6f5d64"},
 	})
 
+	dumper("gcidle.bash", []pair{
+		{0, "8eb60755593b8dfa76522de8379a25f1b4061037dae3692b768fc2c8fa85f269"},
+		{1, "de43d5085e678fe7bec15efccbf0005d3c134ad474b2f52c6a86e8a8b35f6bb9"},
+		{2, "8eb60755593b8dfa76522de8379a25f1b4061037dae3692b768fc2c8fa85f269"},
+		{3, "de43d5085e678fe7bec15efccbf0005d3c134ad474b2f52c6a86e8a8b35f6bb9"},
+		{4, "412f15ad82a3b3d3225408e2d5b0249f96da6001fc666103fb7b025157532d6d"},
+		{5, "FAILED: --idle must not be negative"},
+	})
+
+	dumper("seal.bash", []pair{
+		{0, "1"},
+		{1, "seal.bash: 36743e424992303303e278fdfe46dd4204517253c0ed985344af61cc001092f8 (sealed)"},
+		{2, "s1: "},
+		{3, "session is sealed"},
+		{4, "2"},
+		{5, "session is sealed"},
+		{6, "2"},
+	})
+
+	dumper("output.bash", []pair{
+		{0, "1"},
+		{1, "1"},
+		{2, "FAILED: --output requires a filename"},
+		{3, "1"},
+	})
+
+	dumper("abort.bash", []pair{
+		{0, "1"},
+		{1, "2"},
+		{2, "no step is in progress"},
+		{3, "0"},
+		{4, "2"},
+	})
+
+	dumper("slow.bash", []pair{
+		{0, ": sleepy: 2"},
+		{1, ": medium: 1"},
+		{2, `"Step":"fast"`},
+		{3, "1"},
+	})
+
+	dumper("run.bash", []pair{
+		{0, "ran s1"},
+		{1, "ran s2"},
+		{2, "FAILED: step s2 failed: sh -c echo ran s2; exit 3: exit status 3"},
+		{3, "3"},
+		{4, "1"},
+		{5, "ran s2 again"},
+		{6, "FAILED: step s3 failed: /nonexistent"},
+		{7, "2"},
+		// The command and exit status of steps run by run are recorded,
+		// but not for those completed via the shell function.
+		{8, "), ran `echo ran s1` -> exit 0"},
+		{9, "), ran `echo ran s2 again` -> exit 0"},
+		{10, "no such file or directory, ran `/nonexistent`"},
+		{11, "s4: "},
+		{12, "3"},
+	})
+
+	// A step whose predicate succeeds is completed without being run,
+	// one whose predicate fails is left in progress to be run.
+	dumper("skipif.bash", []pair{
+		{0, "ran s2"},
+		{1, "s1 already completed"},
+		{2, "1"},
+		{3, "0"},
+		{4, "FAILED: --skip-if cannot be used with --fail, --done or --group"},
+	})
+
+	dumper("porcelain.bash", []pair{
+		{0, `{"session":"d617a8e3e01d734cfbd006f569b5830dfc6e960d98a79a18f71978f73564a709","step":"s1","already_complete":false}`},
+		{1, `{"session":"d617a8e3e01d734cfbd006f569b5830dfc6e960d98a79a18f71978f73564a709","step":"s2","already_complete":false}`},
+		{2, "rc=1"},
+		{3, `{"session":"d617a8e3e01d734cfbd006f569b5830dfc6e960d98a79a18f71978f73564a709","step":"s1","already_complete":true,"elapsed":"`},
+		{4, "rc=0"},
+		{5, "FAILED: --porcelain requires a step to be specified"},
+		{6, "FAILED: --porcelain cannot be used with --fail or --done"},
+		{7, `{"session":"d617a8e3e01d734cfbd006f569b5830dfc6e960d98a79a18f71978f73564a709","step":"s3","already_complete":false}`},
+	})
+
+	dumper("result.bash", []pair{
+		{0, `{"rows":42}`},
+		{1, `{"rows":42}`},
+		{2, "step result is not valid json"},
+		{3, "FAILED: step s1 of session 53305a71d04aa5f23154424113a71bafa42c0cbb6dbe29ae07b1883c64fcd309 has no result"},
+		{4, "step s2 does not exist"},
+	})
+
+	backend := env["CHECKPOINT_BACKEND"]
+	if len(backend) == 0 {
+		backend = "directory"
+	}
+	dumper("env.bash", []pair{
+		{0, "backend:   " + backend},
+		{1, "store:     " + tmpDir},
+		{2, "namespace: none"},
+		{3, "session:   none"},
+		{4, `shell:     unsupported shell: "/bin/sh"`},
+		{7, "store:     STORE/store"},
+		{8, "namespace: ns"},
+		{9, "session:   0123abcd (CHECKPOINT_SESSION_ID)"},
+		{10, "shell:     zsh"},
+		{12, "store:     STORE/a"},
+		{13, "store:     STORE/b"},
+	})
+
+	dumper("auto.bash", []pair{
+		{0, "a b"},
+		{1, "a b"},
+		{2, "a c"},
+		{3, "3"},
+		{4, "1"},
+		{5, "FAILED: step false failed: false: exit status 1"},
+		{6, "rc=1"},
+		{7, "FAILED: an optional session and a command following -- must be specified"},
+	})
+
+	dumper("exec.bash", []pair{
+		{0, "first"},
+		{1, "second"},
+		{2, "/marker failed: sh -c test -f "},
+		{3, "1"},
+		{4, "third"},
+		{5, "0"},
+		{6, "0"},
+	})
+
+	dumper("slug.bash", []pair{
+		{0, "slug-test"},
+		{1, "1"},
+		{2, `FAILED: CHECKPOINT_IDS: unsupported session id generator: "other"`},
+	})
+
+	// Glob patterns match entire step names, never paths, and do not
+	// match in-progress steps.
+	dumper("glob.bash", []pair{
+		{0, "tmp-1"},
+		{1, "tmp-2"},
+		{2, "tmp-1"},
+		{3, "tmp-2"},
+		{4, "tmp-10"},
+		{5, "glob.bash"},
+		{6, "keep"},
+		{7, "tmp/x"},
+		{8, "xtmp-3"},
+		{9, "last"},
+		{10, "tmp/x"},
+		{11, "keep"},
+		{12, "xtmp-3"},
+		{13, `invalid glob pattern "[": syntax error in pattern`},
+		{14, "--all cannot be used with --glob"},
+		{15, "steps cannot be specified with --glob"},
+	})
+
+	dumper("reverse.bash", []pair{
+		{0, "third: current"},
+		{1, "second"},
+		{2, "first"},
+		{3, "third"},
+		{4, "second"},
+		{5, "first"},
+		{6, "first"},
+		{7, "second"},
+		{8, "third"},
+	})
+
+	dumper("current.bash", []pair{
+		{0, "0"},
+		{1, "1"},
+		{2, "s1"},
+		{3, "2"},
+		{4, "s2"},
+		{5, "0"},
+	})
+
+	dumper("is-complete.bash", []pair{
+		{0, "1"},
+		{1, "1"},
+		{2, "0"},
+		{3, "1"},
+		{4, "1"},
+		{5, "done"},
+		{6, "done"},
+		{7, "1"},
+	})
+
+	dumper("subsession.bash", []pair{
+		{0, "p1"},
+		{1, "c1"},
+		{2, "c1 done"},
+		{3, "p1 done"},
+		{4, "subsession: child: "},
+		{5, "parent: "},
+		{6, "1"},
+		{7, "1"},
+		{8, "1"},
+		{9, "a parent session and the tags for the subsession must be specified"},
+	})
+
+	dumper("phases.bash", []pair{
+		{0, "fetch"},
+		{1, "configure"},
+		{2, "compile"},
+		{3, "setup done"},
+		{4, "build not done"},
+		{5, "no deploy"},
+		{6, "build done"},
+		{7, "setup: 2/2 completed (fetch, configure)"},
+		{8, "build: 1/1 completed (compile)"},
+		{9, "phase setup: 2/2 completed"},
+		{10, "phase build: 1/1 completed"},
+		{11, "1"},
+		{12, "--content-key cannot be used with --phase"},
+	})
+
+	dumper("idfd.bash", []pair{
+		{0, "1"},
+		{1, "no session found either as an argument, via --id-fd or as environment variable"},
+		{2, "s1"},
+		{3, "s1"},
+		{4, "idfd-other: "},
+		{5, "s1"},
+		{6, "no session id was read from file descriptor 3"},
+		{7, "--id-fd requires a file descriptor"},
+		{8, `--id-fd requires a file descriptor: "x"`},
+	})
+
+	dumper("debug.bash", []pair{
+		{0, "1"},
+		{1, `"args":["s2"]`},
+		{1, `"op":"command"`},
+		{2, `"op":"session"`},
+		{2, `"source":"CHECKPOINT_SESSION_ID"`},
+		{3, `"decision":"started","key":"s2","op":"step"`},
+		{3, `"step":"s2"`},
+		{4, `{"code":1,"op":"exit"`},
+		{5, `"args":["s1"]`},
+		{7, `"decision":"already-complete","key":"s1","op":"step"`},
+		{8, `{"code":0,"op":"exit"`},
+		{9, `"decision":"completed-current","op":"step"`},
+		{10, "0"},
+	})
+
+	dumper("delete-all.bash", []pair{
+		{0, "--force must be specified to delete all sessions"},
+		{1, "--tag can only be used with --all"},
+		{2, "3"},
+		{3, "1"},
+		{4, "0"},
+		{5, "failed to delete 1 of 3 sessions: "},
+		{5, ": session is sealed"},
+		{6, "2"},
+		{7, "2"},
+	})
+
+	dumper("concurrent.bash", []pair{
+		{0, "1"},
+		{1, "2"},
+		{2, "3"},
+		{4, "s1: "},
+		{5, "s2: group g: in progress since"},
+		{6, "s3: group g: in progress since"},
+		{7, "again"},
+		{8, "0"},
+		{9, "4"},
+		{11, "s1: "},
+		{12, "s2: "},
+		{13, "s3: "},
+		{14, "s4: "},
+	})
+
+	dumper("summary.bash", []pair{
+		{0, `{"Total":0,"Completed":0,"InProgress":false,"FirstCreated":null,"LastCompleted":null,"LastActive":null}`},
+		{1, "1"},
+		{2, "2"},
+		{3, "total: 2"},
+		{4, "completed: 1"},
+		{5, "in progress: true"},
+		{6, "first created: "},
+		{7, "last completed: "},
+		{8, "last active: "},
+		{9, `{"Total":2,"Completed":2,"InProgress":false,"FirstCreated":"`},
+	})
+
+	dumper("template.bash", []pair{
+		{0, "fetch"},
+		{1, "build"},
+		{2, "test"},
+		{3, "is not a template"},
+		{4, "1"},
+		{5, "fetch: pending"},
+		{6, "build: pending"},
+		{7, "test: pending"},
+		{8, "0"},
+		{9, "fetched"},
+		{10, "fetch: "},
+		{11, "build: pending"},
+		{12, "test: pending"},
+		{13, "test: pending"},
+		{14, "build: pending"},
+		{15, "fetch: "},
+		{16, "already exists for [template.bash copy]"},
+		{17, "is not a template"},
+	})
+
+	dumper("unknown.bash", []pair{
+		{0, "failed to use session 0000: no such session"},
+		{1, "failed to use session 0000: no such session"},
+		{2, `failed to access session for "0000": no such session`},
+		{3, "2"},
+	})
+
+	dumper("completion.bash", []pair{
+		{2, "replay"},
+		{3, "b4ec70db758d4e967a751cb78f8c7492d7a52bef7f826803f3fd68e1e3f828cd"},
+		{4, "s1 s2"},
+	})
+
+	dumper("steps.bash", []pair{
+		{3, "session,tags,step,created,completed,failed,duration,reason"},
+		{4, "617d37a5afaef71ac587e8481bd1f6eda077a6b520208845c19e1ea338e51cb5,steps.bash;first,deploy,"},
+		{5, "6b851d8176b1fb943bca6f6470a8f9d1361bec23fd4033e6d37f98cf9f3309b9,steps.bash;second,deploy,"},
+		{6, `{"Session":"6b851d8176b1fb943bca6f6470a8f9d1361bec23fd4033e6d37f98cf9f3309b9","Tags":["steps.bash","second"],"Step":"deploy",`},
+		{6, `"Artifacts":{"version":"2"}}`},
+		{7, "tags,step,reason"},
+		{8, "steps.bash;first,deploy,"},
+		{9, "steps.bash;first,test,flaky"},
+	})
+
+	dumper("replay.bash", []pair{
+		{3, "source <(checkpoint use replay.bash 'second tag')"},
+		{4, "completed s1 --artifact 'name=a b' --artifact out=/tmp/result.tar"},
+		{5, "completed s2"},
+		{6, `completed --fail s2 'it'\''s broken'`},
+		{7, "completed s3"},
+		{8, "completed"},
+		{9, "4"},
+		{15, "completed s4"},
+	})
+
+	// Compaction, squashing, reordering, encryption, raw dumps,
+	// verification, migration and lock inspection are only supported by
+	// the directory backend, whose locks are also used to test timeouts.
+	if len(env["CHECKPOINT_BACKEND"]) == 0 {
+		dumper("migrate.bash", []pair{
+			{0, "store format version: 2, current format version: 2"},
+			{1, "store format version: 0, current format version: 2"},
+			{2, "1"},
+			{3, "store format version: 2, current format version: 2"},
+			{4, "migrate does not accept any arguments"},
+			{5, "1"},
+			{6, "7bfd4ee0c539bc9bf688e79225e5dd95fbc3a7f3efd39f0c4e702fc684e95214"},
+			{7, "migrate.bash: 7bfd4ee0c539bc9bf688e79225e5dd95fbc3a7f3efd39f0c4e702fc684e95214"},
+			{8, "s1: current"},
+			{9, "1"},
+			{10, "1"},
+			{11, "1"},
+			{12, "removed"},
+			{13, "1"},
+		})
+
+		dumper("timeout.bash", []pair{
+			{0, "1"},
+			{1, "context deadline exceeded"},
+			{2, "failed to execute step s2: context deadline exceeded"},
+			{3, "context deadline exceeded"},
+			{4, "2"},
+			{6, "s1: "},
+			{7, "s2: current: in progress"},
+			{8, `--timeout requires a positive duration: "0s"`},
+		})
+
+		dumper("verify.bash", []pair{
+			{0, "1"},
+			{1, "2"},
+			{2, "0"},
+			{3, "ID: .s1.123: temporary file left by an interrupted write"},
+			{4, "ID: broken: failed to parse step: invalid character"},
+			{5, "FAILED: unrepaired inconsistencies: 2"},
+			{6, "ID: .s1.123: temporary file left by an interrupted write (fixed)"},
+			{7, "ID: broken: failed to parse step: invalid character"},
+			{8, "FAILED: unrepaired inconsistencies: 1"},
+			{9, "0"},
+		})
+		dumper("trash.bash", []pair{
+			{0, "0"},
+			{1, "1"},
+			{2, "1"},
+			{3, "FAILED: session 8e2018b4daa73cdbe3e34d55cfeba3ac8c3079a6ea30294a33318f13684a0e67 already exists"},
+			{4, "1"},
+			{5, "1"},
+			{6, "0"},
+			{7, "FAILED: session 8e2018b4daa73cdbe3e34d55cfeba3ac8c3079a6ea30294a33318f13684a0e67 is not in the trash"},
+		})
+		dumper("paths.bash", []pair{
+			{0, "in-progress"},
+			{1, "metadata"},
+			{2, "s1"},
+			{3, "3"},
+		})
+		dumper("raw.bash", []pair{
+			{0, "1"},
+			{1, "in-progress -rw------- "},
+			{2, "metadata -rw------- "},
+			{3, "1"},
+			{4, "FAILED: --raw is only supported by dump"},
+		})
+		dumper("compact.bash", []pair{
+			{0, "1"},
+			{1, "2"},
+			{2, "3"},
+			{3, "compact.bash: 6fe6fffd4b7c75bb75533c1cce139e5eb997832a02f0248325cfc5be7fc26184"},
+			{4, "s1: "},
+			{6, "s3: current: in progress since"},
+		})
+		// The second pass must recognise the compacted steps as complete.
+		dumper("compact.bash", []pair{
+			{0, "compact.bash: 6fe6fffd4b7c75bb75533c1cce139e5eb997832a02f0248325cfc5be7fc26184"},
+			{1, "s1: "},
+			{2, "s2: "},
+			{3, "s3: "},
+		})
+
+		dumper("squash.bash", []pair{
+			{0, "1"},
+			{1, "2"},
+			{2, "3"},
+			{3, "FAILED: failed to squash steps for session"},
+			{3, "step s3 is in progress"},
+			{5, "build: "},
+			{6, "s3: current: in progress since"},
+		})
+
+		dumper("reorder.bash", []pair{
+			{0, "b"},
+			{1, "a"},
+			{3, "a: "},
+			{4, "b: "},
+		})
+
+		dumper("encrypted.bash", []pair{
+			{0, "1"},
+			{1, "encrypted.bash, secret tag: "},
+			{2, "s1: "},
+			{3, "0"},
+			{4, "has not been supplied"},
+			{5, "FAILED: CHECKPOINT_KEY: invalid base64 encoded key"},
+		})
+
+		dumper("locks.bash", []pair{
+			{0, "61568748157ab18fbf962968559a08f04b704d65762f4b1b1447dd8d7cc43c26: free"},
+		})
+
+		dumper("unlock.bash", []pair{
+			{0, "1"},
+			{1, "--force must be specified"},
+			{2, "0"},
+		})
+	}
+
 	runner("s6.bash", "1\n2\n3", "")
 	dumper("s6-delete.bash", []pair{
 		{0, `s6.bash: 01b2ad98e69c47b473c54c0e15cfc0ce62d3e209a9b23f8f39ec37bc4a587b9d`},
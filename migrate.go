@@ -0,0 +1,67 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+func runMigrateCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "display the format version of the store without migrating it")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) != 0 {
+		return true, fmt.Errorf("migrate does not accept any arguments")
+	}
+	migrator, ok := mgr.(checkpointstate.Migrator)
+	if !ok {
+		return true, fmt.Errorf("migration is not supported")
+	}
+	store, current, err := migrator.FormatVersion(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to determine the store's format version: %v", err)
+	}
+	// A store in $HOME is only ever moved to the preferred location here,
+	// after it has been migrated, since it must not be in use when moved.
+	from, to := pendingStoreMove(os.Getenv, runtime.GOOS, storeSuffixes[backendName()])
+	if *dryRun {
+		fmt.Fprintf(out, "store format version: %v, current format version: %v\n", store, current)
+		if len(from) > 0 {
+			fmt.Fprintf(out, "store will be moved from %v to %v\n", from, to)
+		}
+		return true, nil
+	}
+	// Migrate is called even if the store is at the current format
+	// version since it may also change the store's layout.
+	migrated, err := migrator.Migrate(ctx)
+	for _, id := range migrated {
+		fmt.Fprintf(out, "%v: migrated\n", id)
+	}
+	if err != nil {
+		return true, fmt.Errorf("failed to migrate store: %v", err)
+	}
+	if len(from) > 0 {
+		if err := moveStore(from, to); err != nil {
+			return true, fmt.Errorf("failed to move store from %v to %v: %v", from, to, err)
+		}
+		fmt.Fprintf(out, "store moved from %v to %v\n", from, to)
+	}
+	if store == current {
+		fmt.Fprintf(out, "store format version: %v, current format version: %v\n", store, current)
+		return true, nil
+	}
+	fmt.Fprintf(out, "store migrated from format version %v to %v\n", store, current)
+	return true, nil
+}
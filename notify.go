@@ -0,0 +1,98 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// notifier displays a desktop notification.
+type notifier interface {
+	notify(title, message string) error
+}
+
+// desktopNotifier displays notifications using osascript on macOS and
+// notify-send, as provided by libnotify, elsewhere.
+type desktopNotifier struct{}
+
+func (desktopNotifier) notify(title, message string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		// strconv.Quote's escaping is compatible with that of
+		// AppleScript strings for the characters that matter.
+		script := fmt.Sprintf("display notification %v with title %v", strconv.Quote(message), strconv.Quote(title))
+		cmd = exec.Command("osascript", "-e", script)
+	} else {
+		cmd = exec.Command("notify-send", title, message)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v: %s", cmd.Args[0], err, out)
+	}
+	return nil
+}
+
+// newNotifier returns the notifier used by --notify; it may be replaced
+// by tests.
+var newNotifier = func() notifier {
+	return desktopNotifier{}
+}
+
+// stepNotifier sends a notification when a step run by run, auto or exec
+// completes, or fails, having taken longer than threshold. A nil
+// stepNotifier never sends notifications.
+type stepNotifier struct {
+	session   string
+	threshold time.Duration
+	notifier  notifier
+}
+
+// extractNotify removes --notify, and its value, the threshold, from args,
+// provided that it appears before any "--", and returns that threshold
+// and true if it was found.
+func extractNotify(args []string) ([]string, time.Duration, bool, error) {
+	args, value, ok, err := extractFlagValue(args, "notify", "a duration")
+	if err != nil || !ok {
+		return args, 0, false, err
+	}
+	threshold, err := time.ParseDuration(value)
+	if err != nil || threshold < 0 {
+		return nil, 0, false, fmt.Errorf("--notify requires a duration: %q", value)
+	}
+	return args, threshold, true, nil
+}
+
+// newStepNotifier returns a stepNotifier for session, or nil if enabled
+// is false.
+func newStepNotifier(session string, threshold time.Duration, enabled bool) *stepNotifier {
+	if !enabled {
+		return nil
+	}
+	return &stepNotifier{session: session, threshold: threshold, notifier: newNotifier()}
+}
+
+// finished sends a notification for step, which was started at started,
+// if it took longer than the notifier's threshold; reason is the reason for
+// its failure, if it failed. Failures to send notifications are only
+// logged, since notifications are purely informational.
+func (n *stepNotifier) finished(step string, started time.Time, reason string) {
+	if n == nil {
+		return
+	}
+	took := time.Since(started)
+	if took <= n.threshold {
+		return
+	}
+	took = took.Round(time.Second)
+	title, message := "checkpoint: step completed", fmt.Sprintf("%v (%v)", step, took)
+	if len(reason) > 0 {
+		title, message = "checkpoint: step failed", fmt.Sprintf("%v (%v): %v", step, took, reason)
+	}
+	err := n.notifier.notify(title, message)
+	debugLog.log("notify", "session", n.session, "step", step, "duration", took.String(), "error", err)
+}
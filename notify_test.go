@@ -0,0 +1,77 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNotifier records the notifications that it is asked to display.
+type fakeNotifier struct {
+	notifications []string
+}
+
+func (fn *fakeNotifier) notify(title, message string) error {
+	fn.notifications = append(fn.notifications, title+": "+message)
+	return nil
+}
+
+func TestNotifyThreshold(t *testing.T) {
+	fake := &fakeNotifier{}
+	n := &stepNotifier{session: "s", threshold: time.Minute, notifier: fake}
+	now := time.Now()
+	n.finished("quick", now.Add(-time.Second), "")
+	n.finished("slow", now.Add(-2*time.Minute), "")
+	n.finished("quick-failure", now.Add(-time.Second), "oops")
+	n.finished("slow-failure", now.Add(-3*time.Minute), "oops")
+	if got, want := strings.Join(fake.notifications, "\n"), "checkpoint: step completed: slow (2m0s)\ncheckpoint: step failed: slow-failure (3m0s): oops"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// A nil notifier, ie. one for which --notify was not specified,
+	// does nothing.
+	var none *stepNotifier
+	none.finished("slow", now.Add(-time.Hour), "")
+}
+
+func TestNotifyRun(t *testing.T) {
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(t, 1)
+	defer cleanup()
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeNotifier{}
+	defer func(orig func() notifier) { newNotifier = orig }(newNotifier)
+	newNotifier = func() notifier { return fake }
+	run := func(args ...string) {
+		if _, err := runRunCmd(ctx, mgr, ioutil.Discard, args); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+	}
+	run("--notify", "1h", ids[0], "a", "--", "sleep", "0.1")
+	if got := len(fake.notifications); got != 0 {
+		t.Errorf("unexpected notifications: %v", fake.notifications)
+	}
+	run("--notify=50ms", ids[0], "b", "--", "sleep", "0.1")
+	run(ids[0], "c", "--", "sleep", "0.1")
+	// Steps that have already been completed are not notified.
+	run("--notify=0s", ids[0], "b", "--", "sleep", "0.1")
+	if got, want := len(fake.notifications), 1; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, fake.notifications)
+	}
+	if got, want := fake.notifications[0], "checkpoint: step completed: b ("; !strings.HasPrefix(got, want) {
+		t.Errorf("%q does not start with %q", got, want)
+	}
+	for _, value := range []string{"", "-1s", "soon"} {
+		if _, err := runRunCmd(ctx, mgr, ioutil.Discard, []string{"--notify=" + value, ids[0], "d", "--", "true"}); err == nil || !strings.Contains(err.Error(), "--notify requires a duration") {
+			t.Errorf("%q: unexpected or missing error: %v", value, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// runParallel runs each of the functions passed to send by produce on one
+// of parallel goroutines. send blocks until a goroutine is ready to run
+// the function, so that no more than parallel of them are outstanding at
+// once, and returns an error, which produce should return, if ctx is
+// canceled or a previous function failed. The first error returned by any
+// of the functions cancels the context passed to the others and is
+// returned by runParallel once they have all finished.
+func runParallel(ctx context.Context, parallel int, produce func(send func(func(context.Context) error) error) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	work := make(chan func(context.Context) error)
+	errs := make(chan error, parallel)
+	var wg sync.WaitGroup
+	wg.Add(parallel)
+	for i := 0; i < parallel; i++ {
+		go func() {
+			defer wg.Done()
+			for fn := range work {
+				if err := fn(ctx); err != nil {
+					errs <- err
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	send := func(fn func(context.Context) error) error {
+		select {
+		case work <- fn:
+			return nil
+		case err := <-errs:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	err := func() error {
+		defer close(work)
+		return produce(send)
+	}()
+	wg.Wait()
+	select {
+	case werr := <-errs:
+		// A failed function is the cause of any cancelation seen by
+		// produce.
+		return werr
+	default:
+	}
+	return err
+}
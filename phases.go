@@ -0,0 +1,68 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// formatPhase returns a one line summary of phase's progress, including
+// how long it took once it is complete.
+func formatPhase(phase checkpointstate.Phase) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "%v: %v/%v completed", phase.Name, phase.Summary.Completed, phase.Summary.Total)
+	if phase.Failed > 0 {
+		fmt.Fprintf(&out, ", %v failed", phase.Failed)
+	}
+	if phase.Summary.InProgress {
+		out.WriteString(", in progress")
+	}
+	if phase.Complete() {
+		fmt.Fprintf(&out, ", took %v", phase.Summary.LastCompleted.Sub(phase.Summary.FirstCreated))
+	}
+	return out.String()
+}
+
+func runPhasesCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("phases", flag.ContinueOnError)
+	jsonOutput := fs.Bool("json", false, "display the phases as a json array")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) > 1 {
+		return true, fmt.Errorf("phases accepts at most one session")
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	phases, err := sess.Phases(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to summarize the phases of session %v: %v", id, err)
+	}
+	if *jsonOutput {
+		buf, err := marshalJSON(phases, "")
+		if err != nil {
+			return true, err
+		}
+		_, err = fmt.Fprintln(out, string(buf))
+		return true, err
+	}
+	for _, phase := range phases {
+		fmt.Fprintf(out, "%v (%v)\n", formatPhase(phase), strings.Join(phase.Steps, ", "))
+	}
+	return true, nil
+}
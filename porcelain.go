@@ -0,0 +1,52 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// porcelainStep is written, as a single line of JSON, to stdout by a step
+// run with --porcelain so that programs, such as CI systems, can determine
+// whether the step was started or had already been completed without
+// relying on the exit status alone.
+type porcelainStep struct {
+	Session         string `json:"session"`
+	Step            string `json:"step"`
+	AlreadyComplete bool   `json:"already_complete"`
+	// Elapsed is the time taken by a step that had already been
+	// completed.
+	Elapsed string `json:"elapsed,omitempty"`
+}
+
+// reportPorcelain writes the porcelainStep for the step name, which was
+// started if done is false and had already been completed otherwise,
+// in the current session.
+func reportPorcelain(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, name string, done bool) error {
+	id, _ := defaultSessionID()
+	ps := porcelainStep{Session: id, Step: name, AlreadyComplete: done}
+	if done {
+		sess, err := mgr.Use(ctx, id, false)
+		if err != nil {
+			return fmt.Errorf("failed to access session for %q: %v", id, err)
+		}
+		steps, err := sess.Steps(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get session steps %v: %v", id, err)
+		}
+		for _, step := range steps {
+			if step.Name == name && !step.Completed.IsZero() {
+				ps.Elapsed = step.Completed.Sub(step.Created).Round(time.Millisecond).String()
+			}
+		}
+	}
+	return json.NewEncoder(out).Encode(ps)
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// progressEvent is written, as a single line of JSON, to the file
+// descriptor specified via --progress-fd for each step that run or exec
+// starts, finishes or skips because it has already been completed.
+type progressEvent struct {
+	// Event is one of started, completed, failed or skipped.
+	Event   string    `json:"event"`
+	Session string    `json:"session"`
+	Step    string    `json:"step"`
+	Time    time.Time `json:"time"`
+	// Duration is the time, in seconds, taken by a completed or failed
+	// step.
+	Duration float64 `json:"duration,omitempty"`
+	Reason   string  `json:"reason,omitempty"`
+}
+
+// progressReporter writes progressEvents so that another process, such
+// as a terminal UI, may display the progress of run and exec without
+// having to parse their output. A nil progressReporter discards all
+// events.
+type progressReporter struct {
+	session string
+	enc     *json.Encoder
+}
+
+// newProgressReporter returns a progressReporter for session that writes
+// to w, or nil if w is nil.
+func newProgressReporter(session string, w io.Writer) *progressReporter {
+	if w == nil {
+		return nil
+	}
+	return &progressReporter{session: session, enc: json.NewEncoder(w)}
+}
+
+// extractProgressFD removes --progress-fd, and its value, from args,
+// provided that it appears before any "--", and returns the specified
+// file descriptor, or nil if the flag was not specified.
+func extractProgressFD(args []string) ([]string, io.Writer, error) {
+	args, fd, ok, err := extractFDFlag(args, "progress-fd")
+	if err != nil || !ok {
+		return args, nil, err
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("fd %v", fd))
+	if _, err := f.Stat(); err != nil {
+		return nil, nil, fmt.Errorf("invalid --progress-fd file descriptor %v: %v", fd, err)
+	}
+	return args, f, nil
+}
+
+// report writes an event for step; started, if not zero, is the time at
+// which the step was started. Errors are ignored, since progress is
+// purely informational, so that a reader that goes away does not cause
+// the step to fail.
+func (p *progressReporter) report(event, step string, started time.Time, reason string) {
+	if p == nil {
+		return
+	}
+	now := time.Now().UTC()
+	ev := progressEvent{Event: event, Session: p.session, Step: step, Time: now, Reason: reason}
+	if !started.IsZero() {
+		ev.Duration = now.Sub(started).Seconds()
+	}
+	p.enc.Encode(ev)
+}
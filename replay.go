@@ -0,0 +1,89 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+func runReplayCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	md, err := sess.Metadata(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to get session metadata %v: %v", id, err)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to get session steps %v: %v", id, err)
+	}
+	if tags, ok := md["Tags"].([]interface{}); ok && len(tags) > 0 {
+		quoted := make([]string, len(tags))
+		for i, tag := range tags {
+			quoted[i] = shellQuote(fmt.Sprintf("%v", tag))
+		}
+		fmt.Fprintf(out, "source <(checkpoint use %v)\n", strings.Join(quoted, " "))
+	}
+	for _, line := range replay(steps) {
+		fmt.Fprintln(out, line)
+	}
+	return true, nil
+}
+
+// replay returns the sequence of completed invocations that would result
+// in the specified steps. Each step is started by naming it, failed
+// steps are explicitly failed and the final step, if it was completed,
+// is completed by a bare invocation since no subsequent step exists to
+// implicitly complete it.
+func replay(steps []checkpointstate.Step) []string {
+	var lines []string
+	for _, step := range steps {
+		line := "completed " + shellQuote(step.Name)
+		keys := make([]string, 0, len(step.Artifacts))
+		for k := range step.Artifacts {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			line += " --artifact " + shellQuote(k+"="+step.Artifacts[k])
+		}
+		lines = append(lines, line)
+		if !step.Failed.IsZero() {
+			line := "completed --fail " + shellQuote(step.Name)
+			if len(step.Reason) > 0 {
+				line += " " + shellQuote(step.Reason)
+			}
+			lines = append(lines, line)
+		}
+	}
+	if n := len(steps); n > 0 && !steps[n-1].Completed.IsZero() {
+		lines = append(lines, "completed")
+	}
+	return lines
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_./=:@%+,-]+$`)
+
+// shellQuote quotes s, if necessary, so that it is interpreted as a
+// single word by the shell.
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+func runResultCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("result", flag.ContinueOnError)
+	set := fs.String("set", "", "record the specified json value as the step's result rather than displaying it")
+	clear := fs.Bool("clear", false, "remove the step's result rather than displaying it")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	setResult := false
+	fs.Visit(func(f *flag.Flag) {
+		setResult = setResult || f.Name == "set"
+	})
+	if setResult && *clear {
+		return true, fmt.Errorf("--set and --clear cannot both be specified")
+	}
+	var id, step string
+	switch len(args) {
+	case 1:
+		id, _ = defaultSessionID()
+		step = args[0]
+	case 2:
+		id, step = args[0], args[1]
+	default:
+		return true, fmt.Errorf("a step, optionally preceded by a session, must be specified")
+	}
+	if len(id) == 0 {
+		return true, errNoSession
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	if setResult || *clear {
+		var result json.RawMessage
+		if setResult {
+			result = json.RawMessage(*set)
+		}
+		if err := sess.SetStepResult(ctx, step, result); err != nil {
+			return true, fmt.Errorf("failed to set the result of step %v for session %v: %v", step, id, err)
+		}
+		return true, nil
+	}
+	result, err := sess.StepResult(ctx, step)
+	if err != nil {
+		return true, fmt.Errorf("failed to get the result of step %v for session %v: %v", step, id, err)
+	}
+	if result == nil {
+		return true, fmt.Errorf("step %v of session %v has no result", step, id)
+	}
+	buf, err := marshalJSON(result, "")
+	if err != nil {
+		return true, err
+	}
+	_, err = fmt.Fprintln(out, string(buf))
+	return true, err
+}
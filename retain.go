@@ -0,0 +1,113 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// retainedSession is a session that is subject to retention.
+type retainedSession struct {
+	id      string
+	created time.Time
+}
+
+// tagValue returns the value of the first of tags of the form key=value.
+func tagValue(tags []string, key string) (string, bool) {
+	prefix := key + "="
+	for _, tag := range tags {
+		if strings.HasPrefix(tag, prefix) {
+			return tag[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+// expendable returns the IDs of the sessions in each group other than the
+// keep most recently created ones, the oldest of each group first, with
+// the groups in lexical order of their values. Sessions created at the
+// same time are ordered by their IDs.
+func expendable(groups map[string][]retainedSession, keep int) []string {
+	values := make([]string, 0, len(groups))
+	for value := range groups {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	var ids []string
+	for _, value := range values {
+		sessions := groups[value]
+		sort.Slice(sessions, func(i, j int) bool {
+			if sessions[i].created.Equal(sessions[j].created) {
+				return sessions[i].id < sessions[j].id
+			}
+			return sessions[i].created.Before(sessions[j].created)
+		})
+		for i := 0; i < len(sessions)-keep; i++ {
+			ids = append(ids, sessions[i].id)
+		}
+	}
+	return ids
+}
+
+func runRetainCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("retain", flag.ContinueOnError)
+	groupBy := fs.String("group-by-tag", "", "group sessions by the value of their tag of the form <key>=<value> for this key")
+	keep := fs.Int("keep", -1, "the number of the most recently created sessions to keep in each group")
+	var tags tagsFlag
+	fs.Var(&tags, "tag", "only consider sessions with this tag, may be repeated")
+	dryRun := fs.Bool("dry-run", false, "display, but do not delete, the sessions that would not be retained")
+	force := fs.Bool("force", false, "must be specified to confirm that --keep 0 is to delete every session in each group")
+	hard := fs.Bool("hard", false, "delete sessions permanently rather than moving them to the trash")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) != 0 {
+		return true, fmt.Errorf("unexpected arguments: %v", strings.Join(args, " "))
+	}
+	if len(*groupBy) == 0 {
+		return true, fmt.Errorf("--group-by-tag must be specified")
+	}
+	if *keep < 0 {
+		return true, fmt.Errorf("--keep must be specified and must not be negative")
+	}
+	if *keep == 0 && !*dryRun && !*force {
+		return true, fmt.Errorf("--force must be specified to delete every session in each group")
+	}
+	groups := map[string][]retainedSession{}
+	err = mgr.Walk(ctx, func(id string, sess checkpointstate.Session) error {
+		md, err := sess.Metadata(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to obtain metadata for session %v: %v", id, err)
+		}
+		sessionTags := sessionTags(md)
+		value, ok := tagValue(sessionTags, *groupBy)
+		if !ok || !hasTags(sessionTags, tags) {
+			return nil
+		}
+		// Sessions whose creation time is unknown cannot be ordered
+		// and are always retained.
+		created, ok := metadataTime(md, "Created")
+		if !ok {
+			return nil
+		}
+		groups[value] = append(groups[value], retainedSession{id: id, created: created})
+		return nil
+	})
+	if err != nil {
+		return true, fmt.Errorf("failed to list sessions: %v", err)
+	}
+	// Sessions are deleted once the walk is complete so as to not
+	// modify the store whilst it is being walked.
+	return true, removeSessions(ctx, mgr, out, expendable(groups, *keep), *dryRun, *hard)
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/cosnicolaou/checkpoint/directory"
+)
+
+func TestRetain(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "retain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+
+	// Create the sessions for each job, oldest first, interleaving the
+	// jobs so that creation order differs from group order.
+	ids := map[string][]string{}
+	for run := 0; run < 4; run++ {
+		for _, job := range []string{"backup", "report", "deploy", "other"} {
+			if (job == "report" && run >= 3) || (job == "deploy" && run >= 1) {
+				continue
+			}
+			tags := []string{"job=" + job, time.Now().Format(time.RFC3339Nano)}
+			if job == "other" {
+				tags = tags[1:]
+			}
+			id := mgr.SessionID(tags...)
+			if _, _, err := mgr.UseWithMetadata(ctx, id, true, map[string]interface{}{"ID": id, "Tags": tags}); err != nil {
+				t.Fatal(err)
+			}
+			ids[job] = append(ids[job], id)
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	retain := func(args ...string) []string {
+		out := &bytes.Buffer{}
+		if _, err := runRetainCmd(ctx, mgr, out, args); err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return strings.Fields(out.String())
+	}
+	list := func() []string {
+		listed, err := mgr.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(listed)
+		return listed
+	}
+	all := list()
+
+	// The oldest sessions of each group that exceeds the retention count
+	// are deleted, the groups in order of their tag values.
+	expired := []string{ids["backup"][0], ids["backup"][1], ids["report"][0]}
+	if got, want := retain("--group-by-tag", "job", "--keep", "2", "--dry-run"), expired; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := list(), all; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := retain("--group-by-tag", "job", "--keep", "2"), expired; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	var remaining []string
+	for _, id := range all {
+		if id != expired[0] && id != expired[1] && id != expired[2] {
+			remaining = append(remaining, id)
+		}
+	}
+	if got, want := list(), remaining; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	trashed, err := mgr.(checkpointstate.Trasher).Trashed(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(trashed), len(expired); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Retention is idempotent.
+	if got := retain("--group-by-tag", "job", "--keep", "2"); len(got) != 0 {
+		t.Errorf("unexpected sessions deleted: %v", got)
+	}
+
+	// --tag restricts the sessions considered and --hard bypasses the
+	// trash.
+	if got, want := retain("--group-by-tag", "job", "--keep", "1", "--hard", "--tag", "job=report"), ids["report"][1:2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if trashed, _ := mgr.(checkpointstate.Trasher).Trashed(ctx); len(trashed) != len(expired) {
+		t.Errorf("unexpected trash: %v", trashed)
+	}
+
+	// --keep 0 requires --force.
+	for _, args := range [][]string{
+		{"--keep", "1"},
+		{"--group-by-tag", "job"},
+		{"--group-by-tag", "job", "--keep", "0"},
+	} {
+		if _, err := runRetainCmd(ctx, mgr, ioutil.Discard, args); err == nil {
+			t.Errorf("%v: expected an error", args)
+		}
+	}
+	if got, want := retain("--group-by-tag", "job", "--keep", "0", "--force", "--hard"), []string{ids["backup"][2], ids["backup"][3], ids["deploy"][0], ids["report"][2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	sort.Strings(ids["other"])
+	if got, want := list(), ids["other"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
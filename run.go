@@ -0,0 +1,162 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// exitCodeError is returned by commands that should exit with a specific
+// status, typically that of a command that they ran. An exitCodeError
+// without an underlying error exits with that status without displaying
+// an error.
+type exitCodeError struct {
+	err  error
+	code int
+}
+
+func (e exitCodeError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %v", e.code)
+	}
+	return e.err.Error()
+}
+
+// isSilent returns true if err is an exitCodeError without an underlying
+// error.
+func isSilent(err error) bool {
+	var ec exitCodeError
+	return errors.As(err, &ec) && ec.err == nil
+}
+
+// exitCode returns the exit status to be used for err.
+func exitCode(err error) int {
+	var ec exitCodeError
+	if errors.As(err, &ec) {
+		return ec.code
+	}
+	return 2
+}
+
+func runRunCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	args, progressOut, err := extractProgressFD(args)
+	if err != nil {
+		return true, err
+	}
+	args, threshold, notify, err := extractNotify(args)
+	if err != nil {
+		return true, err
+	}
+	args, command := splitCommand(args)
+	if len(args) != 2 || len(command) == 0 {
+		return true, fmt.Errorf("a session, a step and a command following -- must be specified")
+	}
+	id, step := args[0], args[1]
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	progress := newProgressReporter(id, progressOut)
+	notifier := newStepNotifier(id, threshold, notify)
+	return true, runCommandStep(ctx, journalSession(id, sess), out, progress, notifier, step, command)
+}
+
+// splitCommand splits args at the first --, returning the arguments
+// before it and the command that follows it.
+func splitCommand(args []string) ([]string, []string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], args[i+1:]
+		}
+	}
+	return args, nil
+}
+
+// autoStep returns the name and StepOption used by auto to run command.
+// The step is identified by a hash of the command's arguments, each of
+// which is hashed separately so that, for example, 'echo a b' and
+// 'echo "a b"' are different steps, and is named for the command.
+func autoStep(command []string) (string, checkpointstate.StepOption) {
+	return quoteCommand(command), checkpointstate.WithContentKey(command...)
+}
+
+func runAutoCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	args, progressOut, err := extractProgressFD(args)
+	if err != nil {
+		return true, err
+	}
+	args, threshold, notify, err := extractNotify(args)
+	if err != nil {
+		return true, err
+	}
+	args, command := splitCommand(args)
+	if len(args) > 1 || len(command) == 0 {
+		return true, fmt.Errorf("an optional session and a command following -- must be specified")
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	progress := newProgressReporter(id, progressOut)
+	notifier := newStepNotifier(id, threshold, notify)
+	step, key := autoStep(command)
+	return true, runCommandStep(ctx, journalSession(id, sess), out, progress, notifier, step, command, key)
+}
+
+// runCommandStep runs command as the specified step unless that step has already
+// been completed. The step is marked as completed if the command succeeds
+// and as failed otherwise. Its progress is reported via progress, and its
+// completion or failure via notifier, either of which may be nil.
+func runCommandStep(ctx context.Context, sess checkpointstate.Session, out io.Writer, progress *progressReporter, notifier *stepNotifier, step string, command []string, opts ...checkpointstate.StepOption) error {
+	// The command is recorded when the step is started so that it is
+	// also recorded if the step fails.
+	opts = append(opts, checkpointstate.WithCommand(command...))
+	done, err := sess.Step(ctx, step, opts...)
+	if err != nil {
+		return err
+	}
+	if done {
+		progress.report("skipped", step, time.Time{}, "")
+		return nil
+	}
+	started := time.Now()
+	progress.report("started", step, time.Time{}, "")
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, out, os.Stderr
+	if err := cmd.Run(); err != nil {
+		reason := fmt.Sprintf("%v: %v", strings.Join(command, " "), err)
+		// The step just started is the current one, whether or not it
+		// is identified by a content key rather than its name.
+		if ferr := sess.Fail(ctx, "", reason); ferr != nil {
+			return fmt.Errorf("failed to mark step %v as failed: %v", step, ferr)
+		}
+		progress.report("failed", step, started, reason)
+		notifier.finished(step, started, reason)
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+			return exitCodeError{fmt.Errorf("step %v failed: %v", step, reason), exitErr.ExitCode()}
+		}
+		return fmt.Errorf("step %v failed: %v", step, reason)
+	}
+	if _, err := sess.Step(ctx, "", checkpointstate.WithExitCode(0)); err != nil {
+		return err
+	}
+	progress.report("completed", step, started, "")
+	notifier.finished(step, started, "")
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// signalContext returns a context that is canceled when the process
+// receives SIGINT or SIGTERM, rather than the process being terminated
+// immediately, so that the current operation may either complete or be
+// abandoned without leaving partially written state behind. The returned
+// functions return the signal received, if any, and stop handling signals.
+func signalContext(ctx context.Context) (context.Context, func() os.Signal, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	var (
+		mu       sync.Mutex
+		received os.Signal
+		done     = make(chan struct{})
+	)
+	go func() {
+		select {
+		case sig := <-ch:
+			mu.Lock()
+			received = sig
+			mu.Unlock()
+			cancel()
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			signal.Stop(ch)
+			close(done)
+			cancel()
+		})
+	}
+	return ctx, func() os.Signal {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}, stop
+}
+
+// signalExitCode returns the exit status used when the process is
+// interrupted by sig, which follows the shell convention of 128 plus
+// the signal number.
+func signalExitCode(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return 128 + int(s)
+	}
+	return 128
+}
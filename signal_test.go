@@ -0,0 +1,68 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/directory"
+)
+
+func TestInterrupt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	mgr := directory.NewManager(dir)
+	id := mgr.SessionID("interrupt")
+	if _, err := mgr.Use(context.Background(), id, true); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, interrupted, stop := signalContext(context.Background())
+	defer stop()
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+	start := time.Now()
+	_, err = runCmd(ctx, mgr, ioutil.Discard, []string{"run", id, "slow-step", "--", "sleep", "60"})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if time.Since(start) > 30*time.Second {
+		t.Errorf("the interrupted command was not canceled")
+	}
+	sig := interrupted()
+	if got, want := sig, os.Signal(syscall.SIGINT); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := signalExitCode(sig), 130; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The interrupted step is recorded as having failed and the session
+	// remains usable.
+	sess, err := mgr.Use(context.Background(), id, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, err := sess.Steps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 1 || steps[0].Name != "slow-step" || steps[0].Failed.IsZero() {
+		t.Fatalf("unexpected steps: %v", steps)
+	}
+	if _, err := sess.Step(context.Background(), "slow-step"); err != nil {
+		t.Fatal(err)
+	}
+}
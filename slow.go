@@ -0,0 +1,92 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+func runSlowCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("slow", flag.ContinueOnError)
+	top := fs.Int("top", 10, "the number of steps to display, zero for all of them")
+	var names tagsFlag
+	fs.Var(&names, "step", "only include steps with this name, may be repeated")
+	jsonOutput := fs.Bool("json", false, "display each step as a json object, one per line")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) > 1 {
+		return true, fmt.Errorf("at most one session may be specified")
+	}
+	wantStep := map[string]bool{}
+	for _, name := range names {
+		wantStep[name] = true
+	}
+	var records []stepRecord
+	collect := func(id string, sess checkpointstate.Session) error {
+		md, err := sess.Metadata(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to obtain metadata for session %v: %v", id, err)
+		}
+		steps, err := sess.Steps(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get session steps %v: %v", id, err)
+		}
+		for _, step := range steps {
+			if step.Completed.IsZero() || (len(wantStep) > 0 && !wantStep[step.Name]) {
+				continue
+			}
+			records = append(records, newStepRecord(id, sessionTags(md), step))
+		}
+		return nil
+	}
+	if len(args) == 1 {
+		sess, err := mgr.Use(ctx, args[0], false)
+		if err != nil {
+			return true, fmt.Errorf("failed to use session %v: %v", args[0], err)
+		}
+		err = collect(args[0], sess)
+	} else {
+		err = mgr.Walk(ctx, collect)
+	}
+	if err != nil {
+		return true, err
+	}
+	records = slowest(records, *top)
+	if *jsonOutput {
+		encoder := json.NewEncoder(out)
+		for _, r := range records {
+			if err := encoder.Encode(r); err != nil {
+				return true, err
+			}
+		}
+		return true, nil
+	}
+	for _, r := range records {
+		fmt.Fprintf(out, "%v: %v: %v\n", r.Session, r.Step, time.Duration(r.Duration*float64(time.Second)))
+	}
+	return true, nil
+}
+
+// slowest returns the n longest running of the supplied steps, or all
+// of them if n is zero, in order of decreasing duration.
+func slowest(records []stepRecord, n int) []stepRecord {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Duration > records[j].Duration
+	})
+	if n > 0 && len(records) > n {
+		records = records[:n]
+	}
+	return records
+}
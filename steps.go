@@ -0,0 +1,157 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// stepRecord represents a single step annotated with the ID and tags of
+// the session that it belongs to.
+type stepRecord struct {
+	Session   string
+	Tags      []string
+	Step      string
+	Created   time.Time
+	Completed *time.Time        `json:",omitempty"`
+	Failed    *time.Time        `json:",omitempty"`
+	Duration  float64           // In seconds, zero for the in-progress step.
+	Artifacts map[string]string `json:",omitempty"`
+	Reason    string            `json:",omitempty"`
+}
+
+var stepRecordHeader = []string{"session", "tags", "step", "created", "completed", "failed", "duration", "reason"}
+
+func newStepRecord(id string, tags []string, step checkpointstate.Step) stepRecord {
+	r := stepRecord{
+		Session:   id,
+		Tags:      tags,
+		Step:      step.Name,
+		Created:   step.Created,
+		Artifacts: step.Artifacts,
+		Reason:    step.Reason,
+	}
+	switch {
+	case !step.Completed.IsZero():
+		r.Completed = &step.Completed
+		r.Duration = step.Completed.Sub(step.Created).Seconds()
+	case !step.Failed.IsZero():
+		r.Failed = &step.Failed
+		r.Duration = step.Failed.Sub(step.Created).Seconds()
+	}
+	return r
+}
+
+func (r stepRecord) csv() []string {
+	format := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+	return []string{
+		r.Session,
+		strings.Join(r.Tags, ";"),
+		r.Step,
+		r.Created.Format(time.RFC3339Nano),
+		format(r.Completed),
+		format(r.Failed),
+		strconv.FormatFloat(r.Duration, 'f', -1, 64),
+		r.Reason,
+	}
+}
+
+// sessionTags returns the tags recorded in a session's metadata.
+func sessionTags(md map[string]interface{}) []string {
+	tags := []string{}
+	if v, ok := md["Tags"].([]interface{}); ok {
+		for _, tag := range v {
+			tags = append(tags, fmt.Sprintf("%v", tag))
+		}
+	}
+	return tags
+}
+
+// hasTags returns true if all of want are included in tags.
+func hasTags(tags, want []string) bool {
+	for _, w := range want {
+		found := false
+		for _, t := range tags {
+			if t == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func runStepsCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("steps", flag.ContinueOnError)
+	var tags, names tagsFlag
+	fs.Var(&tags, "tag", "only include sessions with this tag, may be repeated")
+	fs.Var(&names, "step", "only include steps with this name, may be repeated")
+	jsonOutput := fs.Bool("json", false, "display each step as a json object, one per line, rather than as csv")
+	if _, err := parseFlags(fs, args); err != nil {
+		return true, err
+	}
+	wantStep := map[string]bool{}
+	for _, name := range names {
+		wantStep[name] = true
+	}
+	encoder := json.NewEncoder(out)
+	writer := csv.NewWriter(out)
+	if !*jsonOutput {
+		writer.Write(stepRecordHeader)
+	}
+	err := mgr.Walk(ctx, func(id string, sess checkpointstate.Session) error {
+		md, err := sess.Metadata(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to obtain metadata for session %v: %v", id, err)
+		}
+		sessTags := sessionTags(md)
+		if !hasTags(sessTags, tags) {
+			return nil
+		}
+		steps, err := sess.Steps(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get session steps %v: %v", id, err)
+		}
+		for _, step := range steps {
+			if len(wantStep) > 0 && !wantStep[step.Name] {
+				continue
+			}
+			r := newStepRecord(id, sessTags, step)
+			if *jsonOutput {
+				if err := encoder.Encode(r); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := writer.Write(r.csv()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	writer.Flush()
+	if err != nil {
+		return true, fmt.Errorf("failed to list steps: %v", err)
+	}
+	return true, writer.Error()
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+const (
+	// parentField is the metadata field, set by subsession, that records
+	// the ID of a subsession's parent session.
+	parentField = "Parent"
+	// subsessionsField is the metadata field, maintained by subsession,
+	// that records the IDs of a session's subsessions.
+	subsessionsField = "Subsessions"
+	// defaultSubsessionFuncName is the default name of the shell function
+	// defined by subsession; it differs from that defined by use so that
+	// the steps of both the parent and the subsession may be completed
+	// in the same script.
+	defaultSubsessionFuncName = "subcompleted"
+)
+
+// metadataStrings returns the list of strings stored in the specified
+// metadata field.
+func metadataStrings(md map[string]interface{}, field string) []string {
+	switch v := md[field].(type) {
+	case []string:
+		return v
+	case []interface{}:
+		strs := make([]string, 0, len(v))
+		for _, s := range v {
+			strs = append(strs, fmt.Sprintf("%v", s))
+		}
+		return strs
+	}
+	return nil
+}
+
+// addSubsession records id as a subsession of parent, unless it already
+// is one. The parent's metadata is updated atomically, where supported,
+// so that subsessions created concurrently are all recorded.
+func addSubsession(ctx context.Context, parent checkpointstate.Session, id string) error {
+	return checkpointstate.UpdateMetadata(ctx, parent, func(md map[string]interface{}) (map[string]interface{}, error) {
+		if md == nil {
+			md = map[string]interface{}{}
+		}
+		subsessions := metadataStrings(md, subsessionsField)
+		for _, sub := range subsessions {
+			if sub == id {
+				return nil, nil
+			}
+		}
+		md[subsessionsField] = append(subsessions, id)
+		return md, nil
+	})
+}
+
+func runSubsessionCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("subsession", flag.ContinueOnError)
+	funcName := fs.String("func-name", defaultSubsessionFuncName, "the name of the shell function to be defined")
+	quiet := fs.Bool("quiet", false, "do not warn when an existing subsession is resumed")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) < 2 {
+		return true, fmt.Errorf("a parent session and the tags for the subsession must be specified")
+	}
+	parentID, tags := args[0], args[1:]
+	if err := checkpointstate.ValidateTags(tags...); err != nil {
+		return true, err
+	}
+	if !funcNameRE.MatchString(*funcName) {
+		return true, fmt.Errorf("invalid function name: %q", *funcName)
+	}
+	parent, err := mgr.Use(ctx, parentID, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use parent session %v: %v", parentID, err)
+	}
+	// The subsession's ID is derived from its parent's as well as from its
+	// own tags so that the same tags may be used for the subsessions of
+	// different sessions.
+	id := mgr.SessionID(append([]string{parentID}, tags...)...)
+	previous := existingMetadata(ctx, mgr, id)
+	if previous != nil && previous[parentField] != parentID {
+		return true, fmt.Errorf("session %v already exists and is not a subsession of %v", id, parentID)
+	}
+	_, created, err := mgr.UseWithMetadata(ctx, id, true, map[string]interface{}{
+		"Tags":      tags,
+		"ID":        id,
+		parentField: parentID,
+	})
+	if err != nil {
+		return true, fmt.Errorf("failed to use/create subsession for %v: %v", tags, err)
+	}
+	if !created && !*quiet {
+		warnResumed(os.Stderr, id, tags, previous)
+	}
+	if err := addSubsession(ctx, parent, id); err != nil {
+		return true, fmt.Errorf("failed to record subsession %v of %v: %v", id, parentID, err)
+	}
+	return true, writeShellFunction(out, id, *funcName)
+}
+
+// printRelations displays the parent, and the subsessions, of the session
+// with metadata md. Subsessions that have since been deleted are noted
+// as such.
+func printRelations(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, md map[string]interface{}) {
+	if parent, ok := md[parentField].(string); ok {
+		fmt.Fprintf(out, "parent: %v\n", parent)
+	}
+	for _, id := range metadataStrings(md, subsessionsField) {
+		sub := existingMetadata(ctx, mgr, id)
+		if sub == nil {
+			fmt.Fprintf(out, "subsession: %v (deleted)\n", id)
+			continue
+		}
+		fmt.Fprintf(out, "subsession: %v: %v\n", strings.Join(sessionTags(sub), ", "), id)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+	"github.com/cosnicolaou/checkpoint/journal"
+)
+
+// checkpointSyslogEnvVar requests, when set to any non-empty value, that
+// step transitions be recorded in the system log.
+const checkpointSyslogEnvVar = "CHECKPOINT_SYSLOG"
+
+// journalWriter is nil unless step transitions are to be recorded in
+// the system log.
+var journalWriter journal.Writer
+
+// enableJournal enables recording step transitions in the system log if
+// it has been requested. Failing to access the system log is reported
+// but does not prevent the command from running.
+func enableJournal() {
+	if len(os.Getenv(checkpointSyslogEnvVar)) == 0 {
+		return
+	}
+	w, err := journal.Dial("checkpoint")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: %v: failed to access the system log: %v\n", checkpointSyslogEnvVar, err)
+		return
+	}
+	journalWriter = w
+}
+
+// journalSession returns sess such that its step transitions are recorded
+// in the system log if that has been requested.
+func journalSession(id string, sess checkpointstate.Session) checkpointstate.Session {
+	if journalWriter == nil {
+		return sess
+	}
+	return journal.NewSession(id, sess, journalWriter)
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+const (
+	// templateField is the metadata field, set by template, that marks
+	// a session as a template for new sessions.
+	templateField = "Template"
+	// fromTemplateField and planField are the metadata fields, set by
+	// new --from-template, that record the template that a session was
+	// created from and the names of the steps that it is expected to run.
+	fromTemplateField = "FromTemplate"
+	planField         = "Plan"
+)
+
+func runTemplateCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("template", flag.ContinueOnError)
+	unset := fs.Bool("unset", false, "no longer treat the session as a template")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	md, err := sess.Metadata(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to obtain metadata for session %v: %v", id, err)
+	}
+	if md == nil {
+		md = map[string]interface{}{}
+	}
+	if *unset {
+		delete(md, templateField)
+	} else {
+		md[templateField] = true
+	}
+	if err := sess.SetMetadata(ctx, md); err != nil {
+		return true, fmt.Errorf("failed to write metadata for session %v: %v", id, err)
+	}
+	return true, nil
+}
+
+func runNewCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("new", flag.ContinueOnError)
+	from := fs.String("from-template", "", "the template session whose steps the new session is to run")
+	tags, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(*from) == 0 {
+		return true, fmt.Errorf("--from-template must be specified")
+	}
+	if len(tags) == 0 {
+		return true, fmt.Errorf("no session name provided")
+	}
+	if err := checkpointstate.ValidateTags(tags...); err != nil {
+		return true, err
+	}
+	tmpl, err := mgr.Use(ctx, *from, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use template %v: %v", *from, err)
+	}
+	tmd, err := tmpl.Metadata(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to obtain metadata for template %v: %v", *from, err)
+	}
+	if isTemplate, _ := tmd[templateField].(bool); !isTemplate {
+		return true, fmt.Errorf("session %v is not a template", *from)
+	}
+	steps, err := tmpl.Steps(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to get the steps of template %v: %v", *from, err)
+	}
+	id := mgr.SessionID(tags...)
+	if _, err := mgr.Use(ctx, id, false); err == nil {
+		return true, fmt.Errorf("session %v already exists for %v", id, tags)
+	}
+	_, created, err := mgr.UseWithMetadata(ctx, id, true, map[string]interface{}{
+		"Tags":            tags,
+		"ID":              id,
+		fromTemplateField: *from,
+		planField:         sessionPlan(tmd, steps),
+	})
+	if err != nil {
+		return true, fmt.Errorf("failed to create session for %v: %v", tags, err)
+	}
+	if !created {
+		return true, fmt.Errorf("session %v already exists for %v", id, tags)
+	}
+	fmt.Fprintln(out, id)
+	return true, nil
+}
+
+// sessionPlan returns the names of the steps that a session is expected
+// to run: those in its plan, if it was created from a template, followed
+// by any others that it has run, in order.
+func sessionPlan(md map[string]interface{}, steps []checkpointstate.Step) []string {
+	plan := []string{}
+	seen := map[string]bool{}
+	add := func(name string) {
+		if !seen[name] {
+			seen[name] = true
+			plan = append(plan, name)
+		}
+	}
+	if v, ok := md[planField].([]interface{}); ok {
+		for _, name := range v {
+			add(fmt.Sprintf("%v", name))
+		}
+	}
+	for _, step := range steps {
+		add(step.Name)
+	}
+	return plan
+}
+
+// pendingSteps returns the steps in a session's plan that it has yet
+// to run.
+func pendingSteps(md map[string]interface{}, steps []checkpointstate.Step) []string {
+	run := map[string]bool{}
+	for _, step := range steps {
+		run[step.Name] = true
+	}
+	var pending []string
+	for _, name := range sessionPlan(md, nil) {
+		if !run[name] {
+			pending = append(pending, name)
+		}
+	}
+	return pending
+}
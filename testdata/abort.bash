@@ -0,0 +1,11 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+completed s2 || echo 2
+checkpoint abort
+checkpoint abort 2>&1
+checkpoint state | grep -c s2
+true
+completed s2 || echo 2
+exit 0
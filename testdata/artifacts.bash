@@ -0,0 +1,9 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+trap completed EXIT
+completed s1 --artifact out=/tmp/result.tar || echo 1
+completed s2 || echo 2
+completed --artifact rows=10
+checkpoint state
+exit 0
@@ -0,0 +1,14 @@
+#!/bin/bash
+
+source <(checkpoint use --quiet $(basename $0))
+checkpoint auto -- echo a b
+checkpoint auto -- echo a b
+checkpoint auto $CHECKPOINT_SESSION_ID -- echo "a b"
+checkpoint auto -- echo a c
+checkpoint auto -- echo a c
+checkpoint state | grep -c 'ran `echo'
+checkpoint state | grep -c '^echo "a b": '
+checkpoint auto -- false
+echo "rc=$?"
+checkpoint auto 2>&1
+exit 0
@@ -0,0 +1,19 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+completed s2 || echo 2
+completed
+source <(checkpoint completion bash)
+COMP_WORDS=(checkpoint rep)
+COMP_CWORD=1
+_checkpoint
+echo "${COMPREPLY[@]}"
+COMP_WORDS=(checkpoint state ${CHECKPOINT_SESSION_ID:0:16})
+COMP_CWORD=2
+_checkpoint
+echo "${COMPREPLY[@]}"
+COMP_WORDS=(checkpoint delete $CHECKPOINT_SESSION_ID "")
+COMP_CWORD=3
+_checkpoint
+echo "${COMPREPLY[@]}"
@@ -0,0 +1,16 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+completed --group g s2 || echo 2
+completed --group g s3 || echo 3
+checkpoint state
+completed --done s3
+completed --done s3 && echo again
+checkpoint current | wc -l
+completed --done s2
+completed s2 || echo 2
+completed s4 || echo 4
+completed
+checkpoint state
+exit 0
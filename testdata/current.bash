@@ -0,0 +1,11 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+checkpoint current | wc -l
+completed s1 || echo 1
+checkpoint current
+completed s2 || echo 2
+checkpoint current $CHECKPOINT_SESSION_ID
+completed
+checkpoint current | wc -l
+exit 0
@@ -0,0 +1,9 @@
+#!/bin/bash
+
+source <(checkpoint use --quiet $(basename $0))
+trap completed EXIT
+completed -x || echo 1
+completed -- --done || echo 2
+completed --artifact out=b -- -y || echo 3
+checkpoint state
+exit 0
@@ -0,0 +1,9 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+CHECKPOINT_DEBUG=1 completed s2 2>&1 | grep -v '"op":"lock"'
+checkpoint --debug s1 2>&1 | grep -v '"op":"lock"'
+checkpoint --debug 2>&1 | grep '"op":"step"'
+checkpoint s1 2>&1 | wc -l
+exit 0
@@ -0,0 +1,19 @@
+#!/bin/bash
+
+session() {
+  checkpoint use "$@" | sed -n 's/^export CHECKPOINT_SESSION_ID=//p'
+}
+keep=$(session delete-all keep)
+ci1=$(session delete-all ci)
+ci2=$(session delete-all ci nightly)
+sealed=$(session delete-all ci sealed)
+checkpoint seal $sealed
+checkpoint delete --all 2>&1
+checkpoint delete --tag ci $keep 2>&1
+checkpoint delete --all --tag delete-all --tag ci --dry-run | wc -l
+checkpoint delete --all --tag delete-all --tag ci --tag nightly --dry-run | grep -c $ci2
+checkpoint delete --all --tag delete-all --tag ci --before 7d | wc -l
+checkpoint delete --all --tag delete-all --tag ci --before 2100-01-01T00:00:00Z 2>&1 >/dev/null
+checkpoint delete --all --tag delete-all --dry-run | wc -l
+checkpoint delete --all --tag delete-all --dry-run | grep -c "$keep\|$sealed"
+exit 0
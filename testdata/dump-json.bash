@@ -0,0 +1,9 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+trap completed EXIT
+completed s1 || true
+completed s2 || true
+completed s3 || true
+checkpoint dump --format=json
+exit 0
@@ -0,0 +1,12 @@
+#!/bin/bash
+
+export CHECKPOINT_NAMESPACE=encrypted
+export CHECKPOINT_KEY=$(printf 0123456789abcdef | base64)
+source <(checkpoint use $(basename $0) "secret tag")
+completed s1 || echo 1
+completed
+checkpoint state
+grep -rl "secret tag" $HOME/.checkpointstate/.namespaces/encrypted | wc -l
+CHECKPOINT_KEY= checkpoint state 2>&1
+CHECKPOINT_KEY=invalid checkpoint state 2>&1
+exit 0
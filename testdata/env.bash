@@ -0,0 +1,8 @@
+#!/bin/bash
+
+unset CHECKPOINT_SESSION_ID
+SHELL=/bin/sh checkpoint env
+store=$(mktemp -d)
+CHECKPOINT_DIR=$store/store CHECKPOINT_NAMESPACE=ns CHECKPOINT_SESSION_ID=0123abcd SHELL=/bin/zsh checkpoint env | sed "s|$store|STORE|"
+CHECKPOINT_PATH=$store/a:$store/b checkpoint env | grep store: | sed "s|$store|STORE|"
+exit 0
@@ -0,0 +1,20 @@
+#!/bin/bash
+
+dir=$(mktemp -d)
+cat > $dir/pipeline <<END
+# a pipeline that fails until the marker file is created
+echo first
+
+echo second
+test -f $dir/marker
+echo third
+END
+checkpoint exec $dir/pipeline 2>&1
+echo $?
+touch $dir/marker
+checkpoint exec $dir/pipeline 2>&1
+echo $?
+checkpoint exec $dir/pipeline 2>&1
+echo $?
+rm -rf $dir
+exit 0
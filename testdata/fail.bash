@@ -0,0 +1,8 @@
+#!/bin/bash
+
+source <(checkpoint use --quiet $(basename $0))
+trap completed EXIT
+completed s1 || echo 1
+completed s2 || false || completed --fail s2 could not do it
+checkpoint state
+exit 0
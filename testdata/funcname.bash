@@ -0,0 +1,9 @@
+#!/bin/bash
+
+source <(checkpoint use --func-name mystep $(basename $0))
+echo $CHECKPOINT_SESSION_ID_MYSTEP
+type -t completed || echo "completed is not defined"
+mystep s1 || echo 1
+mystep s2 || echo 2
+mystep
+checkpoint state $CHECKPOINT_SESSION_ID_MYSTEP
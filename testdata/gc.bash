@@ -0,0 +1,18 @@
+#!/bin/bash
+
+export CHECKPOINT_NAMESPACE=gc
+source <(checkpoint use $(basename $0) keep)
+completed s1 || echo 1
+source <(checkpoint use --ttl 1h $(basename $0) later)
+source <(checkpoint use --ttl 1ms $(basename $0) expired)
+completed s1 || echo 1
+sleep 0.1
+checkpoint gc --dry-run
+checkpoint gc
+checkpoint gc
+checkpoint list | grep -c "^[0-9a-f]*:"
+# A subsequent use refreshes the ttl unless requested otherwise.
+source <(checkpoint use --ttl 1ms $(basename $0) later)
+source <(checkpoint use --ttl 1h --refresh-ttl=false $(basename $0) later)
+sleep 0.1
+checkpoint gc
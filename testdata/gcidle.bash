@@ -0,0 +1,20 @@
+#!/bin/bash
+
+# Use a separate store so that the sessions of other scripts are not deleted.
+store=$(mktemp -d)
+export CHECKPOINT_DIR=$store/store
+source <(checkpoint use --quiet $(basename $0) stale)
+completed s1 || true
+completed
+source <(checkpoint use --quiet $(basename $0) empty)
+sleep 1
+source <(checkpoint use --quiet $(basename $0) active)
+completed s1 || true
+completed
+checkpoint gc --idle 500ms --dry-run
+checkpoint gc --idle 1h
+checkpoint gc --idle 500ms
+checkpoint list --ids-only
+checkpoint gc --idle -1s 2>&1
+rm -rf $store
+exit 0
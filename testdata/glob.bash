@@ -0,0 +1,16 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+for step in tmp-1 keep tmp-2 tmp/x tmp-10 xtmp-3 last; do
+  completed $step || true
+done
+checkpoint delete --glob 'tmp-?' --dry-run
+checkpoint delete --glob 'tmp-*'
+checkpoint state | cut -d: -f1
+checkpoint delete --glob '../*'
+checkpoint delete --glob 'tmp/*'
+checkpoint delete --glob '*' --dry-run
+checkpoint delete --glob '[' 2>&1
+checkpoint delete --glob '*' --all 2>&1
+checkpoint delete --glob '*' $CHECKPOINT_SESSION_ID extra 2>&1
+exit 0
@@ -0,0 +1,15 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+trap completed EXIT
+completed s1 || echo 1
+completed s2 || echo 2
+completed s3 || echo 3
+checkpoint history
+checkpoint history --gantt
+# A step that completed before it was created, due to clock skew.
+checkpoint import - <<'EOS' >/dev/null
+{"metadata":{"ID":"history-skewed","Tags":["history-skewed"]},"steps":[{"Name":"a","Created":"2020-01-01T00:00:10Z","Completed":"2020-01-01T00:00:00Z"},{"Name":"b","Created":"2020-01-01T00:00:00Z","Completed":"2020-01-01T00:00:05Z"}]}
+EOS
+checkpoint history --gantt history-skewed
+exit 0
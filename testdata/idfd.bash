@@ -0,0 +1,19 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+id=$CHECKPOINT_SESSION_ID
+other=$(checkpoint use idfd-other | sed -n 's/^export CHECKPOINT_SESSION_ID=//p')
+unset CHECKPOINT_SESSION_ID
+checkpoint current 2>&1
+# The ID is read from the read end of a pipe.
+checkpoint current --id-fd 3 3< <(echo $id)
+checkpoint --id-fd=3 current 3< <(echo $id)
+# An explicit argument takes precedence over --id-fd which takes
+# precedence over the environment.
+checkpoint state --id-fd 3 $other 3< <(echo $id)
+CHECKPOINT_SESSION_ID=$other checkpoint current --id-fd 3 3< <(echo $id)
+checkpoint current --id-fd 3 3< /dev/null 2>&1
+checkpoint current --id-fd 2>&1
+checkpoint current --id-fd x 2>&1
+exit 0
@@ -0,0 +1,13 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1
+checkpoint list --incomplete | grep -c "^${CHECKPOINT_SESSION_ID}:"
+completed
+checkpoint list --incomplete | grep -c "^${CHECKPOINT_SESSION_ID}:"
+completed s2
+checkpoint fail
+checkpoint list --incomplete | grep -c "^${CHECKPOINT_SESSION_ID}:"
+checkpoint list --incomplete --parallel 4 | grep -c "^${CHECKPOINT_SESSION_ID}:"
+checkpoint list --incomplete --since 2100-01-01T00:00:00Z | wc -l | tr -d ' '
+exit 0
@@ -0,0 +1,10 @@
+#!/bin/bash
+
+export HOME=$(mktemp -d)
+checkpoint init --shell bash
+ls -a $HOME | grep -c checkpointstate
+checkpoint init --shell zsh | grep -c "source <(checkpoint completion zsh)"
+checkpoint init --shell fish | grep "completion fish"
+checkpoint init --shell csh 2>&1
+rm -rf $HOME
+exit 0
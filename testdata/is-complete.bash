@@ -0,0 +1,13 @@
+#!/bin/bash
+
+source <(checkpoint use --quiet $(basename $0))
+checkpoint is-complete s1 || echo 1
+checkpoint is-complete s1 || echo 1
+checkpoint current | wc -l
+completed s1 || echo 1
+checkpoint is-complete s1 || echo 1
+completed
+checkpoint is-complete s1 && echo done
+checkpoint is-complete $CHECKPOINT_SESSION_ID s1 && echo done
+checkpoint is-complete s2 2>&1; echo $?
+exit 0
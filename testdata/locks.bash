@@ -0,0 +1,5 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+checkpoint locks $CHECKPOINT_SESSION_ID
+exit 0
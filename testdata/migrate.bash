@@ -0,0 +1,27 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1
+checkpoint migrate --dry-run
+rm $HOME/.checkpointstate/.version
+checkpoint migrate --dry-run
+checkpoint migrate 2>&1 | grep -c "store migrated from format version 0 to 2"
+checkpoint migrate
+checkpoint migrate extra 2>&1
+# Sharding uses its own store since the store is shared by other tests.
+export HOME=$HOME/sharded
+mkdir -p $HOME
+source <(checkpoint use $(basename $0))
+completed s1
+CHECKPOINT_SHARDED=1 checkpoint migrate | grep -c ": migrated"
+ls $HOME/.checkpointstate/${CHECKPOINT_SESSION_ID:0:2}
+checkpoint state $CHECKPOINT_SESSION_ID
+# A store in $HOME is used in place, rather than in the XDG location, until
+# migrate moves it.
+export XDG_STATE_HOME=$HOME/state
+checkpoint state $CHECKPOINT_SESSION_ID | grep -c "s1: current"
+checkpoint migrate --dry-run | grep -c "store will be moved from $HOME/.checkpointstate to $XDG_STATE_HOME/checkpoint"
+checkpoint migrate | grep -c "store moved from $HOME/.checkpointstate to $XDG_STATE_HOME/checkpoint"
+test -e $HOME/.checkpointstate || echo removed
+checkpoint state $CHECKPOINT_SESSION_ID | grep -c "s1: current"
+exit 0
@@ -0,0 +1,16 @@
+#!/bin/bash
+
+source <(checkpoint use --name a $(basename $0) a)
+source <(checkpoint use --name b $(basename $0) b)
+source <(checkpoint use $(basename $0) default)
+a s1 || echo a1
+b s1 || echo b1
+completed s1 || echo c1
+a s2 || echo a2
+false
+b s2 || echo b2
+a
+completed
+checkpoint state $CHECKPOINT_SESSION_ID_A
+checkpoint state $CHECKPOINT_SESSION_ID_B
+checkpoint state
@@ -0,0 +1,13 @@
+#!/bin/bash
+
+export CHECKPOINT_NAMESPACE=output
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+completed
+checkpoint --output $HOME/list.txt list
+grep -c "output.bash" $HOME/list.txt
+checkpoint --output=/dev/null state
+checkpoint --output 2>&1
+checkpoint --output $HOME/use.sh use $(basename $0)
+grep -c "^export CHECKPOINT_SESSION_ID=" $HOME/use.sh
+exit 0
@@ -0,0 +1,11 @@
+#!/bin/bash
+
+export CHECKPOINT_NAMESPACE=paths
+source <(checkpoint use --quiet $(basename $0))
+completed s1 || true
+completed s2 || true
+for path in $(checkpoint paths); do
+  test -f $path && basename $path
+done
+checkpoint paths $CHECKPOINT_SESSION_ID | grep -c "/$CHECKPOINT_SESSION_ID/"
+exit 0
@@ -0,0 +1,16 @@
+#!/bin/bash
+
+source <(checkpoint use --quiet $(basename $0))
+completed --phase setup fetch || echo fetch
+completed --phase setup configure || echo configure
+completed --phase build compile || echo compile
+checkpoint is-complete --phase setup && echo setup done
+checkpoint is-complete --phase build || echo build not done
+checkpoint is-complete --phase deploy || echo no deploy
+completed
+checkpoint is-complete --phase build && echo build done
+checkpoint phases | sed -e 's/, took .*(/ (/'
+checkpoint state | grep '^phase ' | sed -e 's/, took.*//'
+checkpoint phases --json $CHECKPOINT_SESSION_ID | grep -c '"Name":"build"'
+checkpoint is-complete --phase build --content-key x 2>&1
+exit 0
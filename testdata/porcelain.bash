@@ -0,0 +1,15 @@
+#!/bin/bash
+
+source <(checkpoint use --quiet $(basename $0))
+completed --porcelain s1 || true
+completed --porcelain s2 || echo "rc=$?"
+completed --porcelain s1
+echo "rc=$?"
+checkpoint --porcelain 2>&1
+checkpoint --porcelain --done s1 2>&1
+# The porcelain output honours --output.
+output=$(mktemp)
+checkpoint --output "$output" --porcelain s3 >/dev/null || true
+cat "$output"
+rm -f "$output"
+exit 0
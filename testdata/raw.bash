@@ -0,0 +1,9 @@
+#!/bin/bash
+
+export CHECKPOINT_NAMESPACE=raw
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+checkpoint dump --raw | grep -v '^{'
+checkpoint dump --raw | grep -c '"Step":"s1"'
+checkpoint state --raw 2>&1
+exit 0
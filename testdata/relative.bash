@@ -0,0 +1,9 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+trap completed EXIT
+completed s1 || echo 1
+completed s2 || echo 2
+checkpoint state --relative
+checkpoint dump --relative
+exit 0
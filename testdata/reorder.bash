@@ -0,0 +1,8 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed b || echo b
+completed a || echo a
+completed
+checkpoint reorder $CHECKPOINT_SESSION_ID a b
+checkpoint state
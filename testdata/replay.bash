@@ -0,0 +1,13 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0) "second tag")
+checkpoint delete
+source <(checkpoint use $(basename $0) "second tag")
+completed s1 --artifact out=/tmp/result.tar --artifact "name=a b" || echo 1
+completed s2 || echo 2
+completed --fail s2 "it's broken"
+completed s3 || echo 3
+completed
+checkpoint replay
+completed s4 || echo 4
+checkpoint replay
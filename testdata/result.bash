@@ -0,0 +1,12 @@
+#!/bin/bash
+
+source <(checkpoint use --quiet $(basename $0))
+completed s1 || true
+checkpoint result --set '{"rows":42}' s1
+checkpoint result s1
+checkpoint result $CHECKPOINT_SESSION_ID s1
+checkpoint result --set '{"rows":' s1 2>&1
+checkpoint result --clear s1
+checkpoint result s1 2>&1
+checkpoint result s2 2>&1
+exit 0
@@ -0,0 +1,7 @@
+#!/bin/bash
+
+checkpoint use resume.bash 2>&1 >/dev/null
+echo created
+checkpoint use resume.bash 2>&1 >/dev/null
+checkpoint use --quiet resume.bash 2>&1 >/dev/null
+echo resumed
@@ -0,0 +1,10 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed first || true
+completed second || true
+completed third || true
+checkpoint state --reverse | tail -n +2 | cut -d: -f1-2
+checkpoint history --reverse | cut -d: -f1
+checkpoint state | tail -n +2 | cut -d: -f1
+exit 0
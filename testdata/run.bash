@@ -0,0 +1,17 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+id=$CHECKPOINT_SESSION_ID
+checkpoint run $id s1 -- echo ran s1
+checkpoint run $id s1 -- echo ran s1 again
+checkpoint run $id s2 -- sh -c "echo ran s2; exit 3" 2>&1
+echo $?
+checkpoint state $id | grep -c "s2: failed"
+checkpoint run $id s2 -- echo ran s2 again
+checkpoint run $id s3 -- /nonexistent 2>&1
+echo $?
+completed s4 || true
+completed
+checkpoint history $id
+checkpoint history $id | grep -c ", ran "
+exit 0
@@ -1,6 +1,6 @@
 #!/bin/bash
 
-source <(checkpoint use $(basename $0))
+source <(checkpoint use --quiet $(basename $0))
 trap completed EXIT
 completed s1 || echo 1
 if ! completed s2; then
@@ -1,6 +1,6 @@
 #!/bin/bash
 
-source <(checkpoint use $(basename $0))
+source <(checkpoint use --quiet $(basename $0))
 completed s1 || echo 1
 completed s2 || echo 2
 cat does-not-exist &> /dev/null
@@ -0,0 +1,12 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+completed
+checkpoint seal
+checkpoint state
+completed s2 2>&1
+echo $?
+checkpoint delete 2>&1
+checkpoint unseal
+completed s2 || echo 2
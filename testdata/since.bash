@@ -0,0 +1,8 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+checkpoint list --since 1h | grep -c "^${CHECKPOINT_SESSION_ID}:"
+checkpoint list --since 2100-01-01T00:00:00Z | wc -l | tr -d ' '
+checkpoint list --since 1h --by created | grep -c "^${CHECKPOINT_SESSION_ID}:"
+checkpoint list --since 1h --by modified
+exit 0
@@ -0,0 +1,14 @@
+#!/bin/bash
+
+source <(checkpoint use --quiet $(basename $0))
+dir=$(mktemp -d)
+touch $dir/exists
+completed --skip-if "test -f $dir/exists" s1 || echo "ran s1"
+completed --skip-if "test -f $dir/missing" s2 || echo "ran s2"
+completed
+completed --skip-if "test -f $dir/missing" s1 && echo "s1 already completed"
+checkpoint state | grep -c "skip-if=test -f $dir/exists"
+checkpoint state | grep -c "skip-if=test -f $dir/missing"
+checkpoint --skip-if true --group g s3 2>&1
+rm -rf $dir
+exit 0
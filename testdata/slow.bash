@@ -0,0 +1,11 @@
+#!/bin/bash
+
+export CHECKPOINT_NAMESPACE=slow
+source <(checkpoint use $(basename $0))
+completed fast || true
+completed sleepy || sleep 0.2
+completed medium || sleep 0.1
+completed
+checkpoint slow --top 2 $CHECKPOINT_SESSION_ID
+checkpoint slow --json --step fast $CHECKPOINT_SESSION_ID
+checkpoint slow --step sleepy | wc -l
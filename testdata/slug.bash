@@ -0,0 +1,10 @@
+#!/bin/bash
+
+export CHECKPOINT_IDS=slug
+source <(checkpoint use slug test)
+echo $CHECKPOINT_SESSION_ID
+completed s1 || true
+completed
+checkpoint state slug-test | grep -c "^s1: "
+CHECKPOINT_IDS=other checkpoint list 2>&1
+exit 0
@@ -0,0 +1,9 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+completed s2 || echo 2
+completed s3 || echo 3
+checkpoint squash $CHECKPOINT_SESSION_ID build s1 s2
+checkpoint squash $CHECKPOINT_SESSION_ID all build s3 2>&1
+checkpoint state
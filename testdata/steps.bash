@@ -0,0 +1,13 @@
+#!/bin/bash
+
+export CHECKPOINT_NAMESPACE=steps
+source <(checkpoint use --tag $(basename $0) --tag first)
+completed deploy || echo 1
+completed test || echo 2
+completed --fail test "flaky"
+source <(checkpoint use --tag $(basename $0) --tag second)
+completed deploy --artifact version=2 || echo 1
+completed
+checkpoint steps --step deploy
+checkpoint steps --json --tag second
+checkpoint steps --tag first --tag steps.bash | cut -d, -f2-3,8
@@ -0,0 +1,17 @@
+#!/bin/bash
+
+source <(checkpoint use --quiet $(basename $0))
+completed p1 || echo p1
+source <(checkpoint subsession $CHECKPOINT_SESSION_ID child)
+subcompleted c1 || echo c1
+subcompleted
+subcompleted c1 && echo c1 done
+completed
+completed p1 && echo p1 done
+checkpoint state | grep subsession:
+checkpoint state $CHECKPOINT_SESSION_ID_SUBCOMPLETED | grep parent:
+checkpoint dump $CHECKPOINT_SESSION_ID_SUBCOMPLETED | grep -c '"Parent"'
+checkpoint subsession $CHECKPOINT_SESSION_ID child 2>&1 >/dev/null | grep -c resuming
+checkpoint state | grep -c subsession:
+checkpoint subsession $CHECKPOINT_SESSION_ID 2>&1
+exit 0
@@ -0,0 +1,10 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+checkpoint summary --json
+completed s1 || echo 1
+completed s2 || echo 2
+checkpoint summary
+completed
+checkpoint summary $CHECKPOINT_SESSION_ID --json
+exit 0
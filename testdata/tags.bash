@@ -0,0 +1,16 @@
+#!/bin/bash
+
+source <(checkpoint use --quiet a b)
+echo $CHECKPOINT_SESSION_ID
+source <(checkpoint use --quiet --tag a b)
+echo $CHECKPOINT_SESSION_ID
+source <(checkpoint use --quiet --tag a --tag b)
+echo $CHECKPOINT_SESSION_ID
+source <(checkpoint use --quiet b --tag a)
+echo $CHECKPOINT_SESSION_ID
+source <(checkpoint use --quiet --name x -- --tag)
+echo $CHECKPOINT_SESSION_ID_X
+checkpoint use a "" 2>&1
+checkpoint use a $(printf 'x%.0s' $(seq 1025)) 2>&1
+CHECKPOINT_IDS=slug checkpoint use '!!' 2>&1
+exit 0
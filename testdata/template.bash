@@ -0,0 +1,20 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+tmpl=$CHECKPOINT_SESSION_ID
+completed fetch || echo fetch
+completed build || echo build
+completed test || echo test
+completed
+checkpoint new --from-template $tmpl $(basename $0) copy 2>&1
+checkpoint template $tmpl
+checkpoint state $tmpl | head -1 | grep -c "(template)"
+id=$(checkpoint new --from-template $tmpl $(basename $0) copy)
+checkpoint state $id | tail -n +2
+checkpoint steps | grep -c $id
+checkpoint run $id fetch -- echo fetched
+checkpoint state $id | tail -n +2 | cut -d: -f1-2
+checkpoint state --reverse $id | tail -n +2 | cut -d: -f1-2
+checkpoint new --from-template $tmpl $(basename $0) copy 2>&1
+checkpoint new --from-template $id other 2>&1
+exit 0
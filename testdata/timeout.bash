@@ -0,0 +1,15 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+# Hold the lock on the checkpoint from this shell.
+exec 9<$HOME/.checkpointstate/$CHECKPOINT_SESSION_ID
+flock 9
+checkpoint --timeout 200ms state 2>&1
+checkpoint --timeout 200ms s2 2>&1
+checkpoint --output /dev/null --timeout=200ms state 2>&1
+flock -u 9
+checkpoint --timeout 5s s2 || echo 2
+checkpoint --timeout 5s state
+checkpoint --timeout 0s state 2>&1
+exit 0
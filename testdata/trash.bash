@@ -0,0 +1,20 @@
+#!/bin/bash
+
+export CHECKPOINT_DIR=$(mktemp -d)/store
+source <(checkpoint use --quiet $(basename $0))
+completed s1 || true
+completed s2 || true
+checkpoint delete
+checkpoint list --ids-only | wc -l
+checkpoint list --trash | grep -c "^$CHECKPOINT_SESSION_ID: trashed "
+checkpoint restore
+checkpoint state | grep -c "^s2: current"
+checkpoint delete
+source <(checkpoint use --quiet $(basename $0))
+checkpoint restore 2>&1
+checkpoint delete --hard
+checkpoint list --trash | wc -l
+checkpoint empty-trash | grep -c "^$CHECKPOINT_SESSION_ID: trashed "
+checkpoint list --trash | wc -l
+checkpoint restore 2>&1
+exit 0
@@ -0,0 +1,6 @@
+#!/bin/bash
+
+checkpoint state 0000 2>&1
+checkpoint dump 0000 2>&1
+checkpoint delete 0000 2>&1
+echo $?
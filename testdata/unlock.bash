@@ -0,0 +1,8 @@
+#!/bin/bash
+
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+checkpoint unlock $CHECKPOINT_SESSION_ID
+checkpoint unlock --force $CHECKPOINT_SESSION_ID
+checkpoint state | grep -c current
+exit 0
@@ -0,0 +1,17 @@
+#!/bin/bash
+
+export CHECKPOINT_NAMESPACE=verify
+source <(checkpoint use $(basename $0))
+completed s1 || echo 1
+completed s2 || echo 2
+checkpoint verify
+echo $?
+dir=$HOME/.checkpointstate/.namespaces/verify/$CHECKPOINT_SESSION_ID
+echo partial > $dir/.s1.123
+echo "{not json" > $dir/broken
+checkpoint verify 2>&1 | sed -e "s/$CHECKPOINT_SESSION_ID/ID/"
+checkpoint verify --fix $CHECKPOINT_SESSION_ID 2>&1 | sed -e "s/$CHECKPOINT_SESSION_ID/ID/"
+rm $dir/broken
+checkpoint verify
+echo $?
+exit 0
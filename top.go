@@ -0,0 +1,132 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// clearScreen moves the cursor to the top left of the terminal and
+// clears it.
+const clearScreen = "\033[H\033[2J"
+
+// topEntry describes a session with a step in progress.
+type topEntry struct {
+	id        string
+	tags      []string
+	step      checkpointstate.Step
+	completed int
+	total     int
+}
+
+func runTopCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	interval := fs.Duration("interval", 2*time.Second, "the interval at which the display is refreshed")
+	iterations := fs.Int("iterations", 0, "the number of times to display the sessions, zero to do so until interrupted")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) != 0 {
+		return true, fmt.Errorf("unexpected arguments: %v", strings.Join(args, " "))
+	}
+	if *interval <= 0 {
+		return true, fmt.Errorf("--interval must be positive")
+	}
+	clear := isTerminal(out)
+	for i := 1; ; i++ {
+		entries, err := topSessions(ctx, mgr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return true, nil
+			}
+			return true, err
+		}
+		if clear {
+			fmt.Fprint(out, clearScreen)
+		}
+		renderTop(out, entries, time.Now())
+		if *iterations > 0 && i >= *iterations {
+			return true, nil
+		}
+		select {
+		case <-ctx.Done():
+			return true, nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// topSessions returns the sessions that have a step in progress, the one
+// whose step has been in progress the longest first. Sessions that cannot
+// be read, for example because they are deleted whilst being read, are
+// skipped.
+func topSessions(ctx context.Context, mgr checkpointstate.Manager) ([]topEntry, error) {
+	var entries []topEntry
+	err := mgr.Walk(ctx, func(id string, sess checkpointstate.Session) error {
+		current, err := sess.Current(ctx)
+		if err != nil || current == nil {
+			return ctx.Err()
+		}
+		summary, err := sess.Summary(ctx)
+		if err != nil {
+			return ctx.Err()
+		}
+		md, err := sess.Metadata(ctx)
+		if err != nil {
+			return ctx.Err()
+		}
+		entries = append(entries, topEntry{
+			id:        id,
+			tags:      sessionTags(md),
+			step:      *current,
+			completed: summary.Completed,
+			total:     summary.Total,
+		})
+		return nil
+	})
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].step.Created.Equal(entries[j].step.Created) {
+			return entries[i].id < entries[j].id
+		}
+		return entries[i].step.Created.Before(entries[j].step.Created)
+	})
+	return entries, err
+}
+
+// renderTop displays entries as a table, with the time for which each
+// step has been in progress measured relative to now.
+func renderTop(out io.Writer, entries []topEntry, now time.Time) {
+	fmt.Fprintf(out, "checkpoint top - %v, %v session(s) with a step in progress\n\n", now.Format("15:04:05"), len(entries))
+	if len(entries) == 0 {
+		return
+	}
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "ELAPSED\tSTEP\tDONE\tSESSION\tTAGS\n")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%v\t%v\t%v/%v\t%v\t%v\n", now.Sub(e.step.Created).Round(time.Second), e.step.Name, e.completed, e.total, e.id, strings.Join(e.tags, " "))
+	}
+	tw.Flush()
+}
+
+// isTerminal returns true if out is a terminal.
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTop(t *testing.T) {
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(t, 4)
+	defer cleanup()
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Start steps in the third and first sessions, in that order, and
+	// complete one step in the first.
+	for _, step := range []struct {
+		session int
+		names   []string
+	}{
+		{2, []string{"build"}},
+		{0, []string{"fetch", "test"}},
+	} {
+		sess, err := mgr.Use(ctx, ids[step.session], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range step.names {
+			if _, err := sess.Step(ctx, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	entries, err := topSessions(ctx, mgr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(entries), 2; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i, want := range []struct {
+		id, step         string
+		completed, total int
+	}{
+		{ids[2], "build", 0, 1},
+		{ids[0], "test", 1, 2},
+	} {
+		e := entries[i]
+		if e.id != want.id || e.step.Name != want.step || e.completed != want.completed || e.total != want.total {
+			t.Errorf("%v: got %v %v %v/%v, want %v %v %v/%v", i, e.id, e.step.Name, e.completed, e.total, want.id, want.step, want.completed, want.total)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	if _, err := runTopCmd(ctx, mgr, out, []string{"--iterations", "2", "--interval", "1ms"}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), clearScreen) {
+		t.Errorf("the screen should not be cleared when not writing to a terminal")
+	}
+	if got, want := strings.Count(out.String(), "2 session(s) with a step in progress"), 2; got != want {
+		t.Errorf("got %v, want %v:\n%s", got, want, out.String())
+	}
+	lines := strings.Split(out.String(), "\n")
+	if got, want := strings.Fields(lines[3]), []string{"build", "0/1", ids[2], entries[0].tags[0]}; len(got) != 5 || strings.Join(got[1:], " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want <elapsed> %v", got, want)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+// traceEvent is a complete, ie. duration, event in the Chrome Trace Event
+// format as understood by chrome://tracing, perfetto and speedscope.
+// Times are in microseconds.
+type traceEvent struct {
+	Name     string            `json:"name"`
+	Category string            `json:"cat"`
+	Phase    string            `json:"ph"`
+	Start    int64             `json:"ts"`
+	Duration int64             `json:"dur"`
+	PID      int               `json:"pid"`
+	TID      int               `json:"tid"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+// traceFile is the JSON object format of a Chrome trace.
+type traceFile struct {
+	TraceEvents     []traceEvent `json:"traceEvents"`
+	DisplayTimeUnit string       `json:"displayTimeUnit"`
+}
+
+// traceEnd returns the time at which the step ended, now for the
+// in-progress step.
+func traceEnd(step checkpointstate.Step, now time.Time) time.Time {
+	switch {
+	case !step.Completed.IsZero():
+		return step.Completed
+	case !step.Failed.IsZero():
+		return step.Failed
+	}
+	return now
+}
+
+// traceEvents returns a duration event for each of the supplied steps,
+// with the in-progress step treated as running until now. Steps that
+// overlap, ie. those run concurrently, are assigned to different threads,
+// each the lowest numbered one that is free when the step is created, so
+// that a session's steps that ran sequentially all appear in the first.
+func traceEvents(steps []checkpointstate.Step, now time.Time) []traceEvent {
+	sorted := make([]checkpointstate.Step, len(steps))
+	copy(sorted, steps)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Created.Before(sorted[j].Created)
+	})
+	var threads []time.Time // The end of the last step in each thread.
+	events := make([]traceEvent, 0, len(sorted))
+	for _, step := range sorted {
+		end := traceEnd(step, now)
+		tid := 0
+		for ; tid < len(threads); tid++ {
+			if !threads[tid].After(step.Created) {
+				break
+			}
+		}
+		if tid == len(threads) {
+			threads = append(threads, time.Time{})
+		}
+		threads[tid] = end
+		args := map[string]string{}
+		for k, v := range step.Artifacts {
+			args[k] = v
+		}
+		switch {
+		case step.InProgress():
+			args["state"] = "in-progress"
+		case !step.Failed.IsZero():
+			args["state"] = "failed"
+			if len(step.Reason) > 0 {
+				args["reason"] = step.Reason
+			}
+		}
+		if len(step.Group) > 0 {
+			args["group"] = step.Group
+		}
+		if len(step.Command) > 0 {
+			args["command"] = quoteCommand(step.Command)
+		}
+		if len(args) == 0 {
+			args = nil
+		}
+		events = append(events, traceEvent{
+			Name:     step.Name,
+			Category: "step",
+			Phase:    "X",
+			Start:    step.Created.UnixNano() / int64(time.Microsecond),
+			Duration: int64(end.Sub(step.Created) / time.Microsecond),
+			PID:      1,
+			TID:      tid + 1,
+			Args:     args,
+		})
+	}
+	return events
+}
+
+// writeFolded writes the steps in the folded stack format used by
+// flamegraph.pl and speedscope, with the session, the concurrency group,
+// if any, and the step as the frames and the step's duration, in
+// microseconds, as its count. Frames may not contain semicolons or
+// newlines and so these are replaced.
+func writeFolded(out io.Writer, id string, steps []checkpointstate.Step, now time.Time) error {
+	frame := strings.NewReplacer(";", ":", "\n", " ").Replace
+	for _, step := range steps {
+		frames := []string{frame(id)}
+		if len(step.Group) > 0 {
+			frames = append(frames, frame(step.Group))
+		}
+		frames = append(frames, frame(step.Name))
+		duration := traceEnd(step, now).Sub(step.Created) / time.Microsecond
+		if _, err := fmt.Fprintf(out, "%v %v\n", strings.Join(frames, ";"), int64(duration)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runTraceCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("trace", flag.ContinueOnError)
+	folded := fs.Bool("folded", false, "display the steps in folded stack format rather than as a chrome trace")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) > 1 {
+		return true, fmt.Errorf("trace accepts at most one session")
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	sess, err := mgr.Use(ctx, id, false)
+	if err != nil {
+		return true, fmt.Errorf("failed to use session %v: %v", id, err)
+	}
+	steps, err := sess.Steps(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to get session steps %v: %v", id, err)
+	}
+	now := time.Now()
+	if *folded {
+		return true, writeFolded(out, id, steps, now)
+	}
+	buf, err := marshalJSON(traceFile{
+		TraceEvents:     traceEvents(steps, now),
+		DisplayTimeUnit: "ms",
+	}, "  ")
+	if err != nil {
+		return true, err
+	}
+	_, err = fmt.Fprintln(out, string(buf))
+	return true, err
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+func TestTrace(t *testing.T) {
+	ctx := context.Background()
+	mgr, cleanup := newSyntheticStore(t, 1)
+	defer cleanup()
+	ids, err := mgr.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess, err := mgr.Use(ctx, ids[0], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"fetch", "build"} {
+		if _, err := sess.Step(ctx, name); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	out := &bytes.Buffer{}
+	if _, err := runTraceCmd(ctx, mgr, out, []string{ids[0]}); err != nil {
+		t.Fatal(err)
+	}
+	// Validate the structure of the trace without reference to the types
+	// used to generate it.
+	var trace map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &trace); err != nil {
+		t.Fatalf("%v: %s", err, out.Bytes())
+	}
+	events, ok := trace["traceEvents"].([]interface{})
+	if !ok || len(events) != 2 {
+		t.Fatalf("unexpected trace events: %v", trace["traceEvents"])
+	}
+	for i, name := range []string{"fetch", "build"} {
+		event, ok := events[i].(map[string]interface{})
+		if !ok {
+			t.Fatalf("%v: not an object: %v", i, events[i])
+		}
+		for _, field := range []string{"name", "cat", "ph", "ts", "dur", "pid", "tid"} {
+			if _, ok := event[field]; !ok {
+				t.Errorf("%v: missing field %v: %v", i, field, event)
+			}
+		}
+		if got, want := event["name"], name; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := event["ph"], "X"; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if dur := event["dur"].(float64); dur < float64(10*time.Millisecond/time.Microsecond) {
+			t.Errorf("%v: duration is too short: %v", i, dur)
+		}
+	}
+	inProgress := events[1].(map[string]interface{})["args"].(map[string]interface{})
+	if got, want := inProgress["state"], "in-progress"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// --compact applies to the trace as it does to other json output.
+	setJSONIndent(0)
+	defer setJSONIndent(-1)
+	out.Reset()
+	if _, err := runTraceCmd(ctx, mgr, out, []string{ids[0]}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(out.String(), "\n"), 1; got != want {
+		t.Errorf("got %v, want %v: %s", got, want, out.Bytes())
+	}
+
+	out.Reset()
+	if _, err := runTraceCmd(ctx, mgr, out, []string{"--folded", ids[0]}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if got, want := len(lines), 2; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, out.String())
+	}
+	for i, name := range []string{"fetch", "build"} {
+		if prefix := ids[0] + ";" + name + " "; !strings.HasPrefix(lines[i], prefix) {
+			t.Errorf("%v: %q does not start with %q", i, lines[i], prefix)
+		}
+	}
+}
+
+func TestTraceThreads(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(s int) time.Time {
+		return start.Add(time.Duration(s) * time.Second)
+	}
+	steps := []checkpointstate.Step{
+		{Name: "a", Created: at(0), Completed: at(1)},
+		{Name: "b", Created: at(1), Completed: at(5), Group: "g"},
+		{Name: "c", Created: at(2), Completed: at(3), Group: "g"},
+		{Name: "d", Created: at(3), Failed: at(4), Group: "g", Reason: "oops"},
+		{Name: "e", Created: at(5)},
+	}
+	var names []string
+	var threads []int
+	var durations []int64
+	for _, event := range traceEvents(steps, at(7)) {
+		names = append(names, event.Name)
+		threads = append(threads, event.TID)
+		durations = append(durations, event.Duration/int64(time.Second/time.Microsecond))
+	}
+	if got, want := names, []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := threads, []int{1, 1, 2, 2, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := durations, []int64{1, 4, 1, 1, 2}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	out := &bytes.Buffer{}
+	if err := writeFolded(out, "s;1", steps[1:2], at(7)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "s:1;g;b 4000000\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+func trasher(mgr checkpointstate.Manager) (checkpointstate.Trasher, error) {
+	trasher, ok := mgr.(checkpointstate.Trasher)
+	if !ok {
+		return nil, fmt.Errorf("the trash is not supported")
+	}
+	return trasher, nil
+}
+
+// printTrashed displays the ID of each session and the time that it
+// was moved to the trash.
+func printTrashed(out io.Writer, trashed []checkpointstate.TrashedSession) {
+	for _, t := range trashed {
+		fmt.Fprintf(out, "%v: trashed %v\n", t.ID, t.Trashed.Local().Format(time.RFC3339))
+	}
+}
+
+// listTrash displays the sessions in the trash.
+func listTrash(ctx context.Context, mgr checkpointstate.Manager, out io.Writer) error {
+	t, err := trasher(mgr)
+	if err != nil {
+		return err
+	}
+	trashed, err := t.Trashed(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list the trash: %v", err)
+	}
+	printTrashed(out, trashed)
+	return nil
+}
+
+func runRestoreCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	if len(args) > 1 {
+		return true, fmt.Errorf("restore accepts at most one session")
+	}
+	id, err := sessionIDFromArgs(args)
+	if err != nil {
+		return true, err
+	}
+	t, err := trasher(mgr)
+	if err != nil {
+		return true, err
+	}
+	return true, t.Restore(ctx, id)
+}
+
+func runEmptyTrashCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	t, err := trasher(mgr)
+	if err != nil {
+		return true, err
+	}
+	deleted, err := t.EmptyTrash(ctx, args...)
+	printTrashed(out, deleted)
+	if err != nil {
+		return true, fmt.Errorf("failed to empty the trash: %v", err)
+	}
+	return true, nil
+}
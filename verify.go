@@ -0,0 +1,63 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/cosnicolaou/checkpoint/checkpointstate"
+)
+
+func runVerifyCmd(ctx context.Context, mgr checkpointstate.Manager, out io.Writer, args []string) (bool, error) {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fix := fs.Bool("fix", false, "repair the inconsistencies that can be safely repaired")
+	args, err := parseFlags(fs, args)
+	if err != nil {
+		return true, err
+	}
+	if len(args) > 1 {
+		return true, fmt.Errorf("at most one session may be specified")
+	}
+	unfixed := 0
+	verify := func(id string, sess checkpointstate.Session) error {
+		verifier, ok := sess.(checkpointstate.Verifier)
+		if !ok {
+			return fmt.Errorf("verify session %v: %v", id, checkpointstate.ErrNotSupported)
+		}
+		problems, err := verifier.Verify(ctx, *fix)
+		if err != nil {
+			return fmt.Errorf("failed to verify session %v: %v", id, err)
+		}
+		for _, p := range problems {
+			fixed := ""
+			if p.Fixed {
+				fixed = " (fixed)"
+			} else {
+				unfixed++
+			}
+			fmt.Fprintf(out, "%v: %v: %v%v\n", id, p.File, p.Description, fixed)
+		}
+		return nil
+	}
+	if len(args) == 1 {
+		sess, err := mgr.Use(ctx, args[0], false)
+		if err != nil {
+			return true, fmt.Errorf("failed to use session %v: %v", args[0], err)
+		}
+		err = verify(args[0], sess)
+	} else {
+		err = mgr.Walk(ctx, verify)
+	}
+	if err != nil {
+		return true, err
+	}
+	if unfixed > 0 {
+		return true, fmt.Errorf("unrepaired inconsistencies: %v", unfixed)
+	}
+	return true, nil
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	xdgStateHomeEnvVar  = "XDG_STATE_HOME"
+	xdgDataHomeEnvVar   = "XDG_DATA_HOME"
+	localAppDataEnvVar  = "LOCALAPPDATA"
+	checkpointDirEnvVar = "CHECKPOINT_DIR"
+	// checkpointPathEnvVar lists the stores to be used, see storeRoots.
+	checkpointPathEnvVar = "CHECKPOINT_PATH"
+)
+
+// storePath returns the location of the store, named base, for a backend
+// on the operating system goos. If $CHECKPOINT_DIR is set the store is
+// $CHECKPOINT_DIR<suffix>, regardless of any other setting. Otherwise,
+// stores are kept under $XDG_STATE_HOME/checkpoint or, failing that,
+// $XDG_DATA_HOME/checkpoint, if either is set, or in the platform's
+// conventional location, see platformDir, if it has one, and in $HOME as
+// .checkpointstate and .checkpointstate<suffix> otherwise. A store found in
+// $HOME, but not in the preferred location, continues to be used in place
+// until it is moved by migrate, see pendingStoreMove, since moving it
+// here could race with other processes that are using it.
+func storePath(getenv func(string) string, goos, suffix string) string {
+	if dir := getenv(checkpointDirEnvVar); len(dir) > 0 {
+		return dir + suffix
+	}
+	if legacy, _ := pendingStoreMove(getenv, goos, suffix); len(legacy) > 0 {
+		return legacy
+	}
+	if dir := platformDir(getenv, goos); len(dir) > 0 {
+		return filepath.Join(dir, "checkpoint"+suffix)
+	}
+	return legacyStorePath(getenv, goos, suffix)
+}
+
+// legacyStorePath returns the location of the store in the user's home
+// directory or, as has always been the case, in the root directory if
+// there is no home directory.
+func legacyStorePath(getenv func(string) string, goos, suffix string) string {
+	home := homeDir(getenv, goos)
+	if len(home) == 0 {
+		home = string(filepath.Separator)
+	}
+	return filepath.Join(home, ".checkpointstate"+suffix)
+}
+
+// pendingStoreMove returns the location of an existing store in the
+// user's home directory that should be moved to the preferred location,
+// and that location, or empty strings if there is no such store.
+func pendingStoreMove(getenv func(string) string, goos, suffix string) (from, to string) {
+	if len(getenv(checkpointDirEnvVar)) > 0 {
+		return "", ""
+	}
+	dir := platformDir(getenv, goos)
+	if len(dir) == 0 {
+		return "", ""
+	}
+	legacy := legacyStorePath(getenv, goos, suffix)
+	preferred := filepath.Join(dir, "checkpoint"+suffix)
+	if _, err := os.Lstat(preferred); err == nil {
+		return "", ""
+	}
+	if _, err := os.Lstat(legacy); err != nil {
+		return "", ""
+	}
+	return legacy, preferred
+}
+
+// moveStore moves the store at from to to, creating to's parent
+// directory if need be.
+func moveStore(from, to string) error {
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// platformDir returns the directory in which application state is
+// conventionally kept: $XDG_STATE_HOME or $XDG_DATA_HOME if set, on any
+// platform, and otherwise %LOCALAPPDATA% on windows and
+// $HOME/Library/Application Support on macOS. Other platforms have no
+// such directory unless the XDG variables are set.
+func platformDir(getenv func(string) string, goos string) string {
+	for _, v := range []string{xdgStateHomeEnvVar, xdgDataHomeEnvVar} {
+		if dir := getenv(v); len(dir) > 0 {
+			return dir
+		}
+	}
+	switch goos {
+	case "windows":
+		return getenv(localAppDataEnvVar)
+	case "darwin":
+		if home := getenv("HOME"); len(home) > 0 {
+			return filepath.Join(home, "Library", "Application Support")
+		}
+	}
+	return ""
+}
+
+// homeDir returns the user's home directory, which on windows is
+// %USERPROFILE% if $HOME is not set.
+func homeDir(getenv func(string) string, goos string) string {
+	if home := getenv("HOME"); len(home) > 0 || goos != "windows" {
+		return home
+	}
+	return getenv("USERPROFILE")
+}
+
+// storeRoots returns the locations of the stores, named as per
+// storePath, listed in $CHECKPOINT_PATH, in order of precedence, or nil
+// if it is not set. Its elements are separated by the platform's list
+// separator, ie. ':' on unix systems, and each is the location of a
+// store, to which suffix is appended; an empty element denotes the store
+// returned by storePath. Later duplicates are ignored.
+func storeRoots(getenv func(string) string, goos, suffix string) []string {
+	path := getenv(checkpointPathEnvVar)
+	if len(path) == 0 {
+		return nil
+	}
+	separator := ":"
+	if goos == "windows" {
+		separator = ";"
+	}
+	var roots []string
+	seen := map[string]bool{}
+	for _, dir := range strings.Split(path, separator) {
+		var root string
+		if len(dir) > 0 {
+			root = dir + suffix
+		} else {
+			root = storePath(getenv, goos, suffix)
+		}
+		if !seen[root] {
+			roots = append(roots, root)
+			seen[root] = true
+		}
+	}
+	return roots
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStorePath(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "xdg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	home := filepath.Join(tmpDir, "home")
+	state := filepath.Join(tmpDir, "state")
+	data := filepath.Join(tmpDir, "data")
+	env := func(kv ...string) func(string) string {
+		vars := map[string]string{"HOME": home}
+		for i := 0; i < len(kv); i += 2 {
+			vars[kv[i]] = kv[i+1]
+		}
+		return func(k string) string { return vars[k] }
+	}
+	for i, tc := range []struct {
+		getenv func(string) string
+		suffix string
+		want   string
+	}{
+		{env(), "", filepath.Join(home, ".checkpointstate")},
+		{env(), ".db", filepath.Join(home, ".checkpointstate.db")},
+		{env(xdgStateHomeEnvVar, ""), "", filepath.Join(home, ".checkpointstate")},
+		{env(xdgStateHomeEnvVar, state), "", filepath.Join(state, "checkpoint")},
+		{env(xdgStateHomeEnvVar, state), ".db", filepath.Join(state, "checkpoint.db")},
+		{env(xdgDataHomeEnvVar, data), "", filepath.Join(data, "checkpoint")},
+		{env(xdgStateHomeEnvVar, state, xdgDataHomeEnvVar, data), "", filepath.Join(state, "checkpoint")},
+	} {
+		if got, want := storePath(tc.getenv, "linux", tc.suffix), tc.want; got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+
+	// Without $HOME, the store is in the root directory.
+	noHome := func(string) string { return "" }
+	if got, want := storePath(noHome, "linux", ""), filepath.Join(string(filepath.Separator), ".checkpointstate"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// An existing store in $HOME is used in place until it is moved to
+	// the XDG location.
+	legacy := filepath.Join(home, ".checkpointstate")
+	if err := os.MkdirAll(filepath.Join(legacy, "session"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	xdg := filepath.Join(state, "checkpoint")
+	if got, want := storePath(env(xdgStateHomeEnvVar, state), "linux", ""), legacy; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if from, to := pendingStoreMove(env(xdgStateHomeEnvVar, state), "linux", ""); from != legacy || to != xdg {
+		t.Errorf("got %v, %v, want %v, %v", from, to, legacy, xdg)
+	}
+	if from, to := pendingStoreMove(env(), "linux", ""); len(from) > 0 || len(to) > 0 {
+		t.Errorf("unexpected move: %v, %v", from, to)
+	}
+	if err := moveStore(legacy, xdg); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := storePath(env(xdgStateHomeEnvVar, state), "linux", ""), xdg; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(xdg, "session")); err != nil {
+		t.Errorf("store was not moved: %v", err)
+	}
+
+	// An existing XDG store takes precedence over one in $HOME, which is
+	// not moved.
+	if err := os.MkdirAll(legacy, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := storePath(env(xdgStateHomeEnvVar, state), "linux", ""), xdg; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if from, _ := pendingStoreMove(env(xdgStateHomeEnvVar, state), "linux", ""); len(from) > 0 {
+		t.Errorf("unexpected move: %v", from)
+	}
+}
+
+func TestStorePathGOOS(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	home := filepath.Join(tmpDir, "home")
+	profile := filepath.Join(tmpDir, "profile")
+	appData := filepath.Join(tmpDir, "appdata")
+	state := filepath.Join(tmpDir, "state")
+	override := filepath.Join(tmpDir, "override")
+	env := func(kv ...string) func(string) string {
+		vars := map[string]string{}
+		for i := 0; i < len(kv); i += 2 {
+			vars[kv[i]] = kv[i+1]
+		}
+		return func(k string) string { return vars[k] }
+	}
+	support := filepath.Join(home, "Library", "Application Support")
+	for i, tc := range []struct {
+		goos   string
+		getenv func(string) string
+		suffix string
+		want   string
+	}{
+		{"linux", env("HOME", home), "", filepath.Join(home, ".checkpointstate")},
+		{"linux", env("HOME", home, xdgStateHomeEnvVar, state), ".db", filepath.Join(state, "checkpoint.db")},
+		{"freebsd", env("HOME", home), "", filepath.Join(home, ".checkpointstate")},
+		{"darwin", env("HOME", home), "", filepath.Join(support, "checkpoint")},
+		{"darwin", env("HOME", home), ".db", filepath.Join(support, "checkpoint.db")},
+		{"darwin", env("HOME", home, xdgStateHomeEnvVar, state), "", filepath.Join(state, "checkpoint")},
+		{"windows", env("USERPROFILE", profile, localAppDataEnvVar, appData), "", filepath.Join(appData, "checkpoint")},
+		{"windows", env("USERPROFILE", profile, localAppDataEnvVar, appData), ".db", filepath.Join(appData, "checkpoint.db")},
+		{"windows", env("USERPROFILE", profile), "", filepath.Join(profile, ".checkpointstate")},
+		{"windows", env("HOME", home), "", filepath.Join(home, ".checkpointstate")},
+		// CHECKPOINT_DIR takes precedence on every platform.
+		{"linux", env("HOME", home, xdgStateHomeEnvVar, state, checkpointDirEnvVar, override), "", override},
+		{"darwin", env("HOME", home, checkpointDirEnvVar, override), ".db", override + ".db"},
+		{"windows", env(localAppDataEnvVar, appData, checkpointDirEnvVar, override), "", override},
+	} {
+		if got, want := storePath(tc.getenv, tc.goos, tc.suffix), tc.want; got != want {
+			t.Errorf("%v: %v: got %v, want %v", i, tc.goos, got, want)
+		}
+	}
+
+	// An existing store in the home directory is used in place, and may
+	// then be moved to the platform's location.
+	legacy := filepath.Join(profile, ".checkpointstate")
+	if err := os.MkdirAll(filepath.Join(legacy, "session"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	windows := env("USERPROFILE", profile, localAppDataEnvVar, appData)
+	if got, want := storePath(windows, "windows", ""), legacy; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	want := filepath.Join(appData, "checkpoint")
+	if from, to := pendingStoreMove(windows, "windows", ""); from != legacy || to != want {
+		t.Errorf("got %v, %v, want %v, %v", from, to, legacy, want)
+	}
+}
+
+func TestStoreRoots(t *testing.T) {
+	env := func(kv ...string) func(string) string {
+		vars := map[string]string{}
+		for i := 0; i < len(kv); i += 2 {
+			vars[kv[i]] = kv[i+1]
+		}
+		return func(k string) string { return vars[k] }
+	}
+	for i, tc := range []struct {
+		goos   string
+		getenv func(string) string
+		suffix string
+		want   []string
+	}{
+		{"linux", env(checkpointDirEnvVar, "/default"), "", nil},
+		{"linux", env(checkpointPathEnvVar, "/a:/b"), "", []string{"/a", "/b"}},
+		{"linux", env(checkpointPathEnvVar, "/a:/b"), ".db", []string{"/a.db", "/b.db"}},
+		{"linux", env(checkpointPathEnvVar, "/a::/a", checkpointDirEnvVar, "/default"), "", []string{"/a", "/default"}},
+		{"linux", env(checkpointPathEnvVar, ":/a:/default", checkpointDirEnvVar, "/default"), "", []string{"/default", "/a"}},
+		{"windows", env(checkpointPathEnvVar, `c:\a;d:\b`), "", []string{`c:\a`, `d:\b`}},
+	} {
+		if got, want := storeRoots(tc.getenv, tc.goos, tc.suffix), tc.want; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+	}
+}